@@ -1,14 +1,20 @@
 package cmd
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/georgecane/opencoin/pkg/config"
+	"github.com/georgecane/opencoin/pkg/consensus"
 	"github.com/georgecane/opencoin/pkg/crypto"
 	"github.com/georgecane/opencoin/pkg/genesis"
 	"github.com/georgecane/opencoin/pkg/node"
@@ -138,6 +144,86 @@ var keysValidatorCmd = &cobra.Command{
 	},
 }
 
+var walCmd = &cobra.Command{
+	Use:   "wal",
+	Short: "Manage the consensus write-ahead log",
+}
+
+var walRepairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Truncate a corrupted consensus WAL after its last intact record",
+	Run: func(cmd *cobra.Command, args []string) {
+		home, _ := cmd.Flags().GetString("home")
+		path := consensus.WALPath(home)
+		dropped, err := consensus.RepairWAL(path)
+		if err != nil {
+			fmt.Println("failed to repair wal:", err)
+			os.Exit(1)
+		}
+		if dropped == 0 {
+			fmt.Println("wal is intact:", path)
+			return
+		}
+		fmt.Printf("Dropped %d bytes from %s; original kept at %s.corrupt\n", dropped, path, path)
+	},
+}
+
+var signerCmd = &cobra.Command{
+	Use:   "signer",
+	Short: "Run a remote signer holding the validator key",
+	Long: `Run a remote signer holding the validator key. Nodes connect with
+validator.remote_signer and authenticate with their signer identity key; only
+the keys passed with --authorized-key are accepted. The signer refuses to sign
+anything but consensus messages, and never signs below or twice at the
+height/round/step it last signed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		home, _ := cmd.Flags().GetString("home")
+		listen, _ := cmd.Flags().GetString("listen")
+		keyFile, _ := cmd.Flags().GetString("key")
+		identityFile, _ := cmd.Flags().GetString("identity")
+		authorized, _ := cmd.Flags().GetStringSlice("authorized-key")
+		if len(authorized) == 0 {
+			fmt.Println("missing --authorized-key")
+			os.Exit(1)
+		}
+		var clients []ed25519.PublicKey
+		for _, k := range authorized {
+			pub, err := base64.StdEncoding.DecodeString(k)
+			if err != nil || len(pub) != ed25519.PublicKeySize {
+				fmt.Println("invalid authorized key:", k)
+				os.Exit(1)
+			}
+			clients = append(clients, pub)
+		}
+		kp, err := crypto.LoadKeyPair(filepath.Join(home, keyFile))
+		if err != nil {
+			fmt.Println("failed to load validator key:", err)
+			os.Exit(1)
+		}
+		identity, err := crypto.LoadOrCreateEd25519(filepath.Join(home, identityFile))
+		if err != nil {
+			fmt.Println("failed to load signer identity:", err)
+			os.Exit(1)
+		}
+		guarded, err := consensus.NewGuardedSigner(crypto.NewDilithiumSigner(kp.PublicKey, kp.PrivateKey), consensus.SignerStatePath(home))
+		if err != nil {
+			fmt.Println("failed to load signer state:", err)
+			os.Exit(1)
+		}
+		l, err := crypto.ListenSigner(listen)
+		if err != nil {
+			fmt.Println("failed to listen:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signer listening on %s identity %s\n", listen, base64.StdEncoding.EncodeToString(identity.PublicKey))
+		server := crypto.NewSignerServer(guarded, identity.PrivateKey, clients)
+		if err := server.Serve(l); err != nil {
+			fmt.Println("signer stopped:", err)
+			os.Exit(1)
+		}
+	},
+}
+
 var queryCmd = &cobra.Command{
 	Use:   "query",
 	Short: "Query blockchain state",
@@ -168,6 +254,153 @@ var queryAccountCmd = &cobra.Command{
 	},
 }
 
+var queryUnbondingCmd = &cobra.Command{
+	Use:   "unbonding [address]",
+	Short: "Query stake waiting out the unbonding period",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		home, _ := cmd.Flags().GetString("home")
+		store, err := state.OpenStore(home)
+		if err != nil {
+			fmt.Println("failed to open state:", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		entries, err := store.GetUnbondings(types.Address(args[0]))
+		if err != nil {
+			fmt.Println("query failed:", err)
+			os.Exit(1)
+		}
+		if len(entries) == 0 {
+			fmt.Println("no pending unbondings")
+			return
+		}
+		for _, e := range entries {
+			fmt.Printf("validator=%s amount=%d creation_height=%d completes=%s\n",
+				e.Validator, e.Amount, e.CreationHeight, time.Unix(e.CompletionTime, 0).UTC().Format(time.RFC3339))
+		}
+	},
+}
+
+var queryRedelegationsCmd = &cobra.Command{
+	Use:   "redelegations [address]",
+	Short: "Query redelegations that are still slashable for their source validator",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		home, _ := cmd.Flags().GetString("home")
+		store, err := state.OpenStore(home)
+		if err != nil {
+			fmt.Println("failed to open state:", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		entries, err := store.GetRedelegations(types.Address(args[0]))
+		if err != nil {
+			fmt.Println("query failed:", err)
+			os.Exit(1)
+		}
+		if len(entries) == 0 {
+			fmt.Println("no pending redelegations")
+			return
+		}
+		for _, e := range entries {
+			fmt.Printf("from=%s to=%s amount=%d creation_height=%d completes=%s\n",
+				e.SrcValidator, e.DstValidator, e.Amount, e.CreationHeight, time.Unix(e.CompletionTime, 0).UTC().Format(time.RFC3339))
+		}
+	},
+}
+
+var queryRewardsCmd = &cobra.Command{
+	Use:   "rewards [address]",
+	Short: "Query delegation rewards not yet withdrawn",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		home, _ := cmd.Flags().GetString("home")
+		store, err := state.OpenStore(home)
+		if err != nil {
+			fmt.Println("failed to open state:", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		rewards, err := store.GetPendingRewards(types.Address(args[0]))
+		if err != nil {
+			fmt.Println("query failed:", err)
+			os.Exit(1)
+		}
+		if len(rewards) == 0 {
+			fmt.Println("no delegations")
+			return
+		}
+		for _, r := range rewards {
+			fmt.Printf("validator=%s pending=%d\n", r.Validator, r.Amount)
+		}
+	},
+}
+
+var queryAccountProofCmd = &cobra.Command{
+	Use:   "account-proof [address]",
+	Short: "Query an account with a proof against the committed state root",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		home, _ := cmd.Flags().GetString("home")
+		height, _ := cmd.Flags().GetUint64("height")
+		store, err := state.OpenStore(home)
+		if err != nil {
+			fmt.Println("failed to open state:", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		addr := types.Address(args[0])
+		acct, proof, err := store.ProveAccount(addr, height)
+		if err != nil {
+			fmt.Println("query failed:", err)
+			os.Exit(1)
+		}
+		out, err := json.MarshalIndent(&state.ProvenAccount{Address: addr, Account: acct, Proof: proof}, "", "  ")
+		if err != nil {
+			fmt.Println("query failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	},
+}
+
+var queryVerifyAccountProofCmd = &cobra.Command{
+	Use:   "verify-account-proof [file]",
+	Short: "Check an account proof against a trusted state root, without a node",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rootHex, _ := cmd.Flags().GetString("root")
+		raw, err := hex.DecodeString(rootHex)
+		if err != nil || len(raw) != len(types.Hash{}) {
+			fmt.Println("invalid --root: expected a hex state root")
+			os.Exit(1)
+		}
+		var root types.Hash
+		copy(root[:], raw)
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Println("failed to read proof:", err)
+			os.Exit(1)
+		}
+		var proven state.ProvenAccount
+		if err := json.Unmarshal(data, &proven); err != nil {
+			fmt.Println("invalid proof:", err)
+			os.Exit(1)
+		}
+		if err := state.VerifyAccountProof(root, proven.Address, proven.Account, proven.Proof); err != nil {
+			fmt.Println("proof rejected:", err)
+			os.Exit(1)
+		}
+		if proven.Account == nil {
+			fmt.Printf("verified: no account at %s\n", proven.Address)
+			return
+		}
+		acct := proven.Account
+		fmt.Printf("verified: address=%s balance=%d nonce=%d stake=%d rc=%d\n", acct.Address, acct.Balance, acct.Nonce, acct.Stake, acct.RC)
+	},
+}
+
 var txCmd = &cobra.Command{
 	Use:   "tx",
 	Short: "Broadcast transactions",
@@ -235,14 +468,31 @@ func init() {
 	RootCmd.AddCommand(keysCmd)
 	RootCmd.AddCommand(queryCmd)
 	RootCmd.AddCommand(txCmd)
+	RootCmd.AddCommand(walCmd)
+	RootCmd.AddCommand(signerCmd)
 
 	keysCmd.AddCommand(keysAddCmd)
 	keysCmd.AddCommand(keysValidatorCmd)
 
 	queryCmd.AddCommand(queryAccountCmd)
+	queryCmd.AddCommand(queryUnbondingCmd)
+	queryCmd.AddCommand(queryRedelegationsCmd)
+	queryCmd.AddCommand(queryRewardsCmd)
+	queryCmd.AddCommand(queryAccountProofCmd)
+	queryCmd.AddCommand(queryVerifyAccountProofCmd)
+
+	walCmd.AddCommand(walRepairCmd)
 
 	txCmd.AddCommand(txTransferCmd)
 
+	signerCmd.Flags().String("listen", "tcp://127.0.0.1:26659", "address to serve on, unix:///path or tcp://host:port")
+	signerCmd.Flags().String("key", "config/validator_key.json", "validator key file, relative to home")
+	signerCmd.Flags().String("identity", "config/signer_key.json", "signer identity key file, relative to home; created if missing")
+	signerCmd.Flags().StringSlice("authorized-key", nil, "base64 identity public key of a node allowed to connect")
+
+	queryAccountProofCmd.Flags().Uint64("height", 0, "height to prove at; 0 selects the latest committed height")
+	queryVerifyAccountProofCmd.Flags().String("root", "", "trusted state root, hex, from the header at the proof height")
+
 	txTransferCmd.Flags().String("from", "", "sender key name")
 	txTransferCmd.Flags().Uint64("nonce", 0, "transaction nonce")
 }
@@ -18,6 +18,7 @@ type NodeConfig struct {
     Validator   ValidatorConfig `mapstructure:"validator"`
     RC          RCConfig      `mapstructure:"rc"`
     Governance  GovernanceConfig `mapstructure:"governance"`
+    StateSync   StateSyncConfig `mapstructure:"state_sync"`
 }
 
 // P2PConfig represents P2P network configuration
@@ -30,6 +31,8 @@ type P2PConfig struct {
     Seeds          string `mapstructure:"seeds"`
     PrivateKeyFile string `mapstructure:"private_key_file"`
     BootstrapPeers []string `mapstructure:"bootstrap_peers"`
+    BlockSyncBatch    int           `mapstructure:"block_sync_batch"`
+    BlockSyncInterval time.Duration `mapstructure:"block_sync_interval"`
 }
 
 // RPCConfig represents RPC server configuration
@@ -48,14 +51,19 @@ type ConsensusConfig struct {
     TimeoutCommit    time.Duration `mapstructure:"timeout_commit"`
 
     MinStake         uint64  `mapstructure:"min_stake"`
+    MaxCommissionChangeBps uint64 `mapstructure:"max_commission_change_bps"`
     MaxValidators    uint32  `mapstructure:"max_validators"`
     EpochLength      uint64  `mapstructure:"epoch_length"`
     BlockReward      uint64  `mapstructure:"block_reward"`
+    ProposerRewardBps uint64 `mapstructure:"proposer_reward_bps"`
     UnbondingPeriod  uint64  `mapstructure:"unbonding_period"`
     SlashDoubleBps      uint64  `mapstructure:"slash_double_bps"`
     JailDouble          uint64  `mapstructure:"jail_double"`
     SlashOfflineBps     uint64  `mapstructure:"slash_offline_bps"`
     JailOffline         uint64  `mapstructure:"jail_offline"`
+    SignedBlocksWindow  uint64  `mapstructure:"signed_blocks_window"`
+    MaxMissedBps        uint64  `mapstructure:"max_missed_bps"`
+    SeedProposer        bool    `mapstructure:"seed_proposer"`
 }
 
 // ValidatorConfig represents validator configuration
@@ -65,6 +73,11 @@ type ValidatorConfig struct {
     OperatorAddress string `mapstructure:"operator_address"`
     Stake          uint64 `mapstructure:"stake"`
     Commission     uint16 `mapstructure:"commission"`
+    // RemoteSigner is the unix:// or tcp:// address of an `opencoin signer`;
+    // when set the private key file is not used.
+    RemoteSigner       string `mapstructure:"remote_signer"`
+    SignerIdentityFile string `mapstructure:"signer_identity_file"`
+    SignerPubKey       string `mapstructure:"signer_pubkey"`
 }
 
 // RCConfig represents RC parameters.
@@ -86,6 +99,20 @@ type GovernanceConfig struct {
     TimelockEpochs     uint64 `mapstructure:"timelock_epochs"`
 }
 
+// StateSyncConfig represents state snapshot and state sync configuration.
+type StateSyncConfig struct {
+    // Enable restores a node with no blocks from a peer snapshot of the
+    // block at TrustHeight, whose hex hash TrustHash comes from a trusted
+    // source, instead of replaying from genesis.
+    Enable      bool   `mapstructure:"enable"`
+    TrustHeight uint64 `mapstructure:"trust_height"`
+    TrustHash   string `mapstructure:"trust_hash"`
+    // SnapshotInterval is how many blocks apart snapshots are taken; zero
+    // disables them. SnapshotKeepRecent is how many are kept.
+    SnapshotInterval   uint64 `mapstructure:"snapshot_interval"`
+    SnapshotKeepRecent int    `mapstructure:"snapshot_keep_recent"`
+}
+
 // DefaultConfig returns a default configuration
 func DefaultConfig() *NodeConfig {
     return &NodeConfig{
@@ -102,6 +129,8 @@ func DefaultConfig() *NodeConfig {
             MaxPeers:        200,
             PrivateKeyFile:  "config/node_key.json",
             BootstrapPeers:  []string{},
+            BlockSyncBatch:    64,
+            BlockSyncInterval: 10 * time.Second,
         },
 
         RPC: RPCConfig{
@@ -118,14 +147,19 @@ func DefaultConfig() *NodeConfig {
             TimeoutCommit:    1 * time.Second,
 
             MinStake:         100_000_000, // 100 OCN
+            MaxCommissionChangeBps: 100,   // 1% per epoch
             MaxValidators:    100,
             EpochLength:      10_000,
             BlockReward:      1_000_000,   // 1 OCN per block
+            ProposerRewardBps: 500,        // 5% to the proposer, the rest to signers
             UnbondingPeriod:  259200,      // 3 days in seconds
             SlashDoubleBps:      500,       // 5%
             JailDouble:          10,        // 10 epochs
             SlashOfflineBps:     10,        // 0.1%
             JailOffline:         2,         // 2 epochs
+            SignedBlocksWindow:  10_000,    // blocks
+            MaxMissedBps:        5000,      // 50% of the window
+            SeedProposer:        true,
         },
 
         Validator: ValidatorConfig{
@@ -134,6 +168,7 @@ func DefaultConfig() *NodeConfig {
             OperatorAddress: "",
             Stake:          1_000_000_000, // 1000 OCN
             Commission:     1000,          // 10%
+            SignerIdentityFile: "config/signer_client_key.json",
         },
         RC: RCConfig{
             Alpha:    1000,
@@ -150,5 +185,9 @@ func DefaultConfig() *NodeConfig {
             ThresholdPercent:   50,
             TimelockEpochs:     1,
         },
+        StateSync: StateSyncConfig{
+            SnapshotInterval:   10_000,
+            SnapshotKeepRecent: 2,
+        },
     }
 }
@@ -0,0 +1,108 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// ErrNoValidatorSet is returned by Authenticate for a message at a height
+// whose validator set the engine does not know, so its signers cannot be
+// checked either way.
+var ErrNoValidatorSet = errors.New("no validator set for message height")
+
+// Authenticate checks that a consensus message from the network is signed by
+// members of the validator set at its height, without applying it. Gossip
+// calls it before relaying, so forged messages do not spread; whether the
+// message is still useful is left to the handlers.
+func (e *Engine) Authenticate(msg interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch m := msg.(type) {
+	case *types.Proposal:
+		if m == nil || m.Block == nil {
+			return fmt.Errorf("invalid proposal")
+		}
+		signBytes, err := ProposalSignBytes(m)
+		if err != nil {
+			return err
+		}
+		return e.verifySignerLocked(m.Block.Height, m.Block.Proposer, signBytes, m.ProposerSig)
+	case *types.PrecommitVote:
+		if m == nil {
+			return fmt.Errorf("nil vote")
+		}
+		signBytes, err := PrecommitSignBytes(m)
+		if err != nil {
+			return err
+		}
+		return e.verifySignerLocked(m.Height, m.Validator, signBytes, m.Signature)
+	case *types.ViewChange:
+		if m == nil {
+			return fmt.Errorf("nil view change")
+		}
+		signBytes, err := ViewChangeSignBytes(m)
+		if err != nil {
+			return err
+		}
+		if err := e.verifySignerLocked(m.Height, m.Validator, signBytes, m.Signature); err != nil {
+			return err
+		}
+		if m.HighQC == nil {
+			return nil
+		}
+		return e.verifyHighQCLocked(m.HighQC)
+	case *types.QuorumCertificate:
+		if m == nil {
+			return fmt.Errorf("nil qc")
+		}
+		set := e.validatorSetLocked(m.Height)
+		if set == nil {
+			return ErrNoValidatorSet
+		}
+		return VerifyQC(m, set, e.verifier)
+	case *types.TimeoutCertificate:
+		if m == nil {
+			return fmt.Errorf("nil tc")
+		}
+		set := e.validatorSetLocked(m.Height)
+		if set == nil {
+			return ErrNoValidatorSet
+		}
+		if err := VerifyTC(m, set, e.verifier); err != nil {
+			return err
+		}
+		if m.HighQC == nil {
+			return nil
+		}
+		return e.verifyHighQCLocked(m.HighQC)
+	case *types.DuplicateVoteEvidence:
+		if m == nil {
+			return fmt.Errorf("nil evidence")
+		}
+		v := e.dpos.GetValidator(m.Validator)
+		if v == nil {
+			return fmt.Errorf("unknown validator %s", m.Validator)
+		}
+		return VerifyEvidence(m, v.ConsensusPubKey, e.verifier)
+	default:
+		return fmt.Errorf("unsupported consensus message %T", msg)
+	}
+}
+
+// verifySignerLocked checks that addr is in the validator set at height and
+// signed signBytes with sig.
+func (e *Engine) verifySignerLocked(height uint64, addr types.Address, signBytes, sig []byte) error {
+	if e.validatorSetLocked(height) == nil {
+		return ErrNoValidatorSet
+	}
+	pk, ok := e.validatorPubKeyLocked(height, addr)
+	if !ok {
+		return fmt.Errorf("%s is not a validator at height %d", addr, height)
+	}
+	if !e.verifier.Verify(signBytes, sig, pk) {
+		return fmt.Errorf("invalid signature from %s", addr)
+	}
+	return nil
+}
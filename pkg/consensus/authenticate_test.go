@@ -0,0 +1,49 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestAuthenticateChecksSignerAndMembership(t *testing.T) {
+	signer, outsider := newTestSigner(1), newTestSigner(9)
+	dpos := NewDPoS(1, 10)
+	if err := dpos.RegisterValidator("val0", signer.PublicKey(), 100, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	e := newTestEngineWithConfig(t, Config{BlockMaxTxs: 10, MinStake: 1, EpochLength: 4}, signer, "val0", dpos)
+
+	if err := e.Authenticate(signedVote(t, signer, "val0", types.Hash{1}, 1, 0)); err != nil {
+		t.Fatalf("vote from a validator rejected: %v", err)
+	}
+	if err := e.Authenticate(signedVote(t, outsider, "val0", types.Hash{1}, 1, 0)); err == nil {
+		t.Fatalf("vote with a forged signature accepted")
+	}
+	if err := e.Authenticate(signedVote(t, outsider, "mallory", types.Hash{1}, 1, 0)); err == nil {
+		t.Fatalf("vote from a non-validator accepted")
+	}
+
+	prop, err := e.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if err := e.Authenticate(prop); err != nil {
+		t.Fatalf("proposal rejected: %v", err)
+	}
+	forged := *prop
+	forged.Round++
+	if err := e.Authenticate(&forged); err == nil {
+		t.Fatalf("proposal altered after signing accepted")
+	}
+
+	vc := &types.ViewChange{Height: 1, Round: 0, Validator: "mallory"}
+	msg, _ := ViewChangeSignBytes(vc)
+	vc.Signature, _ = outsider.Sign(msg)
+	if err := e.Authenticate(vc); err == nil {
+		t.Fatalf("view change from a non-validator accepted")
+	}
+	if err := e.Authenticate(&types.QuorumCertificate{Height: 1, BlockHash: types.Hash{1}, SigBitmap: []byte{0x01}, Signatures: [][]byte{{1}}}); err == nil {
+		t.Fatalf("qc with a bad signature accepted")
+	}
+}
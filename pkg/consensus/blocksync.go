@@ -0,0 +1,173 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// BlockFetcher fetches committed blocks from peers.
+type BlockFetcher interface {
+	SyncPeers() []string
+	// FetchBlocks returns up to count consecutive committed blocks starting at
+	// from; fewer when the peer has nothing more.
+	FetchBlocks(ctx context.Context, peer string, from uint64, count int) ([]*types.CommittedBlock, error)
+}
+
+// BlockSyncConfig tunes catch-up.
+type BlockSyncConfig struct {
+	BatchSize int // blocks per request
+	Lookahead int // batches that may be fetched ahead of the next block to apply
+}
+
+// BlockSyncer catches a lagging engine up by fetching ranges of committed
+// blocks from several peers in parallel and applying them in height order.
+// Every block is applied through FinalizeBlock, which verifies its commit
+// certificate against the validator set of its height. Sync starts from the
+// engine's committed height, so an interrupted sync resumes where the store left off.
+type BlockSyncer struct {
+	engine  *Engine
+	fetcher BlockFetcher
+	cfg     BlockSyncConfig
+}
+
+// NewBlockSyncer creates a syncer for engine. Zero config values use defaults.
+func NewBlockSyncer(engine *Engine, fetcher BlockFetcher, cfg BlockSyncConfig) *BlockSyncer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 64
+	}
+	if cfg.Lookahead <= 0 {
+		cfg.Lookahead = 4
+	}
+	return &BlockSyncer{engine: engine, fetcher: fetcher, cfg: cfg}
+}
+
+type syncRange struct {
+	from  uint64
+	count int
+}
+
+type syncResult struct {
+	r      syncRange
+	peer   string
+	blocks []*types.CommittedBlock
+	err    error
+}
+
+// Sync fetches and applies blocks until no peer has anything newer, and
+// returns how many blocks were applied. A peer is dropped for the rest of the
+// sync once it fails, has no more blocks, or serves a block that does not verify;
+// its range is handed to another peer.
+func (s *BlockSyncer) Sync(ctx context.Context) (uint64, error) {
+	next := s.engine.CommittedHeight() + 1
+	nextFrom := next
+	idle := s.fetcher.SyncPeers()
+	var queue []syncRange
+	pending := make(map[uint64]syncResult)
+	banned := make(map[string]bool)
+	results := make(chan syncResult)
+	inflight := 0
+	var applied uint64
+
+	for {
+		for len(idle) > 0 {
+			var r syncRange
+			switch {
+			case len(queue) > 0:
+				r, queue = queue[0], queue[1:]
+			case nextFrom < next+uint64(s.cfg.BatchSize*s.cfg.Lookahead):
+				r = syncRange{from: nextFrom, count: s.cfg.BatchSize}
+				nextFrom += uint64(s.cfg.BatchSize)
+			}
+			if r.count == 0 {
+				break
+			}
+			peer := idle[0]
+			idle = idle[1:]
+			inflight++
+			go func() {
+				blocks, err := s.fetcher.FetchBlocks(ctx, peer, r.from, r.count)
+				select {
+				case results <- syncResult{r: r, peer: peer, blocks: blocks, err: err}:
+				case <-ctx.Done():
+				}
+			}()
+		}
+		if inflight == 0 {
+			return applied, nil
+		}
+
+		var res syncResult
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return applied, ctx.Err()
+		}
+		inflight--
+		if res.err != nil || len(res.blocks) == 0 {
+			queue = append([]syncRange{res.r}, queue...)
+			continue
+		}
+		if len(res.blocks) > res.r.count {
+			res.blocks = res.blocks[:res.r.count]
+		}
+		if n := len(res.blocks); n < res.r.count {
+			queue = append([]syncRange{{from: res.r.from + uint64(n), count: res.r.count - n}}, queue...)
+			res.r.count = n
+		}
+		pending[res.r.from] = res
+
+		if !banned[res.peer] {
+			idle = append(idle, res.peer)
+		}
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			n, err := s.applyRange(ready)
+			next += n
+			applied += n
+			if err != nil {
+				queue = append([]syncRange{{from: next, count: ready.r.count - int(n)}}, queue...)
+				banned[ready.peer] = true
+				idle = dropPeer(idle, ready.peer)
+				break
+			}
+		}
+	}
+}
+
+func dropPeer(peers []string, peer string) []string {
+	out := peers[:0]
+	for _, p := range peers {
+		if p != peer {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// applyRange applies the blocks of a fetched range in order and returns how
+// many were applied before the first invalid one.
+func (s *BlockSyncer) applyRange(res syncResult) (uint64, error) {
+	var n uint64
+	for _, cb := range res.blocks {
+		height := res.r.from + n
+		if cb == nil || cb.Block == nil || cb.Block.Height != height {
+			return n, fmt.Errorf("peer %s: unexpected block at height %d", res.peer, height)
+		}
+		if height <= s.engine.CommittedHeight() {
+			// Consensus committed it in the meantime.
+			n++
+			continue
+		}
+		if err := s.engine.FinalizeBlock(cb.Block, cb.Commit, s.engine.contracts); err != nil {
+			return n, fmt.Errorf("peer %s: block %d: %w", res.peer, height, err)
+		}
+		n++
+	}
+	return n, nil
+}
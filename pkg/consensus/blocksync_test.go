@@ -0,0 +1,113 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// storeFetcher serves committed blocks from a store, up to a height limit.
+// Peers named "liar" forge certificates and peers named "down" always fail.
+type storeFetcher struct {
+	store *state.Store
+	peers []string
+
+	mu    sync.Mutex
+	limit uint64
+	calls map[string]int
+}
+
+func (f *storeFetcher) SyncPeers() []string { return f.peers }
+
+func (f *storeFetcher) FetchBlocks(_ context.Context, peer string, from uint64, count int) ([]*types.CommittedBlock, error) {
+	f.mu.Lock()
+	f.calls[peer]++
+	limit := f.limit
+	f.mu.Unlock()
+	if peer == "down" {
+		return nil, fmt.Errorf("connection refused")
+	}
+	var out []*types.CommittedBlock
+	for h := from; h < from+uint64(count) && h <= limit; h++ {
+		block, err := f.store.GetBlockByHeight(h)
+		if err != nil || block == nil {
+			break
+		}
+		qc, err := f.store.GetCommitCertificate(h)
+		if err != nil {
+			return nil, err
+		}
+		if peer == "liar" {
+			forged := *qc
+			forged.Signatures = [][]byte{make([]byte, 64)}
+			qc = &forged
+		}
+		out = append(out, &types.CommittedBlock{Block: block, Commit: qc})
+	}
+	return out, nil
+}
+
+func TestBlockSyncCatchesUpAcrossPeers(t *testing.T) {
+	signer := newTestSigner(1)
+	newDPoS := func() *DPoS {
+		dpos := NewDPoS(1, 10)
+		if err := dpos.RegisterValidator("val0", signer.PublicKey(), 100, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		return dpos
+	}
+	cfg := Config{BlockMaxTxs: 10, MinStake: 1, EpochLength: 4}
+	source := newTestEngineWithConfig(t, cfg, signer, "val0", newDPoS())
+	for source.CommittedHeight() < 20 {
+		prop, err := source.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := source.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+
+	fetcher := &storeFetcher{
+		store: source.state.Store(),
+		peers: []string{"liar", "a", "down", "b"},
+		limit: 9,
+		calls: make(map[string]int),
+	}
+	lagging := newTestEngineWithConfig(t, cfg, signer, "val0", newDPoS())
+	syncer := NewBlockSyncer(lagging, fetcher, BlockSyncConfig{BatchSize: 3, Lookahead: 2})
+
+	n, err := syncer.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if n != 9 || lagging.CommittedHeight() != 9 {
+		t.Fatalf("expected to sync up to the peers' height 9, applied %d, at %d", n, lagging.CommittedHeight())
+	}
+	if fetcher.calls["a"] == 0 || fetcher.calls["b"] == 0 {
+		t.Fatalf("expected ranges fetched from both honest peers: %v", fetcher.calls)
+	}
+
+	// Peers moved on; a later sync resumes from the committed height.
+	fetcher.limit = 20
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("resume sync: %v", err)
+	}
+	if lagging.CommittedHeight() != 20 {
+		t.Fatalf("expected height 20 after resume, got %d", lagging.CommittedHeight())
+	}
+	for h := uint64(1); h <= 20; h++ {
+		if err := VerifyStoredBlock(lagging.state.Store(), h, testVerifier{}); err != nil {
+			t.Fatalf("synced block %d: %v", h, err)
+		}
+	}
+	want, _ := source.state.Store().GetBlockByHeight(20)
+	got, _ := lagging.state.Store().GetBlockByHeight(20)
+	if mustHashBlock(want) != mustHashBlock(got) {
+		t.Fatalf("synced chain diverges from source")
+	}
+}
@@ -0,0 +1,144 @@
+package consensus
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// Gossip may reorder or lose proposals. A validator that misses a certified
+// block cannot validate anything built on it, so it remembers verified QCs for
+// blocks it lacks, holds proposals that extend them, and accepts the missing
+// proposals when peers resend their uncommitted chain on timeout.
+
+// maxOrphanLead bounds how far above the committed height the engine keeps
+// proposals and QCs for blocks it has not validated.
+const maxOrphanLead = 8
+
+// noteMissingLocked remembers a QC for a block that has not been validated
+// here, so the block is accepted without a vote once its proposal arrives.
+func (e *Engine) noteMissingLocked(qc *types.QuorumCertificate) {
+	if qc.Height <= e.height || qc.Height > e.height+maxOrphanLead {
+		return
+	}
+	if _, ok := e.missing[qc.BlockHash]; ok {
+		return
+	}
+	if err := VerifyQC(qc, e.validatorSetLocked(qc.Height), e.verifier); err != nil {
+		return
+	}
+	e.missing[qc.BlockHash] = qc
+}
+
+// holdOrphanLocked returns nil when prop's justify certifies a known or
+// committed block. Otherwise it holds a correctly signed proposal until that
+// block is validated and reports the justify as unknown.
+func (e *Engine) holdOrphanLocked(prop *types.Proposal) error {
+	qc := prop.Justify
+	if qc.Height <= e.height {
+		return nil
+	}
+	if _, ok := e.blocks[qc.BlockHash]; ok {
+		return nil
+	}
+	e.noteMissingLocked(qc)
+	if prop.Block.Height <= e.height+maxOrphanLead {
+		pk, ok := e.validatorPubKeyLocked(prop.Block.Height, prop.Block.Proposer)
+		propBytes, err := ProposalSignBytes(prop)
+		if ok && err == nil && e.verifier.Verify(propBytes, prop.ProposerSig, pk) {
+			e.orphans[viewKey{validator: prop.Block.Proposer, height: prop.Block.Height, round: prop.Round}] = prop
+		}
+	}
+	return fmt.Errorf("invalid justify: unknown block for qc")
+}
+
+// replayOrphansLocked handles the held proposals whose justify certifies
+// parent, and in turn those waiting on them, lowest round first.
+func (e *Engine) replayOrphansLocked(parent types.Hash) {
+	parents := []types.Hash{parent}
+	for len(parents) > 0 {
+		hash := parents[0]
+		parents = parents[1:]
+		var ready []viewKey
+		for key, prop := range e.orphans {
+			if prop.Justify.BlockHash == hash {
+				ready = append(ready, key)
+			}
+		}
+		sort.Slice(ready, func(i, j int) bool {
+			if ready[i].round != ready[j].round {
+				return ready[i].round < ready[j].round
+			}
+			return ready[i].validator < ready[j].validator
+		})
+		for _, key := range ready {
+			prop := e.orphans[key]
+			delete(e.orphans, key)
+			if _, err := e.handleProposalLocked(prop); err == nil {
+				parents = append(parents, mustHashBlock(prop.Block))
+			}
+		}
+	}
+}
+
+// acceptCertifiedLocked validates and stores a block that qc shows a quorum
+// already voted for. The view checks guarding a vote do not apply: the block
+// may be from an earlier round, and no vote is cast for it.
+func (e *Engine) acceptCertifiedLocked(prop *types.Proposal, qc *types.QuorumCertificate) error {
+	block := prop.Block
+	if block.Height != qc.Height {
+		return fmt.Errorf("certified block height mismatch")
+	}
+	parentHash, parentHeight := e.lastFinalized, e.height
+	if prop.Justify != nil {
+		if err := e.holdOrphanLocked(prop); err != nil {
+			return err
+		}
+		if err := e.acceptQCLocked(prop.Justify); err != nil {
+			return fmt.Errorf("invalid justify: %w", err)
+		}
+		parentHash, parentHeight = prop.Justify.BlockHash, prop.Justify.Height
+	}
+	if block.Height != parentHeight+1 || block.PrevHash != parentHash {
+		return fmt.Errorf("block does not extend justify")
+	}
+	ancestors, err := e.ancestorsLocked(parentHash)
+	if err != nil {
+		return err
+	}
+	if err := e.verifyLastCommitLocked(block); err != nil {
+		return err
+	}
+	if err := e.verifyBlockEvidenceLocked(block, ancestors); err != nil {
+		return err
+	}
+	root, err := e.state.PreviewBlockOn(ancestors, block, e.contracts)
+	if err != nil {
+		return err
+	}
+	if root != block.StateRoot {
+		return fmt.Errorf("state root mismatch")
+	}
+	hash := mustHashBlock(block)
+	e.blocks[hash] = block
+	e.justifies[hash] = prop.Justify
+	e.proposals[hash] = prop
+	delete(e.missing, hash)
+	return e.updateQCLocked(qc)
+}
+
+// resendChainLocked rebroadcasts the proposals of the uncommitted chain ending
+// at the tip, newest first, for peers that missed one of them. A receiver
+// learns from each proposal's justify that the next one down is certified.
+func (e *Engine) resendChainLocked() {
+	hash, _ := e.tipLocked()
+	for hash != e.lastFinalized {
+		prop, ok := e.proposals[hash]
+		if !ok {
+			return
+		}
+		_ = e.network.BroadcastProposal(prop)
+		hash = prop.Block.PrevHash
+	}
+}
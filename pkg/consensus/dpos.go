@@ -1,6 +1,7 @@
 package consensus
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"sync"
@@ -8,7 +9,10 @@ import (
 	"github.com/georgecane/opencoin/pkg/types"
 )
 
-// DPoS manages validator registration, delegation, and slashing.
+// DPoS is a view of the validator registry committed in state, from which
+// validator sets are drawn. The engine rebuilds it after every committed
+// block; validators registered directly are only used to seed the registry of
+// a fresh chain.
 type DPoS struct {
 	mu            sync.RWMutex
 	validators    map[types.Address]*types.Validator
@@ -25,7 +29,8 @@ func NewDPoS(minStake uint64, maxValidators uint32) *DPoS {
 	}
 }
 
-// RegisterValidator registers a new validator.
+// RegisterValidator registers a new validator. On a fresh chain the engine
+// writes the validators registered before it starts to state, as genesis.
 func (d *DPoS) RegisterValidator(operatorAddr types.Address, consensusPubKey []byte, stake uint64, commission uint16) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -36,9 +41,6 @@ func (d *DPoS) RegisterValidator(operatorAddr types.Address, consensusPubKey []b
 	if _, exists := d.validators[operatorAddr]; exists {
 		return fmt.Errorf("validator already registered: %s", operatorAddr)
 	}
-	if uint32(len(d.validators)) >= d.maxValidators {
-		return fmt.Errorf("max validators reached: %d", d.maxValidators)
-	}
 
 	d.validators[operatorAddr] = &types.Validator{
 		OperatorAddress: operatorAddr,
@@ -51,74 +53,41 @@ func (d *DPoS) RegisterValidator(operatorAddr types.Address, consensusPubKey []b
 	return nil
 }
 
-// Delegate delegates stake to a validator.
-func (d *DPoS) Delegate(delegator types.Address, validator types.Address, amount uint64) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	v, ok := d.validators[validator]
-	if !ok {
-		return fmt.Errorf("validator not found: %s", validator)
-	}
-	if amount == 0 {
-		return fmt.Errorf("delegation amount must be positive")
-	}
-	v.Delegations[delegator] += amount
-	v.Power += amount
-	return nil
-}
-
-// Undelegate removes a delegation.
-func (d *DPoS) Undelegate(delegator types.Address, validator types.Address, amount uint64) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
+// CheckUnjail reports why validator cannot unjail in currentEpoch, if it
+// cannot: it is not jailed, its term is not over, or slashing took its
+// self-stake below the minimum.
+func (d *DPoS) CheckUnjail(validator types.Address, currentEpoch uint64) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	v, ok := d.validators[validator]
 	if !ok {
 		return fmt.Errorf("validator not found: %s", validator)
 	}
-	delegated := v.Delegations[delegator]
-	if delegated < amount {
-		return fmt.Errorf("insufficient delegation")
+	if !v.Jailed {
+		return fmt.Errorf("validator not jailed: %s", validator)
 	}
-	v.Delegations[delegator] -= amount
-	v.Power -= amount
-	return nil
-}
-
-// SlashDoubleSign slashes and jails a validator for double-signing.
-func (d *DPoS) SlashDoubleSign(validator types.Address, slashBps uint64, jailEpochs uint64, currentEpoch uint64) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	v, ok := d.validators[validator]
-	if !ok {
-		return fmt.Errorf("validator not found: %s", validator)
+	if currentEpoch < v.JailedUntilEpoch {
+		return fmt.Errorf("validator jailed until epoch %d", v.JailedUntilEpoch)
 	}
-	slashAmount := (v.Stake * slashBps) / 10000
-	if v.Stake >= slashAmount {
-		v.Stake -= slashAmount
+	if v.Stake < d.minStake {
+		return fmt.Errorf("stake below minimum: %d < %d", v.Stake, d.minStake)
 	}
-	v.Power = v.Stake
-	v.JailedUntilEpoch = currentEpoch + jailEpochs
 	return nil
 }
 
-// SlashOffline slashes and jails a validator for downtime.
-func (d *DPoS) SlashOffline(validator types.Address, slashBps uint64, jailEpochs uint64, currentEpoch uint64) error {
-	return d.SlashDoubleSign(validator, slashBps, jailEpochs, currentEpoch)
-}
-
-// ValidatorSet returns the current validator set ordered by power, then address.
+// ValidatorSet returns the active validator set: the maxValidators validators
+// with the most power, ordered by power, then address. Jailed validators are excluded.
 func (d *DPoS) ValidatorSet() *types.ValidatorSet {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
 	validators := make([]*types.Validator, 0, len(d.validators))
-	var totalPower uint64
 	for _, v := range d.validators {
+		if v.Jailed {
+			continue
+		}
 		copyV := *v
 		validators = append(validators, &copyV)
-		totalPower += v.Power
 	}
 	sort.Slice(validators, func(i, j int) bool {
 		if validators[i].Power == validators[j].Power {
@@ -126,11 +95,16 @@ func (d *DPoS) ValidatorSet() *types.ValidatorSet {
 		}
 		return validators[i].Power > validators[j].Power
 	})
+	if uint32(len(validators)) > d.maxValidators {
+		validators = validators[:d.maxValidators]
+	}
 
+	var totalPower uint64
 	index := make(map[types.Address]uint32)
 	for i, v := range validators {
 		v.Index = uint32(i)
 		index[v.OperatorAddress] = uint32(i)
+		totalPower += v.Power
 	}
 
 	return &types.ValidatorSet{
@@ -140,6 +114,20 @@ func (d *DPoS) ValidatorSet() *types.ValidatorSet {
 	}
 }
 
+// Validators returns every registered validator, jailed ones included,
+// ordered by address.
+func (d *DPoS) Validators() []*types.Validator {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := make([]*types.Validator, 0, len(d.validators))
+	for _, v := range d.validators {
+		copyV := *v
+		out = append(out, &copyV)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OperatorAddress < out[j].OperatorAddress })
+	return out
+}
+
 // GetValidator returns a validator by address.
 func (d *DPoS) GetValidator(operatorAddr types.Address) *types.Validator {
 	d.mu.RLock()
@@ -151,3 +139,51 @@ func (d *DPoS) GetValidator(operatorAddr types.Address) *types.Validator {
 	copyV := *v
 	return &copyV
 }
+
+// LoadValidators replaces the registry with validators rebuilt from committed
+// state. Power is recomputed from stake and delegations.
+func (d *DPoS) LoadValidators(validators []*types.Validator) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.validators = make(map[types.Address]*types.Validator, len(validators))
+	for _, v := range validators {
+		copyV := *v
+		copyV.Power = v.Stake
+		copyV.Delegations = make(map[types.Address]uint64, len(v.Delegations))
+		for addr, amount := range v.Delegations {
+			copyV.Delegations[addr] = amount
+			copyV.Power += amount
+		}
+		d.validators[v.OperatorAddress] = &copyV
+	}
+}
+
+// CheckDelegation reports why validator cannot take new delegations, if it cannot.
+func (d *DPoS) CheckDelegation(validator types.Address) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	v, ok := d.validators[validator]
+	if !ok {
+		return fmt.Errorf("validator not found: %s", validator)
+	}
+	if v.Jailed {
+		return fmt.Errorf("validator jailed: %s", validator)
+	}
+	return nil
+}
+
+// CheckCreateValidator reports why operatorAddr cannot register with
+// consensusPubKey, if it cannot.
+func (d *DPoS) CheckCreateValidator(operatorAddr types.Address, consensusPubKey []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, exists := d.validators[operatorAddr]; exists {
+		return fmt.Errorf("validator already registered: %s", operatorAddr)
+	}
+	for _, v := range d.validators {
+		if bytes.Equal(v.ConsensusPubKey, consensusPubKey) {
+			return fmt.Errorf("consensus pubkey already used by %s", v.OperatorAddress)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// Validator sets rotate only at epoch boundaries. The set for the following
+// epoch is snapshotted from DPoS when the current epoch begins, so blocks of
+// the next epoch can be voted on before the last blocks of this one commit.
+// An EpochLength of zero keeps the genesis set forever. Blocks commit to the
+// set of the block after them too, so an epoch must span at least three
+// blocks: the third uncommitted block may be the last of the next epoch.
+//
+// Jailed validators do not wait for the next rotation. Committing a block
+// takes its grandchild's QC, and that grandchild already commits to the set
+// of the block after it, so the block that jails a validator removes it from
+// every set signing blocks from setChangeDelay heights after it on.
+
+// setChangeDelay is the distance from a committed block to the first height
+// whose validator set no block can have committed to yet.
+const setChangeDelay = 4
+
+// validatorSetChange is a set replacing the one of its epoch from start on.
+type validatorSetChange struct {
+	start uint64
+	set   *types.ValidatorSet
+}
+
+// epochOf returns the epoch containing height.
+func (e *Engine) epochOf(height uint64) uint64 {
+	if e.cfg.EpochLength == 0 {
+		return 0
+	}
+	return height / e.cfg.EpochLength
+}
+
+// epochStart returns the first height of the epoch containing height.
+func (e *Engine) epochStart(height uint64) uint64 {
+	return e.epochOf(height) * e.cfg.EpochLength
+}
+
+// validatorSetLocked returns the validator set that signs blocks at height, or
+// nil if it is not known.
+func (e *Engine) validatorSetLocked(height uint64) *types.ValidatorSet {
+	if height > e.height {
+		for i := len(e.setChanges) - 1; i >= 0; i-- {
+			if c := e.setChanges[i]; c.start <= height && e.epochOf(c.start) == e.epochOf(height) {
+				return c.set
+			}
+		}
+		if e.cfg.EpochLength == 0 {
+			return e.validatorSet
+		}
+		current := e.epochOf(e.height + 1)
+		switch e.epochOf(height) {
+		case current:
+			return e.validatorSet
+		case current + 1:
+			return e.nextSet
+		}
+	}
+	set, err := e.state.Store().GetValidatorSet(height)
+	if err != nil {
+		return nil
+	}
+	return set
+}
+
+// validatorsHashesLocked returns the hashes of the validator sets that sign
+// the block at height and the block after it.
+func (e *Engine) validatorsHashesLocked(height uint64) (current, next types.Hash, err error) {
+	for i, h := range []*types.Hash{&current, &next} {
+		set := e.validatorSetLocked(height + uint64(i))
+		if set == nil {
+			return current, next, fmt.Errorf("no validator set for height %d", height+uint64(i))
+		}
+		if *h, err = encoding.HashValidatorSet(set); err != nil {
+			return current, next, err
+		}
+	}
+	return current, next, nil
+}
+
+// ValidatorSetAt returns the validator set that signs blocks at height.
+func (e *Engine) ValidatorSetAt(height uint64) (*types.ValidatorSet, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	set := e.validatorSetLocked(height)
+	if set == nil {
+		return nil, fmt.Errorf("no validator set for height %d", height)
+	}
+	return set, nil
+}
+
+// loadValidatorSets restores the current and next epoch sets, and the changes
+// pending after the next height, from the store. Sets that were never
+// persisted, as on a fresh chain, are snapshotted from DPoS.
+func (e *Engine) loadValidatorSets() error {
+	store := e.state.Store()
+	start := e.epochStart(e.height + 1)
+	set, err := store.GetValidatorSet(e.height + 1)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		set = e.dpos.ValidatorSet()
+		if err := store.SetValidatorSet(start, set); err != nil {
+			return err
+		}
+	}
+	e.validatorSet = set
+	for h := e.height + 2; h <= e.height+setChangeDelay; h++ {
+		persisted, err := store.HasValidatorSet(h)
+		if err != nil {
+			return err
+		}
+		if !persisted {
+			continue
+		}
+		set, err := store.GetValidatorSet(h)
+		if err != nil {
+			return err
+		}
+		e.setChanges = append(e.setChanges, validatorSetChange{start: h, set: set})
+	}
+	if e.cfg.EpochLength == 0 {
+		return nil
+	}
+	nextStart := start + e.cfg.EpochLength
+	persisted, err := store.HasValidatorSet(nextStart)
+	if err != nil {
+		return err
+	}
+	if !persisted {
+		e.nextSet = e.dpos.ValidatorSet()
+		return store.SetValidatorSet(nextStart, e.nextSet)
+	}
+	e.nextSet, err = store.GetValidatorSet(nextStart)
+	return err
+}
+
+// rotateValidatorSetLocked moves to the next epoch's set after committing the
+// last block of an epoch and snapshots DPoS for the epoch after that. Changes
+// starting at the next height take effect, and validators the committed block
+// jailed are dropped.
+func (e *Engine) rotateValidatorSetLocked(committed uint64) error {
+	if e.cfg.EpochLength != 0 && (committed+1)%e.cfg.EpochLength == 0 {
+		e.validatorSet = e.nextSet
+		e.nextSet = e.dpos.ValidatorSet()
+		if err := e.state.Store().SetValidatorSet(committed+1+e.cfg.EpochLength, e.nextSet); err != nil {
+			return err
+		}
+	}
+	pending := e.setChanges[:0]
+	for _, c := range e.setChanges {
+		switch {
+		case c.start > committed+1:
+			pending = append(pending, c)
+		case e.epochOf(c.start) == e.epochOf(committed+1):
+			e.validatorSet = c.set
+		}
+	}
+	e.setChanges = pending
+	return e.dropJailedLocked(committed)
+}
+
+// dropJailedLocked removes jailed validators from the sets signing blocks
+// from committed+setChangeDelay on: the rest of that epoch and, if it is the
+// current one, the next epoch.
+func (e *Engine) dropJailedLocked(committed uint64) error {
+	starts := []uint64{committed + setChangeDelay}
+	if e.cfg.EpochLength != 0 && e.epochOf(starts[0]) == e.epochOf(committed+1) {
+		starts = append(starts, e.epochStart(starts[0])+e.cfg.EpochLength)
+	}
+	for _, start := range starts {
+		set := e.withoutJailedLocked(e.validatorSetLocked(start))
+		if set == nil {
+			continue
+		}
+		if err := e.state.Store().SetValidatorSet(start, set); err != nil {
+			return err
+		}
+		e.setChanges = append(e.setChanges, validatorSetChange{start: start, set: set})
+	}
+	return nil
+}
+
+// withoutJailedLocked returns set without its jailed members, or nil if none
+// is jailed or none would remain.
+func (e *Engine) withoutJailedLocked(set *types.ValidatorSet) *types.ValidatorSet {
+	if set == nil {
+		return nil
+	}
+	kept := &types.ValidatorSet{IndexByAddr: make(map[types.Address]uint32)}
+	for _, v := range set.Validators {
+		if reg := e.dpos.GetValidator(v.OperatorAddress); reg != nil && reg.Jailed {
+			continue
+		}
+		member := *v
+		member.Index = uint32(len(kept.Validators))
+		kept.Validators = append(kept.Validators, &member)
+		kept.IndexByAddr[member.OperatorAddress] = member.Index
+		kept.TotalPower += member.Power
+	}
+	if len(kept.Validators) == len(set.Validators) || len(kept.Validators) == 0 {
+		return nil
+	}
+	return kept
+}
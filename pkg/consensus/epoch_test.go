@@ -0,0 +1,92 @@
+package consensus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestValidatorSetRotatesAtEpochBoundary(t *testing.T) {
+	e, _, signers := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1, EpochLength: 3})
+
+	// Joining during epoch 0 is queued: epochs 0 and 1 were fixed at genesis.
+	kp, val1 := fundedAccount(t, e, 10)
+	if err := e.mempool.AddTx(signedTx(t, kp, 0, tx.CreateValidator{ConsensusPubKey: newTestSigner(2).PublicKey(), SelfStake: 10})); err != nil {
+		t.Fatalf("add tx: %v", err)
+	}
+	for e.CommittedHeight() < 7 {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+		if e.CommittedHeight() < 6 {
+			if _, ok := e.validatorSetLocked(e.height + 1).IndexByAddr[val1]; ok && e.height+1 < 6 {
+				t.Fatalf("validator joined mid-epoch at height %d", e.height+1)
+			}
+		}
+	}
+	for h, want := range map[uint64]int{2: 1, 3: 1, 5: 1, 6: 2, 7: 2} {
+		set, err := e.ValidatorSetAt(h)
+		if err != nil {
+			t.Fatalf("set at %d: %v", h, err)
+		}
+		if len(set.Validators) != want {
+			t.Fatalf("height %d: expected %d validators, got %d", h, want, len(set.Validators))
+		}
+		block, err := e.state.Store().GetBlockByHeight(h)
+		if err != nil || block == nil {
+			t.Fatalf("get block %d: %v", h, err)
+		}
+		setHash, _ := encoding.HashValidatorSet(set)
+		if block.ValidatorsHash != setHash {
+			t.Fatalf("height %d: block does not commit to its validator set", h)
+		}
+		next, err := e.ValidatorSetAt(h + 1)
+		if err != nil {
+			t.Fatalf("set at %d: %v", h+1, err)
+		}
+		if nextHash, _ := encoding.HashValidatorSet(next); block.NextValidatorsHash != nextHash {
+			t.Fatalf("height %d: block does not commit to the next validator set", h)
+		}
+	}
+	// Past epochs are served from the store.
+	set, err := e.state.Store().GetValidatorSet(4)
+	if err != nil || set == nil || len(set.Validators) != 1 {
+		t.Fatalf("persisted set for epoch 1: %+v %v", set, err)
+	}
+
+	// A proposal committing to another next set is not voted for.
+	prop, err := e.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	prop.Block.NextValidatorsHash = types.Hash{1}
+	msg, _ := ProposalSignBytes(prop)
+	prop.ProposerSig, _ = signers[0].Sign(msg)
+	if _, err := e.HandleProposal(prop); err == nil || !strings.Contains(err.Error(), "next validator set hash mismatch") {
+		t.Fatalf("tampered next validators hash: %v", err)
+	}
+}
+
+func TestValidatorSetCappedByPower(t *testing.T) {
+	dpos := NewDPoS(1, 2)
+	for i, power := range []uint64{5, 50, 20} {
+		addr := []string{"a", "b", "c"}[i]
+		if err := dpos.RegisterValidator(types.Address(addr), newTestSigner(byte(i+1)).PublicKey(), power, 0); err != nil {
+			t.Fatalf("register %s: %v", addr, err)
+		}
+	}
+	set := dpos.ValidatorSet()
+	if len(set.Validators) != 2 || set.Validators[0].OperatorAddress != "b" || set.Validators[1].OperatorAddress != "c" {
+		t.Fatalf("expected top two by power, got %+v", set.IndexByAddr)
+	}
+	if set.TotalPower != 70 {
+		t.Fatalf("expected total power of active set, got %d", set.TotalPower)
+	}
+}
@@ -0,0 +1,261 @@
+package consensus
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// viewKey identifies the single vote or proposal a validator may sign per view.
+type viewKey struct {
+	validator types.Address
+	height    uint64
+	round     uint64
+}
+
+// VerifyEvidence checks that evidence holds two conflicting messages for its
+// view, both signed with pubKey.
+func VerifyEvidence(ev *types.DuplicateVoteEvidence, pubKey []byte, verifier crypto.Verifier) error {
+	if ev == nil {
+		return fmt.Errorf("nil evidence")
+	}
+	switch {
+	case ev.VoteA != nil && ev.VoteB != nil && ev.ProposalA == nil && ev.ProposalB == nil:
+		for _, v := range []*types.PrecommitVote{ev.VoteA, ev.VoteB} {
+			if v.Validator != ev.Validator || v.Height != ev.Height || v.Round != ev.Round {
+				return fmt.Errorf("vote does not match evidence view")
+			}
+			msg, err := PrecommitSignBytes(v)
+			if err != nil {
+				return err
+			}
+			if !verifier.Verify(msg, v.Signature, pubKey) {
+				return fmt.Errorf("invalid vote signature")
+			}
+		}
+		if ev.VoteA.BlockHash == ev.VoteB.BlockHash {
+			return fmt.Errorf("votes do not conflict")
+		}
+	case ev.ProposalA != nil && ev.ProposalB != nil && ev.VoteA == nil && ev.VoteB == nil:
+		for _, p := range []*types.Proposal{ev.ProposalA, ev.ProposalB} {
+			if p.Block == nil || p.Block.Proposer != ev.Validator || p.Block.Height != ev.Height || p.Round != ev.Round {
+				return fmt.Errorf("proposal does not match evidence view")
+			}
+			msg, err := ProposalSignBytes(p)
+			if err != nil {
+				return err
+			}
+			if !verifier.Verify(msg, p.ProposerSig, pubKey) {
+				return fmt.Errorf("invalid proposal signature")
+			}
+		}
+		if mustHashBlock(ev.ProposalA.Block) == mustHashBlock(ev.ProposalB.Block) {
+			return fmt.Errorf("proposals do not conflict")
+		}
+	default:
+		return fmt.Errorf("evidence must hold two votes or two proposals")
+	}
+	return nil
+}
+
+// HandleEvidence verifies evidence received from the network and adds it to
+// the pool of evidence awaiting inclusion in a block.
+func (e *Engine) HandleEvidence(ev *types.DuplicateVoteEvidence) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.verifyEvidenceLocked(ev, e.clock.Now().Unix()); err != nil {
+		return err
+	}
+	e.addEvidenceLocked(ev)
+	return nil
+}
+
+// PendingEvidence returns the evidence waiting to be included in a block.
+func (e *Engine) PendingEvidence() []*types.DuplicateVoteEvidence {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pendingEvidenceLocked(nil)
+}
+
+// recordVoteLocked remembers a verified vote and reports the validator when it
+// already voted for a different block in the same view.
+func (e *Engine) recordVoteLocked(vote *types.PrecommitVote) {
+	key := viewKey{validator: vote.Validator, height: vote.Height, round: vote.Round}
+	prev, ok := e.seenVotes[key]
+	if !ok {
+		e.seenVotes[key] = vote
+		return
+	}
+	if prev.BlockHash == vote.BlockHash {
+		return
+	}
+	e.reportEvidenceLocked(&types.DuplicateVoteEvidence{
+		Validator: vote.Validator,
+		Height:    vote.Height,
+		Round:     vote.Round,
+		VoteA:     prev,
+		VoteB:     vote,
+	})
+}
+
+// recordProposalLocked remembers a verified proposal and reports the proposer
+// when it already proposed a different block in the same view.
+func (e *Engine) recordProposalLocked(prop *types.Proposal) {
+	key := viewKey{validator: prop.Block.Proposer, height: prop.Block.Height, round: prop.Round}
+	prev, ok := e.seenProposals[key]
+	if !ok {
+		e.seenProposals[key] = prop
+		return
+	}
+	if mustHashBlock(prev.Block) == mustHashBlock(prop.Block) {
+		return
+	}
+	e.reportEvidenceLocked(&types.DuplicateVoteEvidence{
+		Validator: prop.Block.Proposer,
+		Height:    prop.Block.Height,
+		Round:     prop.Round,
+		ProposalA: prev,
+		ProposalB: prop,
+	})
+}
+
+// reportEvidenceLocked pools locally detected evidence and gossips it.
+func (e *Engine) reportEvidenceLocked(ev *types.DuplicateVoteEvidence) {
+	if e.addEvidenceLocked(ev) && e.network != nil {
+		_ = e.network.BroadcastEvidence(ev)
+	}
+}
+
+// addEvidenceLocked pools evidence unless it is already pooled or committed.
+func (e *Engine) addEvidenceLocked(ev *types.DuplicateVoteEvidence) bool {
+	id, err := encoding.EvidenceID(ev)
+	if err != nil {
+		return false
+	}
+	if _, ok := e.evidence[id]; ok {
+		return false
+	}
+	if committed, err := e.state.Store().HasEvidence(id); err != nil || committed {
+		return false
+	}
+	e.evidence[id] = ev
+	return true
+}
+
+// verifyEvidenceLocked checks evidence against a block time: it must be valid,
+// not yet punished, and its offense must be within the unbonding period.
+func (e *Engine) verifyEvidenceLocked(ev *types.DuplicateVoteEvidence, blockTime int64) error {
+	if ev == nil {
+		return fmt.Errorf("nil evidence")
+	}
+	v := e.dpos.GetValidator(ev.Validator)
+	if v == nil {
+		return fmt.Errorf("unknown validator %s", ev.Validator)
+	}
+	if err := VerifyEvidence(ev, v.ConsensusPubKey, e.verifier); err != nil {
+		return err
+	}
+	id, err := encoding.EvidenceID(ev)
+	if err != nil {
+		return err
+	}
+	committed, err := e.state.Store().HasEvidence(id)
+	if err != nil {
+		return err
+	}
+	if committed {
+		return fmt.Errorf("evidence already committed")
+	}
+	if ev.Height > e.height {
+		// The offense is at an uncommitted height, so it cannot be expired.
+		return nil
+	}
+	// The state records block timestamps for the unbonding period, also on
+	// nodes restored from a snapshot, so the age check always runs.
+	offenseTime, ok, err := e.state.Store().GetBlockTime(ev.Height)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no timestamp recorded for height %d", ev.Height)
+	}
+	if blockTime-offenseTime > int64(e.cfg.UnbondingPeriod) {
+		return fmt.Errorf("evidence older than unbonding period")
+	}
+	return nil
+}
+
+// verifyBlockEvidenceLocked checks the evidence carried by a proposed block.
+// Each offense may appear once across the block and its uncommitted ancestors.
+func (e *Engine) verifyBlockEvidenceLocked(block *types.Block, ancestors []*types.Block) error {
+	included, err := evidenceIDs(ancestors)
+	if err != nil {
+		return err
+	}
+	for _, ev := range block.Evidence {
+		if ev == nil || ev.Height > block.Height {
+			return fmt.Errorf("evidence from the future")
+		}
+		if err := e.verifyEvidenceLocked(ev, block.Timestamp); err != nil {
+			return fmt.Errorf("invalid evidence: %w", err)
+		}
+		id, _ := encoding.EvidenceID(ev)
+		if _, ok := included[id]; ok {
+			return fmt.Errorf("duplicate evidence")
+		}
+		included[id] = struct{}{}
+	}
+	return nil
+}
+
+// pendingEvidenceLocked returns pooled evidence not yet included in ancestors,
+// ordered by ID so proposals are deterministic.
+func (e *Engine) pendingEvidenceLocked(ancestors []*types.Block) []*types.DuplicateVoteEvidence {
+	included, err := evidenceIDs(ancestors)
+	if err != nil {
+		return nil
+	}
+	ids := make([]types.Hash, 0, len(e.evidence))
+	for id := range e.evidence {
+		if _, ok := included[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	out := make([]*types.DuplicateVoteEvidence, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, e.evidence[id])
+	}
+	return out
+}
+
+// forgetEvidenceLocked drops the evidence a committed block carried from the
+// pool; the state transition has punished it.
+func (e *Engine) forgetEvidenceLocked(block *types.Block) error {
+	for _, ev := range block.Evidence {
+		id, err := encoding.EvidenceID(ev)
+		if err != nil {
+			return err
+		}
+		delete(e.evidence, id)
+	}
+	return nil
+}
+
+func evidenceIDs(blocks []*types.Block) (map[types.Hash]struct{}, error) {
+	ids := make(map[types.Hash]struct{})
+	for _, b := range blocks {
+		for _, ev := range b.Evidence {
+			id, err := encoding.EvidenceID(ev)
+			if err != nil {
+				return nil, err
+			}
+			ids[id] = struct{}{}
+		}
+	}
+	return ids, nil
+}
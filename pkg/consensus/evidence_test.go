@@ -0,0 +1,218 @@
+package consensus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func signedVote(t *testing.T, signer *testSigner, addr types.Address, blockHash types.Hash, height, round uint64) *types.PrecommitVote {
+	t.Helper()
+	vote := &types.PrecommitVote{BlockHash: blockHash, Height: height, Round: round, Validator: addr}
+	msg, err := PrecommitSignBytes(vote)
+	if err != nil {
+		t.Fatalf("sign bytes: %v", err)
+	}
+	vote.Signature, _ = signer.Sign(msg)
+	return vote
+}
+
+// newEvidenceEngine returns an engine for val0, which holds enough power to
+// commit alone, and the signer of val1, the validator that misbehaves.
+func newEvidenceEngine(t *testing.T) (*Engine, *DPoS, *testSigner) {
+	t.Helper()
+	e, dpos, signers := newStakingTestEngine(t, Config{
+		BlockMaxTxs:     10,
+		MinStake:        1,
+		EpochLength:     5,
+		UnbondingPeriod: 1000,
+	}, 100)
+	e.state.SetStakingParams(state.StakingParams{EpochLength: 5, SlashDoubleBps: 500, JailDoubleEpochs: 2})
+	return e, dpos, signers[1]
+}
+
+func TestDoubleVoteIsSlashed(t *testing.T) {
+	e, dpos, byz := newEvidenceEngine(t)
+
+	for _, h := range []types.Hash{{1}, {2}} {
+		if _, err := e.HandlePrecommitVote(signedVote(t, byz, "val1", h, 1, 0)); err != nil {
+			t.Fatalf("vote: %v", err)
+		}
+	}
+	if got := len(e.PendingEvidence()); got != 1 {
+		t.Fatalf("expected 1 pending evidence, got %d", got)
+	}
+
+	for e.CommittedHeight() < 1 {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	block, err := e.state.Store().GetBlockByHeight(1)
+	if err != nil || block == nil {
+		t.Fatalf("get block: %v", err)
+	}
+	if len(block.Evidence) != 1 || block.Evidence[0].Validator != "val1" {
+		t.Fatalf("expected evidence in block 1, got %+v", block.Evidence)
+	}
+	v := dpos.GetValidator("val1")
+	if v.Stake != 95 || v.JailedUntilEpoch != 2 {
+		t.Fatalf("expected slashed and jailed validator, got stake %d jailed until %d", v.Stake, v.JailedUntilEpoch)
+	}
+	if got := len(e.PendingEvidence()); got != 0 {
+		t.Fatalf("expected evidence pool to drain, got %d", got)
+	}
+	id, _ := encoding.EvidenceID(block.Evidence[0])
+	if ok, err := e.state.Store().HasEvidence(id); err != nil || !ok {
+		t.Fatalf("evidence not recorded: %v", err)
+	}
+	if err := e.HandleEvidence(block.Evidence[0]); err == nil {
+		t.Fatalf("expected committed evidence to be rejected")
+	}
+}
+
+func TestEquivocationAcrossRoundsIsOneOffense(t *testing.T) {
+	// val1 is too small to get a turn as proposer during the test.
+	e, dpos, signers := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1, UnbondingPeriod: 1000}, 20)
+	e.state.SetStakingParams(state.StakingParams{SlashDoubleBps: 500})
+	byz := signers[1]
+	commitUntil(t, e, 1)
+	evidenceIn := func(round uint64) *types.DuplicateVoteEvidence {
+		return &types.DuplicateVoteEvidence{
+			Validator: "val1", Height: 1, Round: round,
+			VoteA: signedVote(t, byz, "val1", types.Hash{1}, 1, round),
+			VoteB: signedVote(t, byz, "val1", types.Hash{2}, 1, round),
+		}
+	}
+	for _, round := range []uint64{0, 1} {
+		if err := e.HandleEvidence(evidenceIn(round)); err != nil {
+			t.Fatalf("evidence in round %d: %v", round, err)
+		}
+	}
+	if got := len(e.PendingEvidence()); got != 1 {
+		t.Fatalf("expected the two rounds pooled as one offense, got %d", got)
+	}
+
+	// A block carrying both is not voted for.
+	prop, err := e.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if len(prop.Block.Evidence) != 1 {
+		t.Fatalf("proposal carries %d pieces of evidence, want 1", len(prop.Block.Evidence))
+	}
+	block := *prop.Block
+	block.Evidence = []*types.DuplicateVoteEvidence{evidenceIn(0), evidenceIn(1)}
+	block.StateRoot, _ = e.state.PreviewBlock(&block, e.contracts)
+	forged := &types.Proposal{Block: &block, Round: prop.Round, Justify: prop.Justify}
+	msg, _ := ProposalSignBytes(forged)
+	forged.ProposerSig, _ = signers[0].Sign(msg)
+	if _, err := e.HandleProposal(forged); err == nil || !strings.Contains(err.Error(), "duplicate evidence") {
+		t.Fatalf("block punishing one offense twice: %v", err)
+	}
+
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if v := dpos.GetValidator("val1"); v.Stake != 19 {
+		t.Fatalf("stake %d, want 19 after a single 5%% slash", v.Stake)
+	}
+	if err := e.HandleEvidence(evidenceIn(2)); err == nil {
+		t.Fatalf("evidence from another round of a punished height accepted")
+	}
+}
+
+func TestEvidenceValidation(t *testing.T) {
+	e, _, byz := newEvidenceEngine(t)
+	pk := byz.PublicKey()
+
+	same := &types.DuplicateVoteEvidence{
+		Validator: "val1", Height: 1, Round: 0,
+		VoteA: signedVote(t, byz, "val1", types.Hash{1}, 1, 0),
+		VoteB: signedVote(t, byz, "val1", types.Hash{1}, 1, 0),
+	}
+	if err := VerifyEvidence(same, pk, testVerifier{}); err == nil {
+		t.Fatalf("expected identical votes to be rejected")
+	}
+	forged := &types.DuplicateVoteEvidence{
+		Validator: "val1", Height: 1, Round: 0,
+		VoteA: signedVote(t, byz, "val1", types.Hash{1}, 1, 0),
+		VoteB: signedVote(t, newTestSigner(9), "val1", types.Hash{2}, 1, 0),
+	}
+	if err := VerifyEvidence(forged, pk, testVerifier{}); err == nil {
+		t.Fatalf("expected forged vote to be rejected")
+	}
+
+	proposal := func(ts int64) *types.Proposal {
+		p := &types.Proposal{Block: &types.Block{Height: 1, Timestamp: ts, Proposer: "val1"}, Round: 0}
+		msg, _ := ProposalSignBytes(p)
+		p.ProposerSig, _ = byz.Sign(msg)
+		return p
+	}
+	props := &types.DuplicateVoteEvidence{
+		Validator: "val1", Height: 1, Round: 0,
+		ProposalA: proposal(1), ProposalB: proposal(2),
+	}
+	if err := VerifyEvidence(props, pk, testVerifier{}); err != nil {
+		t.Fatalf("verify proposal evidence: %v", err)
+	}
+
+	// Commit height 1, then check evidence for it against the unbonding period.
+	for e.CommittedHeight() < 1 {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	block, _ := e.state.Store().GetBlockByHeight(1)
+	ev := &types.DuplicateVoteEvidence{
+		Validator: "val1", Height: 1, Round: 3,
+		VoteA: signedVote(t, byz, "val1", types.Hash{1}, 1, 3),
+		VoteB: signedVote(t, byz, "val1", types.Hash{2}, 1, 3),
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.verifyEvidenceLocked(ev, block.Timestamp+int64(e.cfg.UnbondingPeriod)); err != nil {
+		t.Fatalf("expected evidence within unbonding period: %v", err)
+	}
+	if err := e.verifyEvidenceLocked(ev, block.Timestamp+int64(e.cfg.UnbondingPeriod)+1); err == nil {
+		t.Fatalf("expected expired evidence to be rejected")
+	}
+}
+
+func TestEvidenceNeedsRecordedBlockTime(t *testing.T) {
+	e, _, signers := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1, UnbondingPeriod: 1000}, 1)
+	byz := signers[1]
+	// The state keeps block times for one second only, so the time of block 1
+	// is pruned by block 3 while the block itself stays in the store.
+	e.state.SetStakingParams(state.StakingParams{UnbondingPeriod: 1})
+	commitUntil(t, e, 3)
+	if block, _ := e.state.Store().GetBlockByHeight(1); block == nil {
+		t.Fatalf("block 1 not stored")
+	}
+	tip, _ := e.state.Store().GetBlockByHeight(3)
+
+	evidenceAt := func(height uint64) *types.DuplicateVoteEvidence {
+		return &types.DuplicateVoteEvidence{
+			Validator: "val1", Height: height, Round: 0,
+			VoteA: signedVote(t, byz, "val1", types.Hash{1}, height, 0),
+			VoteB: signedVote(t, byz, "val1", types.Hash{2}, height, 0),
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.verifyEvidenceLocked(evidenceAt(3), tip.Timestamp); err != nil {
+		t.Fatalf("evidence with a recorded time rejected: %v", err)
+	}
+	if err := e.verifyEvidenceLocked(evidenceAt(1), tip.Timestamp); err == nil {
+		t.Fatalf("evidence accepted without a recorded time for its height")
+	}
+}
@@ -0,0 +1,85 @@
+package consensus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// newStakingTestEngine returns an engine for val0, which holds 1000 and
+// commits alone, with validators val1, val2, ... of the given stakes, and the
+// signers of all of them by index. Stakes far below 1000 keep a validator
+// from ever getting a proposer turn. cfg.MinStake is also the registry's
+// minimum stake.
+func newStakingTestEngine(t *testing.T, cfg Config, stakes ...uint64) (*Engine, *DPoS, []*testSigner) {
+	t.Helper()
+	dpos := NewDPoS(cfg.MinStake, 10)
+	var signers []*testSigner
+	for i, stake := range append([]uint64{1000}, stakes...) {
+		signer := newTestSigner(byte(i + 1))
+		if err := dpos.RegisterValidator(types.Address(fmt.Sprintf("val%d", i)), signer.PublicKey(), stake, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		signers = append(signers, signer)
+	}
+	return newTestEngineWithConfig(t, cfg, signers[0], "val0", dpos), dpos, signers
+}
+
+// fundedAccount creates an account with balance on e's state, whose stake
+// backs the resource credits its transactions spend, and returns its key and
+// address.
+func fundedAccount(t *testing.T, e *Engine, balance uint64) (*crypto.Ed25519KeyPair, types.Address) {
+	t.Helper()
+	kp, err := crypto.GenerateEd25519()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	addr, err := crypto.AddressFromPubKey(kp.PublicKey)
+	if err != nil {
+		t.Fatalf("address: %v", err)
+	}
+	acct := &types.Account{Address: types.Address(addr), Balance: balance, Stake: 1000, RC: 1_000_000}
+	if err := e.state.Store().SetAccount(acct); err != nil {
+		t.Fatalf("set account: %v", err)
+	}
+	return kp, acct.Address
+}
+
+// commitUntil drives a validator that can commit alone to height.
+func commitUntil(t *testing.T, e *Engine, height uint64) {
+	t.Helper()
+	for e.CommittedHeight() < height {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+}
+
+// signedTx signs a transaction carrying payload from the account of kp.
+func signedTx(t *testing.T, kp *crypto.Ed25519KeyPair, nonce uint64, payload tx.Payload) *types.Transaction {
+	t.Helper()
+	raw, err := tx.EncodePayload(payload, kp.PublicKey)
+	if err != nil {
+		t.Fatalf("encode payload: %v", err)
+	}
+	from, err := crypto.AddressFromPubKey(kp.PublicKey)
+	if err != nil {
+		t.Fatalf("address: %v", err)
+	}
+	txn := &types.Transaction{From: types.Address(from), To: types.Address(from), Nonce: nonce, Payload: raw}
+	signBytes, err := tx.SigningBytes(txn)
+	if err != nil {
+		t.Fatalf("sign bytes: %v", err)
+	}
+	if txn.Signature, err = crypto.SignEd25519(kp.PrivateKey, signBytes); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return txn
+}
@@ -3,13 +3,11 @@ package consensus
 import (
 	"fmt"
 	"sync"
-	"time"
 
 	"github.com/georgecane/opencoin/pkg/contracts"
 	"github.com/georgecane/opencoin/pkg/crypto"
 	"github.com/georgecane/opencoin/pkg/encoding"
 	"github.com/georgecane/opencoin/pkg/mempool"
-	"github.com/georgecane/opencoin/pkg/rc"
 	"github.com/georgecane/opencoin/pkg/state"
 	"github.com/georgecane/opencoin/pkg/types"
 )
@@ -19,61 +17,167 @@ type Network interface {
 	BroadcastProposal(*types.Proposal) error
 	BroadcastPrecommit(*types.PrecommitVote) error
 	BroadcastQC(*types.QuorumCertificate) error
+	BroadcastViewChange(*types.ViewChange) error
+	BroadcastTC(*types.TimeoutCertificate) error
+	BroadcastEvidence(*types.DuplicateVoteEvidence) error
 }
 
 // Config defines consensus parameters.
 type Config struct {
-	EpochLength   uint64
-	MaxValidators uint32
-	BlockMaxTxs   int
-	MinStake      uint64
-	SlashDouble   uint64
-	JailDouble    uint64
-	SlashOffline  uint64
-	JailOffline   uint64
+	EpochLength     uint64
+	MaxValidators   uint32
+	BlockMaxTxs     int
+	MinStake        uint64
+	UnbondingPeriod uint64 // seconds; older double-sign evidence is rejected
+	// WALPath is where signed messages are logged before they are broadcast;
+	// empty disables the WAL.
+	WALPath string
+	// SeedProposer seeds proposer elections with the block the previous QC
+	// certifies, so the proposer is not known until that QC forms.
+	SeedProposer bool
+	// Snapshots, if set, receives a snapshot of the committed state every
+	// SnapshotInterval blocks; zero disables snapshots.
+	Snapshots        *state.SnapshotStore
+	SnapshotInterval uint64
 }
 
-// Engine implements a HotStuff-like linear consensus with DPoS validator sets.
+// Engine implements chained HotStuff with DPoS validator sets. A QC certifies a
+// block, two consecutive QCs lock its parent, and three commit its grandparent.
 type Engine struct {
-	mu            sync.Mutex
-	cfg           Config
-	state         *state.State
-	dpos          *DPoS
-	mempool       *mempool.Mempool
-	contracts     *contracts.ContractEngine
-	verifier      crypto.Verifier
-	signer        crypto.Signer
-	network       Network
-	validatorSet  *types.ValidatorSet
-	height        uint64
-	round         uint64
-	lastFinalized types.Hash
-	votes         map[types.Hash]map[types.Address]*types.PrecommitVote
-	validatorAddr types.Address
+	mu              sync.Mutex
+	cfg             Config
+	state           *state.State
+	dpos            *DPoS
+	mempool         *mempool.Mempool
+	contracts       *contracts.ContractEngine
+	verifier        crypto.Verifier
+	signer          crypto.Signer
+	network         Network
+	validatorSet    *types.ValidatorSet  // signs blocks in the epoch after the last committed block
+	nextSet         *types.ValidatorSet  // signs blocks in the epoch after that
+	setChanges      []validatorSetChange // replace those sets after the next height
+	height          uint64               // last committed height
+	round           uint64
+	lastFinalized   types.Hash
+	votes           map[types.Hash]map[types.Address]*types.PrecommitVote
+	blocks          map[types.Hash]*types.Block                    // validated, uncommitted blocks
+	qcs             map[types.Hash]*types.QuorumCertificate        // QCs for uncommitted blocks
+	justifies       map[types.Hash]*types.QuorumCertificate        // justify carried by each uncommitted block's proposal
+	proposals       map[types.Hash]*types.Proposal                 // proposal of each uncommitted block
+	missing         map[types.Hash]*types.QuorumCertificate        // verified QCs for blocks not yet received
+	timeouts        map[uint64]map[types.Address]*types.ViewChange // view changes by round at the current height
+	seenVotes       map[viewKey]*types.PrecommitVote
+	seenProposals   map[viewKey]*types.Proposal
+	orphans         map[viewKey]*types.Proposal                 // proposals waiting for the block their justify certifies
+	evidence        map[types.Hash]*types.DuplicateVoteEvidence // pending, keyed by evidence ID
+	wal             *WAL
+	signedProposals map[viewKey]*types.Proposal      // proposals signed by this validator
+	signedVotes     map[viewKey]*types.PrecommitVote // votes signed by this validator
+	schedule        *proposerSchedule                // elects the proposer of the block after the last committed one
+	highQC          *types.QuorumCertificate
+	lockedQC        *types.QuorumCertificate
+	hasVoted        bool
+	lastVoteH       uint64
+	lastVoteR       uint64
+	progress        chan struct{}
+	validatorAddr   types.Address
+	clock           Clock // stamps proposals and ages evidence
 }
 
 // NewEngine creates a new consensus engine.
 func NewEngine(cfg Config, st *state.State, dpos *DPoS, mp *mempool.Mempool, contracts *contracts.ContractEngine, operatorAddr types.Address, signer crypto.Signer, verifier crypto.Verifier, net Network) (*Engine, error) {
 	engine := &Engine{
-		cfg:           cfg,
-		state:         st,
-		dpos:          dpos,
-		mempool:       mp,
-		contracts:     contracts,
-		signer:        signer,
-		verifier:      verifier,
-		network:       net,
-		validatorSet:  dpos.ValidatorSet(),
-		votes:         make(map[types.Hash]map[types.Address]*types.PrecommitVote),
-		validatorAddr: operatorAddr,
+		cfg:             cfg,
+		state:           st,
+		dpos:            dpos,
+		mempool:         mp,
+		contracts:       contracts,
+		signer:          signer,
+		verifier:        verifier,
+		network:         net,
+		votes:           make(map[types.Hash]map[types.Address]*types.PrecommitVote),
+		blocks:          make(map[types.Hash]*types.Block),
+		qcs:             make(map[types.Hash]*types.QuorumCertificate),
+		justifies:       make(map[types.Hash]*types.QuorumCertificate),
+		proposals:       make(map[types.Hash]*types.Proposal),
+		missing:         make(map[types.Hash]*types.QuorumCertificate),
+		timeouts:        make(map[uint64]map[types.Address]*types.ViewChange),
+		seenVotes:       make(map[viewKey]*types.PrecommitVote),
+		seenProposals:   make(map[viewKey]*types.Proposal),
+		orphans:         make(map[viewKey]*types.Proposal),
+		evidence:        make(map[types.Hash]*types.DuplicateVoteEvidence),
+		signedProposals: make(map[viewKey]*types.Proposal),
+		signedVotes:     make(map[viewKey]*types.PrecommitVote),
+		progress:        make(chan struct{}, 1),
+		validatorAddr:   operatorAddr,
+		clock:           systemClock{},
+	}
+	if cfg.EpochLength == 1 || cfg.EpochLength == 2 {
+		return nil, fmt.Errorf("epoch length must be 0 or at least 3")
 	}
 	if err := engine.loadConsensusState(); err != nil {
 		return nil, err
 	}
+	if err := engine.loadRegistry(); err != nil {
+		return nil, err
+	}
+	if err := engine.loadValidatorSets(); err != nil {
+		return nil, err
+	}
+	if err := engine.loadProposerSchedule(); err != nil {
+		return nil, err
+	}
+	if cfg.WALPath != "" {
+		wal, err := OpenWAL(cfg.WALPath)
+		if err != nil {
+			return nil, err
+		}
+		engine.wal = wal
+		engine.replayWALLocked()
+	}
 	return engine, nil
 }
 
-// ProposeBlock builds and broadcasts a new proposal if this node is proposer.
+// Close releases the consensus WAL.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.wal == nil {
+		return nil
+	}
+	return e.wal.Close()
+}
+
+// Status returns the height being decided, the current round, and whether this
+// node has already voted in that round.
+func (e *Engine) Status() (height, round uint64, voted bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, tip := e.tipLocked()
+	height = tip + 1
+	return height, e.round, e.hasVoted && e.lastVoteH == height && e.lastVoteR == e.round
+}
+
+// CommittedHeight returns the height of the last committed block.
+func (e *Engine) CommittedHeight() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.height
+}
+
+// IsProposer reports whether this node is the proposer for the current round.
+func (e *Engine) IsProposer() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.isProposerLocked()
+}
+
+// Progress is signalled whenever the engine votes, changes round, or certifies a block.
+func (e *Engine) Progress() <-chan struct{} {
+	return e.progress
+}
+
+// ProposeBlock builds and broadcasts a new proposal extending the highest QC if this node is proposer.
 func (e *Engine) ProposeBlock() (*types.Proposal, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -81,20 +185,61 @@ func (e *Engine) ProposeBlock() (*types.Proposal, error) {
 	if !e.isProposerLocked() {
 		return nil, fmt.Errorf("not proposer")
 	}
-	txs, err := e.mempool.SelectForBlock(e.cfg.BlockMaxTxs)
+	parentHash, parentHeight := e.tipLocked()
+	key := viewKey{validator: e.validatorAddress(), height: parentHeight + 1, round: e.round}
+	if prev, ok := e.signedProposals[key]; ok {
+		// Already proposed in this view, possibly before a restart: repeat it.
+		if prev.Block.PrevHash != parentHash {
+			return nil, fmt.Errorf("already proposed at height %d round %d", key.height, key.round)
+		}
+		if e.network != nil {
+			if err := e.network.BroadcastProposal(prev); err != nil {
+				return nil, err
+			}
+		}
+		return prev, nil
+	}
+	ancestors, err := e.ancestorsLocked(parentHash)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := e.selectTxsLocked(ancestors, parentHeight+1)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := e.proposalTimestampLocked(ancestors)
+	if err != nil {
+		return nil, err
+	}
+	set := e.validatorSetLocked(parentHeight + 1)
+	setHash, nextSetHash, err := e.validatorsHashesLocked(parentHeight + 1)
+	if err != nil {
+		return nil, err
+	}
+	lastCommit, err := e.lastCommitLocked(parentHash, parentHeight)
 	if err != nil {
 		return nil, err
 	}
 	block := &types.Block{
-		Height:        e.height + 1,
-		PrevHash:      e.lastFinalized,
-		StateRoot:     types.Hash{},
-		Timestamp:     time.Now().Unix(),
-		Proposer:      e.validatorAddress(),
-		Transactions:  txs,
-		ValidatorSigs: make([][]byte, len(e.validatorSet.Validators)),
-	}
-	root, err := e.state.PreviewBlock(block, e.contracts)
+		Height:                 parentHeight + 1,
+		PrevHash:               parentHash,
+		StateRoot:              types.Hash{},
+		Timestamp:              timestamp,
+		Proposer:               e.validatorAddress(),
+		Transactions:           txs,
+		ValidatorSigs:          make([][]byte, len(set.Validators)),
+		Evidence:               e.pendingEvidenceLocked(ancestors),
+		ValidatorsHash:         setHash,
+		NextValidatorsHash:     nextSetHash,
+		LastCommit:             lastCommit,
+		ProposerPrioritiesHash: e.prioritiesHashLocked(ancestors, parentHash, parentHeight+1),
+	}
+	root, err := e.state.PreviewBlockOn(ancestors, block, e.contracts)
+	if err != nil && len(txs) > 0 {
+		// A transaction conflicts with an uncommitted ancestor; keep the chain moving.
+		block.Transactions = nil
+		root, err = e.state.PreviewBlockOn(ancestors, block, e.contracts)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -103,15 +248,12 @@ func (e *Engine) ProposeBlock() (*types.Proposal, error) {
 		Block: block,
 		Round: e.round,
 	}
-	propBytes, err := ProposalSignBytes(prop)
-	if err != nil {
-		return nil, err
+	if e.highQC != nil && e.highQC.Height > e.height {
+		prop.Justify = e.highQC
 	}
-	sig, err := e.signer.Sign(propBytes)
-	if err != nil {
+	if err := e.signProposalLocked(prop); err != nil {
 		return nil, err
 	}
-	prop.ProposerSig = sig
 	if e.network != nil {
 		if err := e.network.BroadcastProposal(prop); err != nil {
 			return nil, err
@@ -120,73 +262,126 @@ func (e *Engine) ProposeBlock() (*types.Proposal, error) {
 	return prop, nil
 }
 
-// HandleProposal validates and votes for a proposal.
+// HandleProposal validates and votes for a proposal. Gossip may deliver a
+// proposal before the one it extends; such a proposal is held and handled once
+// the block its justify certifies has been validated.
 func (e *Engine) HandleProposal(prop *types.Proposal) (*types.PrecommitVote, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	vote, err := e.handleProposalLocked(prop)
+	if err != nil {
+		return nil, err
+	}
+	e.replayOrphansLocked(mustHashBlock(prop.Block))
+	return vote, nil
+}
+
+func (e *Engine) handleProposalLocked(prop *types.Proposal) (*types.PrecommitVote, error) {
 	if prop == nil || prop.Block == nil {
 		return nil, fmt.Errorf("invalid proposal")
 	}
-	if prop.Block.Height != e.height+1 {
+	if qc, ok := e.missing[mustHashBlock(prop.Block)]; ok {
+		return nil, e.acceptCertifiedLocked(prop, qc)
+	}
+	parentHash, parentHeight := e.lastFinalized, e.height
+	if prop.Justify != nil {
+		if err := e.holdOrphanLocked(prop); err != nil {
+			return nil, err
+		}
+		if err := e.acceptQCLocked(prop.Justify); err != nil {
+			return nil, fmt.Errorf("invalid justify: %w", err)
+		}
+		parentHash, parentHeight = prop.Justify.BlockHash, prop.Justify.Height
+	}
+	if prop.Block.Height != parentHeight+1 || prop.Block.PrevHash != parentHash {
+		return nil, fmt.Errorf("block does not extend justify")
+	}
+	if _, tip := e.tipLocked(); prop.Block.Height != tip+1 {
 		return nil, fmt.Errorf("unexpected height")
 	}
-	if prop.Block.PrevHash != e.lastFinalized {
-		return nil, fmt.Errorf("unexpected previous hash")
+	if prop.Round != e.round {
+		return nil, fmt.Errorf("unexpected round")
 	}
 	if !e.isExpectedProposerLocked(prop.Block.Proposer) {
 		return nil, fmt.Errorf("unexpected proposer")
 	}
+	setHash, nextSetHash, err := e.validatorsHashesLocked(prop.Block.Height)
+	if err != nil {
+		return nil, err
+	}
+	if setHash != prop.Block.ValidatorsHash {
+		return nil, fmt.Errorf("validator set hash mismatch")
+	}
+	if nextSetHash != prop.Block.NextValidatorsHash {
+		return nil, fmt.Errorf("next validator set hash mismatch")
+	}
 	propBytes, err := ProposalSignBytes(prop)
 	if err != nil {
 		return nil, err
 	}
-	pk, ok := e.validatorPubKey(prop.Block.Proposer)
+	pk, ok := e.validatorPubKeyLocked(prop.Block.Height, prop.Block.Proposer)
 	if !ok {
 		return nil, fmt.Errorf("unknown proposer")
 	}
 	if !e.verifier.Verify(propBytes, prop.ProposerSig, pk) {
 		return nil, fmt.Errorf("invalid proposer signature")
 	}
-	// Validate timestamp window against RC effective time clamp.
-	lastTimestamps, err := e.state.Store().GetLastTimestamps()
+	e.recordProposalLocked(prop)
+	if !e.canVoteLocked(prop.Block.Height, prop.Round) {
+		return nil, fmt.Errorf("already voted at height %d round %d", prop.Block.Height, prop.Round)
+	}
+	if !e.safeNodeLocked(prop.Block, prop.Justify) {
+		return nil, fmt.Errorf("proposal conflicts with locked qc")
+	}
+	ancestors, err := e.ancestorsLocked(parentHash)
 	if err != nil {
 		return nil, err
 	}
-	if len(lastTimestamps) > 0 {
-		effective := rc.EffectiveTime(prop.Block.Timestamp, lastTimestamps, e.state.RCParams().MaxSkewSec)
-		if effective != prop.Block.Timestamp {
-			return nil, fmt.Errorf("block timestamp outside allowed window")
-		}
+	if err := e.verifyTimestampLocked(prop.Block, ancestors); err != nil {
+		return nil, err
+	}
+	if e.prioritiesHashLocked(ancestors, parentHash, prop.Block.Height) != prop.Block.ProposerPrioritiesHash {
+		return nil, fmt.Errorf("proposer priorities hash mismatch")
+	}
+	if err := e.verifyLastCommitLocked(prop.Block); err != nil {
+		return nil, err
 	}
 	// Validate state root and transaction semantics deterministically.
-	previewRoot, err := e.state.PreviewBlock(prop.Block, e.contracts)
+	if err := e.verifyBlockEvidenceLocked(prop.Block, ancestors); err != nil {
+		return nil, err
+	}
+	previewRoot, err := e.state.PreviewBlockOn(ancestors, prop.Block, e.contracts)
 	if err != nil {
 		return nil, err
 	}
 	if previewRoot != prop.Block.StateRoot {
 		return nil, fmt.Errorf("state root mismatch")
 	}
+	blockHash := mustHashBlock(prop.Block)
+	e.blocks[blockHash] = prop.Block
+	e.justifies[blockHash] = prop.Justify
+	e.proposals[blockHash] = prop
 	vote := &types.PrecommitVote{
-		BlockHash: mustHashBlock(prop.Block),
+		BlockHash: blockHash,
 		Height:    prop.Block.Height,
 		Round:     prop.Round,
 		Validator: e.validatorAddress(),
 	}
-	voteBytes, err := PrecommitSignBytes(vote)
-	if err != nil {
-		return nil, err
-	}
-	sig, err := e.signer.Sign(voteBytes)
-	if err != nil {
+	if err := e.signVoteLocked(vote); err != nil {
 		return nil, err
 	}
-	vote.Signature = sig
+	e.hasVoted, e.lastVoteH, e.lastVoteR = true, vote.Height, vote.Round
+	e.signalLocked()
 	if e.network != nil {
 		if err := e.network.BroadcastPrecommit(vote); err != nil {
 			return nil, err
 		}
 	}
+	// Count our own vote; gossip does not loop messages back to the sender.
+	if _, err := e.addVoteLocked(vote); err != nil {
+		return nil, err
+	}
 	return vote, nil
 }
 
@@ -197,21 +392,36 @@ func (e *Engine) HandlePrecommitVote(vote *types.PrecommitVote) (*types.QuorumCe
 	if vote == nil {
 		return nil, fmt.Errorf("nil vote")
 	}
-	if vote.Height != e.height+1 {
+	if _, tip := e.tipLocked(); vote.Height != tip+1 {
 		return nil, fmt.Errorf("unexpected vote height")
 	}
 	voteBytes, err := PrecommitSignBytes(vote)
 	if err != nil {
 		return nil, err
 	}
-	pk, ok := e.validatorPubKey(vote.Validator)
+	pk, ok := e.validatorPubKeyLocked(vote.Height, vote.Validator)
 	if !ok {
 		return nil, fmt.Errorf("unknown validator")
 	}
 	if !e.verifier.Verify(voteBytes, vote.Signature, pk) {
 		return nil, fmt.Errorf("invalid vote signature")
 	}
+	e.recordVoteLocked(vote)
+	return e.addVoteLocked(vote)
+}
+
+// HandleQC verifies a QC received from the network and applies the HotStuff update rules.
+func (e *Engine) HandleQC(qc *types.QuorumCertificate) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if qc == nil {
+		return fmt.Errorf("nil qc")
+	}
+	return e.acceptQCLocked(qc)
+}
 
+// addVoteLocked records a verified vote and applies the QC once one forms.
+func (e *Engine) addVoteLocked(vote *types.PrecommitVote) (*types.QuorumCertificate, error) {
 	vmap := e.votes[vote.BlockHash]
 	if vmap == nil {
 		vmap = make(map[types.Address]*types.PrecommitVote)
@@ -219,27 +429,35 @@ func (e *Engine) HandlePrecommitVote(vote *types.PrecommitVote) (*types.QuorumCe
 	}
 	vmap[vote.Validator] = vote
 
-	qc, ok := e.tryBuildQC(vote.BlockHash, vmap)
-	if ok {
-		if e.network != nil {
-			_ = e.network.BroadcastQC(qc)
-		}
+	qc, ok := e.tryBuildQC(vote.BlockHash, vote.Height, vote.Round, vmap)
+	if !ok {
+		return nil, nil
+	}
+	if _, known := e.qcs[qc.BlockHash]; known {
+		return qc, nil
+	}
+	if _, ok := e.blocks[qc.BlockHash]; !ok {
+		// The proposal has not been validated yet; the QC is rebuilt when it is.
 		return qc, nil
 	}
-	return nil, nil
+	if e.network != nil {
+		_ = e.network.BroadcastQC(qc)
+	}
+	if err := e.updateQCLocked(qc); err != nil {
+		return nil, err
+	}
+	return qc, nil
 }
 
-// HandleViewChange processes a view change message.
+// HandleViewChange records a view change and advances the round once view
+// changes from more than 2/3 of the voting power form a timeout certificate.
 func (e *Engine) HandleViewChange(vc *types.ViewChange) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	if vc == nil {
 		return fmt.Errorf("nil view change")
 	}
-	if vc.Height != e.height+1 {
-		return fmt.Errorf("unexpected view change height")
-	}
-	pk, ok := e.validatorPubKey(vc.Validator)
+	pk, ok := e.validatorPubKeyLocked(vc.Height, vc.Validator)
 	if !ok {
 		return fmt.Errorf("unknown validator")
 	}
@@ -250,98 +468,269 @@ func (e *Engine) HandleViewChange(vc *types.ViewChange) error {
 	if !e.verifier.Verify(msg, vc.Signature, pk) {
 		return fmt.Errorf("invalid view change signature")
 	}
-	if vc.Round > e.round {
-		e.round = vc.Round
-		_ = e.persistConsensusState()
+	if vc.HighQC != nil {
+		if err := e.verifyHighQCLocked(vc.HighQC); err != nil {
+			return fmt.Errorf("invalid view change high qc: %w", err)
+		}
+		// The sender may have certified a block we missed; failure only means
+		// the QC is stale or for a block we cannot validate yet.
+		_ = e.acceptQCLocked(vc.HighQC)
+	}
+	if _, tip := e.tipLocked(); vc.Height != tip+1 {
+		return fmt.Errorf("unexpected view change height")
+	}
+	if vc.Round < e.round {
+		return fmt.Errorf("stale view change round")
+	}
+	return e.addTimeoutLocked(vc)
+}
+
+// HandleTC verifies a timeout certificate and moves past the round it covers.
+func (e *Engine) HandleTC(tc *types.TimeoutCertificate) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if tc == nil {
+		return fmt.Errorf("nil tc")
+	}
+	if tc.HighQC != nil {
+		if err := e.verifyHighQCLocked(tc.HighQC); err != nil {
+			return fmt.Errorf("invalid tc high qc: %w", err)
+		}
+		_ = e.acceptQCLocked(tc.HighQC)
+	}
+	if _, tip := e.tipLocked(); tc.Height != tip+1 {
+		return fmt.Errorf("unexpected tc height")
+	}
+	if tc.Round < e.round {
+		return nil
+	}
+	if err := VerifyTC(tc, e.validatorSetLocked(tc.Height), e.verifier); err != nil {
+		return err
 	}
+	e.advanceRoundLocked(tc.Round + 1)
 	return nil
 }
 
-// OnTimeout advances the round for view change.
+// OnTimeout stops voting in the current round and announces the timeout to
+// peers. The round only advances once a timeout certificate forms.
 func (e *Engine) OnTimeout() {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	e.round++
+	_, tip := e.tipLocked()
+	vc := &types.ViewChange{
+		Height:    tip + 1,
+		Round:     e.round,
+		Validator: e.validatorAddress(),
+	}
+	if e.highQC != nil && e.highQC.Height > e.height {
+		vc.HighQC = e.highQC
+	}
+	if e.canVoteLocked(vc.Height, vc.Round) {
+		e.hasVoted, e.lastVoteH, e.lastVoteR = true, vc.Height, vc.Round
+	}
+	if err := e.signViewChangeLocked(vc); err != nil {
+		return
+	}
+	if e.network != nil {
+		_ = e.network.BroadcastViewChange(vc)
+		e.resendChainLocked()
+	}
+	if _, ok := e.validatorPubKeyLocked(vc.Height, vc.Validator); ok {
+		_ = e.addTimeoutLocked(vc)
+	}
+}
+
+// addTimeoutLocked records a verified view change and advances the round once
+// a timeout certificate forms.
+func (e *Engine) addTimeoutLocked(vc *types.ViewChange) error {
+	vmap := e.timeouts[vc.Round]
+	if vmap == nil {
+		vmap = make(map[types.Address]*types.ViewChange)
+		e.timeouts[vc.Round] = vmap
+	}
+	vmap[vc.Validator] = vc
+
+	tc, ok := e.tryBuildTC(vc.Height, vc.Round, vmap)
+	if !ok {
+		return nil
+	}
+	if e.network != nil {
+		_ = e.network.BroadcastTC(tc)
+	}
+	e.advanceRoundLocked(tc.Round + 1)
+	return nil
+}
+
+// advanceRoundLocked moves to round and forgets view changes for earlier rounds.
+func (e *Engine) advanceRoundLocked(round uint64) {
+	if round <= e.round {
+		return
+	}
+	e.round = round
+	for r := range e.timeouts {
+		if r < round {
+			delete(e.timeouts, r)
+		}
+	}
 	_ = e.persistConsensusState()
+	e.signalLocked()
 }
 
-// FinalizeBlock finalizes the block once QC achieved.
+// FinalizeBlock commits a block certified by qc directly on top of the last
+// committed block, without waiting for the three-chain rule. It is meant for
+// blocks whose commitment has already been proven elsewhere, such as blocks
+// imported from peers; qc is verified against the validator set of the block's
+// height before anything is applied.
 func (e *Engine) FinalizeBlock(block *types.Block, qc *types.QuorumCertificate, contracts *contracts.ContractEngine) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	if block == nil || qc == nil {
 		return fmt.Errorf("invalid finalize arguments")
 	}
-	if len(qc.Signatures) == len(e.validatorSet.Validators) {
-		block.ValidatorSigs = qc.Signatures
+	if block.PrevHash != e.lastFinalized {
+		return fmt.Errorf("block does not extend last committed block")
 	}
-	root, err := e.state.ApplyBlock(block, contracts)
-	if err != nil {
+	if err := VerifyCommitCertificate(block, qc, e.validatorSetLocked(block.Height), e.verifier); err != nil {
+		return fmt.Errorf("invalid commit certificate: %w", err)
+	}
+	if err := e.applyCommitLocked(block, qc, contracts); err != nil {
+		return err
+	}
+	e.pruneLocked()
+	e.signalLocked()
+	return nil
+}
+
+func (e *Engine) applyCommitLocked(block *types.Block, qc *types.QuorumCertificate, contracts *contracts.ContractEngine) error {
+	if block == nil || qc == nil {
+		return fmt.Errorf("invalid finalize arguments")
+	}
+	// Evidence pooled or carried by later blocks may share this block through a
+	// proposal; attach the signatures to a copy so their encoding, and the hash
+	// of any block carrying them, stays the same.
+	committed := *block
+	if set := e.validatorSetLocked(block.Height); set != nil && len(qc.Signatures) == len(set.Validators) {
+		committed.ValidatorSigs = qc.Signatures
+	}
+	block = &committed
+	if _, err := e.state.ApplyBlock(block, qc, contracts); err != nil {
+		return err
+	}
+	if err := e.reloadRegistryLocked(); err != nil {
+		return err
+	}
+	if err := e.forgetEvidenceLocked(block); err != nil {
+		return err
+	}
+	if err := e.advanceScheduleLocked(block); err != nil {
 		return err
 	}
-	block.StateRoot = root
 	e.height = block.Height
 	e.lastFinalized = mustHashBlock(block)
-	e.validatorSet = e.dpos.ValidatorSet()
-	e.round = 0
+	if err := e.rotateValidatorSetLocked(block.Height); err != nil {
+		return err
+	}
 	if err := e.persistConsensusState(); err != nil {
 		return err
 	}
-	delete(e.votes, qc.BlockHash)
+	e.takeSnapshotLocked(block.Height)
 	return nil
 }
 
-func (e *Engine) tryBuildQC(blockHash types.Hash, votes map[types.Address]*types.PrecommitVote) (*types.QuorumCertificate, bool) {
-	totalPower := e.validatorSet.TotalPower
+// signalLocked wakes the pacemaker without blocking; one pending signal is enough.
+func (e *Engine) signalLocked() {
+	select {
+	case e.progress <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Engine) tryBuildQC(blockHash types.Hash, height, round uint64, votes map[types.Address]*types.PrecommitVote) (*types.QuorumCertificate, bool) {
+	set := e.validatorSetLocked(height)
+	if set == nil {
+		return nil, false
+	}
+	totalPower := set.TotalPower
 	if totalPower == 0 {
 		return nil, false
 	}
 	var signedPower uint64
-	signatures := make([][]byte, len(e.validatorSet.Validators))
-	bitmap := make([]byte, (len(e.validatorSet.Validators)+7)/8)
+	signatures := make([][]byte, len(set.Validators))
+	bitmap := make([]byte, (len(set.Validators)+7)/8)
 	for addr, vote := range votes {
-		idx, ok := e.validatorSet.IndexByAddr[addr]
+		if vote.Height != height || vote.Round != round {
+			continue
+		}
+		idx, ok := set.IndexByAddr[addr]
 		if !ok {
 			continue
 		}
 		signatures[idx] = vote.Signature
 		bitmap[idx/8] |= 1 << (idx % 8)
-		signedPower += e.validatorSet.Validators[idx].Power
+		signedPower += set.Validators[idx].Power
 	}
 	if signedPower*3 <= totalPower*2 {
 		return nil, false
 	}
 	qc := &types.QuorumCertificate{
 		BlockHash:  blockHash,
-		Height:     e.height + 1,
-		Round:      e.round,
+		Height:     height,
+		Round:      round,
 		SigBitmap:  bitmap,
 		Signatures: signatures,
 	}
 	return qc, true
 }
 
+func (e *Engine) tryBuildTC(height, round uint64, timeouts map[types.Address]*types.ViewChange) (*types.TimeoutCertificate, bool) {
+	set := e.validatorSetLocked(height)
+	if set == nil {
+		return nil, false
+	}
+	totalPower := set.TotalPower
+	if totalPower == 0 {
+		return nil, false
+	}
+	var signedPower uint64
+	var highQC *types.QuorumCertificate
+	signatures := make([][]byte, len(set.Validators))
+	bitmap := make([]byte, (len(set.Validators)+7)/8)
+	for addr, vc := range timeouts {
+		if vc.Height != height || vc.Round != round {
+			continue
+		}
+		idx, ok := set.IndexByAddr[addr]
+		if !ok {
+			continue
+		}
+		signatures[idx] = vc.Signature
+		bitmap[idx/8] |= 1 << (idx % 8)
+		signedPower += set.Validators[idx].Power
+		if vc.HighQC != nil && (highQC == nil || qcViewLess(highQC, vc.HighQC)) {
+			highQC = vc.HighQC
+		}
+	}
+	if signedPower*3 <= totalPower*2 {
+		return nil, false
+	}
+	tc := &types.TimeoutCertificate{
+		Height:     height,
+		Round:      round,
+		SigBitmap:  bitmap,
+		Signatures: signatures,
+		HighQC:     highQC,
+	}
+	return tc, true
+}
+
 func (e *Engine) isProposerLocked() bool {
 	return e.isExpectedProposerLocked(e.validatorAddr)
 }
 
 func (e *Engine) isExpectedProposerLocked(addr types.Address) bool {
-	if e.validatorSet == nil || len(e.validatorSet.Validators) == 0 {
-		return false
-	}
-	totalPower := e.validatorSet.TotalPower
-	if totalPower == 0 {
-		return false
-	}
-	seed := (e.height + e.round) % totalPower
-	var acc uint64
-	for _, v := range e.validatorSet.Validators {
-		acc += v.Power
-		if seed < acc {
-			return v.OperatorAddress == addr
-		}
-	}
-	return false
+	parent, _ := e.tipLocked()
+	proposer := e.proposerLocked(parent, e.round)
+	return proposer != "" && proposer == addr
 }
 
 func mustHashBlock(block *types.Block) types.Hash {
@@ -353,18 +742,19 @@ func (e *Engine) validatorAddress() types.Address {
 	return e.validatorAddr
 }
 
-func (e *Engine) validatorPubKey(addr types.Address) ([]byte, bool) {
-	if e.validatorSet == nil {
+func (e *Engine) validatorPubKeyLocked(height uint64, addr types.Address) ([]byte, bool) {
+	set := e.validatorSetLocked(height)
+	if set == nil {
 		return nil, false
 	}
-	idx, ok := e.validatorSet.IndexByAddr[addr]
+	idx, ok := set.IndexByAddr[addr]
 	if !ok {
 		return nil, false
 	}
-	if int(idx) >= len(e.validatorSet.Validators) {
+	if int(idx) >= len(set.Validators) {
 		return nil, false
 	}
-	return e.validatorSet.Validators[idx].ConsensusPubKey, true
+	return set.Validators[idx].ConsensusPubKey, true
 }
 
 func (e *Engine) loadConsensusState() error {
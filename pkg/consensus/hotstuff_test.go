@@ -0,0 +1,503 @@
+package consensus
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// busNet queues broadcasts on a shared bus for the test to deliver.
+type busNet struct {
+	from int
+	bus  *bus
+}
+
+func (n *busNet) BroadcastProposal(p *types.Proposal) error       { return n.bus.send(n.from, -1, p) }
+func (n *busNet) BroadcastPrecommit(v *types.PrecommitVote) error { return n.bus.send(n.from, -1, v) }
+func (n *busNet) BroadcastQC(qc *types.QuorumCertificate) error   { return n.bus.send(n.from, -1, qc) }
+func (n *busNet) BroadcastViewChange(vc *types.ViewChange) error  { return n.bus.send(n.from, -1, vc) }
+func (n *busNet) BroadcastTC(tc *types.TimeoutCertificate) error  { return n.bus.send(n.from, -1, tc) }
+func (n *busNet) BroadcastEvidence(ev *types.DuplicateVoteEvidence) error {
+	return n.bus.send(n.from, -1, ev)
+}
+
+// bus keeps a per-recipient inbox of wire-encoded messages, so recipients never
+// share pointers and delivery order can be shuffled.
+type bus struct {
+	inbox [][]interface{}
+}
+
+func (b *bus) send(from, to int, msg interface{}) error {
+	for i := range b.inbox {
+		if i == from || (to >= 0 && i != to) {
+			continue
+		}
+		b.inbox[i] = append(b.inbox[i], copyMsg(msg))
+	}
+	return nil
+}
+
+func copyMsg(msg interface{}) interface{} {
+	switch m := msg.(type) {
+	case *types.Proposal:
+		b, _ := encoding.MarshalProposal(m)
+		out, _ := encoding.UnmarshalProposal(b)
+		return out
+	case *types.PrecommitVote:
+		b, _ := encoding.MarshalPrecommitVote(m)
+		out, _ := encoding.UnmarshalPrecommitVote(b)
+		return out
+	case *types.QuorumCertificate:
+		b, _ := encoding.MarshalQuorumCertificate(m)
+		out, _ := encoding.UnmarshalQuorumCertificate(b)
+		return out
+	case *types.ViewChange:
+		b, _ := encoding.MarshalViewChange(m)
+		out, _ := encoding.UnmarshalViewChange(b)
+		return out
+	case *types.TimeoutCertificate:
+		b, _ := encoding.MarshalTimeoutCertificate(m)
+		out, _ := encoding.UnmarshalTimeoutCertificate(b)
+		return out
+	case *types.DuplicateVoteEvidence:
+		b, _ := encoding.MarshalDuplicateVoteEvidence(m)
+		out, _ := encoding.UnmarshalDuplicateVoteEvidence(b)
+		return out
+	}
+	return msg
+}
+
+func deliver(e *Engine, msg interface{}) {
+	switch m := msg.(type) {
+	case *types.Proposal:
+		_, _ = e.HandleProposal(m)
+	case *types.PrecommitVote:
+		_, _ = e.HandlePrecommitVote(m)
+	case *types.QuorumCertificate:
+		_ = e.HandleQC(m)
+	case *types.ViewChange:
+		_ = e.HandleViewChange(m)
+	case *types.TimeoutCertificate:
+		_ = e.HandleTC(m)
+	case *types.DuplicateVoteEvidence:
+		_ = e.HandleEvidence(m)
+	}
+}
+
+// byzantine equivocates: it votes for every proposal it sees and sends
+// conflicting proposals to different halves of the network.
+type byzantine struct {
+	idx     int
+	addr    types.Address
+	signer  *testSigner
+	setHash types.Hash
+	highQC  *types.QuorumCertificate
+	rounds  uint64
+}
+
+func (bz *byzantine) observe(msg interface{}, b *bus) {
+	switch m := msg.(type) {
+	case *types.Proposal:
+		if m.Justify != nil && (bz.highQC == nil || qcViewLess(bz.highQC, m.Justify)) {
+			bz.highQC = m.Justify
+		}
+		if m.Round > bz.rounds {
+			bz.rounds = m.Round
+		}
+		vote := &types.PrecommitVote{
+			BlockHash: mustHashBlock(m.Block),
+			Height:    m.Block.Height,
+			Round:     m.Round,
+			Validator: bz.addr,
+		}
+		msgBytes, _ := PrecommitSignBytes(vote)
+		vote.Signature, _ = bz.signer.Sign(msgBytes)
+		_ = b.send(bz.idx, -1, vote)
+	case *types.QuorumCertificate:
+		if bz.highQC == nil || qcViewLess(bz.highQC, m) {
+			bz.highQC = m
+		}
+	}
+}
+
+func (bz *byzantine) equivocate(rng *rand.Rand, b *bus, n int) {
+	var parent types.Hash
+	var height uint64 = 1
+	if bz.highQC != nil {
+		parent, height = bz.highQC.BlockHash, bz.highQC.Height+1
+	}
+	round := uint64(rng.Intn(int(bz.rounds) + 1))
+	for i := 0; i < n; i++ {
+		if i == bz.idx {
+			continue
+		}
+		prop := &types.Proposal{
+			Block: &types.Block{
+				Height:             height,
+				PrevHash:           parent,
+				Timestamp:          time.Now().Unix() + int64(i),
+				Proposer:           bz.addr,
+				ValidatorSigs:      make([][]byte, n),
+				ValidatorsHash:     bz.setHash,
+				NextValidatorsHash: bz.setHash,
+			},
+			Round:   round,
+			Justify: bz.highQC,
+		}
+		msg, _ := ProposalSignBytes(prop)
+		prop.ProposerSig, _ = bz.signer.Sign(msg)
+		_ = b.send(bz.idx, i, prop)
+	}
+}
+
+func runSafetyScenario(t *testing.T, seed int64, steps int) int {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	const n = 4
+	const byzIdx = n - 1
+	signers := make([]*testSigner, n)
+	addrs := make([]types.Address, n)
+	for i := range signers {
+		signers[i] = newTestSigner(byte(i + 1))
+		addrs[i] = types.Address(fmt.Sprintf("val%d", i))
+	}
+	b := &bus{inbox: make([][]interface{}, n)}
+	engines := make([]*Engine, byzIdx)
+	for i := range engines {
+		dpos := NewDPoS(1, n)
+		for j := range signers {
+			if err := dpos.RegisterValidator(addrs[j], signers[j].PublicKey(), 1, 0); err != nil {
+				t.Fatalf("register: %v", err)
+			}
+		}
+		engines[i] = newTestEngine(t, signers[i], addrs[i], dpos)
+		engines[i].network = &busNet{from: i, bus: b}
+	}
+	setHash, _ := encoding.HashValidatorSet(engines[0].validatorSet)
+	bz := &byzantine{idx: byzIdx, addr: addrs[byzIdx], signer: signers[byzIdx], setHash: setHash}
+
+	proposed := make([]string, len(engines))
+	for step := 0; step < steps; step++ {
+		for i, e := range engines {
+			h, r, _ := e.Status()
+			key := fmt.Sprintf("%d/%d", h, r)
+			if proposed[i] != key && e.IsProposer() {
+				proposed[i] = key
+				if prop, err := e.ProposeBlock(); err == nil {
+					_, _ = e.HandleProposal(prop)
+				}
+			}
+		}
+		if rng.Intn(10) == 0 {
+			bz.equivocate(rng, b, n)
+		}
+		if rng.Intn(40) == 0 {
+			engines[rng.Intn(len(engines))].OnTimeout()
+		}
+		// Deliver one message, chosen at random, to a random recipient.
+		to := rng.Intn(n)
+		if len(b.inbox[to]) == 0 {
+			continue
+		}
+		k := rng.Intn(len(b.inbox[to]))
+		msg := b.inbox[to][k]
+		b.inbox[to] = append(b.inbox[to][:k], b.inbox[to][k+1:]...)
+		if rng.Intn(10) == 0 {
+			continue // dropped
+		}
+		if to == byzIdx {
+			bz.observe(msg, b)
+			continue
+		}
+		deliver(engines[to], msg)
+	}
+
+	// Safety: committed chains of honest validators never diverge.
+	maxHeight := uint64(0)
+	for _, e := range engines {
+		if e.CommittedHeight() > maxHeight {
+			maxHeight = e.CommittedHeight()
+		}
+	}
+	for h := uint64(1); h <= maxHeight; h++ {
+		var seen *types.Hash
+		for i, e := range engines {
+			if e.CommittedHeight() < h {
+				continue
+			}
+			block, err := e.state.Store().GetBlockByHeight(h)
+			if err != nil || block == nil {
+				t.Fatalf("seed %d: engine %d missing committed block %d: %v", seed, i, h, err)
+			}
+			hash := mustHashBlock(block)
+			if seen == nil {
+				seen = &hash
+			} else if *seen != hash {
+				t.Fatalf("seed %d: conflicting blocks finalized at height %d", seed, h)
+			}
+		}
+	}
+	return int(maxHeight)
+}
+
+func TestHotStuffSafetyUnderByzantineValidator(t *testing.T) {
+	progressed := 0
+	for seed := int64(1); seed <= 8; seed++ {
+		if runSafetyScenario(t, seed, 3000) > 0 {
+			progressed++
+		}
+	}
+	if progressed == 0 {
+		t.Fatalf("no scenario committed any block")
+	}
+}
+
+func TestLockedValidatorRejectsConflictingProposal(t *testing.T) {
+	signer := newTestSigner(1)
+	dpos := NewDPoS(1, 1)
+	if err := dpos.RegisterValidator("val1", signer.PublicKey(), 1, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	e := newTestEngine(t, signer, "val1", dpos)
+
+	// Certify two blocks so the engine locks on the first.
+	for i := 0; i < 2; i++ {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	if e.lockedQC == nil || e.lockedQC.Height != 1 {
+		t.Fatalf("expected lock at height 1, got %+v", e.lockedQC)
+	}
+
+	// A proposal at the next view that forks below the lock must be refused.
+	e.mu.Lock()
+	e.highQC = nil
+	e.mu.Unlock()
+	setHash, _ := encoding.HashValidatorSet(e.validatorSet)
+	prop := &types.Proposal{
+		Block: &types.Block{
+			Height:             1,
+			Timestamp:          time.Now().Unix() + 1,
+			Proposer:           "val1",
+			ValidatorsHash:     setHash,
+			NextValidatorsHash: setHash,
+		},
+		Round: 0,
+	}
+	msg, _ := ProposalSignBytes(prop)
+	prop.ProposerSig, _ = signer.Sign(msg)
+	e.mu.Lock()
+	e.hasVoted = false
+	e.mu.Unlock()
+	if _, err := e.HandleProposal(prop); err == nil {
+		t.Fatalf("expected conflicting proposal to be rejected")
+	}
+}
+
+func TestTimeoutCertificateRequiresQuorum(t *testing.T) {
+	const n = 4
+	signers := make([]*testSigner, n)
+	dpos := NewDPoS(1, n)
+	for i := range signers {
+		signers[i] = newTestSigner(byte(i + 1))
+		if err := dpos.RegisterValidator(types.Address(fmt.Sprintf("val%d", i)), signers[i].PublicKey(), 1, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	e := newTestEngine(t, signers[0], "val0", dpos)
+	set := dpos.ValidatorSet()
+
+	signVC := func(i int) *types.ViewChange {
+		vc := &types.ViewChange{Height: 1, Round: 0, Validator: types.Address(fmt.Sprintf("val%d", i))}
+		msg, _ := ViewChangeSignBytes(vc)
+		vc.Signature, _ = signers[i].Sign(msg)
+		return vc
+	}
+	for i := 1; i <= 2; i++ {
+		if err := e.HandleViewChange(signVC(i)); err != nil {
+			t.Fatalf("view change %d: %v", i, err)
+		}
+		if _, round, _ := e.Status(); round != 0 {
+			t.Fatalf("round advanced with %d of %d view changes", i, n)
+		}
+	}
+	if err := e.HandleViewChange(signVC(3)); err != nil {
+		t.Fatalf("view change 3: %v", err)
+	}
+	if _, round, _ := e.Status(); round != 1 {
+		t.Fatalf("expected round 1 after tc, got %d", round)
+	}
+
+	tc := &types.TimeoutCertificate{
+		Height:     1,
+		Round:      0,
+		SigBitmap:  make([]byte, 1),
+		Signatures: make([][]byte, n),
+	}
+	for i := 1; i <= 2; i++ {
+		idx := set.IndexByAddr[types.Address(fmt.Sprintf("val%d", i))]
+		tc.Signatures[idx] = signVC(i).Signature
+		tc.SigBitmap[0] |= 1 << idx
+	}
+	if err := VerifyTC(tc, set, testVerifier{}); err == nil {
+		t.Fatalf("expected tc with half the power to fail")
+	}
+	idx := set.IndexByAddr["val3"]
+	tc.Signatures[idx] = signVC(3).Signature
+	tc.SigBitmap[0] |= 1 << idx
+	if err := VerifyTC(tc, set, testVerifier{}); err != nil {
+		t.Fatalf("verify tc: %v", err)
+	}
+}
+
+func TestTimeoutMessagesWithForgedHighQCAreDropped(t *testing.T) {
+	const n = 4
+	signers := make([]*testSigner, n)
+	dpos := NewDPoS(1, n)
+	for i := range signers {
+		signers[i] = newTestSigner(byte(i + 1))
+		if err := dpos.RegisterValidator(types.Address(fmt.Sprintf("val%d", i)), signers[i].PublicKey(), 1, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	e := newTestEngine(t, signers[0], "val0", dpos)
+	signVC := func(i int) *types.ViewChange {
+		vc := &types.ViewChange{Height: 1, Round: 0, Validator: types.Address(fmt.Sprintf("val%d", i))}
+		msg, _ := ViewChangeSignBytes(vc)
+		vc.Signature, _ = signers[i].Sign(msg)
+		return vc
+	}
+
+	// The high QC is not signed, so anyone relaying val1's view change can
+	// swap in a forged one; the view change must then not count.
+	forged := signVC(1)
+	forged.HighQC = &types.QuorumCertificate{Height: 1, BlockHash: types.Hash{1}, SigBitmap: []byte{0x0F}, Signatures: [][]byte{{1}, {2}, {3}, {4}}}
+	if err := e.HandleViewChange(forged); err == nil {
+		t.Fatalf("view change with a forged high qc accepted")
+	}
+	if err := e.Authenticate(forged); err == nil {
+		t.Fatalf("view change with a forged high qc authenticated")
+	}
+	for i := 2; i <= 3; i++ {
+		if err := e.HandleViewChange(signVC(i)); err != nil {
+			t.Fatalf("view change %d: %v", i, err)
+		}
+	}
+	if _, round, _ := e.Status(); round != 0 {
+		t.Fatalf("the dropped view change counted toward a tc")
+	}
+	if err := e.HandleViewChange(signVC(1)); err != nil {
+		t.Fatalf("view change 1: %v", err)
+	}
+	if _, round, _ := e.Status(); round != 1 {
+		t.Fatalf("expected round 1 after tc, got %d", round)
+	}
+
+	// A timeout certificate does not sign its high QC either.
+	set := dpos.ValidatorSet()
+	tc := &types.TimeoutCertificate{Height: 1, Round: 1, SigBitmap: make([]byte, 1), Signatures: make([][]byte, n), HighQC: forged.HighQC}
+	for i := 1; i <= 3; i++ {
+		vc := &types.ViewChange{Height: 1, Round: 1, Validator: types.Address(fmt.Sprintf("val%d", i))}
+		msg, _ := ViewChangeSignBytes(vc)
+		idx := set.IndexByAddr[vc.Validator]
+		tc.Signatures[idx], _ = signers[i].Sign(msg)
+		tc.SigBitmap[0] |= 1 << idx
+	}
+	if err := e.Authenticate(tc); err == nil {
+		t.Fatalf("tc with a forged high qc authenticated")
+	}
+	if err := e.HandleTC(tc); err == nil {
+		t.Fatalf("tc with a forged high qc accepted")
+	}
+	if _, round, _ := e.Status(); round != 1 {
+		t.Fatalf("tc with a forged high qc advanced the round to %d", round)
+	}
+	tc.HighQC = nil
+	if err := e.HandleTC(tc); err != nil {
+		t.Fatalf("tc: %v", err)
+	}
+	if _, round, _ := e.Status(); round != 2 {
+		t.Fatalf("expected round 2 after tc, got %d", round)
+	}
+}
+
+func TestProposalBeforeParentIsHeld(t *testing.T) {
+	signer := newTestSigner(1)
+	newDPoS := func() *DPoS {
+		dpos := NewDPoS(1, 1)
+		if err := dpos.RegisterValidator("val1", signer.PublicKey(), 1, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		return dpos
+	}
+	leader := newTestEngine(t, signer, "val1", newDPoS())
+	var props []*types.Proposal
+	for i := 0; i < 2; i++ {
+		prop, err := leader.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := leader.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+		props = append(props, copyMsg(prop).(*types.Proposal))
+	}
+
+	// A replica that sees the child first holds it until the parent arrives.
+	replica := newTestEngine(t, signer, "val1", newDPoS())
+	if _, err := replica.HandleProposal(props[1]); err == nil {
+		t.Fatalf("expected child without parent to be deferred")
+	}
+	if _, err := replica.HandleProposal(props[0]); err != nil {
+		t.Fatalf("handle parent: %v", err)
+	}
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	if replica.highQC == nil || replica.highQC.Height != 2 {
+		t.Fatalf("held child was not handled: highQC %+v", replica.highQC)
+	}
+}
+
+func TestProposalMustCertifyParent(t *testing.T) {
+	signer := newTestSigner(1)
+	dpos := NewDPoS(1, 1)
+	if err := dpos.RegisterValidator("val1", signer.PublicKey(), 1, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	e := newTestEngine(t, signer, "val1", dpos)
+	for e.CommittedHeight() < 1 {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if prop.Block.Height == 1 && prop.Block.LastCommit != nil {
+			t.Fatalf("first block carries a last commit")
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+
+	prop, err := e.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if lc := prop.Block.LastCommit; lc == nil || lc.BlockHash != prop.Block.PrevHash {
+		t.Fatalf("last commit does not certify the parent: %+v", lc)
+	}
+	prop.Block.LastCommit = nil
+	msg, _ := ProposalSignBytes(prop)
+	prop.ProposerSig, _ = signer.Sign(msg)
+	if _, err := e.HandleProposal(prop); err == nil {
+		t.Fatalf("accepted a proposal without a last commit")
+	}
+}
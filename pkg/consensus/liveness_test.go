@@ -0,0 +1,151 @@
+package consensus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestOfflineValidatorIsJailed(t *testing.T) {
+	e, dpos, _ := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1, EpochLength: 3}, 10)
+	e.state.SetStakingParams(state.StakingParams{
+		EpochLength:        3,
+		SlashOfflineBps:    1000,
+		JailOfflineEpochs:  1,
+		SignedBlocksWindow: 3,
+		MaxMissedBps:       5000,
+	})
+
+	// Blocks 2 to 4 carry the QCs of blocks 1 to 3, which val1 did not
+	// sign; block 4, in epoch 1, fills its window.
+	commitUntil(t, e, 3)
+	if dpos.GetValidator("val1").Jailed {
+		t.Fatalf("validator jailed before its window is full")
+	}
+	commitUntil(t, e, 4)
+	v := dpos.GetValidator("val1")
+	if !v.Jailed || v.Stake != 9 || v.JailedUntilEpoch != 2 {
+		t.Fatalf("expected val1 slashed and jailed, got %+v", v)
+	}
+	if dpos.GetValidator("val0").Jailed {
+		t.Fatalf("signing validator must not be jailed")
+	}
+	set := dpos.ValidatorSet()
+	if _, ok := set.IndexByAddr["val1"]; ok || set.TotalPower != 1000 {
+		t.Fatalf("jailed validator still in set: %+v", set.IndexByAddr)
+	}
+
+	// The jailing is committed state: a restarted node sees it, and staying
+	// offline while jailed is not punished again.
+	commitUntil(t, e, e.CommittedHeight()+4)
+	validators, err := e.state.Store().GetValidators()
+	if err != nil {
+		t.Fatalf("get validators: %v", err)
+	}
+	restarted := NewDPoS(1, 10)
+	restarted.LoadValidators(validators)
+	if v := restarted.GetValidator("val1"); v == nil || !v.Jailed || v.Stake != 9 {
+		t.Fatalf("rebuilt registry: %+v", v)
+	}
+	if err := restarted.CheckUnjail("val1", 1); err == nil {
+		t.Fatalf("expected unjail before jail term to fail")
+	}
+	if err := restarted.CheckUnjail("val1", 2); err != nil {
+		t.Fatalf("unjail: %v", err)
+	}
+}
+
+func TestSlashedBelowMinStakeCannotUnjail(t *testing.T) {
+	signer, absent := newTestSigner(1), newTestSigner(2)
+	kp, err := crypto.GenerateEd25519()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	addr, _ := crypto.AddressFromPubKey(kp.PublicKey)
+	operator := types.Address(addr)
+	dpos := NewDPoS(10, 10)
+	if err := dpos.RegisterValidator("val0", signer.PublicKey(), 1000, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	// The operator holds exactly the minimum self-stake and never signs.
+	if err := dpos.RegisterValidator(operator, absent.PublicKey(), 10, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	e := newTestEngineWithConfig(t, Config{BlockMaxTxs: 10, MinStake: 10, EpochLength: 3}, signer, "val0", dpos)
+	e.state.SetStakingParams(state.StakingParams{
+		MinStake:           10,
+		EpochLength:        3,
+		SlashOfflineBps:    1000,
+		JailOfflineEpochs:  1,
+		SignedBlocksWindow: 3,
+		MaxMissedBps:       5000,
+	})
+	if err := e.state.Store().SetAccount(&types.Account{Address: operator, Stake: 10, RC: 1_000_000}); err != nil {
+		t.Fatalf("set account: %v", err)
+	}
+
+	// Jailed at height 4 with its self-stake slashed to 9; the term ends
+	// with epoch 1.
+	commitUntil(t, e, 7)
+	if v := dpos.GetValidator(operator); !v.Jailed || v.Stake != 9 {
+		t.Fatalf("expected the operator slashed and jailed, got %+v", v)
+	}
+	if err := dpos.CheckUnjail(operator, e.epochOf(e.CommittedHeight()+1)); err == nil || !strings.Contains(err.Error(), "below minimum") {
+		t.Fatalf("registry let a validator below the minimum stake unjail: %v", err)
+	}
+	unjail := signedTx(t, kp, 0, tx.Unjail{})
+	block := &types.Block{Height: e.CommittedHeight() + 1, Timestamp: time.Now().Unix(), Transactions: []*types.Transaction{unjail}}
+	if _, err := e.state.PreviewBlock(block, nil); err == nil || !strings.Contains(err.Error(), "below minimum") {
+		t.Fatalf("state let a validator below the minimum stake unjail: %v", err)
+	}
+}
+
+func TestJailedValidatorLeavesSetWithoutEpochs(t *testing.T) {
+	e, dpos, _ := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1}, 10)
+	e.state.SetStakingParams(state.StakingParams{
+		EpochLength:        3,
+		SlashOfflineBps:    1000,
+		JailOfflineEpochs:  1,
+		SignedBlocksWindow: 3,
+		MaxMissedBps:       5000,
+	})
+
+	// Block 4 jails val1; blocks 5 to 7 may already be certified, and block
+	// 7 commits to the set of block 8, so val1 leaves from block 8.
+	commitUntil(t, e, 4)
+	if !dpos.GetValidator("val1").Jailed {
+		t.Fatalf("expected val1 jailed")
+	}
+	// The pending change is persisted, so a restart picks it up.
+	e.validatorSet, e.setChanges = nil, nil
+	if err := e.loadValidatorSets(); err != nil {
+		t.Fatalf("reload sets: %v", err)
+	}
+	commitUntil(t, e, 10)
+	for h := uint64(1); h <= 10; h++ {
+		set, err := e.ValidatorSetAt(h)
+		if err != nil {
+			t.Fatalf("set at %d: %v", h, err)
+		}
+		_, active := set.IndexByAddr["val1"]
+		if active != (h < 8) {
+			t.Fatalf("height %d: val1 active %v", h, active)
+		}
+		block, err := e.state.Store().GetBlockByHeight(h)
+		if err != nil || block == nil {
+			t.Fatalf("get block %d: %v", h, err)
+		}
+		if setHash, _ := encoding.HashValidatorSet(set); block.ValidatorsHash != setHash {
+			t.Fatalf("height %d: block does not commit to its validator set", h)
+		}
+	}
+	if set, _ := e.ValidatorSetAt(11); len(set.Validators) != 1 || set.TotalPower != 1000 {
+		t.Fatalf("jailed validator back in the set: %+v", set.IndexByAddr)
+	}
+}
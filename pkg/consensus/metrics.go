@@ -0,0 +1,23 @@
+package consensus
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// proposalsRejected counts proposals refused before voting, by reason.
+var proposalsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "opencoin",
+	Subsystem: "consensus",
+	Name:      "proposals_rejected_total",
+	Help:      "Proposals rejected before voting, by reason.",
+}, []string{"reason"})
+
+// snapshotsFailed counts state snapshots that could not be written.
+var snapshotsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "opencoin",
+	Subsystem: "consensus",
+	Name:      "snapshots_failed_total",
+	Help:      "State snapshots that could not be written.",
+})
+
+func init() {
+	prometheus.MustRegister(proposalsRejected, snapshotsFailed)
+}
@@ -0,0 +1,161 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxBackoffShift bounds the exponential backoff so round timeouts cannot overflow.
+const maxBackoffShift = 6
+
+// Clock abstracts time so the pacemaker can be driven deterministically in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// PacemakerConfig defines the round timeouts. Propose and precommit timeouts
+// double with every failed round, up to MaxTimeout when it is non-zero.
+type PacemakerConfig struct {
+	TimeoutPropose   time.Duration
+	TimeoutPrecommit time.Duration
+	TimeoutCommit    time.Duration
+	MaxTimeout       time.Duration
+}
+
+// Pacemaker drives the engine round state machine: propose, vote, collect a QC,
+// finalize, and move to the next round on timeout.
+type Pacemaker struct {
+	engine *Engine
+	cfg    PacemakerConfig
+	clock  Clock
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPacemaker creates a pacemaker for the engine. A nil clock uses wall time.
+func NewPacemaker(engine *Engine, cfg PacemakerConfig, clock Clock) *Pacemaker {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &Pacemaker{engine: engine, cfg: cfg, clock: clock}
+}
+
+// Start runs the pacemaker until ctx is cancelled or Stop is called.
+func (p *Pacemaker) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		return fmt.Errorf("pacemaker already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		p.run(ctx)
+	}()
+	return nil
+}
+
+// Stop halts the pacemaker and waits for the loop to exit.
+func (p *Pacemaker) Stop() {
+	p.mu.Lock()
+	cancel, done := p.cancel, p.done
+	p.cancel = nil
+	p.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// RoundTimeout returns base scaled by 2^round, capped at MaxTimeout.
+func (p *Pacemaker) RoundTimeout(base time.Duration, round uint64) time.Duration {
+	shift := round
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	d := base << shift
+	if p.cfg.MaxTimeout > 0 && (d > p.cfg.MaxTimeout || d < base) {
+		d = p.cfg.MaxTimeout
+	}
+	return d
+}
+
+type roundOutcome int
+
+const (
+	outcomeStopped roundOutcome = iota
+	outcomeCommitted
+	outcomeRoundChanged
+	outcomeTimeout
+)
+
+func (p *Pacemaker) run(ctx context.Context) {
+	for {
+		height, round, _ := p.engine.Status()
+		if p.engine.IsProposer() {
+			p.propose()
+		}
+		switch p.waitRound(ctx, height, round) {
+		case outcomeStopped:
+			return
+		case outcomeCommitted:
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.clock.After(p.cfg.TimeoutCommit):
+			}
+		case outcomeTimeout:
+			p.engine.OnTimeout()
+		case outcomeRoundChanged:
+		}
+	}
+}
+
+// propose builds a proposal and votes for it locally. Failures are not fatal:
+// the round simply times out and the next proposer takes over.
+func (p *Pacemaker) propose() {
+	prop, err := p.engine.ProposeBlock()
+	if err != nil {
+		return
+	}
+	_, _ = p.engine.HandleProposal(prop)
+}
+
+// waitRound waits for the proposal step and then the precommit step of a round.
+func (p *Pacemaker) waitRound(ctx context.Context, height, round uint64) roundOutcome {
+	precommit := false
+	deadline := p.clock.After(p.RoundTimeout(p.cfg.TimeoutPropose, round))
+	for {
+		h, r, voted := p.engine.Status()
+		if h != height {
+			return outcomeCommitted
+		}
+		if r != round {
+			return outcomeRoundChanged
+		}
+		if voted && !precommit {
+			precommit = true
+			deadline = p.clock.After(p.RoundTimeout(p.cfg.TimeoutPrecommit, round))
+		}
+		select {
+		case <-ctx.Done():
+			return outcomeStopped
+		case <-deadline:
+			return outcomeTimeout
+		case <-p.engine.Progress():
+		}
+	}
+}
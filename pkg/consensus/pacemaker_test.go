@@ -0,0 +1,213 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/contracts"
+	"github.com/georgecane/opencoin/pkg/mempool"
+	"github.com/georgecane/opencoin/pkg/rc"
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// testSigner signs with Ed25519 so consensus tests run without the CGO Dilithium build.
+type testSigner struct {
+	priv ed25519.PrivateKey
+}
+
+func newTestSigner(seed byte) *testSigner {
+	return &testSigner{priv: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))}
+}
+
+func (s *testSigner) Sign(msg []byte) ([]byte, error) { return ed25519.Sign(s.priv, msg), nil }
+func (s *testSigner) PublicKey() []byte               { return s.priv.Public().(ed25519.PublicKey) }
+
+type testVerifier struct{}
+
+func (testVerifier) Verify(msg, sig, pk []byte) bool {
+	return len(pk) == ed25519.PublicKeySize && ed25519.Verify(pk, msg, sig)
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_700_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.at.After(c.now) {
+			t.ch <- c.now
+			continue
+		}
+		pending = append(pending, t)
+	}
+	c.timers = pending
+}
+
+func newTestEngine(t *testing.T, signer *testSigner, addr types.Address, dpos *DPoS) *Engine {
+	t.Helper()
+	return newTestEngineWithConfig(t, Config{BlockMaxTxs: 10, MinStake: 1}, signer, addr, dpos)
+}
+
+func newTestEngineWithConfig(t *testing.T, cfg Config, signer *testSigner, addr types.Address, dpos *DPoS) *Engine {
+	t.Helper()
+	store, err := state.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return newTestEngineOnStore(t, cfg, store, signer, addr, dpos)
+}
+
+func newTestEngineOnStore(t *testing.T, cfg Config, store *state.Store, signer *testSigner, addr types.Address, dpos *DPoS) *Engine {
+	t.Helper()
+	params := rc.Params{Alpha: 1, Beta: 1, CSize: 1, CCompute: 1, CStorage: 1, MaxSkewSec: 30, WindowN: 11}
+	st := state.NewState(store, state.NewDAG(), params)
+	ce := contracts.NewContractEngine()
+	mp := mempool.New(st, &tx.Coster{Params: params, Contracts: ce})
+	engine, err := NewEngine(cfg, st, dpos, mp, ce, addr, signer, testVerifier{}, nil)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	return engine
+}
+
+func TestPacemakerRoundTimeoutBackoff(t *testing.T) {
+	p := NewPacemaker(nil, PacemakerConfig{MaxTimeout: 10 * time.Second}, newFakeClock())
+	if got := p.RoundTimeout(time.Second, 0); got != time.Second {
+		t.Fatalf("round 0: got %v", got)
+	}
+	if got := p.RoundTimeout(time.Second, 3); got != 8*time.Second {
+		t.Fatalf("round 3: got %v", got)
+	}
+	if got := p.RoundTimeout(time.Second, 4); got != 10*time.Second {
+		t.Fatalf("round 4 should be capped: got %v", got)
+	}
+	if got := p.RoundTimeout(time.Second, 1000); got != 10*time.Second {
+		t.Fatalf("round 1000 should be capped: got %v", got)
+	}
+}
+
+func TestPacemakerSingleValidatorCommits(t *testing.T) {
+	signer := newTestSigner(1)
+	addr := types.Address("val1")
+	dpos := NewDPoS(1, 10)
+	if err := dpos.RegisterValidator(addr, signer.PublicKey(), 100, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	engine := newTestEngine(t, signer, addr, dpos)
+	clock := newFakeClock()
+	pm := NewPacemaker(engine, PacemakerConfig{
+		TimeoutPropose:   time.Second,
+		TimeoutPrecommit: time.Second,
+		TimeoutCommit:    time.Second,
+	}, clock)
+	if err := pm.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer pm.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		height := engine.CommittedHeight()
+		if height >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pacemaker stalled at height %d", height)
+		}
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	block, err := engine.state.Store().GetBlockByHeight(3)
+	if err != nil || block == nil {
+		t.Fatalf("block 3 not stored: %v", err)
+	}
+}
+
+func TestPacemakerTimeoutAdvancesRound(t *testing.T) {
+	signer := newTestSigner(1)
+	other := newTestSigner(2)
+	dpos := NewDPoS(1, 10)
+	// "a-other" sorts first and proposes round 0, which it never does.
+	if err := dpos.RegisterValidator("a-other", other.PublicKey(), 1, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := dpos.RegisterValidator("val1", signer.PublicKey(), 1, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	engine := newTestEngine(t, signer, "val1", dpos)
+
+	// A single validator's view change is not enough to leave the round.
+	vc := &types.ViewChange{Height: 1, Round: 0, Validator: "a-other"}
+	msg, err := ViewChangeSignBytes(vc)
+	if err != nil {
+		t.Fatalf("sign bytes: %v", err)
+	}
+	vc.Signature, _ = other.Sign(msg)
+	if err := engine.HandleViewChange(vc); err != nil {
+		t.Fatalf("view change: %v", err)
+	}
+	if _, round, _ := engine.Status(); round != 0 {
+		t.Fatalf("round advanced without tc: %d", round)
+	}
+
+	clock := newFakeClock()
+	pm := NewPacemaker(engine, PacemakerConfig{
+		TimeoutPropose:   time.Second,
+		TimeoutPrecommit: time.Second,
+		TimeoutCommit:    time.Second,
+	}, clock)
+	if err := pm.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer pm.Stop()
+
+	// Our own timeout completes the certificate.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, round, _ := engine.Status()
+		if round >= 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("round did not advance, at %d", round)
+		}
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,216 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// maxSchedulePower bounds the total power the priority arithmetic works with;
+// larger sets have their powers scaled down so priorities cannot overflow.
+const maxSchedulePower = math.MaxInt64 / 8
+
+// proposerSchedule elects proposers by weighted round-robin with priority
+// accumulators, as Tendermint does. Each election adds every validator's power
+// to its priority, elects the highest priority and charges the winner the
+// total power, so each validator proposes in proportion to its power and is
+// never far behind its share.
+//
+// Elections may be seeded. The seed adds a jitter below the average power to
+// every priority while the winner is picked; the accumulators themselves are
+// unchanged, so shares still converge, but the winner cannot be known before
+// the seed is.
+type proposerSchedule struct {
+	height     uint64 // height whose round 0 proposer the next election picks
+	priorities map[types.Address]int64
+}
+
+func newProposerSchedule(height uint64, priorities map[types.Address]int64) *proposerSchedule {
+	if priorities == nil {
+		priorities = make(map[types.Address]int64)
+	}
+	return &proposerSchedule{height: height, priorities: priorities}
+}
+
+func (s *proposerSchedule) clone() *proposerSchedule {
+	priorities := make(map[types.Address]int64, len(s.priorities))
+	for addr, p := range s.priorities {
+		priorities[addr] = p
+	}
+	return &proposerSchedule{height: s.height, priorities: priorities}
+}
+
+// elect runs one election over set and returns the winner, or "" for an empty set.
+func (s *proposerSchedule) elect(set *types.ValidatorSet, seed []byte) types.Address {
+	if set == nil || len(set.Validators) == 0 || set.TotalPower == 0 {
+		return ""
+	}
+	scale := set.TotalPower/maxSchedulePower + 1
+	powers := make([]int64, len(set.Validators))
+	var total int64
+	for i, v := range set.Validators {
+		powers[i] = int64(v.Power / scale)
+		total += powers[i]
+	}
+	if total == 0 {
+		return ""
+	}
+	s.sync(set, total)
+	bound := total / int64(len(set.Validators))
+	var winner types.Address
+	var best int64
+	for i, v := range set.Validators {
+		p := s.priorities[v.OperatorAddress] + powers[i]
+		s.priorities[v.OperatorAddress] = p
+		score := p + jitter(seed, v.OperatorAddress, bound)
+		if winner == "" || score > best {
+			winner, best = v.OperatorAddress, score
+		}
+	}
+	s.priorities[winner] -= total
+	return winner
+}
+
+// sync aligns the priorities with set. Validators that left are forgotten and
+// new ones start behind everyone, at -1.125 times the total power, so joining
+// is never a shortcut to proposing. Priorities are then rescaled to a spread of
+// at most twice the total power and centred on zero, which keeps them bounded.
+func (s *proposerSchedule) sync(set *types.ValidatorSet, total int64) {
+	members := make(map[types.Address]bool, len(set.Validators))
+	for _, v := range set.Validators {
+		members[v.OperatorAddress] = true
+		if _, ok := s.priorities[v.OperatorAddress]; !ok {
+			s.priorities[v.OperatorAddress] = -(total + total/8)
+		}
+	}
+	for addr := range s.priorities {
+		if !members[addr] {
+			delete(s.priorities, addr)
+		}
+	}
+	min, max := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, p := range s.priorities {
+		if p < min {
+			min = p
+		}
+		if p > max {
+			max = p
+		}
+	}
+	if diff := max - min; diff > 2*total {
+		ratio := (diff + 2*total - 1) / (2 * total)
+		for addr, p := range s.priorities {
+			s.priorities[addr] = p / ratio
+		}
+	}
+	var sum int64
+	for _, p := range s.priorities {
+		sum += p
+	}
+	avg := sum / int64(len(s.priorities))
+	for addr, p := range s.priorities {
+		s.priorities[addr] = p - avg
+	}
+}
+
+// jitter derives a value in [0, bound) from seed and addr; it is 0 when
+// elections are not seeded.
+func jitter(seed []byte, addr types.Address, bound int64) int64 {
+	if seed == nil || bound <= 0 {
+		return 0
+	}
+	h := encoding.HashBytes(append(append([]byte{}, seed...), addr...))
+	return int64(binary.BigEndian.Uint64(h[:8]) % uint64(bound))
+}
+
+// electionSeed returns the seed for the election at round on top of parent,
+// the block the previous QC certifies, or nil when seeding is disabled.
+func (e *Engine) electionSeed(parent types.Hash, round uint64) []byte {
+	if !e.cfg.SeedProposer {
+		return nil
+	}
+	return append(append([]byte{}, parent[:]...), encoding.MarshalUint64(round)...)
+}
+
+// proposerLocked returns the proposer of the block at round on top of parent,
+// running the elections of any uncommitted ancestors first. Every round is one
+// more election, so a failed round hands over to the next validator in line.
+func (e *Engine) proposerLocked(parent types.Hash, round uint64) types.Address {
+	ancestors, err := e.ancestorsLocked(parent)
+	if err != nil {
+		return ""
+	}
+	s := e.schedule.clone()
+	for _, b := range ancestors {
+		s.elect(e.validatorSetLocked(b.Height), e.electionSeed(b.PrevHash, 0))
+	}
+	set := e.validatorSetLocked(s.height + uint64(len(ancestors)))
+	var proposer types.Address
+	for r := uint64(0); r <= round; r++ {
+		proposer = s.elect(set, e.electionSeed(parent, r))
+	}
+	return proposer
+}
+
+// prioritiesHashLocked returns the hash of the priorities left once the round
+// 0 proposer of the block at height on top of parent is elected, after the
+// elections of its uncommitted ancestors. The block header commits to it, so
+// the priorities restored from a snapshot can be checked.
+func (e *Engine) prioritiesHashLocked(ancestors []*types.Block, parent types.Hash, height uint64) types.Hash {
+	s := e.schedule.clone()
+	for _, b := range ancestors {
+		s.elect(e.validatorSetLocked(b.Height), e.electionSeed(b.PrevHash, 0))
+	}
+	s.elect(e.validatorSetLocked(height), e.electionSeed(parent, 0))
+	return encoding.HashProposerPriorities(height+1, s.priorities)
+}
+
+// advanceScheduleLocked runs the round 0 election of a block being committed,
+// before the committed height moves past it, and persists the result.
+func (e *Engine) advanceScheduleLocked(block *types.Block) error {
+	if block.Height != e.schedule.height {
+		return fmt.Errorf("proposer schedule is at height %d, not %d", e.schedule.height, block.Height)
+	}
+	e.schedule.elect(e.validatorSetLocked(block.Height), e.electionSeed(block.PrevHash, 0))
+	e.schedule.height++
+	if e.state == nil || e.state.Store() == nil {
+		return nil
+	}
+	return e.state.Store().SetProposerPriorities(e.schedule.height, e.schedule.priorities)
+}
+
+// loadProposerSchedule restores the persisted priorities and replays the
+// committed blocks they have not seen yet, from height 1 if none were persisted.
+func (e *Engine) loadProposerSchedule() error {
+	e.schedule = newProposerSchedule(e.height+1, nil)
+	if e.state == nil || e.state.Store() == nil {
+		return nil
+	}
+	store := e.state.Store()
+	height, priorities, err := store.GetProposerPriorities()
+	if err != nil {
+		return err
+	}
+	if priorities == nil {
+		height = 1
+	}
+	e.schedule = newProposerSchedule(height, priorities)
+	if height > e.height+1 {
+		return fmt.Errorf("proposer priorities are for height %d, beyond committed height %d", height, e.height)
+	}
+	for e.schedule.height <= e.height {
+		block, err := store.GetBlockByHeight(e.schedule.height)
+		if err != nil || block == nil {
+			return fmt.Errorf("replay proposer schedule at height %d: %v", e.schedule.height, err)
+		}
+		e.schedule.elect(e.validatorSetLocked(block.Height), e.electionSeed(block.PrevHash, 0))
+		e.schedule.height++
+	}
+	if e.schedule.height != height {
+		return store.SetProposerPriorities(e.schedule.height, e.schedule.priorities)
+	}
+	return nil
+}
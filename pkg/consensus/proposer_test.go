@@ -0,0 +1,133 @@
+package consensus
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func testValidatorSet(powers ...uint64) *types.ValidatorSet {
+	dpos := NewDPoS(1, uint32(len(powers)))
+	for i, power := range powers {
+		if err := dpos.RegisterValidator(types.Address(fmt.Sprintf("val%d", i)), []byte{byte(i)}, power, 0); err != nil {
+			panic(err)
+		}
+	}
+	return dpos.ValidatorSet()
+}
+
+func TestProposerSharesConvergeToPower(t *testing.T) {
+	set := testValidatorSet(50, 20, 15, 10, 4, 1)
+	const elections = 20000
+	for _, seeded := range []bool{false, true} {
+		t.Run(fmt.Sprintf("seeded=%v", seeded), func(t *testing.T) {
+			s := newProposerSchedule(1, nil)
+			counts := make(map[types.Address]int)
+			for i := 0; i < elections; i++ {
+				var seed []byte
+				if seeded {
+					h := encoding.HashBytes(encoding.MarshalUint64(uint64(i)))
+					seed = h[:]
+				}
+				counts[s.elect(set, seed)]++
+			}
+			for _, v := range set.Validators {
+				want := float64(elections) * float64(v.Power) / float64(set.TotalPower)
+				// Accumulators keep every validator within a few elections of
+				// its share; jitter only reorders nearly tied validators.
+				if diff := math.Abs(float64(counts[v.OperatorAddress]) - want); diff > float64(len(set.Validators)) {
+					t.Errorf("%s (power %d) proposed %d times, want %.0f", v.OperatorAddress, v.Power, counts[v.OperatorAddress], want)
+				}
+			}
+		})
+	}
+}
+
+func TestProposerRotatesAmongEqualPower(t *testing.T) {
+	set := testValidatorSet(7, 7, 7, 7)
+	s := newProposerSchedule(1, nil)
+	for window := 0; window < 50; window++ {
+		seen := make(map[types.Address]bool)
+		for i := 0; i < len(set.Validators); i++ {
+			seen[s.elect(set, nil)] = true
+		}
+		if len(seen) != len(set.Validators) {
+			t.Fatalf("window %d elected %d distinct validators, want %d", window, len(seen), len(set.Validators))
+		}
+	}
+}
+
+func TestNewValidatorDoesNotProposeFirst(t *testing.T) {
+	s := newProposerSchedule(1, nil)
+	set := testValidatorSet(10, 10, 10)
+	for i := 0; i < 7; i++ {
+		s.elect(set, nil)
+	}
+	// A newcomer with most of the power still waits for the others' turn.
+	grown := testValidatorSet(10, 10, 10, 100)
+	if got := s.elect(grown, nil); got == "val3" {
+		t.Fatalf("new validator proposed immediately")
+	}
+	for addr, p := range s.priorities {
+		if p > 2*int64(grown.TotalPower) || p < -2*int64(grown.TotalPower) {
+			t.Fatalf("priority of %s out of bounds: %d", addr, p)
+		}
+	}
+}
+
+func TestSeededProposerIsNotFixedByHeight(t *testing.T) {
+	set := testValidatorSet(10, 10, 10, 10)
+	base := newProposerSchedule(1, nil)
+	winners := make(map[types.Address]bool)
+	for i := 0; i < 32; i++ {
+		h := encoding.HashBytes([]byte{byte(i)})
+		winners[base.clone().elect(set, h[:])] = true
+	}
+	if len(winners) < 2 {
+		t.Fatalf("different seeds always elected the same proposer")
+	}
+}
+
+func TestProposerScheduleRestoredAfterRestart(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.powers = []uint64{5, 3, 2, 1}
+	cfg.seedProposer = true
+	cfg.duration = 5 * time.Second
+	cfg.targetHeight = 3
+	s := newSimulation(t, cfg, 1)
+	s.run()
+
+	n := s.nodes[0]
+	want := n.engine.schedule
+	store := n.engine.state.Store()
+	height, priorities, err := store.GetProposerPriorities()
+	if err != nil {
+		t.Fatalf("load priorities: %v", err)
+	}
+	if height != want.height || fmt.Sprint(priorities) != fmt.Sprint(want.priorities) {
+		t.Fatalf("persisted schedule %d %v, engine has %d %v", height, priorities, want.height, want.priorities)
+	}
+
+	reopen := func() *proposerSchedule {
+		e, err := NewEngine(Config{BlockMaxTxs: 10, MinStake: 1, SeedProposer: true}, n.engine.state, n.engine.dpos,
+			n.engine.mempool, n.engine.contracts, n.addr, n.signer, testVerifier{}, nil)
+		if err != nil {
+			t.Fatalf("reopen engine: %v", err)
+		}
+		return e.schedule
+	}
+	if got := reopen(); got.height != want.height || fmt.Sprint(got.priorities) != fmt.Sprint(want.priorities) {
+		t.Fatalf("restored schedule %d %v, want %d %v", got.height, got.priorities, want.height, want.priorities)
+	}
+	// Without persisted progress the schedule is replayed from the first block.
+	if err := store.SetProposerPriorities(1, map[types.Address]int64{}); err != nil {
+		t.Fatalf("reset priorities: %v", err)
+	}
+	if got := reopen(); got.height != want.height || fmt.Sprint(got.priorities) != fmt.Sprint(want.priorities) {
+		t.Fatalf("replayed schedule %d %v, want %d %v", got.height, got.priorities, want.height, want.priorities)
+	}
+}
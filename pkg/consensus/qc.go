@@ -4,43 +4,224 @@ import (
 	"fmt"
 
 	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/state"
 	"github.com/georgecane/opencoin/pkg/types"
 )
 
-// VerifyQC verifies a QC using validator index + bitmap.
+// VerifyQC verifies a QC using validator index + bitmap and requires more than 2/3 of the voting power.
 func VerifyQC(qc *types.QuorumCertificate, set *types.ValidatorSet, verifier crypto.Verifier) error {
 	if qc == nil || set == nil {
 		return fmt.Errorf("nil qc or validator set")
 	}
+	return verifyBitmapSigs(qc.SigBitmap, qc.Signatures, set, verifier, func(v *types.Validator) ([]byte, error) {
+		return PrecommitSignBytes(&types.PrecommitVote{
+			BlockHash: qc.BlockHash,
+			Height:    qc.Height,
+			Round:     qc.Round,
+			Validator: v.OperatorAddress,
+		})
+	})
+}
+
+// VerifyCommitCertificate checks that qc certifies block and carries a quorum
+// of the validator set that was in effect at the block's height.
+func VerifyCommitCertificate(block *types.Block, qc *types.QuorumCertificate, set *types.ValidatorSet, verifier crypto.Verifier) error {
+	if block == nil || qc == nil {
+		return fmt.Errorf("nil block or commit certificate")
+	}
+	hash, err := encoding.HashBlock(block)
+	if err != nil {
+		return err
+	}
+	if qc.BlockHash != hash || qc.Height != block.Height {
+		return fmt.Errorf("commit certificate does not match block %d", block.Height)
+	}
+	return VerifyQC(qc, set, verifier)
+}
+
+// VerifyStoredBlock loads the block committed at height and re-verifies its
+// commit certificate against the validator set persisted for that height.
+func VerifyStoredBlock(store *state.Store, height uint64, verifier crypto.Verifier) error {
+	block, err := store.GetBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("block %d not found", height)
+	}
+	qc, err := store.GetCommitCertificate(height)
+	if err != nil {
+		return err
+	}
+	if qc == nil {
+		return fmt.Errorf("no commit certificate for block %d", height)
+	}
+	set, err := store.GetValidatorSet(height)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return fmt.Errorf("no validator set for height %d", height)
+	}
+	return VerifyCommitCertificate(block, qc, set, verifier)
+}
+
+// VerifyStoredChain re-verifies every block committed since the stored blocks
+// were last verified: each commit certificate against the validator set
+// persisted for its height, and each block against the hash of the one
+// before it. The tip is checked on every call. The verified height is then
+// recorded, so later calls only check the blocks committed since.
+func VerifyStoredChain(store *state.Store, verifier crypto.Verifier) error {
+	tip, err := store.LastBlockHeight()
+	if err != nil || tip == 0 {
+		return err
+	}
+	first, err := store.FirstBlockHeight()
+	if err != nil {
+		return err
+	}
+	verified, err := store.VerifiedHeight()
+	if err != nil {
+		return err
+	}
+	from := verified + 1
+	if from < first {
+		from = first
+	}
+	if from > tip {
+		from = tip
+	}
+	var prevHash types.Hash
+	if from > first {
+		prev, err := store.GetBlockByHeight(from - 1)
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			return fmt.Errorf("block %d not found", from-1)
+		}
+		if prevHash, err = encoding.HashBlock(prev); err != nil {
+			return err
+		}
+	}
+	for h := from; h <= tip; h++ {
+		if err := VerifyStoredBlock(store, h, verifier); err != nil {
+			return fmt.Errorf("verify stored block %d: %w", h, err)
+		}
+		block, err := store.GetBlockByHeight(h)
+		if err != nil {
+			return err
+		}
+		if h > first && block.PrevHash != prevHash {
+			return fmt.Errorf("stored block %d does not extend block %d", h, h-1)
+		}
+		if prevHash, err = encoding.HashBlock(block); err != nil {
+			return err
+		}
+	}
+	return store.SetVerifiedHeight(tip)
+}
+
+// verifyHighQCLocked verifies a QC carried by a view change against the
+// validator set of its height.
+func (e *Engine) verifyHighQCLocked(qc *types.QuorumCertificate) error {
+	set := e.validatorSetLocked(qc.Height)
+	if set == nil {
+		return fmt.Errorf("no validator set for height %d", qc.Height)
+	}
+	return VerifyQC(qc, set, e.verifier)
+}
+
+// VerifyTC verifies the view change signatures of a TC and requires more than
+// 2/3 of the voting power. The carried high QC is checked separately with VerifyQC.
+func VerifyTC(tc *types.TimeoutCertificate, set *types.ValidatorSet, verifier crypto.Verifier) error {
+	if tc == nil || set == nil {
+		return fmt.Errorf("nil tc or validator set")
+	}
+	return verifyBitmapSigs(tc.SigBitmap, tc.Signatures, set, verifier, func(v *types.Validator) ([]byte, error) {
+		return ViewChangeSignBytes(&types.ViewChange{
+			Height:    tc.Height,
+			Round:     tc.Round,
+			Validator: v.OperatorAddress,
+		})
+	})
+}
+
+// verifyBitmapSigs checks the signature of every validator marked in bitmap
+// against the bytes produced by signBytes and enforces a 2/3 power quorum.
+func verifyBitmapSigs(bitmap []byte, sigs [][]byte, set *types.ValidatorSet, verifier crypto.Verifier, signBytes func(*types.Validator) ([]byte, error)) error {
 	if len(set.Validators) == 0 {
 		return fmt.Errorf("empty validator set")
 	}
-	if len(qc.SigBitmap) != (len(set.Validators)+7)/8 {
+	if len(bitmap) != (len(set.Validators)+7)/8 {
 		return fmt.Errorf("invalid bitmap length")
 	}
+	var power uint64
 	for i, v := range set.Validators {
 		byteIdx := i / 8
 		bitIdx := uint(i % 8)
-		signed := (qc.SigBitmap[byteIdx] & (1 << bitIdx)) != 0
+		signed := (bitmap[byteIdx] & (1 << bitIdx)) != 0
 		if !signed {
 			continue
 		}
-		if i >= len(qc.Signatures) || len(qc.Signatures[i]) == 0 {
+		if i >= len(sigs) || len(sigs[i]) == 0 {
 			return fmt.Errorf("missing signature for validator index %d", i)
 		}
-		vote := &types.PrecommitVote{
-			BlockHash: qc.BlockHash,
-			Height:    qc.Height,
-			Round:     qc.Round,
-			Validator: v.OperatorAddress,
-		}
-		msg, err := PrecommitSignBytes(vote)
+		msg, err := signBytes(v)
 		if err != nil {
 			return err
 		}
-		if !verifier.Verify(msg, qc.Signatures[i], v.ConsensusPubKey) {
+		if !verifier.Verify(msg, sigs[i], v.ConsensusPubKey) {
 			return fmt.Errorf("invalid signature for validator index %d", i)
 		}
+		power += v.Power
+	}
+	if power*3 <= set.TotalPower*2 {
+		return fmt.Errorf("insufficient voting power: %d of %d", power, set.TotalPower)
+	}
+	return nil
+}
+
+// lastCommitLocked returns the certificate for the parent a new block extends:
+// the high QC while the parent is uncommitted, or the stored commit
+// certificate once it is. Blocks at height 1 have no parent to certify.
+func (e *Engine) lastCommitLocked(parentHash types.Hash, parentHeight uint64) (*types.QuorumCertificate, error) {
+	if parentHeight == 0 {
+		return nil, nil
+	}
+	if e.highQC != nil && e.highQC.BlockHash == parentHash {
+		return e.highQC, nil
+	}
+	qc, err := e.state.Store().GetCommitCertificate(parentHeight)
+	if err != nil {
+		return nil, err
+	}
+	if qc == nil || qc.BlockHash != parentHash {
+		return nil, fmt.Errorf("no certificate for parent block %d", parentHeight)
+	}
+	return qc, nil
+}
+
+// verifyLastCommitLocked checks that block carries a valid certificate for its
+// parent. The certificate decides which validators are paid for the parent,
+// so it must be present exactly when there is a parent.
+func (e *Engine) verifyLastCommitLocked(block *types.Block) error {
+	lc := block.LastCommit
+	if block.Height <= 1 {
+		if lc != nil {
+			return fmt.Errorf("unexpected last commit at height %d", block.Height)
+		}
+		return nil
+	}
+	if lc == nil {
+		return fmt.Errorf("missing last commit")
+	}
+	if lc.BlockHash != block.PrevHash || lc.Height+1 != block.Height {
+		return fmt.Errorf("last commit does not certify the parent block")
+	}
+	if err := VerifyQC(lc, e.validatorSetLocked(lc.Height), e.verifier); err != nil {
+		return fmt.Errorf("invalid last commit: %w", err)
 	}
 	return nil
 }
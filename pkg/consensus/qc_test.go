@@ -0,0 +1,98 @@
+package consensus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommitCertificatesPersistedAndVerified(t *testing.T) {
+	signer := newTestSigner(1)
+	newDPoS := func() *DPoS {
+		dpos := NewDPoS(1, 10)
+		if err := dpos.RegisterValidator("val0", signer.PublicKey(), 100, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		return dpos
+	}
+	e := newTestEngine(t, signer, "val0", newDPoS())
+	for e.CommittedHeight() < 3 {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		if _, err := e.HandleProposal(prop); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	store := e.state.Store()
+	for h := uint64(1); h <= 3; h++ {
+		qc, err := store.GetCommitCertificate(h)
+		if err != nil || qc == nil {
+			t.Fatalf("commit certificate %d: %+v %v", h, qc, err)
+		}
+		if err := VerifyStoredBlock(store, h, testVerifier{}); err != nil {
+			t.Fatalf("verify stored block %d: %v", h, err)
+		}
+	}
+
+	// A node importing the chain accepts the stored certificate and rejects a forged one.
+	block, _ := store.GetBlockByHeight(1)
+	qc, _ := store.GetCommitCertificate(1)
+	importer := newTestEngine(t, signer, "val0", newDPoS())
+	forged := *qc
+	forged.Signatures = [][]byte{make([]byte, len(qc.Signatures[0]))}
+	if err := importer.FinalizeBlock(block, &forged, importer.contracts); err == nil {
+		t.Fatalf("expected forged certificate to be rejected")
+	}
+	if err := importer.FinalizeBlock(block, qc, importer.contracts); err != nil {
+		t.Fatalf("finalize imported block: %v", err)
+	}
+	if got, err := importer.state.Store().GetCommitCertificate(1); err != nil || got == nil || got.BlockHash != qc.BlockHash {
+		t.Fatalf("imported certificate not persisted: %+v %v", got, err)
+	}
+	if importer.CommittedHeight() != 1 {
+		t.Fatalf("expected height 1, got %d", importer.CommittedHeight())
+	}
+}
+
+func TestStoredChainVerifiedBelowTheTip(t *testing.T) {
+	e, _, _ := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1})
+	commitUntil(t, e, 5)
+	store := e.state.Store()
+
+	// A certificate below the tip that does not verify is found.
+	good, _ := store.GetCommitCertificate(2)
+	forged := *good
+	forged.Signatures = [][]byte{make([]byte, len(good.Signatures[0]))}
+	if err := store.SetCommitCertificate(&forged); err != nil {
+		t.Fatalf("set certificate: %v", err)
+	}
+	if err := VerifyStoredChain(store, testVerifier{}); err == nil || !strings.Contains(err.Error(), "block 2") {
+		t.Fatalf("forged certificate of block 2: %v", err)
+	}
+	if verified, _ := store.VerifiedHeight(); verified != 0 {
+		t.Fatalf("failed verification recorded height %d", verified)
+	}
+
+	if err := store.SetCommitCertificate(good); err != nil {
+		t.Fatalf("set certificate: %v", err)
+	}
+	if err := VerifyStoredChain(store, testVerifier{}); err != nil {
+		t.Fatalf("verify chain: %v", err)
+	}
+	if verified, _ := store.VerifiedHeight(); verified != 5 {
+		t.Fatalf("verified height %d, want 5", verified)
+	}
+
+	// Later calls check the blocks committed since, and the tip.
+	commitUntil(t, e, 7)
+	good, _ = store.GetCommitCertificate(7)
+	forged = *good
+	forged.Signatures = [][]byte{make([]byte, len(good.Signatures[0]))}
+	if err := store.SetCommitCertificate(&forged); err != nil {
+		t.Fatalf("set certificate: %v", err)
+	}
+	if err := VerifyStoredChain(store, testVerifier{}); err == nil || !strings.Contains(err.Error(), "block 7") {
+		t.Fatalf("forged certificate of the tip: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// qcViewLess orders QCs by (height, round). Honest validators vote at most once
+// per view and only in increasing views, so two QCs with the same view certify
+// the same block.
+func qcViewLess(a, b *types.QuorumCertificate) bool {
+	if a.Height != b.Height {
+		return a.Height < b.Height
+	}
+	return a.Round < b.Round
+}
+
+// tipLocked returns the block new proposals must extend: the block certified by
+// highQC, or the last committed block when nothing newer is certified.
+func (e *Engine) tipLocked() (types.Hash, uint64) {
+	if e.highQC != nil && e.highQC.Height > e.height {
+		return e.highQC.BlockHash, e.highQC.Height
+	}
+	return e.lastFinalized, e.height
+}
+
+// ancestorsLocked returns the uncommitted chain ending at hash, oldest first.
+func (e *Engine) ancestorsLocked(hash types.Hash) ([]*types.Block, error) {
+	var chain []*types.Block
+	for hash != e.lastFinalized {
+		b, ok := e.blocks[hash]
+		if !ok {
+			return nil, fmt.Errorf("missing uncommitted ancestor %s", hash)
+		}
+		chain = append([]*types.Block{b}, chain...)
+		hash = b.PrevHash
+	}
+	return chain, nil
+}
+
+// extendsLocked reports whether the chain ending at hash contains target.
+func (e *Engine) extendsLocked(hash, target types.Hash) bool {
+	for {
+		if hash == target {
+			return true
+		}
+		b, ok := e.blocks[hash]
+		if !ok {
+			return false
+		}
+		hash = b.PrevHash
+	}
+}
+
+// canVoteLocked enforces that votes are cast in strictly increasing views.
+func (e *Engine) canVoteLocked(height, round uint64) bool {
+	if !e.hasVoted {
+		return true
+	}
+	if height != e.lastVoteH {
+		return height > e.lastVoteH
+	}
+	return round > e.lastVoteR
+}
+
+// safeNodeLocked is the HotStuff voting predicate: the block must extend the
+// locked block, or its justify must be newer than the lock.
+func (e *Engine) safeNodeLocked(block *types.Block, justify *types.QuorumCertificate) bool {
+	if e.lockedQC == nil || e.lockedQC.Height <= e.height {
+		return true
+	}
+	if e.extendsLocked(block.PrevHash, e.lockedQC.BlockHash) {
+		return true
+	}
+	return justify != nil && qcViewLess(e.lockedQC, justify)
+}
+
+// acceptQCLocked verifies a QC for a known block and applies it.
+func (e *Engine) acceptQCLocked(qc *types.QuorumCertificate) error {
+	if qc.Height <= e.height {
+		if qc.Height == e.height && qc.BlockHash == e.lastFinalized {
+			return nil
+		}
+		return fmt.Errorf("qc for committed height %d", qc.Height)
+	}
+	if _, ok := e.blocks[qc.BlockHash]; !ok {
+		e.noteMissingLocked(qc)
+		return fmt.Errorf("unknown block for qc")
+	}
+	if _, ok := e.qcs[qc.BlockHash]; ok {
+		return nil
+	}
+	if err := VerifyQC(qc, e.validatorSetLocked(qc.Height), e.verifier); err != nil {
+		return err
+	}
+	return e.updateQCLocked(qc)
+}
+
+// updateQCLocked applies the chained HotStuff rules for a verified QC over a
+// known block: raise highQC, lock on the parent, and commit the grandparent.
+func (e *Engine) updateQCLocked(qc *types.QuorumCertificate) error {
+	_, oldTip := e.tipLocked()
+	e.qcs[qc.BlockHash] = qc
+	if e.highQC == nil || qcViewLess(e.highQC, qc) {
+		e.highQC = qc
+	}
+	block := e.blocks[qc.BlockHash]
+	if parentQC, ok := e.qcs[block.PrevHash]; ok {
+		if e.lockedQC == nil || qcViewLess(e.lockedQC, parentQC) {
+			e.lockedQC = parentQC
+		}
+	}
+	// A block is only validated once its parent is certified, so a known parent
+	// and grandparent form a three-chain of consecutive QCs.
+	if parent, ok := e.blocks[block.PrevHash]; ok {
+		if _, ok := e.blocks[parent.PrevHash]; ok {
+			if err := e.commitLocked(parent.PrevHash, block.PrevHash); err != nil {
+				return err
+			}
+		}
+	}
+	if _, tip := e.tipLocked(); tip != oldTip {
+		e.round = 0
+		e.timeouts = make(map[uint64]map[types.Address]*types.ViewChange)
+		_ = e.persistConsensusState()
+		e.signalLocked()
+	}
+	return nil
+}
+
+// commitLocked applies every uncommitted block up to and including hash; child
+// is the block extending hash on the committed chain. Each block is committed
+// with the QC its child carried as justify rather than any QC seen locally, so
+// every node records the same signers for it.
+func (e *Engine) commitLocked(hash, child types.Hash) error {
+	chain, err := e.ancestorsLocked(hash)
+	if err != nil {
+		return err
+	}
+	for i, b := range chain {
+		next := child
+		if i+1 < len(chain) {
+			next = mustHashBlock(chain[i+1])
+		}
+		qc := e.justifies[next]
+		if qc == nil {
+			return fmt.Errorf("missing justify for block %s", mustHashBlock(b))
+		}
+		if err := e.applyCommitLocked(b, qc, e.contracts); err != nil {
+			return err
+		}
+	}
+	e.pruneLocked()
+	return nil
+}
+
+// pruneLocked drops blocks, QCs and votes at or below the committed height
+// and compacts the WAL.
+func (e *Engine) pruneLocked() {
+	for h, b := range e.blocks {
+		if b.Height <= e.height {
+			delete(e.blocks, h)
+			delete(e.qcs, h)
+			delete(e.justifies, h)
+			delete(e.proposals, h)
+		}
+	}
+	for k := range e.seenVotes {
+		if k.height <= e.height {
+			delete(e.seenVotes, k)
+		}
+	}
+	for k := range e.seenProposals {
+		if k.height <= e.height {
+			delete(e.seenProposals, k)
+		}
+	}
+	for h, qc := range e.missing {
+		if qc.Height <= e.height {
+			delete(e.missing, h)
+		}
+	}
+	for k := range e.orphans {
+		if k.height <= e.height {
+			delete(e.orphans, k)
+		}
+	}
+	for k := range e.signedProposals {
+		if k.height <= e.height {
+			delete(e.signedProposals, k)
+		}
+	}
+	for k := range e.signedVotes {
+		if k.height <= e.height {
+			delete(e.signedVotes, k)
+		}
+	}
+	// A failed compaction leaves the WAL intact; it is retried on the next commit.
+	_ = e.compactWALLocked()
+	for h, vmap := range e.votes {
+		for _, v := range vmap {
+			if v.Height <= e.height {
+				delete(e.votes, h)
+			}
+			break
+		}
+	}
+}
+
+// selectTxsLocked picks mempool transactions for a block at height that are
+// not already included in an uncommitted ancestor.
+func (e *Engine) selectTxsLocked(ancestors []*types.Block, height uint64) ([]*types.Transaction, error) {
+	included := make(map[types.Hash]struct{})
+	for _, b := range ancestors {
+		for _, t := range b.Transactions {
+			h, err := encoding.HashTransaction(t)
+			if err != nil {
+				return nil, err
+			}
+			included[h] = struct{}{}
+		}
+	}
+	candidates, err := e.mempool.SelectForBlock(e.cfg.BlockMaxTxs + len(included))
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]*types.Transaction, 0, len(candidates))
+	for _, t := range candidates {
+		h, err := encoding.HashTransaction(t)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := included[h]; ok {
+			continue
+		}
+		if err := e.checkStakeTxLocked(t, height); err != nil {
+			continue
+		}
+		if len(txs) == e.cfg.BlockMaxTxs {
+			break
+		}
+		txs = append(txs, t)
+	}
+	return txs, nil
+}
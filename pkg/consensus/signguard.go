@@ -0,0 +1,146 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/encoding"
+)
+
+// Within a round a validator proposes, then votes, then times out.
+const (
+	stepPropose    uint8 = 1
+	stepVote       uint8 = 2
+	stepViewChange uint8 = 3
+)
+
+// SignerStatePath returns the location of the signer high-water mark in a
+// signer home directory.
+func SignerStatePath(home string) string {
+	return filepath.Join(home, "signer", "state.json")
+}
+
+// ParseSignBytes identifies consensus signing bytes and returns the height,
+// round and step they sign for. Only the exact encodings produced by
+// ProposalSignBytes, PrecommitSignBytes and ViewChangeSignBytes are accepted.
+func ParseSignBytes(msg []byte) (height, round uint64, step uint8, err error) {
+	if v, err := encoding.UnmarshalPrecommitVote(msg); err == nil && len(v.Signature) == 0 {
+		if b, err := PrecommitSignBytes(v); err == nil && bytes.Equal(b, msg) {
+			return v.Height, v.Round, stepVote, nil
+		}
+	}
+	if vc, err := encoding.UnmarshalViewChange(msg); err == nil && len(vc.Signature) == 0 {
+		if b, err := ViewChangeSignBytes(vc); err == nil && bytes.Equal(b, msg) {
+			return vc.Height, vc.Round, stepViewChange, nil
+		}
+	}
+	if p, err := encoding.UnmarshalProposal(msg); err == nil && p.Block != nil && len(p.ProposerSig) == 0 {
+		if b, err := ProposalSignBytes(p); err == nil && bytes.Equal(b, msg) {
+			return p.Block.Height, p.Round, stepPropose, nil
+		}
+	}
+	return 0, 0, 0, fmt.Errorf("not a consensus message")
+}
+
+// signState is the last message a GuardedSigner signed.
+type signState struct {
+	Height    uint64 `json:"height"`
+	Round     uint64 `json:"round"`
+	Step      uint8  `json:"step"`
+	SignBytes []byte `json:"sign_bytes"`
+	Signature []byte `json:"signature"`
+}
+
+// GuardedSigner signs only consensus messages and only in increasing
+// height/round/step order, so a validator cannot be made to double-sign even
+// if its node is compromised or restarted from stale state. The high-water
+// mark is persisted before a signature is released. A request identical to the
+// last one is answered with the same signature.
+type GuardedSigner struct {
+	mu     sync.Mutex
+	signer crypto.Signer
+	path   string
+	last   *signState
+}
+
+// NewGuardedSigner wraps signer with the high-water mark stored at path.
+func NewGuardedSigner(signer crypto.Signer, path string) (*GuardedSigner, error) {
+	g := &GuardedSigner{signer: signer, path: path}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var last signState
+	if err := json.Unmarshal(raw, &last); err != nil {
+		return nil, fmt.Errorf("load signer state: %w", err)
+	}
+	g.last = &last
+	return g, nil
+}
+
+// Sign signs msg if it is a consensus message beyond the high-water mark.
+func (g *GuardedSigner) Sign(msg []byte) ([]byte, error) {
+	height, round, step, err := ParseSignBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if last := g.last; last != nil {
+		switch {
+		case height == last.Height && round == last.Round && step == last.Step:
+			if bytes.Equal(msg, last.SignBytes) {
+				return last.Signature, nil
+			}
+			return nil, fmt.Errorf("double sign refused at height %d round %d step %d", height, round, step)
+		case height < last.Height,
+			height == last.Height && round < last.Round,
+			height == last.Height && round == last.Round && step < last.Step:
+			return nil, fmt.Errorf("height %d round %d step %d is below signed %d/%d/%d",
+				height, round, step, last.Height, last.Round, last.Step)
+		}
+	}
+	sig, err := g.signer.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	next := &signState{Height: height, Round: round, Step: step, SignBytes: append([]byte(nil), msg...), Signature: sig}
+	if err := g.persist(next); err != nil {
+		return nil, err
+	}
+	g.last = next
+	return sig, nil
+}
+
+// PublicKey returns the public key of the wrapped signer.
+func (g *GuardedSigner) PublicKey() []byte {
+	return g.signer.PublicKey()
+}
+
+func (g *GuardedSigner) persist(s *signState) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(g.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp := g.path + ".tmp"
+	if err := writeFileSync(tmp, raw); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, g.path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
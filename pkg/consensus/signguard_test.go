@@ -0,0 +1,163 @@
+package consensus
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func mustSignBytes(t *testing.T, signBytes func() ([]byte, error)) []byte {
+	t.Helper()
+	b, err := signBytes()
+	if err != nil {
+		t.Fatalf("sign bytes: %v", err)
+	}
+	return b
+}
+
+func voteBytes(t *testing.T, height, round uint64, block byte) []byte {
+	return mustSignBytes(t, func() ([]byte, error) {
+		return PrecommitSignBytes(&types.PrecommitVote{BlockHash: types.Hash{block}, Height: height, Round: round, Validator: "val1"})
+	})
+}
+
+func viewChangeBytes(t *testing.T, height, round uint64) []byte {
+	return mustSignBytes(t, func() ([]byte, error) {
+		return ViewChangeSignBytes(&types.ViewChange{Height: height, Round: round, Validator: "val1"})
+	})
+}
+
+func proposalBytes(t *testing.T, height, round uint64) []byte {
+	prop := &types.Proposal{
+		Block: &types.Block{Height: height, PrevHash: types.Hash{1}, Timestamp: 1_700_000_000, Proposer: "val1"},
+		Round: round,
+		Justify: &types.QuorumCertificate{
+			BlockHash:  types.Hash{1},
+			Height:     height - 1,
+			SigBitmap:  []byte{1},
+			Signatures: [][]byte{{7}},
+		},
+	}
+	return mustSignBytes(t, func() ([]byte, error) { return ProposalSignBytes(prop) })
+}
+
+func TestParseSignBytes(t *testing.T) {
+	cases := []struct {
+		name   string
+		msg    []byte
+		height uint64
+		round  uint64
+		step   uint8
+	}{
+		{"proposal", proposalBytes(t, 5, 2), 5, 2, stepPropose},
+		{"vote", voteBytes(t, 5, 2, 9), 5, 2, stepVote},
+		{"view change", viewChangeBytes(t, 5, 2), 5, 2, stepViewChange},
+	}
+	for _, tc := range cases {
+		height, round, step, err := ParseSignBytes(tc.msg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if height != tc.height || round != tc.round || step != tc.step {
+			t.Fatalf("%s: got %d/%d/%d, want %d/%d/%d", tc.name, height, round, step, tc.height, tc.round, tc.step)
+		}
+	}
+	signed := append(voteBytes(t, 5, 2, 9), 0x2a, 1, 0) // with a signature field
+	for _, msg := range [][]byte{nil, []byte("transfer 100 coins"), signed} {
+		if _, _, _, err := ParseSignBytes(msg); err == nil {
+			t.Fatalf("accepted %x as a consensus message", msg)
+		}
+	}
+}
+
+func TestGuardedSignerRefusesDoubleSign(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	g, err := NewGuardedSigner(newTestSigner(1), path)
+	if err != nil {
+		t.Fatalf("new guarded signer: %v", err)
+	}
+	sign := func(msg []byte) ([]byte, error) { return g.Sign(msg) }
+
+	first, err := sign(voteBytes(t, 5, 1, 1))
+	if err != nil {
+		t.Fatalf("vote: %v", err)
+	}
+	again, err := sign(voteBytes(t, 5, 1, 1))
+	if err != nil || !bytes.Equal(again, first) {
+		t.Fatalf("identical request: %v", err)
+	}
+	if _, err := sign(voteBytes(t, 5, 1, 2)); err == nil {
+		t.Fatalf("signed a second vote in the same view")
+	}
+	if _, err := sign(proposalBytes(t, 5, 1)); err == nil {
+		t.Fatalf("signed a proposal after voting in the same view")
+	}
+	if _, err := sign(voteBytes(t, 5, 0, 1)); err == nil {
+		t.Fatalf("signed a vote for an earlier round")
+	}
+	if _, err := sign(viewChangeBytes(t, 5, 1)); err != nil {
+		t.Fatalf("view change after vote: %v", err)
+	}
+	if _, err := sign([]byte("transfer 100 coins")); err == nil {
+		t.Fatalf("signed a non-consensus message")
+	}
+
+	// The high-water mark survives a restart.
+	g, err = NewGuardedSigner(newTestSigner(1), path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := sign(voteBytes(t, 5, 1, 1)); err == nil {
+		t.Fatalf("signed below the persisted high-water mark")
+	}
+	if _, err := sign(proposalBytes(t, 6, 0)); err != nil {
+		t.Fatalf("proposal at next height: %v", err)
+	}
+}
+
+// refusalCounter counts requests a GuardedSigner refused.
+type refusalCounter struct {
+	signer  crypto.Signer
+	refused int
+}
+
+func (r *refusalCounter) Sign(msg []byte) ([]byte, error) {
+	sig, err := r.signer.Sign(msg)
+	if err != nil {
+		r.refused++
+	}
+	return sig, err
+}
+
+func (r *refusalCounter) PublicKey() []byte { return r.signer.PublicKey() }
+
+// An honest engine signs in height/round/step order, so a guard never refuses it.
+func TestSimulationWithGuardedSigners(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.dropRate = 0.1
+	cfg.faults = map[int]simFault{1: faultSilentProposer}
+	cfg.duration = 30 * time.Second
+	for seed := int64(1); seed <= int64(*simRuns); seed++ {
+		s := newSimulation(t, cfg, seed)
+		var counters []*refusalCounter
+		for _, n := range s.nodes {
+			g, err := NewGuardedSigner(n.signer, filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatalf("guarded signer: %v", err)
+			}
+			c := &refusalCounter{signer: g}
+			counters = append(counters, c)
+			n.engine.signer = c
+		}
+		s.run()
+		for i, c := range counters {
+			if c.refused > 0 {
+				t.Fatalf("seed %d: guard refused %d requests from val%d", seed, c.refused, i)
+			}
+		}
+	}
+}
@@ -31,11 +31,15 @@ func PrecommitSignBytes(v *types.PrecommitVote) ([]byte, error) {
 }
 
 // ViewChangeSignBytes returns deterministic signing bytes for a view change.
+// The high QC is excluded so timeout certificates can be verified from the
+// height, round and signer alone; receivers verify it as a QC on its own and
+// drop view changes whose high QC fails.
 func ViewChangeSignBytes(v *types.ViewChange) ([]byte, error) {
 	if v == nil {
 		return nil, nil
 	}
 	cp := *v
 	cp.Signature = nil
+	cp.HighQC = nil
 	return encoding.MarshalViewChange(&cp)
 }
@@ -0,0 +1,568 @@
+package consensus
+
+import (
+	"container/heap"
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// The simulation runs several engines in one goroutine over a simulated
+// network. Time is virtual and every random choice (delays, drops, which peers
+// see which equivocating message) comes from one seeded source, so a run is
+// fully determined by its seed and configuration.
+
+var (
+	simSeed = flag.Int64("sim.seed", 0, "run simulation scenarios with this seed only")
+	simRuns = flag.Int("sim.runs", 3, "number of seeds per simulation scenario")
+)
+
+// simFault is a Byzantine behaviour of a simulated validator.
+type simFault int
+
+const (
+	faultNone simFault = iota
+	// faultSilentProposer never proposes; it still votes and times out.
+	faultSilentProposer
+	// faultDoubleVote sends some peers a second vote for a made-up block.
+	faultDoubleVote
+	// faultDoubleProposal sends some peers a second, conflicting proposal.
+	faultDoubleProposal
+)
+
+// simPartition splits the network into groups between from and until, measured
+// from the start of the run. Messages between groups are dropped; validators
+// not listed form a group of their own.
+type simPartition struct {
+	from, until time.Duration
+	groups      [][]int
+}
+
+type simConfig struct {
+	validators   int
+	powers       []uint64 // voting power per validator; 1 each when empty
+	seedProposer bool
+	faults       map[int]simFault
+	dropRate     float64
+	minDelay     time.Duration
+	maxDelay     time.Duration
+	partitions   []simPartition
+	timeout      time.Duration // base round timeout, doubled per failed round
+	maxTimeout   time.Duration
+	syncInterval time.Duration // how often each validator runs block sync against a random peer
+	duration     time.Duration // virtual run time
+	targetHeight uint64        // height every honest validator must commit by the end
+}
+
+type simEvent struct {
+	at  time.Time
+	seq uint64
+	fn  func()
+}
+
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
+
+type simNode struct {
+	idx     int
+	addr    types.Address
+	signer  *testSigner
+	engine  *Engine
+	fault   simFault
+	height  uint64 // last observed Status
+	round   uint64
+	timer   uint64 // generation of the armed round timeout
+	checked uint64 // committed height already compared by checkSafety
+}
+
+// simulation is the harness. It implements Clock for the engines and Network
+// through simNet.
+type simulation struct {
+	t     *testing.T
+	cfg   simConfig
+	seed  int64
+	rng   *rand.Rand
+	start time.Time
+	now   time.Time
+	seq   uint64
+	queue simQueue
+	nodes []*simNode
+	// committed holds the first block hash seen committed at each height.
+	committed map[uint64]types.Hash
+
+	events, delivered, dropped int
+}
+
+type simNet struct {
+	sim  *simulation
+	from int
+}
+
+func (n *simNet) BroadcastProposal(p *types.Proposal) error {
+	n.sim.broadcast(n.from, p)
+	return nil
+}
+
+func (n *simNet) BroadcastPrecommit(v *types.PrecommitVote) error {
+	n.sim.broadcast(n.from, v)
+	return nil
+}
+
+func (n *simNet) BroadcastQC(qc *types.QuorumCertificate) error {
+	n.sim.broadcast(n.from, qc)
+	return nil
+}
+
+func (n *simNet) BroadcastViewChange(vc *types.ViewChange) error {
+	n.sim.broadcast(n.from, vc)
+	return nil
+}
+
+func (n *simNet) BroadcastTC(tc *types.TimeoutCertificate) error {
+	n.sim.broadcast(n.from, tc)
+	return nil
+}
+
+func (n *simNet) BroadcastEvidence(ev *types.DuplicateVoteEvidence) error {
+	n.sim.broadcast(n.from, ev)
+	return nil
+}
+
+func newSimulation(t *testing.T, cfg simConfig, seed int64) *simulation {
+	t.Helper()
+	start := time.Unix(1_700_000_000, 0)
+	s := &simulation{
+		t:         t,
+		cfg:       cfg,
+		seed:      seed,
+		rng:       rand.New(rand.NewSource(seed)),
+		start:     start,
+		now:       start,
+		committed: make(map[uint64]types.Hash),
+	}
+	for i := 0; i < cfg.validators; i++ {
+		s.nodes = append(s.nodes, &simNode{
+			idx:    i,
+			addr:   types.Address(fmt.Sprintf("val%d", i)),
+			signer: newTestSigner(byte(i + 1)),
+			fault:  cfg.faults[i],
+			height: ^uint64(0),
+		})
+	}
+	for _, n := range s.nodes {
+		dpos := NewDPoS(1, uint32(cfg.validators))
+		for _, v := range s.nodes {
+			power := uint64(1)
+			if v.idx < len(cfg.powers) {
+				power = cfg.powers[v.idx]
+			}
+			if err := dpos.RegisterValidator(v.addr, v.signer.PublicKey(), power, 0); err != nil {
+				t.Fatalf("register %s: %v", v.addr, err)
+			}
+		}
+		engineCfg := Config{BlockMaxTxs: 10, MinStake: 1, SeedProposer: cfg.seedProposer}
+		n.engine = newTestEngineWithConfig(t, engineCfg, n.signer, n.addr, dpos)
+		n.engine.network = &simNet{sim: s, from: n.idx}
+		n.engine.clock = s
+	}
+	return s
+}
+
+// Now implements Clock.
+func (s *simulation) Now() time.Time { return s.now }
+
+// After implements Clock.
+func (s *simulation) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	s.schedule(d, func() { ch <- s.now })
+	return ch
+}
+
+func (s *simulation) schedule(d time.Duration, fn func()) {
+	s.seq++
+	heap.Push(&s.queue, &simEvent{at: s.now.Add(d), seq: s.seq, fn: fn})
+}
+
+// fail stops the run and prints how to reproduce it.
+func (s *simulation) fail(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf("%s\nseed=%d at %v after %d events; reproduce with: go test ./pkg/consensus -run '%s' -sim.seed=%d",
+		fmt.Sprintf(format, args...), s.seed, s.now.Sub(s.start), s.events, s.t.Name(), s.seed)
+}
+
+// run drives the engines until the configured virtual duration has elapsed,
+// checking safety after every event and liveness at the end.
+func (s *simulation) run() {
+	s.t.Helper()
+	for i := range s.nodes {
+		s.poke(i)
+		if s.cfg.syncInterval > 0 {
+			i := i
+			s.schedule(s.cfg.syncInterval, func() { s.sync(i) })
+		}
+	}
+	end := s.start.Add(s.cfg.duration)
+	for s.queue.Len() > 0 {
+		ev := heap.Pop(&s.queue).(*simEvent)
+		if ev.at.After(end) {
+			break
+		}
+		s.now = ev.at
+		s.events++
+		ev.fn()
+		s.checkSafety()
+	}
+	s.checkLiveness()
+}
+
+// poke re-arms a validator's round timer and schedules its proposal whenever
+// its height or round has moved, mirroring the pacemaker.
+func (s *simulation) poke(i int) {
+	n := s.nodes[i]
+	height, round, _ := n.engine.Status()
+	if height == n.height && round == n.round {
+		return
+	}
+	n.height, n.round = height, round
+	s.armTimeout(i)
+	if n.fault != faultSilentProposer && n.engine.IsProposer() {
+		s.schedule(s.cfg.minDelay, func() { s.propose(i) })
+	}
+}
+
+func (s *simulation) armTimeout(i int) {
+	n := s.nodes[i]
+	n.timer++
+	gen := n.timer
+	shift := n.round
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	d := s.cfg.timeout << shift
+	if s.cfg.maxTimeout > 0 && d > s.cfg.maxTimeout {
+		d = s.cfg.maxTimeout
+	}
+	s.schedule(d, func() {
+		if n.timer != gen {
+			return
+		}
+		n.engine.OnTimeout()
+		s.armTimeout(i)
+		s.poke(i)
+	})
+}
+
+func (s *simulation) propose(i int) {
+	e := s.nodes[i].engine
+	prop, err := e.ProposeBlock()
+	if err == nil {
+		_, _ = e.HandleProposal(prop)
+	}
+	s.poke(i)
+}
+
+// sync mirrors the node's block sync loop: the validator fetches committed
+// blocks it lacks from a random peer it can reach.
+func (s *simulation) sync(i int) {
+	peer := s.rng.Intn(len(s.nodes) - 1)
+	if peer >= i {
+		peer++
+	}
+	fetcher := &simFetcher{sim: s, from: i, peer: peer}
+	_, _ = NewBlockSyncer(s.nodes[i].engine, fetcher, BlockSyncConfig{}).Sync(context.Background())
+	s.poke(i)
+	s.schedule(s.cfg.syncInterval, func() { s.sync(i) })
+}
+
+// simFetcher serves block sync from another validator's store.
+type simFetcher struct {
+	sim        *simulation
+	from, peer int
+}
+
+func (f *simFetcher) SyncPeers() []string {
+	if f.sim.partitioned(f.from, f.peer) {
+		return nil
+	}
+	return []string{string(f.sim.nodes[f.peer].addr)}
+}
+
+func (f *simFetcher) FetchBlocks(_ context.Context, _ string, from uint64, count int) ([]*types.CommittedBlock, error) {
+	store := f.sim.nodes[f.peer].engine.state.Store()
+	var out []*types.CommittedBlock
+	for h := from; h < from+uint64(count); h++ {
+		block, err := store.GetBlockByHeight(h)
+		if err != nil || block == nil {
+			break
+		}
+		qc, err := store.GetCommitCertificate(h)
+		if err != nil || qc == nil {
+			break
+		}
+		out = append(out, &types.CommittedBlock{Block: block, Commit: qc})
+	}
+	return out, nil
+}
+
+// broadcast sends msg from a validator to every peer. Equivocating validators
+// send each peer the real message, a conflicting one, or both.
+func (s *simulation) broadcast(from int, msg interface{}) {
+	alt := s.conflicting(from, msg)
+	for to := range s.nodes {
+		if to == from {
+			continue
+		}
+		if alt == nil {
+			s.send(from, to, msg)
+			continue
+		}
+		switch s.rng.Intn(3) {
+		case 0:
+			s.send(from, to, msg)
+		case 1:
+			s.send(from, to, alt)
+		default:
+			s.send(from, to, msg)
+			s.send(from, to, alt)
+		}
+	}
+}
+
+// conflicting returns a second message signed by a Byzantine validator for
+// the same view as msg, or nil.
+func (s *simulation) conflicting(from int, msg interface{}) interface{} {
+	n := s.nodes[from]
+	switch m := msg.(type) {
+	case *types.PrecommitVote:
+		if n.fault != faultDoubleVote {
+			return nil
+		}
+		alt := *m
+		s.rng.Read(alt.BlockHash[:])
+		sb, _ := PrecommitSignBytes(&alt)
+		alt.Signature, _ = n.signer.Sign(sb)
+		return &alt
+	case *types.Proposal:
+		if n.fault != faultDoubleProposal {
+			return nil
+		}
+		alt := copyMsg(m).(*types.Proposal)
+		alt.Block.Timestamp++
+		sb, _ := ProposalSignBytes(alt)
+		alt.ProposerSig, _ = n.signer.Sign(sb)
+		return alt
+	}
+	return nil
+}
+
+func (s *simulation) send(from, to int, msg interface{}) {
+	if s.rng.Float64() < s.cfg.dropRate {
+		s.dropped++
+		return
+	}
+	delay := s.cfg.minDelay
+	if span := s.cfg.maxDelay - s.cfg.minDelay; span > 0 {
+		delay += time.Duration(s.rng.Int63n(int64(span)))
+	}
+	cp := copyMsg(msg)
+	s.schedule(delay, func() {
+		if s.partitioned(from, to) {
+			s.dropped++
+			return
+		}
+		s.delivered++
+		deliver(s.nodes[to].engine, cp)
+		s.poke(to)
+	})
+}
+
+func (s *simulation) partitioned(a, b int) bool {
+	elapsed := s.now.Sub(s.start)
+	for _, p := range s.cfg.partitions {
+		if elapsed < p.from || elapsed >= p.until {
+			continue
+		}
+		if groupOf(p.groups, a) != groupOf(p.groups, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func groupOf(groups [][]int, idx int) int {
+	for g, members := range groups {
+		for _, m := range members {
+			if m == idx {
+				return g
+			}
+		}
+	}
+	return -1 - idx
+}
+
+func (s *simulation) honest() []*simNode {
+	var out []*simNode
+	for _, n := range s.nodes {
+		if n.fault == faultNone {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// checkSafety fails if two validators committed different blocks at a height.
+// Faulty validators run an honest engine too, so all of them are checked.
+func (s *simulation) checkSafety() {
+	s.t.Helper()
+	for _, n := range s.nodes {
+		for ; n.checked < n.engine.CommittedHeight(); n.checked++ {
+			h := n.checked + 1
+			block, err := n.engine.state.Store().GetBlockByHeight(h)
+			if err != nil || block == nil {
+				s.fail("%s: committed block %d missing: %v", n.addr, h, err)
+			}
+			hash := mustHashBlock(block)
+			if prev, ok := s.committed[h]; ok && prev != hash {
+				s.fail("safety violated: %s committed %s at height %d, another validator committed %s",
+					n.addr, hash, h, prev)
+			}
+			s.committed[h] = hash
+		}
+	}
+}
+
+// checkLiveness fails unless every honest validator reached the target height.
+func (s *simulation) checkLiveness() {
+	s.t.Helper()
+	for _, n := range s.honest() {
+		if h := n.engine.CommittedHeight(); h < s.cfg.targetHeight {
+			s.fail("liveness violated: %s committed %d blocks, want at least %d (delivered %d, dropped %d)",
+				n.addr, h, s.cfg.targetHeight, s.delivered, s.dropped)
+		}
+	}
+}
+
+// simSeeds returns the seeds each scenario runs with.
+func simSeeds() []int64 {
+	if *simSeed != 0 {
+		return []int64{*simSeed}
+	}
+	seeds := make([]int64, *simRuns)
+	for i := range seeds {
+		seeds[i] = int64(i + 1)
+	}
+	return seeds
+}
+
+func runSimulation(t *testing.T, cfg simConfig) {
+	for _, seed := range simSeeds() {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			newSimulation(t, cfg, seed).run()
+		})
+	}
+}
+
+func baseSimConfig() simConfig {
+	return simConfig{
+		validators:   4,
+		minDelay:     10 * time.Millisecond,
+		maxDelay:     60 * time.Millisecond,
+		timeout:      500 * time.Millisecond,
+		maxTimeout:   4 * time.Second,
+		syncInterval: 2 * time.Second,
+		duration:     20 * time.Second,
+		targetHeight: 8,
+	}
+}
+
+func TestSimulationHonestNetwork(t *testing.T) {
+	runSimulation(t, baseSimConfig())
+}
+
+func TestSimulationLossyNetwork(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.dropRate = 0.1
+	cfg.maxDelay = 400 * time.Millisecond
+	runSimulation(t, cfg)
+}
+
+func TestSimulationHealsPartition(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.partitions = []simPartition{{from: 2 * time.Second, until: 8 * time.Second, groups: [][]int{{0, 1}, {2, 3}}}}
+	cfg.duration = 30 * time.Second
+	runSimulation(t, cfg)
+}
+
+func TestSimulationSilentProposer(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.faults = map[int]simFault{1: faultSilentProposer}
+	cfg.duration = 30 * time.Second
+	cfg.targetHeight = 5
+	runSimulation(t, cfg)
+}
+
+func TestSimulationDoubleVoter(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.faults = map[int]simFault{2: faultDoubleVote}
+	runSimulation(t, cfg)
+}
+
+func TestSimulationEquivocatingProposer(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.faults = map[int]simFault{0: faultDoubleProposal}
+	cfg.duration = 30 * time.Second
+	runSimulation(t, cfg)
+}
+
+func TestSimulationWeightedSeededProposer(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.powers = []uint64{4, 3, 2, 2}
+	cfg.seedProposer = true
+	runSimulation(t, cfg)
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	cfg := baseSimConfig()
+	cfg.dropRate = 0.05
+	cfg.faults = map[int]simFault{3: faultDoubleVote}
+	cfg.duration = 10 * time.Second
+	cfg.targetHeight = 0
+	trace := func() string {
+		s := newSimulation(t, cfg, 42)
+		s.run()
+		out := fmt.Sprintf("events=%d delivered=%d dropped=%d", s.events, s.delivered, s.dropped)
+		for _, n := range s.nodes {
+			h := n.engine.CommittedHeight()
+			block, _ := n.engine.state.Store().GetBlockByHeight(h)
+			out += fmt.Sprintf(" %s@%d", n.addr, h)
+			if block != nil {
+				out += ":" + mustHashBlock(block).String()
+			}
+		}
+		return out
+	}
+	if a, b := trace(), trace(); a != b {
+		t.Fatalf("same seed produced different runs:\n%s\n%s", a, b)
+	}
+}
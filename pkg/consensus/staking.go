@@ -0,0 +1,61 @@
+package consensus
+
+import (
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// loadRegistry rebuilds DPoS from the validator registry committed in state.
+// On a fresh chain without a registry in state, the validators registered in
+// DPoS are written to state first, as genesis.
+func (e *Engine) loadRegistry() error {
+	store := e.state.Store()
+	validators, err := store.GetValidators()
+	if err != nil {
+		return err
+	}
+	if len(validators) == 0 && e.height == 0 {
+		for _, v := range e.dpos.Validators() {
+			if err := store.SetValidator(v); err != nil {
+				return err
+			}
+		}
+	}
+	return e.reloadRegistryLocked()
+}
+
+// reloadRegistryLocked makes DPoS follow the registry committed in state,
+// where staking transactions, evidence and downtime change it.
+func (e *Engine) reloadRegistryLocked() error {
+	validators, err := e.state.Store().GetValidators()
+	if err != nil {
+		return err
+	}
+	e.dpos.LoadValidators(validators)
+	return nil
+}
+
+// checkStakeTxLocked rejects staking transactions the committed registry
+// already rules out for a block at height: delegations and redelegations to
+// unknown or jailed validators, validators registering an address or key
+// already in use, and unjailing before the jail term is over or with too
+// little self-stake. The state
+// transition enforces the same rules; proposals leave such transactions out
+// because a single failing transaction voids the transactions of a block.
+func (e *Engine) checkStakeTxLocked(t *types.Transaction, height uint64) error {
+	env, err := tx.DecodePayload(t.Payload)
+	if err != nil {
+		return err
+	}
+	switch p := env.Payload.(type) {
+	case tx.StakeDelegate:
+		return e.dpos.CheckDelegation(p.Validator)
+	case tx.StakeRedelegate:
+		return e.dpos.CheckDelegation(p.To)
+	case tx.CreateValidator:
+		return e.dpos.CheckCreateValidator(t.From, p.ConsensusPubKey)
+	case tx.Unjail:
+		return e.dpos.CheckUnjail(t.From, e.epochOf(height))
+	}
+	return nil
+}
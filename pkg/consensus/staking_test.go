@@ -0,0 +1,221 @@
+package consensus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestDelegationsFollowState(t *testing.T) {
+	e, dpos, signers := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1, UnbondingPeriod: 1000}, 1)
+	signer, other := signers[0], signers[1]
+	kp, delegator := fundedAccount(t, e, 500)
+	commitUntil(t, e, 1)
+
+	if err := e.mempool.AddTx(signedTx(t, kp, 0, tx.StakeDelegate{Validator: "val1", Amount: 300})); err != nil {
+		t.Fatalf("add tx: %v", err)
+	}
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if v := dpos.GetValidator("val1"); v.Power != 301 || v.Delegations[delegator] != 300 {
+		t.Fatalf("registry did not follow the delegation: %+v", v)
+	}
+	if acct, _ := e.state.GetAccount(delegator); acct.Balance != 200 || acct.Stake != 1300 {
+		t.Fatalf("balance %d stake %d, want 200 and 1300", acct.Balance, acct.Stake)
+	}
+
+	// A restarted node rebuilds the same registry from committed state.
+	validators, err := e.state.Store().GetValidators()
+	if err != nil {
+		t.Fatalf("get validators: %v", err)
+	}
+	restarted := NewDPoS(1, 10)
+	restarted.LoadValidators(validators)
+	if v := restarted.GetValidator("val1"); v == nil || v.Power != 301 || v.Delegations[delegator] != 300 {
+		t.Fatalf("rebuilt registry: %+v", v)
+	}
+
+	// Proposals delegating to unknown or jailed validators are not voted for.
+	if err := e.HandleEvidence(&types.DuplicateVoteEvidence{
+		Validator: "val1", Height: 1, Round: 0,
+		VoteA: signedVote(t, other, "val1", types.Hash{1}, 1, 0),
+		VoteB: signedVote(t, other, "val1", types.Hash{2}, 1, 0),
+	}); err != nil {
+		t.Fatalf("evidence: %v", err)
+	}
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if !dpos.GetValidator("val1").Jailed {
+		t.Fatalf("double signer not jailed")
+	}
+	for target, reason := range map[types.Address]string{"val1": "jailed", "val9": "not found"} {
+		prop, err := e.ProposeBlock()
+		if err != nil {
+			t.Fatalf("propose: %v", err)
+		}
+		prop.Block.Transactions = []*types.Transaction{signedTx(t, kp, 1, tx.StakeDelegate{Validator: target, Amount: 100})}
+		msg, _ := ProposalSignBytes(prop)
+		prop.ProposerSig, _ = signer.Sign(msg)
+		if _, err := e.HandleProposal(prop); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Fatalf("delegation to %s: got %v, want %q", target, err, reason)
+		}
+	}
+}
+
+func TestValidatorLifecycleTransactions(t *testing.T) {
+	// The new validator only joins a validator set from epoch 2 on, at
+	// height 16, which the test stays below.
+	e, dpos, _ := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 100, EpochLength: 8, UnbondingPeriod: 1000})
+	e.state.SetStakingParams(state.StakingParams{MinStake: 100, EpochLength: 8, MaxCommissionChangeBps: 100, JailDoubleEpochs: 1})
+	kp, operator := fundedAccount(t, e, 1000)
+	preview := func(txn *types.Transaction) error {
+		_, err := e.state.PreviewBlock(&types.Block{Height: e.CommittedHeight() + 1, Timestamp: time.Now().Unix(), Transactions: []*types.Transaction{txn}}, nil)
+		return err
+	}
+	cons := newTestSigner(3)
+	consKey := cons.PublicKey()
+	doubleVote := func(height uint64) {
+		t.Helper()
+		if err := e.HandleEvidence(&types.DuplicateVoteEvidence{
+			Validator: operator, Height: height, Round: 0,
+			VoteA: signedVote(t, cons, operator, types.Hash{1}, height, 0),
+			VoteB: signedVote(t, cons, operator, types.Hash{2}, height, 0),
+		}); err != nil {
+			t.Fatalf("evidence: %v", err)
+		}
+		commitUntil(t, e, e.CommittedHeight()+3)
+	}
+
+	for _, c := range []struct {
+		payload tx.Payload
+		reason  string
+	}{
+		{tx.CreateValidator{ConsensusPubKey: consKey, SelfStake: 50, Commission: 1000}, "below minimum"},
+		{tx.CreateValidator{ConsensusPubKey: consKey, SelfStake: 100, Commission: 10_001}, "commission"},
+		{tx.EditValidator{Commission: 1000}, "validator not found"},
+	} {
+		if err := preview(signedTx(t, kp, 0, c.payload)); err == nil || !strings.Contains(err.Error(), c.reason) {
+			t.Fatalf("%T: got %v, want %q", c.payload, err, c.reason)
+		}
+	}
+	if err := e.mempool.AddTx(signedTx(t, kp, 0, tx.CreateValidator{ConsensusPubKey: consKey, SelfStake: 100, Commission: 1000})); err != nil {
+		t.Fatalf("add tx: %v", err)
+	}
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if v := dpos.GetValidator(operator); v == nil || v.Stake != 100 || v.Power != 100 || v.Commission != 1000 {
+		t.Fatalf("registry: %+v", v)
+	}
+	if acct, _ := e.state.GetAccount(operator); acct.Balance != 900 || acct.Stake != 1100 {
+		t.Fatalf("balance %d stake %d, want 900 and 1100", acct.Balance, acct.Stake)
+	}
+	if err := preview(signedTx(t, kp, 1, tx.CreateValidator{ConsensusPubKey: consKey, SelfStake: 100})); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("second create: %v", err)
+	}
+
+	// The commission was set at creation in epoch 0 and moves at most 1% an epoch.
+	if err := preview(signedTx(t, kp, 1, tx.EditValidator{Commission: 1050})); err == nil || !strings.Contains(err.Error(), "already changed in epoch 0") {
+		t.Fatalf("edit in creation epoch: %v", err)
+	}
+	// A double sign committed in epoch 0 jails the validator until epoch 1.
+	doubleVote(1)
+	if v := dpos.GetValidator(operator); !v.Jailed || v.JailedUntilEpoch != 1 {
+		t.Fatalf("double signer: %+v", v)
+	}
+	if err := preview(signedTx(t, kp, 1, tx.Unjail{})); err == nil || !strings.Contains(err.Error(), "jailed until epoch 1") {
+		t.Fatalf("unjail in epoch 0: %v", err)
+	}
+	commitUntil(t, e, 8)
+	if err := preview(signedTx(t, kp, 1, tx.EditValidator{Commission: 1200})); err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Fatalf("large edit: %v", err)
+	}
+	// The jail term is over, so the validator unjails itself.
+	for nonce, payload := range []tx.Payload{tx.EditValidator{Commission: 1100}, tx.Unjail{}} {
+		if err := e.mempool.AddTx(signedTx(t, kp, uint64(nonce)+1, payload)); err != nil {
+			t.Fatalf("add tx: %v", err)
+		}
+	}
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if v := dpos.GetValidator(operator); v.Commission != 1100 || v.Jailed {
+		t.Fatalf("after edit and unjail: %+v", v)
+	}
+	if err := preview(signedTx(t, kp, 3, tx.Unjail{})); err == nil || !strings.Contains(err.Error(), "not jailed") {
+		t.Fatalf("unjail when not jailed: %v", err)
+	}
+	doubleVote(2)
+	if err := preview(signedTx(t, kp, 3, tx.Unjail{})); err == nil || !strings.Contains(err.Error(), "jailed until epoch 2") {
+		t.Fatalf("unjail in epoch 1: %v", err)
+	}
+	if h := e.CommittedHeight(); h >= 16 {
+		t.Fatalf("committed height %d reached the epoch the new validator joins", h)
+	}
+}
+
+func TestRedelegationStaysSlashableAndCannotHop(t *testing.T) {
+	e, dpos, signers := newStakingTestEngine(t, Config{BlockMaxTxs: 10, MinStake: 1, UnbondingPeriod: 1000}, 1, 1)
+	byz := signers[1]
+	clock := newFakeClock()
+	e.clock = clock
+	e.state.SetStakingParams(state.StakingParams{UnbondingPeriod: 100, SlashDoubleBps: 500})
+	kp, delegator := fundedAccount(t, e, 1000)
+	commitUntil(t, e, 2)
+
+	// val1 equivocated at height 1; the delegator moves part of its stake to
+	// val2 afterwards, and the evidence lands in the same block.
+	if err := e.HandleEvidence(&types.DuplicateVoteEvidence{
+		Validator: "val1", Height: 1, Round: 0,
+		VoteA: signedVote(t, byz, "val1", types.Hash{1}, 1, 0),
+		VoteB: signedVote(t, byz, "val1", types.Hash{2}, 1, 0),
+	}); err != nil {
+		t.Fatalf("evidence: %v", err)
+	}
+	for nonce, payload := range []tx.Payload{
+		tx.StakeDelegate{Validator: "val1", Amount: 1000},
+		tx.StakeRedelegate{From: "val1", To: "val2", Amount: 600},
+	} {
+		if err := e.mempool.AddTx(signedTx(t, kp, uint64(nonce), payload)); err != nil {
+			t.Fatalf("add tx: %v", err)
+		}
+	}
+	commitUntil(t, e, e.CommittedHeight()+3)
+
+	// The stake that moved and the stake that stayed both lose 5%.
+	if v := dpos.GetValidator("val2"); v.Power != 571 || v.Delegations[delegator] != 570 {
+		t.Fatalf("val2 after slashed redelegation: %+v", v)
+	}
+	if v := dpos.GetValidator("val1"); v.Delegations[delegator] != 380 {
+		t.Fatalf("val1 after slashing the delegation that stayed: %+v", v)
+	}
+	// The redelegated loss leaves the account at once, the bonded one when
+	// that delegation is next settled.
+	if acct, _ := e.state.GetAccount(delegator); acct.Stake != 1970 || acct.Balance != 0 {
+		t.Fatalf("stake %d balance %d, want 1970 and 0", acct.Stake, acct.Balance)
+	}
+	entries, err := e.state.Store().GetRedelegations(delegator)
+	if err != nil {
+		t.Fatalf("redelegations: %v", err)
+	}
+	if len(entries) != 1 || entries[0].SrcValidator != "val1" || entries[0].DstValidator != "val2" || entries[0].Amount != 570 {
+		t.Fatalf("expected one slashed entry of 570, got %+v", entries)
+	}
+
+	// The stake cannot hop on from val2 until the redelegation matures.
+	hop := signedTx(t, kp, 2, tx.StakeRedelegate{From: "val2", To: "val0", Amount: 570})
+	preview := &types.Block{Height: e.CommittedHeight() + 1, Timestamp: clock.Now().Unix(), Transactions: []*types.Transaction{hop}}
+	if _, err := e.state.PreviewBlock(preview, nil); err == nil || !strings.Contains(err.Error(), "not matured") {
+		t.Fatalf("hop before maturity: %v", err)
+	}
+	clock.Advance(time.Duration(entries[0].CompletionTime-clock.Now().Unix()) * time.Second)
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if entries, _ := e.state.Store().GetRedelegations(delegator); len(entries) != 0 {
+		t.Fatalf("matured entries still pending: %+v", entries)
+	}
+	if err := e.mempool.AddTx(hop); err != nil {
+		t.Fatalf("add tx: %v", err)
+	}
+	commitUntil(t, e, e.CommittedHeight()+3)
+	if v := dpos.GetValidator("val0"); v.Delegations[delegator] != 570 {
+		t.Fatalf("val0 after matured redelegation: %+v", v)
+	}
+}
@@ -0,0 +1,178 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// SnapshotFetcher fetches state snapshots from peers.
+type SnapshotFetcher interface {
+	SyncPeers() []string
+	ListSnapshots(ctx context.Context, peer string) ([]*types.SnapshotManifest, error)
+	FetchSnapshotChunk(ctx context.Context, peer string, height uint64, index uint32) ([]byte, error)
+}
+
+// takeSnapshotLocked snapshots the state just committed at height when
+// height is a multiple of the snapshot interval.
+func (e *Engine) takeSnapshotLocked(height uint64) {
+	if e.cfg.Snapshots == nil || e.cfg.SnapshotInterval == 0 || height%e.cfg.SnapshotInterval != 0 {
+		return
+	}
+	e.cfg.Snapshots.Take(e.state.Store(), height, func(err error) {
+		if err != nil {
+			snapshotsFailed.Inc()
+		}
+	})
+}
+
+// StateSync restores store, which must not have committed any block, from a
+// peer snapshot taken at trustHeight, so the node continues from there instead
+// of replaying the chain. trustHash is the hash of the block at trustHeight,
+// obtained from a source the operator trusts. The block is fetched from peers
+// and checked against it; the restored state must then rebuild the block's
+// state root, and hold the validator sets and proposer priorities its header
+// commits to. Peers serving a chunk that does not match the manifest are
+// skipped for that chunk.
+func StateSync(ctx context.Context, store *state.Store, blocks BlockFetcher, snapshots SnapshotFetcher, trustHeight uint64, trustHash types.Hash) error {
+	trusted, err := fetchTrustedBlock(ctx, blocks, trustHeight, trustHash)
+	if err != nil {
+		return err
+	}
+
+	// Peers that list the same manifest serve the same chunks.
+	var manifests []*types.SnapshotManifest
+	servers := make(map[string][]string)
+	for _, peer := range snapshots.SyncPeers() {
+		list, err := snapshots.ListSnapshots(ctx, peer)
+		if err != nil {
+			continue
+		}
+		for _, m := range list {
+			if m == nil || m.Height != trustHeight || m.BlockHash != trustHash || m.Format != state.SnapshotFormat || m.StateRoot != trusted.Block.StateRoot {
+				continue
+			}
+			b, err := encoding.MarshalSnapshotManifest(m)
+			if err != nil {
+				continue
+			}
+			if servers[string(b)] == nil {
+				manifests = append(manifests, m)
+			}
+			servers[string(b)] = append(servers[string(b)], peer)
+		}
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("no peer serves a snapshot of block %d %s", trustHeight, trustHash)
+	}
+
+	err = nil
+	for _, m := range manifests {
+		b, _ := encoding.MarshalSnapshotManifest(m)
+		if err = restoreSnapshot(ctx, store, snapshots, m, servers[string(b)], trusted); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// fetchTrustedBlock returns the block at height with its commit certificate
+// from the first peer that serves the block with hash.
+func fetchTrustedBlock(ctx context.Context, blocks BlockFetcher, height uint64, hash types.Hash) (*types.CommittedBlock, error) {
+	for _, peer := range blocks.SyncPeers() {
+		fetched, err := blocks.FetchBlocks(ctx, peer, height, 1)
+		if err != nil || len(fetched) == 0 {
+			continue
+		}
+		cb := fetched[0]
+		if cb == nil || cb.Block == nil || cb.Commit == nil || cb.Block.Height != height {
+			continue
+		}
+		if h, err := encoding.HashBlock(cb.Block); err != nil || h != hash {
+			continue
+		}
+		if cb.Commit.Height != height || cb.Commit.BlockHash != hash {
+			continue
+		}
+		return cb, nil
+	}
+	return nil, fmt.Errorf("no peer serves block %d with the trusted hash %s", height, hash)
+}
+
+// restoreSnapshot restores the snapshot of m, fetching each chunk from the
+// first of peers that serves it intact.
+func restoreSnapshot(ctx context.Context, store *state.Store, snapshots SnapshotFetcher, m *types.SnapshotManifest, peers []string, trusted *types.CommittedBlock) error {
+	r, err := store.NewSnapshotRestorer(m)
+	if err != nil {
+		return err
+	}
+	for index := uint32(0); int(index) < len(m.Chunks); index++ {
+		applied := false
+		for _, peer := range peers {
+			chunk, err := snapshots.FetchSnapshotChunk(ctx, peer, m.Height, index)
+			if err != nil {
+				continue
+			}
+			if err := r.ApplyChunk(index, chunk); err == nil {
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			if err := r.Abort(); err != nil {
+				return err
+			}
+			return fmt.Errorf("no peer serves chunk %d of snapshot %d intact", index, m.Height)
+		}
+	}
+	if err := r.Finish(trusted.Block.StateRoot); err != nil {
+		return err
+	}
+	if err := checkRestoredConsensusState(store, trusted.Block); err != nil {
+		if abortErr := r.Abort(); abortErr != nil {
+			return abortErr
+		}
+		return err
+	}
+	return r.Commit(trusted.Block, trusted.Commit)
+}
+
+// checkRestoredConsensusState checks the restored validator sets that sign
+// the block and the one after it, and the proposer priorities that elect the
+// next proposer, against the hashes in the block header.
+func checkRestoredConsensusState(store *state.Store, block *types.Block) error {
+	for i, want := range []types.Hash{block.ValidatorsHash, block.NextValidatorsHash} {
+		height := block.Height + uint64(i)
+		set, err := store.GetValidatorSet(height)
+		if err != nil {
+			return err
+		}
+		if set == nil {
+			return fmt.Errorf("snapshot has no validator set for height %d", height)
+		}
+		got, err := encoding.HashValidatorSet(set)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("snapshot validator set for height %d does not match header", height)
+		}
+	}
+	height, priorities, err := store.GetProposerPriorities()
+	if err != nil {
+		return err
+	}
+	if priorities == nil || height != block.Height+1 {
+		return fmt.Errorf("snapshot has no proposer priorities for height %d", block.Height+1)
+	}
+	if encoding.HashProposerPriorities(height, priorities) != block.ProposerPrioritiesHash {
+		return fmt.Errorf("snapshot proposer priorities do not match header")
+	}
+	return nil
+}
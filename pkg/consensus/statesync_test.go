@@ -0,0 +1,134 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/state"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// snapshotServer serves the snapshots of a SnapshotStore to every peer; "liar"
+// corrupts the chunks it serves and "down" refuses.
+type snapshotServer struct {
+	snapshots *state.SnapshotStore
+	peers     []string
+}
+
+func (s *snapshotServer) SyncPeers() []string { return s.peers }
+
+func (s *snapshotServer) ListSnapshots(_ context.Context, peer string) ([]*types.SnapshotManifest, error) {
+	if peer == "down" {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return s.snapshots.ListSnapshots()
+}
+
+func (s *snapshotServer) FetchSnapshotChunk(_ context.Context, peer string, height uint64, index uint32) ([]byte, error) {
+	chunk, err := s.snapshots.LoadSnapshotChunk(height, index)
+	if err != nil {
+		return nil, err
+	}
+	if peer == "liar" {
+		chunk[0] ^= 1
+	}
+	return chunk, nil
+}
+
+func TestStateSyncRestoresAndContinues(t *testing.T) {
+	signer := newTestSigner(1)
+	dpos := NewDPoS(1, 10)
+	if err := dpos.RegisterValidator("val0", signer.PublicKey(), 100, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	snapshots := state.NewSnapshotStore(t.TempDir(), 2)
+	cfg := Config{BlockMaxTxs: 10, MinStake: 1, EpochLength: 4, Snapshots: snapshots, SnapshotInterval: 3}
+	source := newTestEngineWithConfig(t, cfg, signer, "val0", dpos)
+	source.state.SetRewardParams(state.RewardParams{BlockReward: 1000})
+	// A peer serves a snapshot of block 9 whose proposer priorities, which
+	// the state root does not cover, were tampered with.
+	forged := state.NewSnapshotStore(t.TempDir(), 1)
+	// Wait after every block so no snapshot is skipped for an earlier one
+	// still being written.
+	for h := uint64(1); h <= 10; h++ {
+		commitUntil(t, source, h)
+		snapshots.Wait()
+		if h != 9 {
+			continue
+		}
+		next, priorities, err := source.state.Store().GetProposerPriorities()
+		if err != nil || next != 10 {
+			t.Fatalf("priorities for %d: %v", next, err)
+		}
+		tampered := map[types.Address]int64{"val0": priorities["val0"] + 1}
+		if err := source.state.Store().SetProposerPriorities(next, tampered); err != nil {
+			t.Fatalf("tamper: %v", err)
+		}
+		forged.Take(source.state.Store(), 9, func(error) {})
+		forged.Wait()
+		if err := source.state.Store().SetProposerPriorities(next, priorities); err != nil {
+			t.Fatalf("restore priorities: %v", err)
+		}
+	}
+	manifests, err := snapshots.ListSnapshots()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(manifests) != 2 || manifests[0].Height != 9 || manifests[1].Height != 6 {
+		t.Fatalf("expected the snapshots at 9 and 6 to be kept, got %d", len(manifests))
+	}
+
+	trusted, err := source.state.Store().GetBlockByHeight(9)
+	if err != nil || trusted == nil {
+		t.Fatalf("block 9: %v", err)
+	}
+	blocks := &storeFetcher{store: source.state.Store(), peers: []string{"a"}, limit: 10, calls: make(map[string]int)}
+	server := &snapshotServer{snapshots: snapshots, peers: []string{"down", "liar", "a"}}
+
+	store, err := state.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	if err := StateSync(context.Background(), store, blocks, server, 9, types.Hash{1}); err == nil {
+		t.Fatalf("synced against a hash no peer serves")
+	}
+	if err := StateSync(context.Background(), store, blocks, server, 6, mustHashBlock(trusted)); err == nil {
+		t.Fatalf("synced block 6 against the hash of block 9")
+	}
+	err = StateSync(context.Background(), store, blocks, &snapshotServer{snapshots: forged, peers: []string{"a"}}, 9, mustHashBlock(trusted))
+	if err == nil || !strings.Contains(err.Error(), "proposer priorities") {
+		t.Fatalf("synced a snapshot with tampered proposer priorities: %v", err)
+	}
+	if err := StateSync(context.Background(), store, blocks, server, 9, mustHashBlock(trusted)); err != nil {
+		t.Fatalf("state sync: %v", err)
+	}
+	if err := VerifyStoredBlock(store, 9, testVerifier{}); err != nil {
+		t.Fatalf("restored tip: %v", err)
+	}
+
+	restored := newTestEngineOnStore(t, Config{BlockMaxTxs: 10, MinStake: 1, EpochLength: 4}, store, signer, "val0", NewDPoS(1, 10))
+	restored.state.SetRewardParams(state.RewardParams{BlockReward: 1000})
+	if restored.CommittedHeight() != 9 {
+		t.Fatalf("restored engine at height %d, want 9", restored.CommittedHeight())
+	}
+	// The blocks after the snapshot apply on the restored state.
+	if _, err := NewBlockSyncer(restored, blocks, BlockSyncConfig{}).Sync(context.Background()); err != nil {
+		t.Fatalf("block sync: %v", err)
+	}
+	if restored.CommittedHeight() != 10 {
+		t.Fatalf("restored engine synced to %d, want 10", restored.CommittedHeight())
+	}
+	want, _ := state.ComputeStateRoot(source.state.Store())
+	if got, _ := state.ComputeStateRoot(store); got != want {
+		t.Fatalf("restored state diverges from source")
+	}
+	before, _ := restored.state.GetAccount("val0")
+	commitUntil(t, restored, 13)
+	after, _ := restored.state.GetAccount("val0")
+	if after.Balance <= before.Balance {
+		t.Fatalf("rewards not paid after restore: %d then %d", before.Balance, after.Balance)
+	}
+}
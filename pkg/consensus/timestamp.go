@@ -0,0 +1,118 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/rc"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// Block timestamps are unix seconds. A block must be stamped strictly after its
+// parent and after the median of the recent timestamps, and a validator only
+// votes for a block stamped within MaxSkewSec of its own clock. Because the
+// clock bound moves with the local clock rather than with the chain, a chain
+// that stalled for a while can resume with current timestamps.
+
+// Reasons a proposal's timestamp is rejected, as reported in metrics.
+const (
+	rejectTimestampNotAfterParent = "timestamp_not_after_parent"
+	rejectTimestampNotAfterMedian = "timestamp_not_after_median"
+	rejectTimestampTooFarAhead    = "timestamp_too_far_ahead"
+	rejectTimestampTooFarBehind   = "timestamp_too_far_behind"
+)
+
+// timestampError is a timestamp rule violation.
+type timestampError struct {
+	reason string
+	msg    string
+}
+
+func (e *timestampError) Error() string { return e.msg }
+
+// recentTimestampsLocked returns the timestamp window a block on top of
+// ancestors is checked against: the committed window extended with the
+// uncommitted ancestors, as the state applies them.
+func (e *Engine) recentTimestampsLocked(ancestors []*types.Block) ([]int64, error) {
+	window, err := e.state.Store().GetLastTimestamps()
+	if err != nil {
+		return nil, err
+	}
+	n := e.state.RCParams().WindowN
+	for _, b := range ancestors {
+		window = append(window, b.Timestamp)
+		if n > 0 && len(window) > n {
+			window = window[len(window)-n:]
+		}
+	}
+	return window, nil
+}
+
+// checkChainTimestamp applies the rules that depend only on the chain: ts must
+// be after the parent timestamp, the last of window, and after its median.
+func checkChainTimestamp(ts int64, window []int64) error {
+	if len(window) == 0 {
+		return nil
+	}
+	if parent := window[len(window)-1]; ts <= parent {
+		return &timestampError{rejectTimestampNotAfterParent,
+			fmt.Sprintf("block timestamp %d not after parent timestamp %d", ts, parent)}
+	}
+	if median := rc.Median(window); ts <= median {
+		return &timestampError{rejectTimestampNotAfterMedian,
+			fmt.Sprintf("block timestamp %d not after median timestamp %d", ts, median)}
+	}
+	return nil
+}
+
+// checkClockTimestamp rejects timestamps more than maxSkew seconds away from now.
+func checkClockTimestamp(ts, now, maxSkew int64) error {
+	if ts > now+maxSkew {
+		return &timestampError{rejectTimestampTooFarAhead,
+			fmt.Sprintf("block timestamp %d more than %ds ahead of local time %d", ts, maxSkew, now)}
+	}
+	if ts < now-maxSkew {
+		return &timestampError{rejectTimestampTooFarBehind,
+			fmt.Sprintf("block timestamp %d more than %ds behind local time %d", ts, maxSkew, now)}
+	}
+	return nil
+}
+
+// verifyTimestampLocked checks the timestamp of a block on top of ancestors
+// before voting for it, counting a rejection in metrics.
+func (e *Engine) verifyTimestampLocked(block *types.Block, ancestors []*types.Block) error {
+	window, err := e.recentTimestampsLocked(ancestors)
+	if err != nil {
+		return err
+	}
+	err = checkChainTimestamp(block.Timestamp, window)
+	if err == nil {
+		err = checkClockTimestamp(block.Timestamp, e.clock.Now().Unix(), e.state.RCParams().MaxSkewSec)
+	}
+	if tsErr, ok := err.(*timestampError); ok {
+		proposalsRejected.WithLabelValues(tsErr.reason).Inc()
+	}
+	return err
+}
+
+// proposalTimestampLocked stamps a block on top of ancestors with the local
+// time, moved past the parent and the median when the clock lags the chain.
+func (e *Engine) proposalTimestampLocked(ancestors []*types.Block) (int64, error) {
+	window, err := e.recentTimestampsLocked(ancestors)
+	if err != nil {
+		return 0, err
+	}
+	now := e.clock.Now().Unix()
+	ts := now
+	if len(window) > 0 {
+		if min := window[len(window)-1] + 1; ts < min {
+			ts = min
+		}
+		if min := rc.Median(window) + 1; ts < min {
+			ts = min
+		}
+	}
+	if err := checkClockTimestamp(ts, now, e.state.RCParams().MaxSkewSec); err != nil {
+		return 0, fmt.Errorf("cannot propose: %w", err)
+	}
+	return ts, nil
+}
@@ -0,0 +1,114 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTimestampTestEngine(t *testing.T, parent int64) (*Engine, *testSigner, *fakeClock) {
+	t.Helper()
+	signer := newTestSigner(1)
+	dpos := NewDPoS(1, 1)
+	if err := dpos.RegisterValidator("val1", signer.PublicKey(), 1, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	e := newTestEngine(t, signer, "val1", dpos)
+	clock := newFakeClock()
+	e.clock = clock
+	if err := e.state.Store().SetLastTimestamps([]int64{parent}); err != nil {
+		t.Fatalf("set timestamps: %v", err)
+	}
+	return e, signer, clock
+}
+
+func TestProposalTimestampRules(t *testing.T) {
+	now := newFakeClock().Now().Unix()
+	cases := []struct {
+		name   string
+		ts     int64
+		reason string
+	}{
+		{"same as parent", now - 10, rejectTimestampNotAfterParent},
+		{"before parent", now - 11, rejectTimestampNotAfterParent},
+		{"too far ahead", now + 31, rejectTimestampTooFarAhead},
+		{"too far behind", now - 31, rejectTimestampTooFarBehind},
+		{"valid", now - 9, ""},
+		{"at max skew", now + 30, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := now - 10
+			if tc.reason == rejectTimestampTooFarBehind {
+				parent = now - 40
+			}
+			e, signer, _ := newTimestampTestEngine(t, parent)
+			prop, err := e.ProposeBlock()
+			if err != nil {
+				t.Fatalf("propose: %v", err)
+			}
+			prop.Block.Timestamp = tc.ts
+			// The state records the block time, so the root follows it.
+			prop.Block.StateRoot, _ = e.state.PreviewBlock(prop.Block, e.contracts)
+			msg, _ := ProposalSignBytes(prop)
+			prop.ProposerSig, _ = signer.Sign(msg)
+
+			var before float64
+			if tc.reason != "" {
+				before = testutil.ToFloat64(proposalsRejected.WithLabelValues(tc.reason))
+			}
+			_, err = e.HandleProposal(prop)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("valid timestamp rejected: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("timestamp %d accepted", tc.ts)
+			}
+			if got := testutil.ToFloat64(proposalsRejected.WithLabelValues(tc.reason)); got != before+1 {
+				t.Fatalf("%s rejections went from %v to %v", tc.reason, before, got)
+			}
+			if _, _, voted := e.Status(); voted {
+				t.Fatalf("voted for a rejected proposal")
+			}
+		})
+	}
+}
+
+func TestTimestampMustFollowMedian(t *testing.T) {
+	window := []int64{300, 400, 150}
+	err := checkChainTimestamp(200, window)
+	if tsErr, ok := err.(*timestampError); !ok || tsErr.reason != rejectTimestampNotAfterMedian {
+		t.Fatalf("expected median rejection, got %v", err)
+	}
+	if err := checkChainTimestamp(301, window); err != nil {
+		t.Fatalf("timestamp after median rejected: %v", err)
+	}
+}
+
+func TestProposerStampsPastParent(t *testing.T) {
+	e, _, clock := newTimestampTestEngine(t, newFakeClock().Now().Unix()+5)
+	prop, err := e.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if want := clock.Now().Unix() + 6; prop.Block.Timestamp != want {
+		t.Fatalf("timestamp %d, want %d", prop.Block.Timestamp, want)
+	}
+	if _, err := e.HandleProposal(prop); err != nil {
+		t.Fatalf("own proposal rejected: %v", err)
+	}
+
+	// A proposer whose clock is too far behind the chain does not propose.
+	e, _, clock = newTimestampTestEngine(t, newFakeClock().Now().Unix()+60)
+	if _, err := e.ProposeBlock(); err == nil {
+		t.Fatalf("proposed a block stamped beyond the allowed skew")
+	}
+	clock.Advance(time.Minute)
+	if _, err := e.ProposeBlock(); err != nil {
+		t.Fatalf("propose after clock caught up: %v", err)
+	}
+}
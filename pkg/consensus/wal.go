@@ -0,0 +1,452 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// The consensus WAL durably records every proposal, vote and view change this
+// validator signs before it leaves the process. Each record is framed as
+//
+//	length (4 bytes) | crc32c of body (4 bytes) | body = type (1 byte) | message
+//
+// A record cut short at the end of the file is a write torn by a crash; its
+// message was never broadcast, so it is dropped on open. Any other damage is
+// reported as a WALCorruptError and must be repaired with RepairWAL.
+
+const (
+	walProposal   byte = 1
+	walVote       byte = 2
+	walViewChange byte = 3
+
+	walHeaderSize = 8
+	maxWALRecord  = 32 << 20
+	// walCompactAfter is how many records accumulate before records for
+	// committed heights are dropped.
+	walCompactAfter = 1024
+)
+
+var walCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// WALPath returns the location of the consensus WAL in a node home directory.
+func WALPath(home string) string {
+	return filepath.Join(home, "consensus", "wal")
+}
+
+// WALRecord is one signed message. Exactly one field is set.
+type WALRecord struct {
+	Proposal   *types.Proposal
+	Vote       *types.PrecommitVote
+	ViewChange *types.ViewChange
+}
+
+// height returns the height the recorded message was signed for.
+func (r *WALRecord) height() uint64 {
+	switch {
+	case r.Proposal != nil:
+		return r.Proposal.Block.Height
+	case r.Vote != nil:
+		return r.Vote.Height
+	default:
+		return r.ViewChange.Height
+	}
+}
+
+// WALCorruptError reports damaged WAL data at Offset. Everything before Offset is intact.
+type WALCorruptError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *WALCorruptError) Error() string {
+	return fmt.Sprintf("consensus wal %s corrupt at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *WALCorruptError) Unwrap() error { return e.Err }
+
+var errTornRecord = errors.New("torn record")
+
+// WAL is an append-only, fsynced log of signed consensus messages.
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	records []*WALRecord
+}
+
+// OpenWAL opens or creates the WAL at path and loads its records. A torn
+// final record is truncated away; other corruption is returned as a
+// *WALCorruptError and the WAL is not opened.
+func OpenWAL(path string) (*WAL, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create wal dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+	records, end, err := readWAL(f)
+	if errors.Is(err, errTornRecord) {
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("truncate torn wal record: %w", err)
+		}
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		var corrupt *WALCorruptError
+		if errors.As(err, &corrupt) {
+			corrupt.Path = path
+		}
+		return nil, err
+	}
+	return &WAL{path: path, f: f, records: records}, nil
+}
+
+// RepairWAL truncates the WAL at path after its last intact record, keeping a
+// copy of the original as path+".corrupt". It returns how many bytes were dropped.
+func RepairWAL(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("open wal: %w", err)
+	}
+	defer f.Close()
+	_, end, err := readWAL(f)
+	if err == nil {
+		return 0, nil
+	}
+	var corrupt *WALCorruptError
+	if !errors.Is(err, errTornRecord) && !errors.As(err, &corrupt) {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := copyFile(path, path+".corrupt"); err != nil {
+		return 0, fmt.Errorf("back up wal: %w", err)
+	}
+	if err := f.Truncate(end); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return info.Size() - end, nil
+}
+
+// Records returns the records loaded on open followed by those written since.
+func (w *WAL) Records() []*WALRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*WALRecord(nil), w.records...)
+}
+
+// Len returns the number of records in the WAL.
+func (w *WAL) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.records)
+}
+
+// Write appends rec and syncs it to disk before returning.
+func (w *WAL) Write(rec *WALRecord) error {
+	frame, err := encodeWALRecord(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.Write(frame); err != nil {
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	w.records = append(w.records, rec)
+	return nil
+}
+
+// Compact rewrites the WAL without records at or below committed height. The
+// new log is synced and atomically renamed over the old one.
+func (w *WAL) Compact(committed uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var kept []*WALRecord
+	var buf []byte
+	for _, rec := range w.records {
+		if rec.height() <= committed {
+			continue
+		}
+		frame, err := encodeWALRecord(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, frame...)
+		kept = append(kept, rec)
+	}
+	tmp := w.path + ".tmp"
+	if err := writeFileSync(tmp, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return fmt.Errorf("replace wal: %w", err)
+	}
+	if err := syncDir(filepath.Dir(w.path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen wal: %w", err)
+	}
+	w.f.Close()
+	w.f = f
+	w.records = kept
+	return nil
+}
+
+// Close closes the WAL file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+func encodeWALRecord(rec *WALRecord) ([]byte, error) {
+	var typ byte
+	var msg []byte
+	var err error
+	switch {
+	case rec.Proposal != nil:
+		typ = walProposal
+		msg, err = encoding.MarshalProposal(rec.Proposal)
+	case rec.Vote != nil:
+		typ = walVote
+		msg, err = encoding.MarshalPrecommitVote(rec.Vote)
+	case rec.ViewChange != nil:
+		typ = walViewChange
+		msg, err = encoding.MarshalViewChange(rec.ViewChange)
+	default:
+		return nil, fmt.Errorf("empty wal record")
+	}
+	if err != nil {
+		return nil, err
+	}
+	body := append([]byte{typ}, msg...)
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(body, walCRC))
+	return append(frame, body...), nil
+}
+
+func decodeWALRecord(body []byte) (*WALRecord, error) {
+	if len(body) < 1 {
+		return nil, fmt.Errorf("empty record")
+	}
+	msg := body[1:]
+	switch body[0] {
+	case walProposal:
+		p, err := encoding.UnmarshalProposal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if p.Block == nil {
+			return nil, fmt.Errorf("proposal without block")
+		}
+		return &WALRecord{Proposal: p}, nil
+	case walVote:
+		v, err := encoding.UnmarshalPrecommitVote(msg)
+		if err != nil {
+			return nil, err
+		}
+		return &WALRecord{Vote: v}, nil
+	case walViewChange:
+		vc, err := encoding.UnmarshalViewChange(msg)
+		if err != nil {
+			return nil, err
+		}
+		return &WALRecord{ViewChange: vc}, nil
+	default:
+		return nil, fmt.Errorf("unknown record type %d", body[0])
+	}
+}
+
+// readWAL decodes records from the start of f. It returns the records and the
+// offset just past the last intact one, with errTornRecord when the file ends
+// inside a record or a *WALCorruptError when a record is damaged.
+func readWAL(f *os.File) ([]*WALRecord, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read wal: %w", err)
+	}
+	var records []*WALRecord
+	var off int64
+	for int(off) < len(data) {
+		rest := data[off:]
+		if len(rest) < walHeaderSize {
+			return records, off, errTornRecord
+		}
+		size := binary.BigEndian.Uint32(rest[0:4])
+		if size == 0 || size > maxWALRecord {
+			return records, off, &WALCorruptError{Offset: off, Err: fmt.Errorf("invalid record size %d", size)}
+		}
+		if len(rest) < walHeaderSize+int(size) {
+			return records, off, errTornRecord
+		}
+		body := rest[walHeaderSize : walHeaderSize+int(size)]
+		if crc32.Checksum(body, walCRC) != binary.BigEndian.Uint32(rest[4:8]) {
+			return records, off, &WALCorruptError{Offset: off, Err: fmt.Errorf("checksum mismatch")}
+		}
+		rec, err := decodeWALRecord(body)
+		if err != nil {
+			return records, off, &WALCorruptError{Offset: off, Err: err}
+		}
+		records = append(records, rec)
+		off += int64(walHeaderSize) + int64(size)
+	}
+	return records, off, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(dst, data)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// signProposalLocked signs prop and logs it to the WAL. It refuses to sign a
+// different block for a view this validator already proposed in.
+func (e *Engine) signProposalLocked(prop *types.Proposal) error {
+	key := viewKey{validator: e.validatorAddress(), height: prop.Block.Height, round: prop.Round}
+	if prev, ok := e.signedProposals[key]; ok && mustHashBlock(prev.Block) != mustHashBlock(prop.Block) {
+		return fmt.Errorf("already proposed a different block at height %d round %d", key.height, key.round)
+	}
+	msg, err := ProposalSignBytes(prop)
+	if err != nil {
+		return err
+	}
+	sig, err := e.signer.Sign(msg)
+	if err != nil {
+		return err
+	}
+	prop.ProposerSig = sig
+	if err := e.logSignedLocked(&WALRecord{Proposal: prop}); err != nil {
+		return err
+	}
+	e.signedProposals[key] = prop
+	return nil
+}
+
+// signVoteLocked signs vote and logs it to the WAL. It refuses to sign a vote
+// for a different block in a view this validator already voted in.
+func (e *Engine) signVoteLocked(vote *types.PrecommitVote) error {
+	key := viewKey{validator: vote.Validator, height: vote.Height, round: vote.Round}
+	if prev, ok := e.signedVotes[key]; ok && prev.BlockHash != vote.BlockHash {
+		return fmt.Errorf("already voted for a different block at height %d round %d", key.height, key.round)
+	}
+	msg, err := PrecommitSignBytes(vote)
+	if err != nil {
+		return err
+	}
+	sig, err := e.signer.Sign(msg)
+	if err != nil {
+		return err
+	}
+	vote.Signature = sig
+	if err := e.logSignedLocked(&WALRecord{Vote: vote}); err != nil {
+		return err
+	}
+	e.signedVotes[key] = vote
+	return nil
+}
+
+// signViewChangeLocked signs vc and logs it to the WAL.
+func (e *Engine) signViewChangeLocked(vc *types.ViewChange) error {
+	msg, err := ViewChangeSignBytes(vc)
+	if err != nil {
+		return err
+	}
+	sig, err := e.signer.Sign(msg)
+	if err != nil {
+		return err
+	}
+	vc.Signature = sig
+	return e.logSignedLocked(&WALRecord{ViewChange: vc})
+}
+
+func (e *Engine) logSignedLocked(rec *WALRecord) error {
+	if e.wal == nil {
+		return nil
+	}
+	return e.wal.Write(rec)
+}
+
+// replayWALLocked restores what this validator signed before a restart: the
+// proposals and votes per view, and the highest view it voted or timed out in.
+func (e *Engine) replayWALLocked() {
+	for _, rec := range e.wal.Records() {
+		var height, round uint64
+		switch {
+		case rec.Proposal != nil:
+			key := viewKey{validator: e.validatorAddress(), height: rec.Proposal.Block.Height, round: rec.Proposal.Round}
+			e.signedProposals[key] = rec.Proposal
+			continue
+		case rec.Vote != nil:
+			e.signedVotes[viewKey{validator: rec.Vote.Validator, height: rec.Vote.Height, round: rec.Vote.Round}] = rec.Vote
+			height, round = rec.Vote.Height, rec.Vote.Round
+		default:
+			height, round = rec.ViewChange.Height, rec.ViewChange.Round
+		}
+		if e.canVoteLocked(height, round) {
+			e.hasVoted, e.lastVoteH, e.lastVoteR = true, height, round
+		}
+	}
+}
+
+// compactWALLocked drops WAL records for committed heights once enough have piled up.
+func (e *Engine) compactWALLocked() error {
+	if e.wal == nil || e.wal.Len() < walCompactAfter {
+		return nil
+	}
+	return e.wal.Compact(e.height)
+}
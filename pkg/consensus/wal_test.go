@@ -0,0 +1,115 @@
+package consensus
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestWALPreventsDoubleSignAfterRestart(t *testing.T) {
+	signer := newTestSigner(1)
+	newDPoS := func() *DPoS {
+		dpos := NewDPoS(1, 10)
+		if err := dpos.RegisterValidator("val0", signer.PublicKey(), 100, 0); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		return dpos
+	}
+	cfg := Config{BlockMaxTxs: 10, MinStake: 1, WALPath: WALPath(t.TempDir())}
+
+	e := newTestEngineWithConfig(t, cfg, signer, "val0", newDPoS())
+	prop, err := e.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if _, err := e.HandleProposal(prop); err != nil {
+		t.Fatalf("vote: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// The restarted validator has lost its in-memory state but not its WAL.
+	restarted := newTestEngineWithConfig(t, cfg, signer, "val0", newDPoS())
+	t.Cleanup(func() { _ = restarted.Close() })
+	if _, _, voted := restarted.Status(); !voted {
+		t.Fatalf("expected the vote at height 1 round 0 to be restored")
+	}
+	again, err := restarted.ProposeBlock()
+	if err != nil {
+		t.Fatalf("propose after restart: %v", err)
+	}
+	if mustHashBlock(again.Block) != mustHashBlock(prop.Block) {
+		t.Fatalf("re-proposed a different block in the same view")
+	}
+	if _, err := restarted.HandleProposal(again); err == nil {
+		t.Fatalf("expected no second vote in the same view")
+	}
+	restarted.mu.Lock()
+	err = restarted.signVoteLocked(&types.PrecommitVote{BlockHash: types.Hash{9}, Height: 1, Round: 0, Validator: "val0"})
+	restarted.mu.Unlock()
+	if err == nil {
+		t.Fatalf("expected a conflicting vote to be refused")
+	}
+}
+
+func TestWALTornAndCorruptRecords(t *testing.T) {
+	path := WALPath(t.TempDir())
+	w, err := OpenWAL(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for r := uint64(0); r < 3; r++ {
+		if err := w.Write(&WALRecord{Vote: &types.PrecommitVote{Height: 1, Round: r, Validator: "val0", Signature: []byte{1}}}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	intact, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// A record torn by a crash is dropped on open.
+	if err := os.WriteFile(path, append(append([]byte(nil), intact...), 0, 0, 0, 40, 1), 0o600); err != nil {
+		t.Fatalf("write torn: %v", err)
+	}
+	w, err = OpenWAL(path)
+	if err != nil {
+		t.Fatalf("open torn wal: %v", err)
+	}
+	if w.Len() != 3 {
+		t.Fatalf("expected 3 records, got %d", w.Len())
+	}
+	_ = w.Close()
+
+	// Damage in the middle refuses to open until repaired.
+	damaged := append([]byte(nil), intact...)
+	damaged[len(damaged)-2] ^= 0xff
+	if err := os.WriteFile(path, damaged, 0o600); err != nil {
+		t.Fatalf("write damaged: %v", err)
+	}
+	var corrupt *WALCorruptError
+	if _, err := OpenWAL(path); !errors.As(err, &corrupt) {
+		t.Fatalf("expected corruption error, got %v", err)
+	}
+	dropped, err := RepairWAL(path)
+	if err != nil || dropped == 0 {
+		t.Fatalf("repair: dropped %d, %v", dropped, err)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Fatalf("expected backup of damaged wal: %v", err)
+	}
+	w, err = OpenWAL(path)
+	if err != nil {
+		t.Fatalf("open repaired wal: %v", err)
+	}
+	defer w.Close()
+	if w.Len() != 2 {
+		t.Fatalf("expected the 2 intact records, got %d", w.Len())
+	}
+}
@@ -3,8 +3,10 @@ package crypto
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 type keyFile struct {
@@ -85,3 +87,22 @@ func LoadEd25519(path string) (*Ed25519KeyPair, error) {
 	}
 	return &Ed25519KeyPair{PublicKey: pub, PrivateKey: priv}, nil
 }
+
+// LoadOrCreateEd25519 loads an Ed25519 keypair from disk, generating and
+// saving a new one if the file does not exist.
+func LoadOrCreateEd25519(path string) (*Ed25519KeyPair, error) {
+	kp, err := LoadEd25519(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return kp, err
+	}
+	if kp, err = GenerateEd25519(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := SaveEd25519(path, kp); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
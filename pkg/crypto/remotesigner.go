@@ -0,0 +1,410 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A remote signer holds the validator key in a separate process and signs for
+// the node over a Unix or TCP socket. Both ends hold an Ed25519 identity key
+// and only talk to peers whose identity they were configured with.
+//
+// A connection starts with an X25519 exchange of ephemeral keys. Each side
+// derives a ChaCha20-Poly1305 key per direction from the shared secret and
+// then sends, encrypted, its identity key and a signature over the handshake
+// transcript. Every later frame is
+//
+//	length (4 bytes) | sealed body, nonce = per-direction frame counter
+//
+// where a request body is type (1 byte) | message, and a response body is
+// status (1 byte) | public key, signature or error text.
+
+const (
+	signerReqPubKey byte = 1
+	signerReqSign   byte = 2
+
+	signerStatusOK    byte = 0
+	signerStatusError byte = 1
+
+	maxSignerFrame = 32 << 20
+	// DefaultSignerTimeout bounds a handshake or a request round trip.
+	DefaultSignerTimeout = 5 * time.Second
+)
+
+var signerProtocol = []byte("opencoin-remote-signer-v1")
+
+// ParseSignerAddr splits a signer address of the form unix:///path/to/socket
+// or tcp://host:port into a network and an address for net.Dial.
+func ParseSignerAddr(addr string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	default:
+		return "", "", fmt.Errorf("signer address %q must start with unix:// or tcp://", addr)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("signer address %q has no path or host", addr)
+	}
+	return network, address, nil
+}
+
+// signerConn is an authenticated, encrypted connection to the other end.
+type signerConn struct {
+	conn       net.Conn
+	send, recv cipher.AEAD
+	sendN      uint64
+	recvN      uint64
+}
+
+// handshakeSigner runs the handshake on conn. The dialing side is the client.
+// authorized reports whether a peer identity is allowed to connect.
+func handshakeSigner(conn net.Conn, client bool, identity ed25519.PrivateKey, authorized func(ed25519.PublicKey) bool) (*signerConn, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	local := eph.PublicKey().Bytes()
+	if _, err := conn.Write(local); err != nil {
+		return nil, fmt.Errorf("send ephemeral key: %w", err)
+	}
+	remote := make([]byte, len(local))
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, fmt.Errorf("read ephemeral key: %w", err)
+	}
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(remoteKey)
+	if err != nil {
+		return nil, err
+	}
+	clientEph, serverEph := local, remote
+	if !client {
+		clientEph, serverEph = remote, local
+	}
+	transcript := sha256.Sum256(bytes.Join([][]byte{signerProtocol, clientEph, serverEph}, nil))
+	keys, err := hkdf.Key(sha256.New, shared, transcript[:], string(signerProtocol), 2*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	clientKey, serverKey := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:]
+	sc := &signerConn{conn: conn}
+	sendKey, recvKey := clientKey, serverKey
+	if !client {
+		sendKey, recvKey = serverKey, clientKey
+	}
+	if sc.send, err = chacha20poly1305.New(sendKey); err != nil {
+		return nil, err
+	}
+	if sc.recv, err = chacha20poly1305.New(recvKey); err != nil {
+		return nil, err
+	}
+
+	role := func(isClient bool) []byte {
+		if isClient {
+			return append(transcript[:], "client"...)
+		}
+		return append(transcript[:], "server"...)
+	}
+	pub := identity.Public().(ed25519.PublicKey)
+	auth := append(append([]byte{}, pub...), ed25519.Sign(identity, role(client))...)
+	if err := sc.writeFrame(auth); err != nil {
+		return nil, fmt.Errorf("send identity: %w", err)
+	}
+	peerAuth, err := sc.readFrame()
+	if err != nil {
+		return nil, fmt.Errorf("read identity: %w", err)
+	}
+	if len(peerAuth) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid identity message")
+	}
+	peer := ed25519.PublicKey(peerAuth[:ed25519.PublicKeySize])
+	if !ed25519.Verify(peer, role(!client), peerAuth[ed25519.PublicKeySize:]) {
+		return nil, fmt.Errorf("peer failed to prove its identity")
+	}
+	if !authorized(peer) {
+		return nil, fmt.Errorf("peer identity %x is not authorized", []byte(peer))
+	}
+	return sc, nil
+}
+
+func frameNonce(n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+func (c *signerConn) writeFrame(body []byte) error {
+	if c.sendN == ^uint64(0) {
+		return fmt.Errorf("frame counter exhausted")
+	}
+	sealed := c.send.Seal(nil, frameNonce(c.sendN), body, nil)
+	c.sendN++
+	if len(sealed) > maxSignerFrame {
+		return fmt.Errorf("frame too large: %d bytes", len(sealed))
+	}
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	_, err := c.conn.Write(append(frame, sealed...))
+	return err
+}
+
+func (c *signerConn) readFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxSignerFrame {
+		return nil, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, sealed); err != nil {
+		return nil, err
+	}
+	if c.recvN == ^uint64(0) {
+		return nil, fmt.Errorf("frame counter exhausted")
+	}
+	body, err := c.recv.Open(nil, frameNonce(c.recvN), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("frame authentication failed")
+	}
+	c.recvN++
+	return body, nil
+}
+
+// RemoteSignerConfig configures a connection to a remote signer.
+type RemoteSignerConfig struct {
+	// Addr is unix:///path/to/socket or tcp://host:port.
+	Addr string
+	// Identity is the key this node authenticates with.
+	Identity ed25519.PrivateKey
+	// SignerKey is the identity key the signer must present.
+	SignerKey ed25519.PublicKey
+	// Timeout bounds a handshake or a request; DefaultSignerTimeout when zero.
+	Timeout time.Duration
+}
+
+// RemoteSigner implements Signer by forwarding signing requests to a remote
+// signer process. A broken connection is redialled on the next request.
+type RemoteSigner struct {
+	cfg       RemoteSignerConfig
+	network   string
+	address   string
+	publicKey []byte
+
+	mu   sync.Mutex
+	conn *signerConn
+}
+
+// DialRemoteSigner connects to the signer and fetches the validator public key.
+func DialRemoteSigner(cfg RemoteSignerConfig) (*RemoteSigner, error) {
+	network, address, err := ParseSignerAddr(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Identity) != ed25519.PrivateKeySize || len(cfg.SignerKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("remote signer requires an ed25519 identity and signer key")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultSignerTimeout
+	}
+	rs := &RemoteSigner{cfg: cfg, network: network, address: address}
+	pub, err := rs.request(signerReqPubKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	rs.publicKey = pub
+	return rs, nil
+}
+
+// Sign asks the remote signer to sign message.
+func (rs *RemoteSigner) Sign(message []byte) ([]byte, error) {
+	return rs.request(signerReqSign, message)
+}
+
+// PublicKey returns the validator public key held by the remote signer.
+func (rs *RemoteSigner) PublicKey() []byte {
+	return rs.publicKey
+}
+
+// Close closes the connection to the signer.
+func (rs *RemoteSigner) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.conn == nil {
+		return nil
+	}
+	err := rs.conn.conn.Close()
+	rs.conn = nil
+	return err
+}
+
+// request performs one round trip, redialling once if the connection broke.
+// Repeating a signing request is safe: the signer answers an identical request
+// with the signature it already produced.
+func (rs *RemoteSigner) request(typ byte, body []byte) ([]byte, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if rs.conn == nil {
+			if rs.conn, err = rs.dial(); err != nil {
+				continue
+			}
+		}
+		var resp []byte
+		resp, err = rs.roundTrip(typ, body)
+		if err != nil {
+			_ = rs.conn.conn.Close()
+			rs.conn = nil
+			continue
+		}
+		if len(resp) == 0 {
+			return nil, fmt.Errorf("remote signer: empty response")
+		}
+		if resp[0] != signerStatusOK {
+			return nil, fmt.Errorf("remote signer: %s", resp[1:])
+		}
+		return resp[1:], nil
+	}
+	return nil, fmt.Errorf("remote signer %s: %w", rs.cfg.Addr, err)
+}
+
+func (rs *RemoteSigner) dial() (*signerConn, error) {
+	conn, err := net.DialTimeout(rs.network, rs.address, rs.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(rs.cfg.Timeout))
+	sc, err := handshakeSigner(conn, true, rs.cfg.Identity, func(peer ed25519.PublicKey) bool {
+		return peer.Equal(rs.cfg.SignerKey)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (rs *RemoteSigner) roundTrip(typ byte, body []byte) ([]byte, error) {
+	_ = rs.conn.conn.SetDeadline(time.Now().Add(rs.cfg.Timeout))
+	if err := rs.conn.writeFrame(append([]byte{typ}, body...)); err != nil {
+		return nil, err
+	}
+	return rs.conn.readFrame()
+}
+
+// SignerServer serves signing requests from authorized nodes. Requests are
+// handled one at a time, so the signer sees them in a single order.
+type SignerServer struct {
+	signer   Signer
+	identity ed25519.PrivateKey
+	clients  []ed25519.PublicKey
+	timeout  time.Duration
+
+	mu sync.Mutex
+}
+
+// NewSignerServer creates a server signing with signer for the given clients.
+func NewSignerServer(signer Signer, identity ed25519.PrivateKey, clients []ed25519.PublicKey) *SignerServer {
+	return &SignerServer{signer: signer, identity: identity, clients: clients, timeout: DefaultSignerTimeout}
+}
+
+// ListenSigner listens on a signer address, replacing a stale Unix socket.
+func ListenSigner(addr string) (net.Listener, error) {
+	network, address, err := ParseSignerAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// Serve accepts connections until l is closed.
+func (s *SignerServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SignerServer) authorized(peer ed25519.PublicKey) bool {
+	for _, c := range s.clients {
+		if peer.Equal(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SignerServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	sc, err := handshakeSigner(conn, false, s.identity, s.authorized)
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	for {
+		req, err := sc.readFrame()
+		if err != nil {
+			return
+		}
+		if err := sc.writeFrame(s.handle(req)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *SignerServer) handle(req []byte) []byte {
+	fail := func(err error) []byte {
+		return append([]byte{signerStatusError}, err.Error()...)
+	}
+	if len(req) == 0 {
+		return fail(fmt.Errorf("empty request"))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req[0] {
+	case signerReqPubKey:
+		return append([]byte{signerStatusOK}, s.signer.PublicKey()...)
+	case signerReqSign:
+		sig, err := s.signer.Sign(req[1:])
+		if err != nil {
+			return fail(err)
+		}
+		return append([]byte{signerStatusOK}, sig...)
+	default:
+		return fail(fmt.Errorf("unknown request type %d", req[0]))
+	}
+}
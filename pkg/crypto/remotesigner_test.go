@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ed25519Signer lets the tests run without the CGO Dilithium build.
+type ed25519Signer struct {
+	kp *Ed25519KeyPair
+}
+
+func (s *ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	if bytes.HasPrefix(msg, []byte("refuse")) {
+		return nil, fmt.Errorf("refused")
+	}
+	return SignEd25519(s.kp.PrivateKey, msg)
+}
+
+func (s *ed25519Signer) PublicKey() []byte { return s.kp.PublicKey }
+
+type signerFixture struct {
+	addr      string
+	validator *Ed25519KeyPair
+	server    *Ed25519KeyPair
+	client    *Ed25519KeyPair
+}
+
+func mustEd25519(t *testing.T) *Ed25519KeyPair {
+	t.Helper()
+	kp, err := GenerateEd25519()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return kp
+}
+
+func startSigner(t *testing.T) *signerFixture {
+	t.Helper()
+	f := &signerFixture{
+		addr:      "unix://" + filepath.Join(t.TempDir(), "signer.sock"),
+		validator: mustEd25519(t),
+		server:    mustEd25519(t),
+		client:    mustEd25519(t),
+	}
+	f.serve(t)
+	return f
+}
+
+func (f *signerFixture) serve(t *testing.T) {
+	t.Helper()
+	l, err := ListenSigner(f.addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	server := NewSignerServer(&ed25519Signer{f.validator}, f.server.PrivateKey, []ed25519.PublicKey{f.client.PublicKey})
+	go func() { _ = server.Serve(l) }()
+}
+
+func (f *signerFixture) dial(identity ed25519.PrivateKey, signerKey ed25519.PublicKey) (*RemoteSigner, error) {
+	return DialRemoteSigner(RemoteSignerConfig{Addr: f.addr, Identity: identity, SignerKey: signerKey, Timeout: time.Second})
+}
+
+func TestRemoteSignerSigns(t *testing.T) {
+	f := startSigner(t)
+	rs, err := f.dial(f.client.PrivateKey, f.server.PublicKey)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer rs.Close()
+	if !bytes.Equal(rs.PublicKey(), f.validator.PublicKey) {
+		t.Fatalf("public key mismatch")
+	}
+	msg := []byte("vote")
+	sig, err := rs.Sign(msg)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if !VerifyEd25519(f.validator.PublicKey, msg, sig) {
+		t.Fatalf("invalid signature")
+	}
+	if _, err := rs.Sign([]byte("refuse this")); err == nil {
+		t.Fatalf("expected the signer's refusal to be returned")
+	}
+	// The connection stays usable after a refusal.
+	if _, err := rs.Sign(msg); err != nil {
+		t.Fatalf("sign after refusal: %v", err)
+	}
+}
+
+func TestRemoteSignerAuthenticatesBothEnds(t *testing.T) {
+	f := startSigner(t)
+	stranger := mustEd25519(t)
+	if _, err := f.dial(stranger.PrivateKey, f.server.PublicKey); err == nil {
+		t.Fatalf("signer accepted an unauthorized node")
+	}
+	if _, err := f.dial(f.client.PrivateKey, stranger.PublicKey); err == nil {
+		t.Fatalf("node accepted a signer with the wrong identity")
+	}
+}
+
+func TestRemoteSignerRedials(t *testing.T) {
+	f := startSigner(t)
+	rs, err := f.dial(f.client.PrivateKey, f.server.PublicKey)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer rs.Close()
+	// Drop the connection under the client, as a signer restart would.
+	rs.mu.Lock()
+	_ = rs.conn.conn.Close()
+	rs.mu.Unlock()
+	if _, err := rs.Sign([]byte("vote")); err != nil {
+		t.Fatalf("sign after reconnect: %v", err)
+	}
+}
+
+func TestParseSignerAddr(t *testing.T) {
+	for addr, want := range map[string][2]string{
+		"unix:///run/signer.sock": {"unix", "/run/signer.sock"},
+		"tcp://127.0.0.1:26659":   {"tcp", "127.0.0.1:26659"},
+	} {
+		network, address, err := ParseSignerAddr(addr)
+		if err != nil || network != want[0] || address != want[1] {
+			t.Fatalf("%s: got %s %s %v", addr, network, address, err)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:26659", "tcp://", "http://host"} {
+		if _, _, err := ParseSignerAddr(addr); err == nil {
+			t.Fatalf("accepted %q", addr)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package encoding
 import (
 	"crypto/sha256"
 	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
 
 	"github.com/georgecane/opencoin/pkg/types"
 )
@@ -85,6 +88,49 @@ func HashViewChange(vc *types.ViewChange) (types.Hash, error) {
 	return HashBytes(b), nil
 }
 
+// HashValidatorSet commits to the signing keys and voting power of a validator
+// set, in index order. Staking details such as delegations are not covered.
+func HashValidatorSet(set *types.ValidatorSet) (types.Hash, error) {
+	if set == nil {
+		return types.Hash{}, fmt.Errorf("validator set is nil")
+	}
+	var b []byte
+	for _, v := range set.Validators {
+		b = protowire.AppendBytes(b, []byte(v.OperatorAddress))
+		b = protowire.AppendBytes(b, v.ConsensusPubKey)
+		b = protowire.AppendVarint(b, v.Power)
+	}
+	return HashBytes(b), nil
+}
+
+// HashProposerPriorities commits to the proposer priorities that elect the
+// proposer of height, in address order.
+func HashProposerPriorities(height uint64, priorities map[types.Address]int64) types.Hash {
+	addrs := make([]string, 0, len(priorities))
+	for addr := range priorities {
+		addrs = append(addrs, string(addr))
+	}
+	sort.Strings(addrs)
+	b := protowire.AppendVarint(nil, height)
+	for _, addr := range addrs {
+		b = protowire.AppendBytes(b, []byte(addr))
+		b = protowire.AppendVarint(b, uint64(priorities[types.Address(addr)]))
+	}
+	return HashBytes(b)
+}
+
+// EvidenceID identifies the offense proven by evidence: the offender and the
+// height. Equivocating in several rounds of a height is one offense, so all
+// evidence for it shares an ID and the validator is only punished once.
+func EvidenceID(ev *types.DuplicateVoteEvidence) (types.Hash, error) {
+	if ev == nil {
+		return types.Hash{}, fmt.Errorf("evidence is nil")
+	}
+	b := []byte(ev.Validator)
+	b = append(b, MarshalUint64(ev.Height)...)
+	return HashBytes(b), nil
+}
+
 // HashBytesOrErr wraps HashBytes to satisfy interfaces needing error.
 func HashBytesOrErr(data []byte, err error) (types.Hash, error) {
 	if err != nil {
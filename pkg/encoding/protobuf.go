@@ -3,6 +3,7 @@ package encoding
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
 
 	"google.golang.org/protobuf/encoding/protowire"
 
@@ -56,7 +57,11 @@ func MarshalBlock(block *types.Block) ([]byte, error) {
 		b = protowire.AppendTag(b, 7, protowire.BytesType)
 		b = protowire.AppendBytes(b, sig)
 	}
-	return b, nil
+	b, err := appendEvidence(b, block.Evidence)
+	if err != nil {
+		return nil, err
+	}
+	return appendLastCommit(appendValidatorsHashes(b, block), block.LastCommit)
 }
 
 // MarshalBlockForHash deterministically encodes a Block header for hashing.
@@ -84,6 +89,53 @@ func MarshalBlockForHash(block *types.Block) ([]byte, error) {
 		b = protowire.AppendTag(b, 6, protowire.BytesType)
 		b = protowire.AppendBytes(b, txBytes)
 	}
+	b, err := appendEvidence(b, block.Evidence)
+	if err != nil {
+		return nil, err
+	}
+	return appendLastCommit(appendValidatorsHashes(b, block), block.LastCommit)
+}
+
+// appendValidatorsHashes appends the hashes of the validator sets signing the
+// block and the next one, and of the proposer priorities electing the next
+// proposer. Unset hashes are left out.
+func appendValidatorsHashes(b []byte, block *types.Block) []byte {
+	if h := block.ValidatorsHash; h != (types.Hash{}) {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, h[:])
+	}
+	if h := block.NextValidatorsHash; h != (types.Hash{}) {
+		b = protowire.AppendTag(b, 11, protowire.BytesType)
+		b = protowire.AppendBytes(b, h[:])
+	}
+	if h := block.ProposerPrioritiesHash; h != (types.Hash{}) {
+		b = protowire.AppendTag(b, 12, protowire.BytesType)
+		b = protowire.AppendBytes(b, h[:])
+	}
+	return b
+}
+
+func appendLastCommit(b []byte, qc *types.QuorumCertificate) ([]byte, error) {
+	if qc == nil {
+		return b, nil
+	}
+	qcBytes, err := MarshalQuorumCertificate(qc)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, 10, protowire.BytesType)
+	return protowire.AppendBytes(b, qcBytes), nil
+}
+
+func appendEvidence(b []byte, evidence []*types.DuplicateVoteEvidence) ([]byte, error) {
+	for _, ev := range evidence {
+		evBytes, err := MarshalDuplicateVoteEvidence(ev)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, evBytes)
+	}
 	return b, nil
 }
 
@@ -120,6 +172,14 @@ func MarshalProposal(p *types.Proposal) ([]byte, error) {
 	b = protowire.AppendVarint(b, p.Round)
 	b = protowire.AppendTag(b, 3, protowire.BytesType)
 	b = protowire.AppendBytes(b, p.ProposerSig)
+	if p.Justify != nil {
+		qcBytes, err := MarshalQuorumCertificate(p.Justify)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, qcBytes)
+	}
 	return b, nil
 }
 
@@ -181,6 +241,211 @@ func MarshalViewChange(vc *types.ViewChange) ([]byte, error) {
 	b = protowire.AppendBytes(b, []byte(vc.Validator))
 	b = protowire.AppendTag(b, 4, protowire.BytesType)
 	b = protowire.AppendBytes(b, vc.Signature)
+	if vc.HighQC != nil {
+		qcBytes, err := MarshalQuorumCertificate(vc.HighQC)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, qcBytes)
+	}
+	return b, nil
+}
+
+// MarshalTimeoutCertificate deterministically encodes a TimeoutCertificate.
+func MarshalTimeoutCertificate(tc *types.TimeoutCertificate) ([]byte, error) {
+	if tc == nil {
+		return nil, fmt.Errorf("timeout certificate is nil")
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, tc.Height)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, tc.Round)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, tc.SigBitmap)
+	for _, sig := range tc.Signatures {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, sig)
+	}
+	if tc.HighQC != nil {
+		qcBytes, err := MarshalQuorumCertificate(tc.HighQC)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, qcBytes)
+	}
+	return b, nil
+}
+
+// MarshalDuplicateVoteEvidence deterministically encodes a DuplicateVoteEvidence.
+func MarshalDuplicateVoteEvidence(ev *types.DuplicateVoteEvidence) ([]byte, error) {
+	if ev == nil {
+		return nil, fmt.Errorf("evidence is nil")
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte(ev.Validator))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, ev.Height)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, ev.Round)
+	for i, v := range []*types.PrecommitVote{ev.VoteA, ev.VoteB} {
+		if v == nil {
+			continue
+		}
+		vb, err := MarshalPrecommitVote(v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, protowire.Number(4+i), protowire.BytesType)
+		b = protowire.AppendBytes(b, vb)
+	}
+	for i, p := range []*types.Proposal{ev.ProposalA, ev.ProposalB} {
+		if p == nil {
+			continue
+		}
+		pb, err := MarshalProposal(p)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, protowire.Number(6+i), protowire.BytesType)
+		b = protowire.AppendBytes(b, pb)
+	}
+	return b, nil
+}
+
+// MarshalValidator deterministically encodes a Validator. Delegations are
+// written in address order.
+func MarshalValidator(v *types.Validator) ([]byte, error) {
+	if v == nil {
+		return nil, fmt.Errorf("validator is nil")
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte(v.OperatorAddress))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, v.ConsensusPubKey)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, v.Power)
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, v.Stake)
+	delegators := make([]string, 0, len(v.Delegations))
+	for addr := range v.Delegations {
+		delegators = append(delegators, string(addr))
+	}
+	sort.Strings(delegators)
+	for _, addr := range delegators {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, []byte(addr))
+		entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, v.Delegations[types.Address(addr)])
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(v.Commission))
+	b = protowire.AppendTag(b, 7, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(v.Index))
+	if v.Jailed {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	b = protowire.AppendTag(b, 9, protowire.VarintType)
+	b = protowire.AppendVarint(b, v.JailedUntilEpoch)
+	if v.CommissionUpdateHeight != 0 {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, v.CommissionUpdateHeight)
+	}
+	return b, nil
+}
+
+// MarshalValidatorSet deterministically encodes a ValidatorSet in index order.
+func MarshalValidatorSet(set *types.ValidatorSet) ([]byte, error) {
+	if set == nil {
+		return nil, fmt.Errorf("validator set is nil")
+	}
+	var b []byte
+	for _, v := range set.Validators {
+		vb, err := MarshalValidator(v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, vb)
+	}
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, set.TotalPower)
+	return b, nil
+}
+
+// MarshalBlockRangeRequest deterministically encodes a BlockRangeRequest.
+func MarshalBlockRangeRequest(req *types.BlockRangeRequest) ([]byte, error) {
+	if req == nil {
+		return nil, fmt.Errorf("block range request is nil")
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, req.From)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(req.Count))
+	return b, nil
+}
+
+// MarshalSnapshotManifest deterministically encodes a SnapshotManifest.
+func MarshalSnapshotManifest(m *types.SnapshotManifest) ([]byte, error) {
+	if m == nil {
+		return nil, fmt.Errorf("snapshot manifest is nil")
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.Height)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Format))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.BlockHash[:])
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.StateRoot[:])
+	for _, h := range m.Chunks {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, h[:])
+	}
+	return b, nil
+}
+
+// MarshalSnapshotRequest deterministically encodes a SnapshotRequest.
+func MarshalSnapshotRequest(req *types.SnapshotRequest) ([]byte, error) {
+	if req == nil {
+		return nil, fmt.Errorf("snapshot request is nil")
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, req.Height)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(req.Index))
+	return b, nil
+}
+
+// MarshalCommittedBlock deterministically encodes a CommittedBlock.
+func MarshalCommittedBlock(cb *types.CommittedBlock) ([]byte, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("committed block is nil")
+	}
+	blockBytes, err := MarshalBlock(cb.Block)
+	if err != nil {
+		return nil, err
+	}
+	qcBytes, err := MarshalQuorumCertificate(cb.Commit)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, blockBytes)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, qcBytes)
 	return b, nil
 }
 
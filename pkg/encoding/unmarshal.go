@@ -169,6 +169,64 @@ func UnmarshalBlock(b []byte) (*types.Block, error) {
 			}
 			block.ValidatorSigs = append(block.ValidatorSigs, append([]byte(nil), v...))
 			b = b[n:]
+		case 8:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid evidence type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid evidence bytes")
+			}
+			ev, err := UnmarshalDuplicateVoteEvidence(v)
+			if err != nil {
+				return nil, err
+			}
+			block.Evidence = append(block.Evidence, ev)
+			b = b[n:]
+		case 9:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validators_hash type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 || len(v) != len(block.ValidatorsHash) {
+				return nil, fmt.Errorf("invalid validators_hash")
+			}
+			copy(block.ValidatorsHash[:], v)
+			b = b[n:]
+		case 10:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid last_commit type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid last_commit bytes")
+			}
+			qc, err := UnmarshalQuorumCertificate(v)
+			if err != nil {
+				return nil, err
+			}
+			block.LastCommit = qc
+			b = b[n:]
+		case 11:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid next_validators_hash type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 || len(v) != len(block.NextValidatorsHash) {
+				return nil, fmt.Errorf("invalid next_validators_hash")
+			}
+			copy(block.NextValidatorsHash[:], v)
+			b = b[n:]
+		case 12:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid proposer_priorities_hash type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 || len(v) != len(block.ProposerPrioritiesHash) {
+				return nil, fmt.Errorf("invalid proposer_priorities_hash")
+			}
+			copy(block.ProposerPrioritiesHash[:], v)
+			b = b[n:]
 		default:
 			n = protowire.ConsumeFieldValue(num, typ, b)
 			if n < 0 {
@@ -179,3 +237,839 @@ func UnmarshalBlock(b []byte) (*types.Block, error) {
 	}
 	return &block, nil
 }
+
+// UnmarshalProposal decodes a Proposal from protobuf wire format.
+func UnmarshalProposal(b []byte) (*types.Proposal, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty proposal")
+	}
+	var p types.Proposal
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid proposal tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid block type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid block bytes")
+			}
+			block, err := UnmarshalBlock(v)
+			if err != nil {
+				return nil, err
+			}
+			p.Block = block
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid round type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid round")
+			}
+			p.Round = v
+			b = b[n:]
+		case 3:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid proposer_sig type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid proposer_sig")
+			}
+			p.ProposerSig = append(p.ProposerSig[:0], v...)
+			b = b[n:]
+		case 4:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid justify type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid justify bytes")
+			}
+			qc, err := UnmarshalQuorumCertificate(v)
+			if err != nil {
+				return nil, err
+			}
+			p.Justify = qc
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid proposal field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &p, nil
+}
+
+// UnmarshalPrecommitVote decodes a PrecommitVote from protobuf wire format.
+func UnmarshalPrecommitVote(b []byte) (*types.PrecommitVote, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty precommit vote")
+	}
+	var v types.PrecommitVote
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid precommit vote tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid block_hash type")
+			}
+			val, n := protowire.ConsumeBytes(b)
+			if n < 0 || len(val) != len(v.BlockHash) {
+				return nil, fmt.Errorf("invalid block_hash")
+			}
+			copy(v.BlockHash[:], val)
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid height type")
+			}
+			val, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid height")
+			}
+			v.Height = val
+			b = b[n:]
+		case 3:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid round type")
+			}
+			val, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid round")
+			}
+			v.Round = val
+			b = b[n:]
+		case 4:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator type")
+			}
+			val, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator")
+			}
+			v.Validator = types.Address(string(val))
+			b = b[n:]
+		case 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid signature type")
+			}
+			val, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid signature")
+			}
+			v.Signature = append(v.Signature[:0], val...)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid precommit vote field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &v, nil
+}
+
+// UnmarshalQuorumCertificate decodes a QuorumCertificate from protobuf wire format.
+func UnmarshalQuorumCertificate(b []byte) (*types.QuorumCertificate, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty quorum certificate")
+	}
+	var qc types.QuorumCertificate
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid quorum certificate tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid block_hash type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 || len(v) != len(qc.BlockHash) {
+				return nil, fmt.Errorf("invalid block_hash")
+			}
+			copy(qc.BlockHash[:], v)
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid height type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid height")
+			}
+			qc.Height = v
+			b = b[n:]
+		case 3:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid round type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid round")
+			}
+			qc.Round = v
+			b = b[n:]
+		case 4:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid sig_bitmap type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid sig_bitmap")
+			}
+			qc.SigBitmap = append([]byte(nil), v...)
+			b = b[n:]
+		case 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid aggregated_sig type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid aggregated_sig")
+			}
+			qc.AggregatedSig = append([]byte(nil), v...)
+			b = b[n:]
+		case 6:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid sig type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid sig")
+			}
+			qc.Signatures = append(qc.Signatures, append([]byte(nil), v...))
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid quorum certificate field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &qc, nil
+}
+
+// UnmarshalViewChange decodes a ViewChange from protobuf wire format.
+func UnmarshalViewChange(b []byte) (*types.ViewChange, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty view change")
+	}
+	var vc types.ViewChange
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid view change tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid height type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid height")
+			}
+			vc.Height = v
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid round type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid round")
+			}
+			vc.Round = v
+			b = b[n:]
+		case 3:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator")
+			}
+			vc.Validator = types.Address(string(v))
+			b = b[n:]
+		case 4:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid signature type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid signature")
+			}
+			vc.Signature = append(vc.Signature[:0], v...)
+			b = b[n:]
+		case 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid high_qc type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid high_qc bytes")
+			}
+			qc, err := UnmarshalQuorumCertificate(v)
+			if err != nil {
+				return nil, err
+			}
+			vc.HighQC = qc
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid view change field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &vc, nil
+}
+
+// UnmarshalTimeoutCertificate decodes a TimeoutCertificate from protobuf wire format.
+func UnmarshalTimeoutCertificate(b []byte) (*types.TimeoutCertificate, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty timeout certificate")
+	}
+	var tc types.TimeoutCertificate
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid timeout certificate tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid height type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid height")
+			}
+			tc.Height = v
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid round type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid round")
+			}
+			tc.Round = v
+			b = b[n:]
+		case 3:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid sig_bitmap type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid sig_bitmap")
+			}
+			tc.SigBitmap = append([]byte(nil), v...)
+			b = b[n:]
+		case 4:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid sig type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid sig")
+			}
+			tc.Signatures = append(tc.Signatures, append([]byte(nil), v...))
+			b = b[n:]
+		case 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid high_qc type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid high_qc bytes")
+			}
+			qc, err := UnmarshalQuorumCertificate(v)
+			if err != nil {
+				return nil, err
+			}
+			tc.HighQC = qc
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid timeout certificate field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &tc, nil
+}
+
+// UnmarshalDuplicateVoteEvidence decodes a DuplicateVoteEvidence from protobuf wire format.
+func UnmarshalDuplicateVoteEvidence(b []byte) (*types.DuplicateVoteEvidence, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty evidence")
+	}
+	var ev types.DuplicateVoteEvidence
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid evidence tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator")
+			}
+			ev.Validator = types.Address(string(v))
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid height type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid height")
+			}
+			ev.Height = v
+			b = b[n:]
+		case 3:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid round type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid round")
+			}
+			ev.Round = v
+			b = b[n:]
+		case 4, 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid vote type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid vote bytes")
+			}
+			vote, err := UnmarshalPrecommitVote(v)
+			if err != nil {
+				return nil, err
+			}
+			if num == 4 {
+				ev.VoteA = vote
+			} else {
+				ev.VoteB = vote
+			}
+			b = b[n:]
+		case 6, 7:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid proposal type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid proposal bytes")
+			}
+			prop, err := UnmarshalProposal(v)
+			if err != nil {
+				return nil, err
+			}
+			if num == 6 {
+				ev.ProposalA = prop
+			} else {
+				ev.ProposalB = prop
+			}
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid evidence field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &ev, nil
+}
+
+// UnmarshalValidator decodes a Validator from protobuf wire format.
+func UnmarshalValidator(b []byte) (*types.Validator, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty validator")
+	}
+	v := types.Validator{Delegations: make(map[types.Address]uint64)}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid validator tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1, 2:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator field %d type", num)
+			}
+			val, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator field %d", num)
+			}
+			if num == 1 {
+				v.OperatorAddress = types.Address(string(val))
+			} else {
+				v.ConsensusPubKey = append([]byte(nil), val...)
+			}
+			b = b[n:]
+		case 3, 4, 6, 7, 8, 9, 10:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid validator field %d type", num)
+			}
+			val, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator field %d", num)
+			}
+			switch num {
+			case 3:
+				v.Power = val
+			case 4:
+				v.Stake = val
+			case 6:
+				v.Commission = uint16(val)
+			case 7:
+				v.Index = uint32(val)
+			case 8:
+				v.Jailed = val != 0
+			case 9:
+				v.JailedUntilEpoch = val
+			case 10:
+				v.CommissionUpdateHeight = val
+			}
+			b = b[n:]
+		case 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid delegation type")
+			}
+			entry, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid delegation")
+			}
+			addr, amount, err := unmarshalDelegationEntry(entry)
+			if err != nil {
+				return nil, err
+			}
+			v.Delegations[addr] = amount
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &v, nil
+}
+
+func unmarshalDelegationEntry(b []byte) (types.Address, uint64, error) {
+	var addr types.Address
+	var amount uint64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", 0, fmt.Errorf("invalid delegation tag")
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return "", 0, fmt.Errorf("invalid delegator")
+			}
+			addr = types.Address(string(v))
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return "", 0, fmt.Errorf("invalid delegation amount")
+			}
+			amount = v
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", 0, fmt.Errorf("invalid delegation field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return addr, amount, nil
+}
+
+// UnmarshalValidatorSet decodes a ValidatorSet and rebuilds its address index.
+func UnmarshalValidatorSet(b []byte) (*types.ValidatorSet, error) {
+	set := &types.ValidatorSet{IndexByAddr: make(map[types.Address]uint32)}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid validator set tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator bytes")
+			}
+			val, err := UnmarshalValidator(v)
+			if err != nil {
+				return nil, err
+			}
+			val.Index = uint32(len(set.Validators))
+			set.IndexByAddr[val.OperatorAddress] = val.Index
+			set.Validators = append(set.Validators, val)
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid total_power type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid total_power")
+			}
+			set.TotalPower = v
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator set field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return set, nil
+}
+
+// UnmarshalBlockRangeRequest decodes a BlockRangeRequest from protobuf wire format.
+func UnmarshalBlockRangeRequest(b []byte) (*types.BlockRangeRequest, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty block range request")
+	}
+	var req types.BlockRangeRequest
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid block range request tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid from type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid from")
+			}
+			req.From = v
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid count type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 1<<32-1 {
+				return nil, fmt.Errorf("invalid count")
+			}
+			req.Count = uint32(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid block range request field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &req, nil
+}
+
+// UnmarshalSnapshotManifest decodes a SnapshotManifest from protobuf wire format.
+func UnmarshalSnapshotManifest(b []byte) (*types.SnapshotManifest, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty snapshot manifest")
+	}
+	var m types.SnapshotManifest
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid snapshot manifest tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1, 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid snapshot manifest field %d type", num)
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || (num == 2 && v > 1<<32-1) {
+				return nil, fmt.Errorf("invalid snapshot manifest field %d", num)
+			}
+			if num == 1 {
+				m.Height = v
+			} else {
+				m.Format = uint32(v)
+			}
+			b = b[n:]
+		case 3, 4, 5:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid snapshot manifest field %d type", num)
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 || len(v) != len(types.Hash{}) {
+				return nil, fmt.Errorf("invalid snapshot manifest field %d", num)
+			}
+			switch num {
+			case 3:
+				copy(m.BlockHash[:], v)
+			case 4:
+				copy(m.StateRoot[:], v)
+			case 5:
+				var h types.Hash
+				copy(h[:], v)
+				m.Chunks = append(m.Chunks, h)
+			}
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid snapshot manifest field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &m, nil
+}
+
+// UnmarshalSnapshotRequest decodes a SnapshotRequest from protobuf wire format.
+func UnmarshalSnapshotRequest(b []byte) (*types.SnapshotRequest, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty snapshot request")
+	}
+	var req types.SnapshotRequest
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid snapshot request tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid height type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid height")
+			}
+			req.Height = v
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid index type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 1<<32-1 {
+				return nil, fmt.Errorf("invalid index")
+			}
+			req.Index = uint32(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid snapshot request field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	return &req, nil
+}
+
+// UnmarshalCommittedBlock decodes a CommittedBlock from protobuf wire format.
+// Both the block and its commit certificate are required.
+func UnmarshalCommittedBlock(b []byte) (*types.CommittedBlock, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty committed block")
+	}
+	var cb types.CommittedBlock
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid committed block tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid block type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid block bytes")
+			}
+			block, err := UnmarshalBlock(v)
+			if err != nil {
+				return nil, err
+			}
+			cb.Block = block
+			b = b[n:]
+		case 2:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid commit type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid commit bytes")
+			}
+			qc, err := UnmarshalQuorumCertificate(v)
+			if err != nil {
+				return nil, err
+			}
+			cb.Commit = qc
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid committed block field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+	if cb.Block == nil || cb.Commit == nil {
+		return nil, fmt.Errorf("committed block missing block or commit")
+	}
+	return &cb, nil
+}
@@ -0,0 +1,163 @@
+package encoding
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestConsensusMessageRoundTrip(t *testing.T) {
+	prop := &types.Proposal{
+		Block: &types.Block{
+			Height:                 7,
+			Timestamp:              1_700_000_000,
+			Proposer:               "val1",
+			ValidatorSigs:          [][]byte{{}, {1, 2}},
+			LastCommit:             &types.QuorumCertificate{BlockHash: types.Hash{4}, Height: 6, SigBitmap: []byte{0x01}, Signatures: [][]byte{{5}}},
+			ValidatorsHash:         types.Hash{6},
+			NextValidatorsHash:     types.Hash{7},
+			ProposerPrioritiesHash: types.Hash{8},
+		},
+		Round:       2,
+		ProposerSig: []byte{9, 9},
+	}
+	b, err := MarshalProposal(prop)
+	if err != nil {
+		t.Fatalf("marshal proposal: %v", err)
+	}
+	gotProp, err := UnmarshalProposal(b)
+	if err != nil {
+		t.Fatalf("unmarshal proposal: %v", err)
+	}
+	if gotProp.Round != 2 || gotProp.Block.Height != 7 || !bytes.Equal(gotProp.ProposerSig, prop.ProposerSig) {
+		t.Fatalf("proposal mismatch: %+v", gotProp)
+	}
+	if lc := gotProp.Block.LastCommit; lc == nil || lc.BlockHash != (types.Hash{4}) || lc.Height != 6 || !bytes.Equal(lc.Signatures[0], []byte{5}) {
+		t.Fatalf("last commit mismatch: %+v", lc)
+	}
+	if gotProp.Block.ValidatorsHash != (types.Hash{6}) || gotProp.Block.NextValidatorsHash != (types.Hash{7}) || gotProp.Block.ProposerPrioritiesHash != (types.Hash{8}) {
+		t.Fatalf("validators hashes mismatch: %+v", gotProp.Block)
+	}
+	// The block hash, which validators sign, commits to the next set.
+	other := *prop.Block
+	other.NextValidatorsHash = types.Hash{8}
+	h1, _ := HashBlock(prop.Block)
+	h2, _ := HashBlock(&other)
+	if h1 == h2 {
+		t.Fatalf("block hash does not cover the next validators hash")
+	}
+	other = *prop.Block
+	other.ProposerPrioritiesHash = types.Hash{9}
+	if h3, _ := HashBlock(&other); h1 == h3 {
+		t.Fatalf("block hash does not cover the proposer priorities hash")
+	}
+
+	qc := &types.QuorumCertificate{
+		BlockHash:  types.Hash{1},
+		Height:     7,
+		Round:      2,
+		SigBitmap:  []byte{0x02},
+		Signatures: [][]byte{{}, {3}},
+	}
+	b, err = MarshalQuorumCertificate(qc)
+	if err != nil {
+		t.Fatalf("marshal qc: %v", err)
+	}
+	gotQC, err := UnmarshalQuorumCertificate(b)
+	if err != nil {
+		t.Fatalf("unmarshal qc: %v", err)
+	}
+	if gotQC.BlockHash != qc.BlockHash || len(gotQC.Signatures) != 2 || len(gotQC.Signatures[0]) != 0 {
+		t.Fatalf("qc mismatch: %+v", gotQC)
+	}
+
+	vc := &types.ViewChange{Height: 7, Round: 3, Validator: "val2", Signature: []byte{4}, HighQC: qc}
+	b, err = MarshalViewChange(vc)
+	if err != nil {
+		t.Fatalf("marshal view change: %v", err)
+	}
+	gotVC, err := UnmarshalViewChange(b)
+	if err != nil {
+		t.Fatalf("unmarshal view change: %v", err)
+	}
+	if gotVC.Height != 7 || gotVC.Round != 3 || gotVC.Validator != "val2" {
+		t.Fatalf("view change mismatch: %+v", gotVC)
+	}
+	if gotVC.HighQC == nil || gotVC.HighQC.BlockHash != qc.BlockHash {
+		t.Fatalf("view change high qc mismatch: %+v", gotVC.HighQC)
+	}
+
+	tc := &types.TimeoutCertificate{
+		Height:     7,
+		Round:      3,
+		SigBitmap:  []byte{0x01},
+		Signatures: [][]byte{{5}, {}},
+		HighQC:     qc,
+	}
+	b, err = MarshalTimeoutCertificate(tc)
+	if err != nil {
+		t.Fatalf("marshal tc: %v", err)
+	}
+	gotTC, err := UnmarshalTimeoutCertificate(b)
+	if err != nil {
+		t.Fatalf("unmarshal tc: %v", err)
+	}
+	if gotTC.Height != 7 || gotTC.Round != 3 || len(gotTC.Signatures) != 2 || len(gotTC.Signatures[1]) != 0 {
+		t.Fatalf("tc mismatch: %+v", gotTC)
+	}
+	if gotTC.HighQC == nil || gotTC.HighQC.Height != qc.Height {
+		t.Fatalf("tc high qc mismatch: %+v", gotTC.HighQC)
+	}
+
+	cb := &types.CommittedBlock{Block: prop.Block, Commit: qc}
+	b, err = MarshalCommittedBlock(cb)
+	if err != nil {
+		t.Fatalf("marshal committed block: %v", err)
+	}
+	gotCB, err := UnmarshalCommittedBlock(b)
+	if err != nil {
+		t.Fatalf("unmarshal committed block: %v", err)
+	}
+	if gotCB.Block.Height != 7 || gotCB.Commit.BlockHash != qc.BlockHash {
+		t.Fatalf("committed block mismatch: %+v", gotCB)
+	}
+
+	b, err = MarshalBlockRangeRequest(&types.BlockRangeRequest{From: 12, Count: 64})
+	if err != nil {
+		t.Fatalf("marshal block range request: %v", err)
+	}
+	gotReq, err := UnmarshalBlockRangeRequest(b)
+	if err != nil {
+		t.Fatalf("unmarshal block range request: %v", err)
+	}
+	if gotReq.From != 12 || gotReq.Count != 64 {
+		t.Fatalf("block range request mismatch: %+v", gotReq)
+	}
+
+	manifest := &types.SnapshotManifest{Height: 100, Format: 1, BlockHash: types.Hash{1}, StateRoot: types.Hash{2}, Chunks: []types.Hash{{3}, {4}}}
+	b, err = MarshalSnapshotManifest(manifest)
+	if err != nil {
+		t.Fatalf("marshal snapshot manifest: %v", err)
+	}
+	gotManifest, err := UnmarshalSnapshotManifest(b)
+	if err != nil {
+		t.Fatalf("unmarshal snapshot manifest: %v", err)
+	}
+	if gotManifest.Height != 100 || gotManifest.Format != 1 || gotManifest.BlockHash != manifest.BlockHash ||
+		gotManifest.StateRoot != manifest.StateRoot || len(gotManifest.Chunks) != 2 || gotManifest.Chunks[1] != manifest.Chunks[1] {
+		t.Fatalf("snapshot manifest mismatch: %+v", gotManifest)
+	}
+
+	b, err = MarshalSnapshotRequest(&types.SnapshotRequest{Height: 100, Index: 7})
+	if err != nil {
+		t.Fatalf("marshal snapshot request: %v", err)
+	}
+	gotSnapReq, err := UnmarshalSnapshotRequest(b)
+	if err != nil {
+		t.Fatalf("unmarshal snapshot request: %v", err)
+	}
+	if gotSnapReq.Height != 100 || gotSnapReq.Index != 7 {
+		t.Fatalf("snapshot request mismatch: %+v", gotSnapReq)
+	}
+}
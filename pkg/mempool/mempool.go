@@ -125,9 +125,16 @@ func (m *Mempool) SelectForBlock(max int) ([]*types.Transaction, error) {
 	h := &txHeap{}
 	heap.Init(h)
 
-	// Seed heap with first valid tx per sender.
+	// Seed heap with first valid tx per sender, skipping transactions whose
+	// nonce was already used by a committed block.
 	for addr, st := range senders {
-		tx := st.queue[0]
+		for st.cursor < len(st.queue) && st.queue[st.cursor].Nonce < st.acct.Nonce {
+			st.cursor++
+		}
+		if st.cursor == len(st.queue) {
+			continue
+		}
+		tx := st.queue[st.cursor]
 		if tx.Nonce != st.acct.Nonce {
 			continue
 		}
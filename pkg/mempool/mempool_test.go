@@ -80,6 +80,30 @@ func TestMempoolOrdering(t *testing.T) {
 	}
 }
 
+func TestSelectSkipsCommittedTransactions(t *testing.T) {
+	kp := keyFromSeed(0x01)
+	addr, _ := crypto.AddressFromPubKey(kp.PublicKey)
+	acct := &types.Account{Address: types.Address(addr), Nonce: 0, RC: 100}
+	state := &mockState{accounts: map[types.Address]*types.Account{acct.Address: acct}}
+	mp := New(state, &mockCoster{})
+
+	if err := mp.AddTx(mustSignedTransfer(t, kp, acct.Address, "x", 0)); err != nil {
+		t.Fatalf("add tx0: %v", err)
+	}
+	// tx0 is committed before the sender submits tx1.
+	acct.Nonce = 1
+	if err := mp.AddTx(mustSignedTransfer(t, kp, acct.Address, "x", 1)); err != nil {
+		t.Fatalf("add tx1: %v", err)
+	}
+	selected, err := mp.SelectForBlock(2)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if len(selected) != 1 || selected[0].Nonce != 1 {
+		t.Fatalf("expected only tx1, got %d txs", len(selected))
+	}
+}
+
 func keyFromSeed(b byte) *crypto.Ed25519KeyPair {
 	seed := bytes.Repeat([]byte{b}, ed25519.SeedSize)
 	priv := ed25519.NewKeyFromSeed(seed)
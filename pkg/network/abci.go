@@ -3,6 +3,8 @@
 package network
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/georgecane/opencoin/pkg/consensus"
 	"github.com/georgecane/opencoin/pkg/contracts"
 	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/encoding"
 	"github.com/georgecane/opencoin/pkg/state"
 	"github.com/georgecane/opencoin/pkg/types"
 )
@@ -23,6 +26,13 @@ type ABCIApp struct {
 	verifier       crypto.Verifier
 	mempool        []*types.Transaction
 	blockHeight    uint64
+
+	// State sync; nil until EnableStateSync.
+	store         *state.Store
+	snapshots     *state.SnapshotStore
+	restore       *state.SnapshotRestorer
+	restoreRoot   types.Hash
+	restoreChunks uint32
 }
 
 // NewABCIApp creates a new ABCI application
@@ -37,6 +47,13 @@ func NewABCIApp(dagState *state.DAGState, dposEngine *consensus.DPoSEngine, cont
 	}
 }
 
+// EnableStateSync serves the snapshots in snapshots to peers and restores
+// offered snapshots into store.
+func (app *ABCIApp) EnableStateSync(store *state.Store, snapshots *state.SnapshotStore) {
+	app.store = store
+	app.snapshots = snapshots
+}
+
 // Info implements ABCI Info
 func (app *ABCIApp) Info(req abcitypes.RequestInfo) abcitypes.ResponseInfo {
 	return abcitypes.ResponseInfo{
@@ -185,24 +202,100 @@ func (app *ABCIApp) Query(req abcitypes.RequestQuery) abcitypes.ResponseQuery {
 	}
 }
 
-// ListSnapshots implements ABCI ListSnapshots (for state sync)
+// ListSnapshots implements ABCI ListSnapshots (for state sync). The snapshot
+// metadata is the encoded manifest, and its hash the manifest hash.
 func (app *ABCIApp) ListSnapshots(req abcitypes.RequestListSnapshots) abcitypes.ResponseListSnapshots {
-	return abcitypes.ResponseListSnapshots{Snapshots: []*abcitypes.Snapshot{}}
+	if app.snapshots == nil {
+		return abcitypes.ResponseListSnapshots{Snapshots: []*abcitypes.Snapshot{}}
+	}
+	manifests, err := app.snapshots.ListSnapshots()
+	if err != nil {
+		return abcitypes.ResponseListSnapshots{Snapshots: []*abcitypes.Snapshot{}}
+	}
+	out := make([]*abcitypes.Snapshot, 0, len(manifests))
+	for _, m := range manifests {
+		metadata, err := encoding.MarshalSnapshotManifest(m)
+		if err != nil {
+			continue
+		}
+		hash := sha256.Sum256(metadata)
+		out = append(out, &abcitypes.Snapshot{
+			Height:   m.Height,
+			Format:   m.Format,
+			Chunks:   uint32(len(m.Chunks)),
+			Hash:     hash[:],
+			Metadata: metadata,
+		})
+	}
+	return abcitypes.ResponseListSnapshots{Snapshots: out}
 }
 
-// OfferSnapshot implements ABCI OfferSnapshot (for state sync)
+// OfferSnapshot implements ABCI OfferSnapshot (for state sync). The app hash
+// comes from the light client verified header and must be the state root the
+// manifest claims.
 func (app *ABCIApp) OfferSnapshot(req abcitypes.RequestOfferSnapshot) abcitypes.ResponseOfferSnapshot {
-	return abcitypes.ResponseOfferSnapshot{}
+	if app.store == nil || req.Snapshot == nil {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_ABORT}
+	}
+	if req.Snapshot.Format != state.SnapshotFormat {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT_FORMAT}
+	}
+	m, err := encoding.UnmarshalSnapshotManifest(req.Snapshot.Metadata)
+	if err != nil {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}
+	}
+	hash := sha256.Sum256(req.Snapshot.Metadata)
+	if !bytes.Equal(hash[:], req.Snapshot.Hash) || m.Height != req.Snapshot.Height || uint32(len(m.Chunks)) != req.Snapshot.Chunks {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}
+	}
+	if !bytes.Equal(m.StateRoot[:], req.AppHash) {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}
+	}
+	restore, err := app.store.NewSnapshotRestorer(m)
+	if err != nil {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_ABORT}
+	}
+	app.restore = restore
+	app.restoreRoot = m.StateRoot
+	app.restoreChunks = uint32(len(m.Chunks))
+	return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_ACCEPT}
 }
 
 // LoadSnapshotChunk implements ABCI LoadSnapshotChunk (for state sync)
 func (app *ABCIApp) LoadSnapshotChunk(req abcitypes.RequestLoadSnapshotChunk) abcitypes.ResponseLoadSnapshotChunk {
-	return abcitypes.ResponseLoadSnapshotChunk{}
+	if app.snapshots == nil || req.Format != state.SnapshotFormat {
+		return abcitypes.ResponseLoadSnapshotChunk{}
+	}
+	chunk, err := app.snapshots.LoadSnapshotChunk(req.Height, req.Chunk)
+	if err != nil {
+		return abcitypes.ResponseLoadSnapshotChunk{}
+	}
+	return abcitypes.ResponseLoadSnapshotChunk{Chunk: chunk}
 }
 
-// ApplySnapshotChunk implements ABCI ApplySnapshotChunk (for state sync)
+// ApplySnapshotChunk implements ABCI ApplySnapshotChunk (for state sync). A
+// chunk that does not match the manifest is fetched again from another peer.
 func (app *ABCIApp) ApplySnapshotChunk(req abcitypes.RequestApplySnapshotChunk) abcitypes.ResponseApplySnapshotChunk {
-	return abcitypes.ResponseApplySnapshotChunk{}
+	if app.restore == nil {
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ABORT}
+	}
+	if err := app.restore.ApplyChunk(req.Index, req.Chunk); err != nil {
+		return abcitypes.ResponseApplySnapshotChunk{
+			Result:        abcitypes.ResponseApplySnapshotChunk_RETRY,
+			RefetchChunks: []uint32{req.Index},
+			RejectSenders: []string{req.Sender},
+		}
+	}
+	if app.restore.NextChunk() < app.restoreChunks {
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ACCEPT}
+	}
+	// Every chunk is in: the rebuilt state must have the trusted root.
+	restore := app.restore
+	app.restore = nil
+	if err := restore.Finish(app.restoreRoot); err != nil {
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_REJECT_SNAPSHOT}
+	}
+	return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ACCEPT}
 }
 
 // validateTransaction validates a transaction
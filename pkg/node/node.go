@@ -2,11 +2,16 @@ package node
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -33,9 +38,13 @@ type Node struct {
 	mempool   *mempool.Mempool
 	dpos      *consensus.DPoS
 	consensus *consensus.Engine
+	pacemaker *consensus.Pacemaker
+	syncer    *consensus.BlockSyncer
+	snapshots *state.SnapshotStore
 	p2p       *p2p.P2P
 	httpSrv   *http.Server
 	genesis   *genesis.Genesis
+	remote    *crypto.RemoteSigner
 }
 
 // New creates a new node.
@@ -69,65 +78,160 @@ func (n *Node) Start(ctx context.Context) error {
 		WindowN:    gen.RCParams.WindowN,
 	}
 	n.state = state.NewState(store, n.dag, rcParams)
+	n.state.SetRewardParams(state.RewardParams{
+		BlockReward:       n.cfg.Consensus.BlockReward,
+		ProposerRewardBps: n.cfg.Consensus.ProposerRewardBps,
+	})
+	n.state.SetStakingParams(state.StakingParams{
+		UnbondingPeriod:        int64(n.cfg.Consensus.UnbondingPeriod),
+		SlashDoubleBps:         n.cfg.Consensus.SlashDoubleBps,
+		MinStake:               n.cfg.Consensus.MinStake,
+		EpochLength:            n.cfg.Consensus.EpochLength,
+		MaxCommissionChangeBps: n.cfg.Consensus.MaxCommissionChangeBps,
+		JailDoubleEpochs:       n.cfg.Consensus.JailDouble,
+		SlashOfflineBps:        n.cfg.Consensus.SlashOfflineBps,
+		JailOfflineEpochs:      n.cfg.Consensus.JailOffline,
+		SignedBlocksWindow:     n.cfg.Consensus.SignedBlocksWindow,
+		MaxMissedBps:           n.cfg.Consensus.MaxMissedBps,
+	})
 	n.contracts = contracts.NewContractEngine()
 	n.dpos = consensus.NewDPoS(n.cfg.Consensus.MinStake, n.cfg.Consensus.MaxValidators)
 
+	p2pNode, err := p2p.New(ctx, p2p.Config{
+		ListenAddrs:    []string{toMultiaddr(n.cfg.P2P.ListenAddr)},
+		BootstrapPeers: n.cfg.P2P.BootstrapPeers,
+	})
+	if err != nil {
+		return err
+	}
+	n.p2p = p2pNode
+	blockSync := p2p.NewBlockSync(n.p2p, n.store)
+	n.snapshots = state.NewSnapshotStore(state.SnapshotsDir(n.cfg.HomeDir), n.cfg.StateSync.SnapshotKeepRecent)
+	snapshotSync := p2p.NewSnapshotSync(n.p2p, n.snapshots)
+
+	if n.cfg.StateSync.Enable {
+		if err := n.stateSync(ctx, blockSync, snapshotSync); err != nil {
+			return fmt.Errorf("state sync: %w", err)
+		}
+	}
 	if err := n.applyGenesis(); err != nil {
 		return err
 	}
+	if err := consensus.VerifyStoredChain(n.store, crypto.NewDilithiumVerifier()); err != nil {
+		return err
+	}
 
 	coster := &tx.Coster{Params: rcParams, Contracts: n.contracts}
 	n.mempool = mempool.New(n.state, coster)
 
+	// Every node follows the chain through block sync; only validators sign,
+	// gossip consensus messages and keep a WAL of what they signed.
+	var (
+		operator types.Address
+		signer   crypto.Signer
+		network  consensus.Network
+		gossip   *p2p.ConsensusGossip
+		walPath  string
+	)
 	if n.cfg.Validator.Enabled {
-		keyPath := filepath.Join(n.cfg.HomeDir, n.cfg.Validator.PrivateKeyFile)
-		kp, err := crypto.LoadKeyPair(keyPath)
-		if err != nil {
-			return err
-		}
-		signer := crypto.NewDilithiumSigner(kp.PublicKey, kp.PrivateKey)
-		verifier := crypto.NewDilithiumVerifier()
 		if n.cfg.Validator.OperatorAddress == "" {
 			return fmt.Errorf("validator operator_address required")
 		}
-		engine, err := consensus.NewEngine(consensus.Config{
-			EpochLength:   n.cfg.Consensus.EpochLength,
-			MaxValidators: n.cfg.Consensus.MaxValidators,
-			BlockMaxTxs:   1000,
-			MinStake:      n.cfg.Consensus.MinStake,
-			SlashDouble:   n.cfg.Consensus.SlashDoubleBps,
-			JailDouble:    n.cfg.Consensus.JailDouble,
-			SlashOffline:  n.cfg.Consensus.SlashOfflineBps,
-			JailOffline:   n.cfg.Consensus.JailOffline,
-		}, n.state, n.dpos, n.mempool, n.contracts, types.Address(n.cfg.Validator.OperatorAddress), signer, verifier, nil)
+		operator = types.Address(n.cfg.Validator.OperatorAddress)
+		signer, err = n.validatorSigner()
 		if err != nil {
 			return err
 		}
-		n.consensus = engine
+		gossip, err = p2p.NewConsensusGossip(n.p2p, n.genesis.ChainID)
+		if err != nil {
+			return err
+		}
+		network = gossip
+		walPath = consensus.WALPath(n.cfg.HomeDir)
 	}
-
-	p2pNode, err := p2p.New(ctx, p2p.Config{
-		ListenAddrs:    []string{toMultiaddr(n.cfg.P2P.ListenAddr)},
-		BootstrapPeers: n.cfg.P2P.BootstrapPeers,
-	})
+	engine, err := consensus.NewEngine(consensus.Config{
+		EpochLength:      n.cfg.Consensus.EpochLength,
+		MaxValidators:    n.cfg.Consensus.MaxValidators,
+		BlockMaxTxs:      1000,
+		MinStake:         n.cfg.Consensus.MinStake,
+		UnbondingPeriod:  n.cfg.Consensus.UnbondingPeriod,
+		SeedProposer:     n.cfg.Consensus.SeedProposer,
+		WALPath:          walPath,
+		Snapshots:        n.snapshots,
+		SnapshotInterval: n.cfg.StateSync.SnapshotInterval,
+	}, n.state, n.dpos, n.mempool, n.contracts, operator, signer, crypto.NewDilithiumVerifier(), network)
 	if err != nil {
 		return err
 	}
-	n.p2p = p2pNode
+	n.consensus = engine
+	n.syncer = consensus.NewBlockSyncer(engine, blockSync, consensus.BlockSyncConfig{
+		BatchSize: n.cfg.P2P.BlockSyncBatch,
+	})
+	if n.cfg.Validator.Enabled {
+		if err := gossip.Start(ctx, engine); err != nil {
+			return err
+		}
+		n.pacemaker = consensus.NewPacemaker(engine, consensus.PacemakerConfig{
+			TimeoutPropose:   n.cfg.Consensus.TimeoutPropose,
+			TimeoutPrecommit: n.cfg.Consensus.TimeoutPrecommit,
+			TimeoutCommit:    n.cfg.Consensus.TimeoutCommit,
+		}, nil)
+	}
 
 	n.httpSrv = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", n.cfg.RPC.Addr, n.cfg.RPC.Port),
 		Handler: n.httpHandler(),
 	}
 	go n.httpSrv.ListenAndServe()
+
+	// Catch up before taking part in consensus, then keep checking for
+	// blocks committed without us.
+	if _, err := n.syncer.Sync(ctx); err != nil {
+		return fmt.Errorf("block sync: %w", err)
+	}
+	go n.syncLoop(ctx)
+	if n.pacemaker != nil {
+		if err := n.pacemaker.Start(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (n *Node) syncLoop(ctx context.Context) {
+	interval := n.cfg.P2P.BlockSyncInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = n.syncer.Sync(ctx)
+		}
+	}
+}
+
 // Stop stops node services.
 func (n *Node) Stop(ctx context.Context) error {
+	if n.pacemaker != nil {
+		n.pacemaker.Stop()
+	}
 	if n.httpSrv != nil {
 		_ = n.httpSrv.Shutdown(ctx)
 	}
+	if n.consensus != nil {
+		_ = n.consensus.Close()
+	}
+	if n.remote != nil {
+		_ = n.remote.Close()
+	}
+	if n.snapshots != nil {
+		n.snapshots.Wait()
+	}
 	if n.store != nil {
 		_ = n.store.Close()
 	}
@@ -145,12 +249,102 @@ func (n *Node) httpHandler() http.Handler {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/account_proof", n.handleAccountProof)
 	return mux
 }
 
+// handleAccountProof serves an account with its proof against the committed
+// state root: /account_proof?address=...[&height=...].
+func (n *Node) handleAccountProof(w http.ResponseWriter, r *http.Request) {
+	addr := types.Address(r.URL.Query().Get("address"))
+	if addr == "" {
+		http.Error(w, "missing address", http.StatusBadRequest)
+		return
+	}
+	var height uint64
+	if h := r.URL.Query().Get("height"); h != "" {
+		v, err := strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid height", http.StatusBadRequest)
+			return
+		}
+		height = v
+	}
+	acct, proof, err := n.store.ProveAccount(addr, height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&state.ProvenAccount{Address: addr, Account: acct, Proof: proof})
+}
+
+// stateSync restores a node that has no blocks yet from a peer snapshot of
+// the configured trusted block, retrying until peers serve one.
+func (n *Node) stateSync(ctx context.Context, blocks consensus.BlockFetcher, snapshots consensus.SnapshotFetcher) error {
+	height, err := n.store.LastBlockHeight()
+	if err != nil || height > 0 {
+		return err
+	}
+	cfg := n.cfg.StateSync
+	raw, err := hex.DecodeString(cfg.TrustHash)
+	if err != nil || len(raw) != len(types.Hash{}) || cfg.TrustHeight == 0 {
+		return fmt.Errorf("trust_height and a hex trust_hash are required")
+	}
+	var trustHash types.Hash
+	copy(trustHash[:], raw)
+	interval := n.cfg.P2P.BlockSyncInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		err := consensus.StateSync(ctx, n.store, blocks, snapshots, cfg.TrustHeight, trustHash)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+	}
+}
+
 func (n *Node) applyGenesis() error {
-	// Initialize accounts.
+	// Committed state, including state restored from a snapshot, is
+	// authoritative and must not be reset.
+	height, err := n.store.LastBlockHeight()
+	if err != nil {
+		return err
+	}
+	if height == 0 {
+		if err := n.writeGenesisState(); err != nil {
+			return err
+		}
+	}
+	// Rebuild the validator registry, delegations included, from state.
+	validators, err := n.store.GetValidators()
+	if err != nil {
+		return err
+	}
+	n.dpos.LoadValidators(validators)
+	if ts, err := n.store.GetLastTimestamps(); err == nil && len(ts) == 0 {
+		_ = n.store.SetLastTimestamps([]int64{n.genesis.GenesisTime.Unix()})
+	}
+	return nil
+}
+
+// writeGenesisState initializes the genesis accounts and validators that are
+// not in the store yet.
+func (n *Node) writeGenesisState() error {
 	for _, acct := range n.genesis.Accounts {
+		existing, err := n.store.GetAccount(acct.Address)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
 		stateAcct := &types.Account{
 			Address: acct.Address,
 			Balance: acct.Balance,
@@ -162,18 +356,60 @@ func (n *Node) applyGenesis() error {
 			return err
 		}
 	}
-	// Initialize validators.
 	for _, v := range n.genesis.Validators {
-		if err := n.dpos.RegisterValidator(v.OperatorAddress, v.ConsensusPubKey, v.Stake, v.Commission); err != nil {
+		existing, err := n.store.GetValidator(v.OperatorAddress)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		if v.Stake < n.cfg.Consensus.MinStake {
+			return fmt.Errorf("genesis validator %s: stake below minimum: %d < %d", v.OperatorAddress, v.Stake, n.cfg.Consensus.MinStake)
+		}
+		if err := n.store.SetValidator(&types.Validator{
+			OperatorAddress: v.OperatorAddress,
+			ConsensusPubKey: v.ConsensusPubKey,
+			Stake:           v.Stake,
+			Commission:      v.Commission,
+		}); err != nil {
 			return err
 		}
-	}
-	if ts, err := n.store.GetLastTimestamps(); err == nil && len(ts) == 0 {
-		_ = n.store.SetLastTimestamps([]int64{n.genesis.GenesisTime.Unix()})
 	}
 	return nil
 }
 
+// validatorSigner returns the signer for consensus messages: a connection to
+// the configured remote signer, or the local validator key file.
+func (n *Node) validatorSigner() (crypto.Signer, error) {
+	v := n.cfg.Validator
+	if v.RemoteSigner == "" {
+		kp, err := crypto.LoadKeyPair(filepath.Join(n.cfg.HomeDir, v.PrivateKeyFile))
+		if err != nil {
+			return nil, err
+		}
+		return crypto.NewDilithiumSigner(kp.PublicKey, kp.PrivateKey), nil
+	}
+	identity, err := crypto.LoadOrCreateEd25519(filepath.Join(n.cfg.HomeDir, v.SignerIdentityFile))
+	if err != nil {
+		return nil, fmt.Errorf("load signer identity: %w", err)
+	}
+	signerKey, err := base64.StdEncoding.DecodeString(v.SignerPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer_pubkey: %w", err)
+	}
+	remote, err := crypto.DialRemoteSigner(crypto.RemoteSignerConfig{
+		Addr:      v.RemoteSigner,
+		Identity:  identity.PrivateKey,
+		SignerKey: signerKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.remote = remote
+	return remote, nil
+}
+
 func toMultiaddr(addr string) string {
 	if strings.HasPrefix(addr, "/") {
 		return addr
@@ -0,0 +1,181 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+const blockSyncProtocol = protocol.ID("/opencoin/blocksync/1.0")
+
+const (
+	// maxBlockSyncBatch caps how many blocks a single request may return.
+	maxBlockSyncBatch = 128
+	// maxBlockSyncFrame caps the encoded size of one committed block.
+	maxBlockSyncFrame = 32 << 20
+	blockSyncTimeout  = 30 * time.Second
+)
+
+// BlockStore serves committed blocks and their commit certificates.
+type BlockStore interface {
+	GetBlockByHeight(height uint64) (*types.Block, error)
+	GetCommitCertificate(height uint64) (*types.QuorumCertificate, error)
+}
+
+// BlockSync serves and fetches ranges of committed blocks over a libp2p
+// request/response stream. A request is one frame holding a BlockRangeRequest;
+// the response is one frame per CommittedBlock, in height order, terminated by
+// closing the stream. A peer returns fewer blocks than asked when it reaches its tip.
+type BlockSync struct {
+	p     *P2P
+	store BlockStore
+}
+
+// NewBlockSync registers the block sync protocol handler serving from store.
+func NewBlockSync(p *P2P, store BlockStore) *BlockSync {
+	s := &BlockSync{p: p, store: store}
+	p.Host.SetStreamHandler(blockSyncProtocol, s.handleStream)
+	return s
+}
+
+// SyncPeers returns the IDs of the currently connected peers.
+func (s *BlockSync) SyncPeers() []string {
+	peers := s.p.Host.Network().Peers()
+	out := make([]string, 0, len(peers))
+	for _, id := range peers {
+		out = append(out, id.String())
+	}
+	return out
+}
+
+// FetchBlocks asks peerID for up to count committed blocks starting at from.
+// The returned blocks are decoded but not verified.
+func (s *BlockSync) FetchBlocks(ctx context.Context, peerID string, from uint64, count int) ([]*types.CommittedBlock, error) {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer id: %w", err)
+	}
+	if count > maxBlockSyncBatch {
+		count = maxBlockSyncBatch
+	}
+	ctx, cancel := context.WithTimeout(ctx, blockSyncTimeout)
+	defer cancel()
+	stream, err := s.p.Host.NewStream(ctx, id, blockSyncProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	req, err := encoding.MarshalBlockRangeRequest(&types.BlockRangeRequest{From: from, Count: uint32(count)})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(stream, req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return nil, err
+	}
+	var out []*types.CommittedBlock
+	for len(out) < count {
+		frame, err := readFrame(stream)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cb, err := encoding.UnmarshalCommittedBlock(frame)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cb)
+	}
+	return out, nil
+}
+
+func (s *BlockSync) handleStream(stream network.Stream) {
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(blockSyncTimeout))
+	frame, err := readFrame(stream)
+	if err != nil {
+		_ = stream.Reset()
+		return
+	}
+	req, err := encoding.UnmarshalBlockRangeRequest(frame)
+	if err != nil || req.From == 0 {
+		_ = stream.Reset()
+		return
+	}
+	count := uint64(req.Count)
+	if count > maxBlockSyncBatch {
+		count = maxBlockSyncBatch
+	}
+	for h := req.From; h < req.From+count; h++ {
+		block, err := s.store.GetBlockByHeight(h)
+		if err != nil || block == nil {
+			return
+		}
+		qc, err := s.store.GetCommitCertificate(h)
+		if err != nil || qc == nil {
+			return
+		}
+		b, err := encoding.MarshalCommittedBlock(&types.CommittedBlock{Block: block, Commit: qc})
+		if err != nil {
+			return
+		}
+		if err := writeFrame(stream, b); err != nil {
+			return
+		}
+	}
+}
+
+// writeFrame writes b prefixed with its 4-byte big-endian length. Unlike
+// writeBytes it fits whole blocks.
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxBlockSyncFrame {
+		return fmt.Errorf("frame too large")
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame. It returns io.EOF only when
+// the stream ends cleanly before a new frame.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated frame length")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(lenBuf[:])
+	if size == 0 || size > maxBlockSyncFrame {
+		return nil, fmt.Errorf("invalid frame size %d", size)
+	}
+	out := make([]byte, size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return out, nil
+}
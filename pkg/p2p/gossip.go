@@ -0,0 +1,245 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/georgecane/opencoin/pkg/consensus"
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// Consensus gossip topic kinds. Full topic names are scoped by chain ID.
+const (
+	topicProposal   = "proposal"
+	topicPrecommit  = "precommit"
+	topicQC         = "qc"
+	topicViewChange = "viewchange"
+	topicTC         = "tc"
+	topicEvidence   = "evidence"
+)
+
+// ConsensusHandler receives decoded consensus messages from the network.
+// Authenticate checks a message's signers before it is relayed; it returns
+// consensus.ErrNoValidatorSet when it cannot tell.
+type ConsensusHandler interface {
+	Authenticate(msg interface{}) error
+	HandleProposal(*types.Proposal) (*types.PrecommitVote, error)
+	HandlePrecommitVote(*types.PrecommitVote) (*types.QuorumCertificate, error)
+	HandleQC(*types.QuorumCertificate) error
+	HandleViewChange(*types.ViewChange) error
+	HandleTC(*types.TimeoutCertificate) error
+	HandleEvidence(*types.DuplicateVoteEvidence) error
+}
+
+// ConsensusTopic returns the gossip topic name for a message kind on a chain.
+func ConsensusTopic(chainID, kind string) string {
+	return fmt.Sprintf("/opencoin/%s/consensus/%s/1.0", chainID, kind)
+}
+
+// ConsensusGossip implements consensus.Network over libp2p pubsub topics.
+type ConsensusGossip struct {
+	p      *P2P
+	topics map[string]*pubsub.Topic
+}
+
+// NewConsensusGossip joins the consensus topics for chainID.
+func NewConsensusGossip(p *P2P, chainID string) (*ConsensusGossip, error) {
+	if chainID == "" {
+		return nil, fmt.Errorf("chain id required")
+	}
+	g := &ConsensusGossip{p: p, topics: make(map[string]*pubsub.Topic)}
+	for _, kind := range []string{topicProposal, topicPrecommit, topicQC, topicViewChange, topicTC, topicEvidence} {
+		name := ConsensusTopic(chainID, kind)
+		topic, err := p.Topic(name)
+		if err != nil {
+			return nil, fmt.Errorf("join %s: %w", name, err)
+		}
+		g.topics[kind] = topic
+	}
+	return g, nil
+}
+
+// Start registers validators that authenticate messages with h before they
+// are relayed, subscribes to the consensus topics and dispatches messages
+// into h until ctx is cancelled.
+func (g *ConsensusGossip) Start(ctx context.Context, h ConsensusHandler) error {
+	for kind, topic := range g.topics {
+		if err := g.p.PubSub.RegisterTopicValidator(topic.String(), g.validatorFor(kind, h)); err != nil {
+			return fmt.Errorf("register validator %s: %w", topic.String(), err)
+		}
+	}
+	for kind, topic := range g.topics {
+		sub, err := topic.Subscribe()
+		if err != nil {
+			return fmt.Errorf("subscribe %s: %w", topic.String(), err)
+		}
+		go g.readLoop(ctx, sub, kind, h)
+	}
+	return nil
+}
+
+// BroadcastProposal publishes a signed proposal.
+func (g *ConsensusGossip) BroadcastProposal(p *types.Proposal) error {
+	b, err := encoding.MarshalProposal(p)
+	if err != nil {
+		return err
+	}
+	return g.publish(topicProposal, b)
+}
+
+// BroadcastPrecommit publishes a signed precommit vote.
+func (g *ConsensusGossip) BroadcastPrecommit(v *types.PrecommitVote) error {
+	b, err := encoding.MarshalPrecommitVote(v)
+	if err != nil {
+		return err
+	}
+	return g.publish(topicPrecommit, b)
+}
+
+// BroadcastQC publishes a quorum certificate.
+func (g *ConsensusGossip) BroadcastQC(qc *types.QuorumCertificate) error {
+	b, err := encoding.MarshalQuorumCertificate(qc)
+	if err != nil {
+		return err
+	}
+	return g.publish(topicQC, b)
+}
+
+// BroadcastViewChange publishes a signed view change.
+func (g *ConsensusGossip) BroadcastViewChange(vc *types.ViewChange) error {
+	b, err := encoding.MarshalViewChange(vc)
+	if err != nil {
+		return err
+	}
+	return g.publish(topicViewChange, b)
+}
+
+// BroadcastTC publishes a timeout certificate.
+func (g *ConsensusGossip) BroadcastTC(tc *types.TimeoutCertificate) error {
+	b, err := encoding.MarshalTimeoutCertificate(tc)
+	if err != nil {
+		return err
+	}
+	return g.publish(topicTC, b)
+}
+
+// BroadcastEvidence publishes double-sign evidence.
+func (g *ConsensusGossip) BroadcastEvidence(ev *types.DuplicateVoteEvidence) error {
+	b, err := encoding.MarshalDuplicateVoteEvidence(ev)
+	if err != nil {
+		return err
+	}
+	return g.publish(topicEvidence, b)
+}
+
+func (g *ConsensusGossip) publish(kind string, data []byte) error {
+	topic, ok := g.topics[kind]
+	if !ok {
+		return fmt.Errorf("unknown topic %s", kind)
+	}
+	return topic.Publish(g.p.ctx, data)
+}
+
+func (g *ConsensusGossip) readLoop(ctx context.Context, sub *pubsub.Subscription, kind string, h ConsensusHandler) {
+	defer sub.Cancel()
+	self := g.p.Host.ID()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		// Pubsub delivers our own publications locally; the engine already processed them.
+		if msg.ReceivedFrom == self {
+			continue
+		}
+		// The message was authenticated before it was relayed, so an error
+		// means it is stale or not applicable in the current round.
+		if err := dispatch(msg.ValidatorData, h); err != nil {
+			gossipUnhandled.WithLabelValues(kind).Inc()
+		}
+	}
+}
+
+// dispatch hands a message decoded by the topic validator to h.
+func dispatch(msg interface{}, h ConsensusHandler) error {
+	switch m := msg.(type) {
+	case *types.Proposal:
+		_, err := h.HandleProposal(m)
+		return err
+	case *types.PrecommitVote:
+		_, err := h.HandlePrecommitVote(m)
+		return err
+	case *types.QuorumCertificate:
+		return h.HandleQC(m)
+	case *types.ViewChange:
+		return h.HandleViewChange(m)
+	case *types.TimeoutCertificate:
+		return h.HandleTC(m)
+	case *types.DuplicateVoteEvidence:
+		return h.HandleEvidence(m)
+	default:
+		return fmt.Errorf("unsupported consensus message %T", msg)
+	}
+}
+
+// decodeMessage decodes a message of kind and rejects one that is
+// structurally incomplete.
+func decodeMessage(kind string, data []byte) (interface{}, bool) {
+	switch kind {
+	case topicProposal:
+		p, err := encoding.UnmarshalProposal(data)
+		return p, err == nil && p.Block != nil && len(p.ProposerSig) > 0
+	case topicPrecommit:
+		v, err := encoding.UnmarshalPrecommitVote(data)
+		return v, err == nil && v.Validator != "" && len(v.Signature) > 0
+	case topicQC:
+		qc, err := encoding.UnmarshalQuorumCertificate(data)
+		return qc, err == nil && len(qc.SigBitmap) > 0
+	case topicViewChange:
+		vc, err := encoding.UnmarshalViewChange(data)
+		return vc, err == nil && vc.Validator != "" && len(vc.Signature) > 0
+	case topicTC:
+		tc, err := encoding.UnmarshalTimeoutCertificate(data)
+		return tc, err == nil && len(tc.SigBitmap) > 0
+	case topicEvidence:
+		ev, err := encoding.UnmarshalDuplicateVoteEvidence(data)
+		return ev, err == nil && ev.Validator != ""
+	default:
+		return nil, false
+	}
+}
+
+// validatorFor decodes messages of kind and authenticates their signers with
+// h. Messages that do not decode, or are not signed by the validators they
+// claim, are rejected and not relayed; messages whose validator set h does
+// not know are ignored. The decoded message is kept for dispatch.
+func (g *ConsensusGossip) validatorFor(kind string, h ConsensusHandler) func(context.Context, peer.ID, *pubsub.Message) pubsub.ValidationResult {
+	self := g.p.Host.ID()
+	return func(_ context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		decoded, ok := decodeMessage(kind, msg.Data)
+		if !ok {
+			gossipRejected.WithLabelValues(kind, "malformed").Inc()
+			return pubsub.ValidationReject
+		}
+		msg.ValidatorData = decoded
+		// Our own publications were signed by the engine.
+		if from == self {
+			return pubsub.ValidationAccept
+		}
+		switch err := h.Authenticate(decoded); {
+		case err == nil:
+			return pubsub.ValidationAccept
+		case errors.Is(err, consensus.ErrNoValidatorSet):
+			gossipRejected.WithLabelValues(kind, "unknown_validator_set").Inc()
+			return pubsub.ValidationIgnore
+		default:
+			gossipRejected.WithLabelValues(kind, "unauthenticated").Inc()
+			return pubsub.ValidationReject
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package p2p
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// gossipRejected counts consensus messages refused by gossip validation, and
+// so not relayed, by topic kind and reason.
+var gossipRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "opencoin",
+	Subsystem: "p2p",
+	Name:      "gossip_rejected_total",
+	Help:      "Consensus messages refused by gossip validation, by kind and reason.",
+}, []string{"kind", "reason"})
+
+// gossipUnhandled counts authenticated consensus messages the engine did not
+// apply, most often because they were stale, by topic kind.
+var gossipUnhandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "opencoin",
+	Subsystem: "p2p",
+	Name:      "gossip_unhandled_total",
+	Help:      "Authenticated consensus messages the engine did not apply, by kind.",
+}, []string{"kind"})
+
+func init() {
+	prometheus.MustRegister(gossipRejected, gossipUnhandled)
+}
@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+const snapshotProtocol = protocol.ID("/opencoin/snapshot/1.0")
+
+const (
+	// maxSnapshotList caps how many manifests a peer may list.
+	maxSnapshotList = 16
+	snapshotTimeout = time.Minute
+)
+
+// SnapshotSource serves state snapshots.
+type SnapshotSource interface {
+	ListSnapshots() ([]*types.SnapshotManifest, error)
+	LoadSnapshotChunk(height uint64, index uint32) ([]byte, error)
+}
+
+// SnapshotSync serves and fetches state snapshots over a libp2p
+// request/response stream. A request is one frame holding a SnapshotRequest.
+// A request for height zero is answered with one frame per SnapshotManifest,
+// newest first; any other with a single frame holding the chunk. Either
+// response ends by closing the stream.
+type SnapshotSync struct {
+	p      *P2P
+	source SnapshotSource
+}
+
+// NewSnapshotSync registers the snapshot protocol handler serving from
+// source.
+func NewSnapshotSync(p *P2P, source SnapshotSource) *SnapshotSync {
+	s := &SnapshotSync{p: p, source: source}
+	p.Host.SetStreamHandler(snapshotProtocol, s.handleStream)
+	return s
+}
+
+// SyncPeers returns the IDs of the currently connected peers.
+func (s *SnapshotSync) SyncPeers() []string {
+	peers := s.p.Host.Network().Peers()
+	out := make([]string, 0, len(peers))
+	for _, id := range peers {
+		out = append(out, id.String())
+	}
+	return out
+}
+
+// ListSnapshots asks peerID for the manifests of the snapshots it serves.
+func (s *SnapshotSync) ListSnapshots(ctx context.Context, peerID string) ([]*types.SnapshotManifest, error) {
+	var out []*types.SnapshotManifest
+	err := s.request(ctx, peerID, &types.SnapshotRequest{}, func(frame []byte) error {
+		if len(out) == maxSnapshotList {
+			return fmt.Errorf("too many snapshots listed")
+		}
+		m, err := encoding.UnmarshalSnapshotManifest(frame)
+		if err != nil {
+			return err
+		}
+		out = append(out, m)
+		return nil
+	})
+	return out, err
+}
+
+// FetchSnapshotChunk asks peerID for chunk index of its snapshot at height.
+// The chunk is not verified.
+func (s *SnapshotSync) FetchSnapshotChunk(ctx context.Context, peerID string, height uint64, index uint32) ([]byte, error) {
+	if height == 0 {
+		return nil, fmt.Errorf("no snapshot at height 0")
+	}
+	var chunk []byte
+	err := s.request(ctx, peerID, &types.SnapshotRequest{Height: height, Index: index}, func(frame []byte) error {
+		if chunk != nil {
+			return fmt.Errorf("unexpected frame after chunk")
+		}
+		chunk = frame
+		return nil
+	})
+	if err == nil && chunk == nil {
+		err = fmt.Errorf("peer has no chunk %d of snapshot %d", index, height)
+	}
+	return chunk, err
+}
+
+// request sends req to peerID and passes every response frame to fn.
+func (s *SnapshotSync) request(ctx context.Context, peerID string, req *types.SnapshotRequest, fn func(frame []byte) error) error {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer id: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	stream, err := s.p.Host.NewStream(ctx, id, snapshotProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	b, err := encoding.MarshalSnapshotRequest(req)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(stream, b); err != nil {
+		return err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return err
+	}
+	for {
+		frame, err := readFrame(stream)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(frame); err != nil {
+			_ = stream.Reset()
+			return err
+		}
+	}
+}
+
+func (s *SnapshotSync) handleStream(stream network.Stream) {
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(snapshotTimeout))
+	frame, err := readFrame(stream)
+	if err != nil {
+		_ = stream.Reset()
+		return
+	}
+	req, err := encoding.UnmarshalSnapshotRequest(frame)
+	if err != nil || s.source == nil {
+		_ = stream.Reset()
+		return
+	}
+	if req.Height != 0 {
+		chunk, err := s.source.LoadSnapshotChunk(req.Height, req.Index)
+		if err != nil || len(chunk) == 0 {
+			return
+		}
+		_ = writeFrame(stream, chunk)
+		return
+	}
+	manifests, err := s.source.ListSnapshots()
+	if err != nil {
+		return
+	}
+	if len(manifests) > maxSnapshotList {
+		manifests = manifests[:maxSnapshotList]
+	}
+	for _, m := range manifests {
+		b, err := encoding.MarshalSnapshotManifest(m)
+		if err != nil {
+			return
+		}
+		if err := writeFrame(stream, b); err != nil {
+			return
+		}
+	}
+}
@@ -147,3 +147,198 @@ func unmarshalAccount(b []byte) (*types.Account, error) {
 	}
 	return acct, nil
 }
+
+func marshalUnbondingEntries(entries []*types.UnbondingEntry) []byte {
+	var b []byte
+	for _, e := range entries {
+		var eb []byte
+		eb = protowire.AppendTag(eb, 1, protowire.BytesType)
+		eb = protowire.AppendBytes(eb, []byte(e.Delegator))
+		eb = protowire.AppendTag(eb, 2, protowire.BytesType)
+		eb = protowire.AppendBytes(eb, []byte(e.Validator))
+		eb = protowire.AppendTag(eb, 3, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, e.Amount)
+		eb = protowire.AppendTag(eb, 4, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, e.CreationHeight)
+		eb = protowire.AppendTag(eb, 5, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, uint64(e.CompletionTime))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, eb)
+	}
+	return b
+}
+
+func unmarshalUnbondingEntries(b []byte) ([]*types.UnbondingEntry, error) {
+	var entries []*types.UnbondingEntry
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid unbonding tag")
+		}
+		b = b[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid unbonding field")
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid unbonding entry")
+		}
+		b = b[n:]
+		entry, err := unmarshalUnbondingEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func unmarshalUnbondingEntry(b []byte) (*types.UnbondingEntry, error) {
+	e := &types.UnbondingEntry{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid unbonding entry tag")
+		}
+		b = b[n:]
+		switch {
+		case (num == 1 || num == 2) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid unbonding address")
+			}
+			if num == 1 {
+				e.Delegator = types.Address(string(v))
+			} else {
+				e.Validator = types.Address(string(v))
+			}
+			b = b[n:]
+		case num >= 3 && num <= 5 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid unbonding value")
+			}
+			switch num {
+			case 3:
+				e.Amount = v
+			case 4:
+				e.CreationHeight = v
+			case 5:
+				e.CompletionTime = int64(v)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid unbonding entry field")
+			}
+			b = b[n:]
+		}
+	}
+	return e, nil
+}
+
+func marshalRedelegationEntries(entries []*types.RedelegationEntry) []byte {
+	var b []byte
+	for _, e := range entries {
+		var eb []byte
+		eb = protowire.AppendTag(eb, 1, protowire.BytesType)
+		eb = protowire.AppendBytes(eb, []byte(e.Delegator))
+		eb = protowire.AppendTag(eb, 2, protowire.BytesType)
+		eb = protowire.AppendBytes(eb, []byte(e.SrcValidator))
+		eb = protowire.AppendTag(eb, 3, protowire.BytesType)
+		eb = protowire.AppendBytes(eb, []byte(e.DstValidator))
+		eb = protowire.AppendTag(eb, 4, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, e.Amount)
+		eb = protowire.AppendTag(eb, 5, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, e.CreationHeight)
+		eb = protowire.AppendTag(eb, 6, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, uint64(e.CompletionTime))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, eb)
+	}
+	return b
+}
+
+func unmarshalRedelegationEntries(b []byte) ([]*types.RedelegationEntry, error) {
+	var entries []*types.RedelegationEntry
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid redelegation tag")
+		}
+		b = b[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid redelegation field")
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid redelegation entry")
+		}
+		b = b[n:]
+		entry, err := unmarshalRedelegationEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func unmarshalRedelegationEntry(b []byte) (*types.RedelegationEntry, error) {
+	e := &types.RedelegationEntry{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid redelegation entry tag")
+		}
+		b = b[n:]
+		switch {
+		case num >= 1 && num <= 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid redelegation address")
+			}
+			switch num {
+			case 1:
+				e.Delegator = types.Address(string(v))
+			case 2:
+				e.SrcValidator = types.Address(string(v))
+			case 3:
+				e.DstValidator = types.Address(string(v))
+			}
+			b = b[n:]
+		case num >= 4 && num <= 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid redelegation value")
+			}
+			switch num {
+			case 4:
+				e.Amount = v
+			case 5:
+				e.CreationHeight = v
+			case 6:
+				e.CompletionTime = int64(v)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid redelegation entry field")
+			}
+			b = b[n:]
+		}
+	}
+	return e, nil
+}
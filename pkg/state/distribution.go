@@ -0,0 +1,303 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// Delegator rewards are distributed lazily, F1 style. Each validator keeps
+// the cumulative reward earned per delegated unit, and each delegation
+// snapshots that ratio when it last changed, so what a delegation earned is
+// its amount times the ratio's growth since. Paying a validator's delegators
+// is then a single update per block, however many there are.
+//
+// Slashing a validator's delegations is lazy too. The validator records a
+// slash event with the fraction burned and the ratio at the time, and starts
+// a new slash period; a delegation settled in an earlier period earned at its
+// full amount up to each event since and at the reduced amount after it.
+
+// rewardRatioScale is the fixed-point scale of reward ratios.
+var rewardRatioScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+// stakeRecordVersion identifies the layout of delegation and validator
+// reward records; stores written with an older layout are converted when
+// opened.
+const stakeRecordVersion = 1
+
+// validatorRewards is the reward accounting of a validator's delegations.
+type validatorRewards struct {
+	delegated uint64   // sum of the validator's delegations
+	period    uint64   // slash events recorded so far
+	ratio     *big.Int // reward per delegated unit, scaled by rewardRatioScale
+}
+
+// delegationRecord is a delegation as stored: its amount when it was last
+// settled, and the slash period and reward ratio it was settled at.
+type delegationRecord struct {
+	amount uint64
+	period uint64
+	ratio  *big.Int
+}
+
+func validatorRewardsKey(validator types.Address) []byte {
+	return append([]byte(validatorRewardsPrefix), validator...)
+}
+
+// slashEventKey orders the slash events of a validator by period.
+func slashEventKey(validator types.Address, period uint64) []byte {
+	key := protowire.AppendBytes([]byte(slashEventPrefix), []byte(validator))
+	return binary.BigEndian.AppendUint64(key, period)
+}
+
+// encodeStakeRecord is the value layout shared by delegations, validator
+// rewards and slash events: two 8-byte big-endian amounts followed by a ratio.
+func encodeStakeRecord(amount, period uint64, ratio *big.Int) []byte {
+	b := make([]byte, 16, 16+len(ratio.Bytes()))
+	binary.BigEndian.PutUint64(b, amount)
+	binary.BigEndian.PutUint64(b[8:], period)
+	return append(b, ratio.Bytes()...)
+}
+
+func decodeStakeRecord(b []byte) (uint64, uint64, *big.Int, error) {
+	if len(b) < 16 {
+		return 0, 0, nil, fmt.Errorf("invalid stake record")
+	}
+	return binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:]), new(big.Int).SetBytes(b[16:]), nil
+}
+
+func getValidatorRewards(reader pebble.Reader, validator types.Address) (*validatorRewards, error) {
+	val, closer, err := reader.Get(validatorRewardsKey(validator))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return &validatorRewards{ratio: new(big.Int)}, nil
+		}
+		return nil, fmt.Errorf("get validator rewards: %w", err)
+	}
+	defer closer.Close()
+	delegated, period, ratio, err := decodeStakeRecord(val)
+	if err != nil {
+		return nil, err
+	}
+	return &validatorRewards{delegated: delegated, period: period, ratio: ratio}, nil
+}
+
+func setValidatorRewards(writer pebble.Writer, validator types.Address, r *validatorRewards) error {
+	return writer.Set(validatorRewardsKey(validator), encodeStakeRecord(r.delegated, r.period, r.ratio), nil)
+}
+
+// getSlashEvent returns the fraction, in basis points, that the slash event
+// ending period burned and the reward ratio when it did.
+func getSlashEvent(reader pebble.Reader, validator types.Address, period uint64) (uint64, *big.Int, error) {
+	val, closer, err := reader.Get(slashEventKey(validator, period))
+	if err != nil {
+		return 0, nil, fmt.Errorf("get slash event %d of %s: %w", period, validator, err)
+	}
+	defer closer.Close()
+	bps, _, ratio, err := decodeStakeRecord(val)
+	return bps, ratio, err
+}
+
+// earned returns what amount earned while the ratio grew from start to end.
+func earned(amount uint64, start, end *big.Int) uint64 {
+	growth := new(big.Int).Sub(end, start)
+	if growth.Sign() <= 0 {
+		return 0
+	}
+	reward := growth.Mul(growth, new(big.Int).SetUint64(amount))
+	reward.Quo(reward, rewardRatioScale)
+	if !reward.IsUint64() {
+		return ^uint64(0)
+	}
+	return reward.Uint64()
+}
+
+// settle returns the amount of d after the slash events recorded since it was
+// settled, and the rewards it earned meanwhile.
+func (d *delegationRecord) settle(reader pebble.Reader, validator types.Address, r *validatorRewards) (uint64, uint64, error) {
+	amount, start := d.amount, d.ratio
+	var reward uint64
+	for period := d.period; period < r.period; period++ {
+		bps, ratio, err := getSlashEvent(reader, validator, period)
+		if err != nil {
+			return 0, 0, err
+		}
+		reward += earned(amount, start, ratio)
+		amount -= slashAmount(amount, bps)
+		start = ratio
+	}
+	return amount, reward + earned(amount, start, r.ratio), nil
+}
+
+// slashAmount returns the share of amount that slashing bps burns.
+func slashAmount(amount, bps uint64) uint64 {
+	slash := mulDiv(amount, bps, 10_000)
+	if slash > amount {
+		slash = amount
+	}
+	return slash
+}
+
+// accrueDelegatorRewards adds reward to what the validator's delegations
+// have earned. Rounding dust is not distributed.
+func accrueDelegatorRewards(batch *pebble.Batch, validator types.Address, reward uint64) error {
+	r, err := getValidatorRewards(batch, validator)
+	if err != nil {
+		return err
+	}
+	if reward == 0 || r.delegated == 0 {
+		return nil
+	}
+	growth := new(big.Int).SetUint64(reward)
+	growth.Mul(growth, rewardRatioScale)
+	growth.Quo(growth, new(big.Int).SetUint64(r.delegated))
+	r.ratio.Add(r.ratio, growth)
+	return setValidatorRewards(batch, validator, r)
+}
+
+// slashDelegations burns slashBps of every delegation to validator by
+// recording a slash event. Each delegation takes its loss when next settled.
+func slashDelegations(batch *pebble.Batch, validator types.Address, slashBps uint64) error {
+	r, err := getValidatorRewards(batch, validator)
+	if err != nil {
+		return err
+	}
+	if slashBps == 0 || r.delegated == 0 {
+		return nil
+	}
+	if err := batch.Set(slashEventKey(validator, r.period), encodeStakeRecord(slashBps, 0, r.ratio), nil); err != nil {
+		return err
+	}
+	// Delegations round their loss down each, so together they may keep a
+	// few units more than the total; updateDelegation absorbs the difference.
+	r.delegated -= slashAmount(r.delegated, slashBps)
+	r.period++
+	return setValidatorRewards(batch, validator, r)
+}
+
+// updateDelegation settles the delegation of acct to validator and sets it to
+// amount. The rewards the delegation earned are paid to acct's balance, and
+// what slashing burned since it was last settled leaves acct's stake; the
+// new amount earns from the current ratio on.
+func updateDelegation(batch *pebble.Batch, validator types.Address, acct *types.Account, amount uint64) error {
+	r, err := getValidatorRewards(batch, validator)
+	if err != nil {
+		return err
+	}
+	d, err := getDelegationRecord(batch, validator, acct.Address)
+	if err != nil {
+		return err
+	}
+	current, reward, err := d.settle(batch, validator, r)
+	if err != nil {
+		return err
+	}
+	acct.Balance += reward
+	burned := d.amount - current
+	if burned > acct.Stake {
+		burned = acct.Stake
+	}
+	acct.Stake -= burned
+	if current > r.delegated {
+		current = r.delegated
+	}
+	r.delegated = r.delegated - current + amount
+	if err := setValidatorRewards(batch, validator, r); err != nil {
+		return err
+	}
+	key := delegationKey(validator, acct.Address)
+	if amount == 0 {
+		return batch.Delete(key, nil)
+	}
+	return batch.Set(key, encodeStakeRecord(amount, r.period, r.ratio), nil)
+}
+
+// DelegationReward is what a delegation has earned and not yet withdrawn.
+type DelegationReward struct {
+	Validator types.Address
+	Amount    uint64
+}
+
+// GetPendingRewards returns the unwithdrawn rewards of every delegation of
+// delegator, ordered by validator.
+func (s *Store) GetPendingRewards(delegator types.Address) ([]DelegationReward, error) {
+	var out []DelegationReward
+	err := iterateDelegationRecords(s.db, func(validator, d types.Address, rec *delegationRecord) error {
+		if d != delegator {
+			return nil
+		}
+		r, err := getValidatorRewards(s.db, validator)
+		if err != nil {
+			return err
+		}
+		_, reward, err := rec.settle(s.db, validator, r)
+		if err != nil {
+			return err
+		}
+		out = append(out, DelegationReward{Validator: validator, Amount: reward})
+		return nil
+	})
+	return out, err
+}
+
+// migrateStakeRecords converts delegation and validator reward records
+// written before slash periods, an amount and a ratio, to the current layout.
+// Converted records change the state root, so the state tree is rebuilt.
+func (s *Store) migrateStakeRecords() error {
+	val, closer, err := s.db.Get([]byte(metaStakeRecordVersion))
+	switch {
+	case err == nil:
+		version := binary.BigEndian.Uint64(val)
+		closer.Close()
+		if version == stakeRecordVersion {
+			return nil
+		}
+		return fmt.Errorf("unknown stake record version %d", version)
+	case err != pebble.ErrNotFound:
+		return err
+	}
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	converted := false
+	for _, prefix := range []string{delegationPrefix, validatorRewardsPrefix} {
+		iter, err := s.db.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: []byte(prefix + string([]byte{0xFF})),
+		})
+		if err != nil {
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			old := iter.Value()
+			if len(old) < 8 {
+				iter.Close()
+				return fmt.Errorf("invalid stake record")
+			}
+			rec := encodeStakeRecord(binary.BigEndian.Uint64(old), 0, new(big.Int).SetBytes(old[8:]))
+			if err := batch.Set(append([]byte(nil), iter.Key()...), rec, nil); err != nil {
+				iter.Close()
+				return err
+			}
+			converted = true
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	if converted {
+		if err := batch.Delete([]byte(metaStateTreeVersion), nil); err != nil {
+			return err
+		}
+	}
+	version := make([]byte, 8)
+	binary.BigEndian.PutUint64(version, stakeRecordVersion)
+	if err := batch.Set([]byte(metaStakeRecordVersion), version, nil); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestDelegatorRewardsAcrossSlash(t *testing.T) {
+	store := openTestStore(t)
+	alice := &types.Account{Address: "alice", Stake: 1000}
+	bob := &types.Account{Address: "bob", Stake: 3000}
+	carol := &types.Account{Address: "carol", Stake: 1000}
+
+	batch := store.NewIndexedBatch()
+	for _, acct := range []*types.Account{alice, bob} {
+		if err := updateDelegation(batch, "val", acct, acct.Stake); err != nil {
+			t.Fatalf("delegate: %v", err)
+		}
+	}
+	// One reward unit per delegated unit before the slash, and after it.
+	if err := accrueDelegatorRewards(batch, "val", 4000); err != nil {
+		t.Fatalf("accrue: %v", err)
+	}
+	if err := slashDelegations(batch, "val", 1000); err != nil {
+		t.Fatalf("slash: %v", err)
+	}
+	// carol joins after the slash and does not take it.
+	if err := updateDelegation(batch, "val", carol, carol.Stake); err != nil {
+		t.Fatalf("delegate: %v", err)
+	}
+	if err := accrueDelegatorRewards(batch, "val", 4600); err != nil {
+		t.Fatalf("accrue: %v", err)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	batch.Close()
+
+	want := map[types.Address]struct{ amount, reward uint64 }{
+		"alice": {900, 1000 + 900},
+		"bob":   {2700, 3000 + 2700},
+		"carol": {1000, 1000},
+	}
+	delegations := make(map[types.Address]uint64)
+	err := iterateDelegations(store.db, func(_, delegator types.Address, amount uint64) error {
+		delegations[delegator] = amount
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("delegations: %v", err)
+	}
+	for addr, w := range want {
+		if got := delegations[addr]; got != w.amount {
+			t.Fatalf("%s delegation %d, want %d", addr, got, w.amount)
+		}
+		pending, err := store.GetPendingRewards(addr)
+		if err != nil || len(pending) != 1 || pending[0].Amount != w.reward {
+			t.Fatalf("%s pending %+v, want %d: %v", addr, pending, w.reward, err)
+		}
+	}
+
+	// Withdrawing pays what accrued on both sides of the slash and takes the
+	// slashed stake out of the account; the next rewards start afresh.
+	batch = store.NewIndexedBatch()
+	defer batch.Close()
+	if err := updateDelegation(batch, "val", alice, 900); err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	if alice.Balance != 1900 || alice.Stake != 900 {
+		t.Fatalf("alice balance %d stake %d after withdrawing, want 1900 and 900", alice.Balance, alice.Stake)
+	}
+	if err := updateDelegation(batch, "val", alice, 900); err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	if alice.Balance != 1900 || alice.Stake != 900 {
+		t.Fatalf("second withdrawal paid again: balance %d stake %d", alice.Balance, alice.Stake)
+	}
+	if err := updateDelegation(batch, "val", bob, 0); err != nil {
+		t.Fatalf("undelegate: %v", err)
+	}
+	if bob.Balance != 5700 || bob.Stake != 2700 {
+		t.Fatalf("bob balance %d stake %d after leaving, want 5700 and 2700", bob.Balance, bob.Stake)
+	}
+	r, err := getValidatorRewards(batch, "val")
+	if err != nil {
+		t.Fatalf("rewards: %v", err)
+	}
+	if r.delegated != 1900 || r.period != 1 {
+		t.Fatalf("validator delegated %d in period %d, want 1900 in 1", r.delegated, r.period)
+	}
+}
+
+func TestOpenStoreMigratesStakeRecords(t *testing.T) {
+	home := t.TempDir()
+	store, err := OpenStore(home)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	// Records from before slash periods hold an amount and a ratio.
+	old := make([]byte, 8, 9)
+	binary.BigEndian.PutUint64(old, 500)
+	old = append(old, 7)
+	batch := store.db.NewBatch()
+	for _, key := range [][]byte{delegationKey("val", "alice"), validatorRewardsKey("val")} {
+		if err := batch.Set(key, old, nil); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := batch.Delete([]byte(metaStakeRecordVersion), nil); err != nil {
+		t.Fatalf("delete version: %v", err)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	store.Close()
+
+	store, err = OpenStore(home)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	d, err := getDelegationRecord(store.db, "val", "alice")
+	if err != nil || d.amount != 500 || d.period != 0 || d.ratio.Int64() != 7 {
+		t.Fatalf("migrated delegation %+v: %v", d, err)
+	}
+	r, err := getValidatorRewards(store.db, "val")
+	if err != nil || r.delegated != 500 || r.period != 0 || r.ratio.Int64() != 7 {
+		t.Fatalf("migrated rewards %+v: %v", r, err)
+	}
+	got, _ := ComputeStateRoot(store)
+	if err := store.rebuildStateTree(0); err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if want, _ := ComputeStateRoot(store); got != want {
+		t.Fatalf("state tree not rebuilt over the migrated records")
+	}
+}
@@ -1,7 +1,11 @@
 package state
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
 	"sort"
 
 	"github.com/cockroachdb/pebble"
@@ -9,69 +13,421 @@ import (
 	"github.com/georgecane/opencoin/pkg/types"
 )
 
-// ComputeStateRoot computes a deterministic Merkle root over account state.
-func ComputeStateRoot(store *Store) (types.Hash, error) {
-	return ComputeStateRootFromReader(store.db)
+// The state root is the root of a sparse Merkle tree over the consensus state:
+// accounts, staking records, the evidence punished and the timestamps of
+// recent blocks. A record sits at the path given by the
+// SHA-256 of its store key, and its leaf commits to the path and the hash of
+// its value. An empty subtree hashes to zero and a subtree holding a single
+// leaf is that leaf, so the tree is only as deep as it takes to tell the
+// paths apart. Nodes are stored by position and by the height that wrote
+// them, and a changed record rehashes only the nodes on its path, so the tree
+// of every height since it was built can still be read back for proofs.
+// Leaves keep their record, which is how a proof at an earlier height gets
+// the account it proves.
+
+// stateTreeVersion identifies the tree layout; stores built with another
+// layout, or before there was a tree, are rebuilt when opened.
+const stateTreeVersion = 3
+
+// latestTree selects the newest version of every tree node.
+const latestTree = math.MaxUint64
+
+// stateTreeFlushSize bounds the writes buffered while rebuilding the tree.
+const stateTreeFlushSize = 100_000
+
+// coveredPrefixes are the store prefixes the state root commits to.
+var coveredPrefixes = []string{accountPrefix, unbondingPrefix, redelegationPrefix, validatorPrefix, delegationPrefix, validatorRewardsPrefix, slashEventPrefix, signingInfoPrefix, blockTimePrefix, evidencePrefix, metaLastTimestamps}
+
+func isCovered(key []byte) bool {
+	for _, prefix := range coveredPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// treeNode is a node of the state tree. Leaves also carry their record.
+type treeNode struct {
+	leaf      bool
+	hash      types.Hash
+	path      types.Hash
+	valueHash types.Hash
+	value     []byte
+}
+
+func newLeaf(path types.Hash, value []byte) *treeNode {
+	valueHash := types.Hash(sha256.Sum256(value))
+	return &treeNode{leaf: true, hash: leafHash(path, valueHash), path: path, valueHash: valueHash, value: value}
+}
+
+func leafHash(path, valueHash types.Hash) types.Hash {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(path[:])
+	h.Write(valueHash[:])
+	var out types.Hash
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+func innerHash(left, right types.Hash) types.Hash {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	var out types.Hash
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+func nodeHash(n *treeNode) types.Hash {
+	if n == nil {
+		return types.Hash{}
+	}
+	return n.hash
+}
+
+// pathBit returns bit depth of path, most significant first.
+func pathBit(path types.Hash, depth int) byte {
+	return path[depth/8] >> (7 - uint(depth%8)) & 1
+}
+
+// siblingPath returns path with bit depth flipped.
+func siblingPath(path types.Hash, depth int) types.Hash {
+	path[depth/8] ^= 1 << (7 - uint(depth%8))
+	return path
+}
+
+// treeNodeKey addresses the node at depth on path: the depth followed by the
+// first depth bits of path. Each version of the node is stored under it
+// followed by the height that wrote it.
+func treeNodeKey(depth int, path types.Hash) []byte {
+	n := (depth + 7) / 8
+	key := make([]byte, len(stateTreePrefix)+2+n, len(stateTreePrefix)+2+n+8)
+	copy(key, stateTreePrefix)
+	binary.BigEndian.PutUint16(key[len(stateTreePrefix):], uint16(depth))
+	prefix := key[len(stateTreePrefix)+2:]
+	copy(prefix, path[:n])
+	if depth%8 != 0 {
+		prefix[n-1] &= 0xFF << (8 - uint(depth%8))
+	}
+	return key
+}
+
+// encodeTreeNode encodes n; an empty value marks a node removed at a height.
+func encodeTreeNode(n *treeNode) []byte {
+	if !n.leaf {
+		return append([]byte{0x01}, n.hash[:]...)
+	}
+	b := append([]byte{0x00}, n.path[:]...)
+	return append(b, n.value...)
+}
+
+func decodeTreeNode(b []byte) (*treeNode, error) {
+	switch {
+	case len(b) == 0:
+		return nil, nil
+	case len(b) == 33 && b[0] == 0x01:
+		n := &treeNode{}
+		copy(n.hash[:], b[1:])
+		return n, nil
+	case len(b) >= 33 && b[0] == 0x00:
+		var path types.Hash
+		copy(path[:], b[1:33])
+		return newLeaf(path, append([]byte(nil), b[33:]...)), nil
+	}
+	return nil, fmt.Errorf("invalid state tree node")
+}
+
+// getTreeNode returns the node at depth on path in the tree as of version,
+// nil if there is none.
+func getTreeNode(reader pebble.Reader, depth int, path types.Hash, version uint64) (*treeNode, error) {
+	key := treeNodeKey(depth, path)
+	upper := append(binary.BigEndian.AppendUint64(key, version), 0x00)
+	iter, err := reader.NewIter(&pebble.IterOptions{LowerBound: key, UpperBound: upper})
+	if err != nil {
+		return nil, fmt.Errorf("get state tree node: %w", err)
+	}
+	defer iter.Close()
+	if !iter.Last() {
+		if err := iter.Error(); err != nil {
+			return nil, fmt.Errorf("get state tree node: %w", err)
+		}
+		return nil, nil
+	}
+	return decodeTreeNode(iter.Value())
+}
+
+// nodeWriter is the part of pebble.Writer the tree writes through.
+type nodeWriter interface {
+	Set(key, value []byte, opts *pebble.WriteOptions) error
+}
+
+func setTreeNode(writer nodeWriter, depth int, path types.Hash, version uint64, n *treeNode) error {
+	return writer.Set(binary.BigEndian.AppendUint64(treeNodeKey(depth, path), version), encodeTreeNode(n), nil)
+}
+
+// removeTreeNode empties the position at depth on path from version on.
+func removeTreeNode(writer nodeWriter, depth int, path types.Hash, version uint64) error {
+	return writer.Set(binary.BigEndian.AppendUint64(treeNodeKey(depth, path), version), nil, nil)
 }
 
-// ComputeStateRootFromReader computes a deterministic Merkle root over a reader view.
-func ComputeStateRootFromReader(reader pebble.Reader) (types.Hash, error) {
-	type kv struct {
-		key []byte
-		val []byte
+// updateTree sets the record at path to leaf, or removes it when leaf is nil,
+// in the subtree at depth, writing the changed nodes at version, and returns
+// the subtree's new top node, nil once it is empty.
+func updateTree(batch *pebble.Batch, version uint64, depth int, path types.Hash, leaf *treeNode) (*treeNode, error) {
+	node, err := getTreeNode(batch, depth, path, latestTree)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case node == nil || (node.leaf && node.path == path):
+		if leaf == nil {
+			if node == nil {
+				return nil, nil
+			}
+			return nil, removeTreeNode(batch, depth, path, version)
+		}
+		return leaf, setTreeNode(batch, depth, path, version, leaf)
+	case node.leaf:
+		if leaf == nil {
+			return node, nil
+		}
+		// Another record sits here alone: push it a level down, where the
+		// insertion below meets it again until their paths part.
+		if err := setTreeNode(batch, depth+1, node.path, version, node); err != nil {
+			return nil, err
+		}
+	}
+	child, err := updateTree(batch, version, depth+1, path, leaf)
+	if err != nil {
+		return nil, err
+	}
+	sibling, err := getTreeNode(batch, depth+1, siblingPath(path, depth), latestTree)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case child == nil && sibling == nil:
+		return nil, removeTreeNode(batch, depth, path, version)
+	case child == nil && sibling.leaf, sibling == nil && child.leaf:
+		// A single record is left below: it moves up to this node.
+		last := child
+		if last == nil {
+			last = sibling
+		}
+		if err := removeTreeNode(batch, depth+1, last.path, version); err != nil {
+			return nil, err
+		}
+		return last, setTreeNode(batch, depth, path, version, last)
+	}
+	left, right := nodeHash(child), nodeHash(sibling)
+	if pathBit(path, depth) == 1 {
+		left, right = right, left
 	}
-	var items []kv
-	err := iterateAccounts(reader, func(key []byte, acct *types.Account) error {
-		val, err := marshalAccount(acct)
+	inner := &treeNode{hash: innerHash(left, right)}
+	return inner, setTreeNode(batch, depth, path, version, inner)
+}
+
+// updateStateTree folds the consensus records written in batch into the
+// state tree as of version, the height the writes belong to, and returns the
+// new state root. Only the paths of those records are rehashed. Folding the
+// same writes again leaves the tree unchanged.
+func updateStateTree(batch *pebble.Batch, version uint64) (types.Hash, error) {
+	touched := make(map[string]struct{})
+	r := batch.Reader()
+	for {
+		_, key, _, ok, err := r.Next()
 		if err != nil {
-			return err
+			return types.Hash{}, err
 		}
-		items = append(items, kv{key: append([]byte(nil), key...), val: val})
-		return nil
-	})
+		if !ok {
+			break
+		}
+		if isCovered(key) {
+			touched[string(key)] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(touched))
+	for key := range touched {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := types.Hash(sha256.Sum256([]byte(key)))
+		var leaf *treeNode
+		val, closer, err := batch.Get([]byte(key))
+		switch {
+		case err == nil:
+			leaf = newLeaf(path, append([]byte(nil), val...))
+			closer.Close()
+		case err != pebble.ErrNotFound:
+			return types.Hash{}, err
+		}
+		if _, err := updateTree(batch, version, 0, path, leaf); err != nil {
+			return types.Hash{}, err
+		}
+	}
+	return stateRootFromReader(batch, latestTree)
+}
+
+// ComputeStateRoot returns the committed state root.
+func ComputeStateRoot(store *Store) (types.Hash, error) {
+	return stateRootFromReader(store.db, latestTree)
+}
+
+func stateRootFromReader(reader pebble.Reader, version uint64) (types.Hash, error) {
+	root, err := getTreeNode(reader, 0, types.Hash{}, version)
 	if err != nil {
 		return types.Hash{}, err
 	}
-	sort.Slice(items, func(i, j int) bool {
-		return string(items[i].key) < string(items[j].key)
+	return nodeHash(root), nil
+}
+
+// treeRecord is a consensus record by path, as the tree is built from.
+type treeRecord struct {
+	path  types.Hash
+	value []byte
+}
+
+// migrateStateTree builds the state tree from the flat records if the store
+// has none or one of another layout, as stores written before the tree have.
+// This is the only full scan of the state; afterwards the tree is updated
+// with every write.
+func (s *Store) migrateStateTree() error {
+	val, closer, err := s.db.Get([]byte(metaStateTreeVersion))
+	switch {
+	case err == nil:
+		version := binary.BigEndian.Uint64(val)
+		closer.Close()
+		if version == stateTreeVersion {
+			return nil
+		}
+	case err != pebble.ErrNotFound:
+		return err
+	}
+	height, err := lastBlockHeight(s.db)
+	if err != nil {
+		return err
+	}
+	return s.rebuildStateTree(height)
+}
+
+// rebuildStateTree replaces the state tree with one built bottom-up from
+// every consensus record in the store, which is the state at height. Earlier
+// heights are not in the new tree.
+func (s *Store) rebuildStateTree(height uint64) error {
+	var records []treeRecord
+	for _, prefix := range coveredPrefixes {
+		iter, err := s.db.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: []byte(prefix + string([]byte{0xFF})),
+		})
+		if err != nil {
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			records = append(records, treeRecord{
+				path:  sha256.Sum256(iter.Key()),
+				value: append([]byte(nil), iter.Value()...),
+			})
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i].path[:], records[j].path[:]) < 0
 	})
-	leaves := make([][]byte, 0, len(items))
-	for _, it := range items {
-		h := sha256.New()
-		h.Write([]byte{0x00})
-		h.Write(it.key)
-		h.Write(it.val)
-		leaves = append(leaves, h.Sum(nil))
-	}
-	if len(leaves) == 0 {
-		return types.Hash{}, nil
-	}
-	root := merkleRoot(leaves)
-	var out types.Hash
-	copy(out[:], root)
-	return out, nil
+
+	w := &flushingWriter{db: s.db, batch: s.db.NewBatch()}
+	if err := w.batch.DeleteRange([]byte(stateTreePrefix), []byte(stateTreePrefix+string([]byte{0xFF})), nil); err != nil {
+		w.batch.Close()
+		return err
+	}
+	if _, err := buildTree(w, height, 0, records); err != nil {
+		w.batch.Close()
+		return err
+	}
+	version := make([]byte, 8)
+	binary.BigEndian.PutUint64(version, stateTreeVersion)
+	if err := w.batch.Set([]byte(metaStateTreeVersion), version, nil); err != nil {
+		w.batch.Close()
+		return err
+	}
+	base := make([]byte, 8)
+	binary.BigEndian.PutUint64(base, height)
+	if err := w.batch.Set([]byte(metaStateTreeBase), base, nil); err != nil {
+		w.batch.Close()
+		return err
+	}
+	return w.flush(pebble.Sync)
 }
 
-func merkleRoot(leaves [][]byte) []byte {
-	if len(leaves) == 0 {
-		return nil
+// buildTree writes the subtree at depth holding records, which share their
+// first depth bits and are sorted by path, at version and returns its top
+// node.
+func buildTree(w nodeWriter, version uint64, depth int, records []treeRecord) (*treeNode, error) {
+	switch len(records) {
+	case 0:
+		return nil, nil
+	case 1:
+		leaf := newLeaf(records[0].path, records[0].value)
+		return leaf, setTreeNode(w, depth, leaf.path, version, leaf)
 	}
-	nodes := leaves
-	for len(nodes) > 1 {
-		var next [][]byte
-		for i := 0; i < len(nodes); i += 2 {
-			left := nodes[i]
-			right := left
-			if i+1 < len(nodes) {
-				right = nodes[i+1]
-			}
-			h := sha256.New()
-			h.Write([]byte{0x01})
-			h.Write(left)
-			h.Write(right)
-			next = append(next, h.Sum(nil))
+	split := sort.Search(len(records), func(i int) bool { return pathBit(records[i].path, depth) == 1 })
+	left, err := buildTree(w, version, depth+1, records[:split])
+	if err != nil {
+		return nil, err
+	}
+	right, err := buildTree(w, version, depth+1, records[split:])
+	if err != nil {
+		return nil, err
+	}
+	inner := &treeNode{hash: innerHash(nodeHash(left), nodeHash(right))}
+	return inner, setTreeNode(w, depth, records[0].path, version, inner)
+}
+
+// stateTreeBase returns the height the state tree was built at; the tree has
+// no earlier heights.
+func stateTreeBase(reader pebble.Reader) (uint64, error) {
+	val, closer, err := reader.Get([]byte(metaStateTreeBase))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, nil
 		}
-		nodes = next
+		return 0, err
+	}
+	defer closer.Close()
+	if len(val) != 8 {
+		return 0, fmt.Errorf("invalid state tree base")
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// flushingWriter commits its batch every stateTreeFlushSize writes, so a
+// rebuild does not hold the whole tree in memory.
+type flushingWriter struct {
+	db     *pebble.DB
+	batch  *pebble.Batch
+	writes int
+}
+
+func (w *flushingWriter) Set(key, value []byte, _ *pebble.WriteOptions) error {
+	if err := w.batch.Set(key, value, nil); err != nil {
+		return err
 	}
-	return nodes[0]
+	w.writes++
+	if w.writes < stateTreeFlushSize {
+		return nil
+	}
+	err := w.flush(pebble.NoSync)
+	w.batch, w.writes = w.db.NewBatch(), 0
+	return err
+}
+
+func (w *flushingWriter) flush(opts *pebble.WriteOptions) error {
+	defer w.batch.Close()
+	return w.batch.Commit(opts)
 }
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// AccountProof proves an account, or that there is none, against the state
+// root of the block at Height. Siblings are the hashes next to the account's
+// path in the state tree, from the root down to where the path ends. An
+// exclusion proof ends either at an empty position or at the single other
+// record there, given by LeafPath and LeafValueHash.
+type AccountProof struct {
+	Height        uint64   `json:"height"`
+	Siblings      [][]byte `json:"siblings"`
+	LeafPath      []byte   `json:"leaf_path,omitempty"`
+	LeafValueHash []byte   `json:"leaf_value_hash,omitempty"`
+}
+
+// ProvenAccount is an account, nil if there is none, with its proof, as
+// queries return it.
+type ProvenAccount struct {
+	Address types.Address  `json:"address"`
+	Account *types.Account `json:"account"`
+	Proof   *AccountProof  `json:"proof"`
+}
+
+func accountPath(addr types.Address) types.Hash {
+	return sha256.Sum256([]byte(accountPrefix + string(addr)))
+}
+
+// ProveAccount returns the account at addr, nil if there is none, with a
+// proof against the state root of the block at height; zero selects the
+// latest committed block. Heights from before the state tree was built, as
+// happens when a store is migrated or restored from a snapshot, cannot be
+// proven.
+func (s *Store) ProveAccount(addr types.Address, height uint64) (*types.Account, *AccountProof, error) {
+	snap := s.db.NewSnapshot()
+	defer snap.Close()
+
+	latest, err := lastBlockHeight(snap)
+	if err != nil {
+		return nil, nil, err
+	}
+	if height == 0 {
+		height = latest
+	}
+	if height > latest {
+		return nil, nil, fmt.Errorf("height %d is above the latest committed height %d", height, latest)
+	}
+	base, err := stateTreeBase(snap)
+	if err != nil {
+		return nil, nil, err
+	}
+	if height < base {
+		return nil, nil, fmt.Errorf("state at height %d not retained, the state tree starts at %d", height, base)
+	}
+
+	proof := &AccountProof{Height: height}
+	path := accountPath(addr)
+	for depth := 0; ; depth++ {
+		node, err := getTreeNode(snap, depth, path, height)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case node == nil:
+			return nil, proof, nil
+		case node.leaf && node.path == path:
+			acct, err := unmarshalAccount(node.value)
+			if err != nil {
+				return nil, nil, err
+			}
+			return acct, proof, nil
+		case node.leaf:
+			proof.LeafPath = append([]byte(nil), node.path[:]...)
+			proof.LeafValueHash = append([]byte(nil), node.valueHash[:]...)
+			return nil, proof, nil
+		}
+		sibling, err := getTreeNode(snap, depth+1, siblingPath(path, depth), height)
+		if err != nil {
+			return nil, nil, err
+		}
+		h := nodeHash(sibling)
+		proof.Siblings = append(proof.Siblings, h[:])
+	}
+}
+
+// VerifyAccountProof checks that root commits to acct at addr, or, when acct
+// is nil, that it holds no account at addr. It needs nothing but its
+// arguments, so a client can check a node's answer against a root it trusts.
+func VerifyAccountProof(root types.Hash, addr types.Address, acct *types.Account, proof *AccountProof) error {
+	if proof == nil {
+		return fmt.Errorf("proof is nil")
+	}
+	if len(proof.Siblings) > len(types.Hash{})*8 {
+		return fmt.Errorf("proof too deep")
+	}
+	path := accountPath(addr)
+
+	var h types.Hash
+	switch {
+	case acct != nil:
+		if acct.Address != addr {
+			return fmt.Errorf("account is for %s, not %s", acct.Address, addr)
+		}
+		if len(proof.LeafPath) != 0 || len(proof.LeafValueHash) != 0 {
+			return fmt.Errorf("inclusion proof ends at another record")
+		}
+		val, err := marshalAccount(acct)
+		if err != nil {
+			return err
+		}
+		h = leafHash(path, sha256.Sum256(val))
+	case len(proof.LeafPath) != 0:
+		var leafPath, valueHash types.Hash
+		if len(proof.LeafPath) != len(leafPath) || len(proof.LeafValueHash) != len(valueHash) {
+			return fmt.Errorf("invalid proof leaf")
+		}
+		copy(leafPath[:], proof.LeafPath)
+		copy(valueHash[:], proof.LeafValueHash)
+		if leafPath == path {
+			return fmt.Errorf("proof shows an account at %s", addr)
+		}
+		for depth := range proof.Siblings {
+			if pathBit(leafPath, depth) != pathBit(path, depth) {
+				return fmt.Errorf("proof leaf is off the account path")
+			}
+		}
+		h = leafHash(leafPath, valueHash)
+	}
+
+	for depth := len(proof.Siblings) - 1; depth >= 0; depth-- {
+		var sibling types.Hash
+		if len(proof.Siblings[depth]) != len(sibling) {
+			return fmt.Errorf("invalid proof sibling")
+		}
+		copy(sibling[:], proof.Siblings[depth])
+		if pathBit(path, depth) == 0 {
+			h = innerHash(h, sibling)
+		} else {
+			h = innerHash(sibling, h)
+		}
+	}
+	if h != root {
+		return fmt.Errorf("proof does not match state root")
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestAccountProofs(t *testing.T) {
+	store := openTestStore(t)
+	for i := 0; i < 100; i++ {
+		if err := store.SetAccount(testAccount(i, uint64(i+1))); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	root, err := ComputeStateRoot(store)
+	if err != nil {
+		t.Fatalf("root: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		addr := testAccount(i, 0).Address
+		acct, proof, err := store.ProveAccount(addr, 0)
+		if err != nil {
+			t.Fatalf("prove %s: %v", addr, err)
+		}
+		if acct == nil || acct.Balance != uint64(i+1) {
+			t.Fatalf("proved account %+v", acct)
+		}
+		if err := VerifyAccountProof(root, addr, acct, proof); err != nil {
+			t.Fatalf("verify %s: %v", addr, err)
+		}
+		forged := *acct
+		forged.Balance++
+		if err := VerifyAccountProof(root, addr, &forged, proof); err == nil {
+			t.Fatalf("forged balance verified for %s", addr)
+		}
+		if err := VerifyAccountProof(root, addr, nil, proof); err == nil {
+			t.Fatalf("existing account %s proven absent", addr)
+		}
+	}
+
+	// Missing accounts end either at an empty position or at another record.
+	var empty, other int
+	for i := 0; i < 100; i++ {
+		addr := types.Address(fmt.Sprintf("missing%d", i))
+		acct, proof, err := store.ProveAccount(addr, 0)
+		if err != nil {
+			t.Fatalf("prove %s: %v", addr, err)
+		}
+		if acct != nil {
+			t.Fatalf("missing account proved present")
+		}
+		// The proof survives the JSON queries return it in.
+		data, err := json.Marshal(&ProvenAccount{Address: addr, Proof: proof})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var proven ProvenAccount
+		if err := json.Unmarshal(data, &proven); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if err := VerifyAccountProof(root, proven.Address, proven.Account, proven.Proof); err != nil {
+			t.Fatalf("verify exclusion of %s: %v", addr, err)
+		}
+		if err := VerifyAccountProof(root, addr, &types.Account{Address: addr}, proof); err == nil {
+			t.Fatalf("missing account %s proven present", addr)
+		}
+		if len(proof.LeafPath) == 0 {
+			empty++
+		} else {
+			other++
+		}
+	}
+	if empty == 0 || other == 0 {
+		t.Fatalf("exclusion proofs not exercised: %d empty, %d other", empty, other)
+	}
+
+	if _, _, err := store.ProveAccount(testAccount(0, 0).Address, 5); err == nil {
+		t.Fatalf("expected a height above the latest block to fail")
+	}
+	acct, proof, _ := store.ProveAccount(testAccount(0, 0).Address, 0)
+	if err := VerifyAccountProof(types.Hash{1}, acct.Address, acct, proof); err == nil {
+		t.Fatalf("proof verified against another root")
+	}
+}
+
+func TestAccountProofEmptyState(t *testing.T) {
+	store := openTestStore(t)
+	acct, proof, err := store.ProveAccount("nobody", 0)
+	if err != nil || acct != nil {
+		t.Fatalf("prove: %v %+v", err, acct)
+	}
+	if err := VerifyAccountProof(types.Hash{}, "nobody", nil, proof); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestAccountProofsAtEarlierHeights(t *testing.T) {
+	store := openTestStore(t)
+	addr := testAccount(0, 0).Address
+	roots := make(map[uint64]types.Hash)
+	for h := uint64(1); h <= 4; h++ {
+		err := store.writeState(func(batch *pebble.Batch) error {
+			if err := setBlockWithWriter(batch, &types.Block{Height: h}, types.Hash{byte(h)}); err != nil {
+				return err
+			}
+			for i := 0; i < 20; i++ {
+				if err := setAccountWithWriter(batch, testAccount(i, h*100+uint64(i)), nil); err != nil {
+					return err
+				}
+			}
+			if h == 4 {
+				// The account is gone at the last height only.
+				return batch.Delete([]byte(accountPrefix+string(addr)), nil)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("write height %d: %v", h, err)
+		}
+		roots[h], _ = ComputeStateRoot(store)
+	}
+
+	for h := uint64(1); h <= 3; h++ {
+		acct, proof, err := store.ProveAccount(addr, h)
+		if err != nil {
+			t.Fatalf("prove at %d: %v", h, err)
+		}
+		if acct == nil || acct.Balance != h*100 || proof.Height != h {
+			t.Fatalf("proved %+v at %d", acct, proof.Height)
+		}
+		if err := VerifyAccountProof(roots[h], addr, acct, proof); err != nil {
+			t.Fatalf("verify at %d: %v", h, err)
+		}
+		if err := VerifyAccountProof(roots[h+1], addr, acct, proof); err == nil {
+			t.Fatalf("proof at %d verified against the next root", h)
+		}
+	}
+	acct, proof, err := store.ProveAccount(addr, 0)
+	if err != nil || acct != nil || proof.Height != 4 {
+		t.Fatalf("latest proof: %v %+v", err, acct)
+	}
+	if err := VerifyAccountProof(roots[4], addr, nil, proof); err != nil {
+		t.Fatalf("verify exclusion: %v", err)
+	}
+
+	// A rebuilt tree starts at the height it was built at.
+	if err := store.rebuildStateTree(4); err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if _, _, err := store.ProveAccount(addr, 3); err == nil {
+		t.Fatalf("expected a height before the rebuild to fail")
+	}
+}
@@ -0,0 +1,277 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// redelegationKey orders entries by completion time, like unbondingKey.
+func redelegationKey(completion int64, delegator types.Address) []byte {
+	if completion < 0 {
+		completion = 0
+	}
+	key := append([]byte(redelegationPrefix), make([]byte, 8)...)
+	binary.BigEndian.PutUint64(key[len(redelegationPrefix):], uint64(completion))
+	return append(key, delegator...)
+}
+
+// redelegationIndexKey indexes the entries of delegator to dst completing at
+// completion. The index is derived from the entries and not part of the state
+// root; it lets a redelegation check for stake still maturing at its source
+// without scanning every entry.
+func redelegationIndexKey(delegator, dst types.Address, completion int64) []byte {
+	if completion < 0 {
+		completion = 0
+	}
+	return binary.BigEndian.AppendUint64(redelegationIndexPrefixOf(delegator, dst), uint64(completion))
+}
+
+// redelegationIndexPrefixOf groups the index keys of delegator to dst.
+func redelegationIndexPrefixOf(delegator, dst types.Address) []byte {
+	key := protowire.AppendBytes([]byte(redelegationIndexPrefix), []byte(delegator))
+	return protowire.AppendBytes(key, []byte(dst))
+}
+
+// hasMaturingRedelegation reports whether delegator redelegated to dst and the
+// entry has not matured yet.
+func hasMaturingRedelegation(reader pebble.Reader, delegator, dst types.Address) (bool, error) {
+	prefix := redelegationIndexPrefixOf(delegator, dst)
+	iter, err := reader.NewIter(&pebble.IterOptions{LowerBound: prefix})
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	if !iter.First() {
+		return false, iter.Error()
+	}
+	return bytes.HasPrefix(iter.Key(), prefix), nil
+}
+
+// GetRedelegations returns the maturing redelegations of delegator, earliest first.
+func (s *Store) GetRedelegations(delegator types.Address) ([]*types.RedelegationEntry, error) {
+	return getRedelegationsFromReader(s.db, delegator)
+}
+
+// getRedelegationsFromReader finds the entries of delegator through the
+// index, which holds the completion time of each.
+func getRedelegationsFromReader(reader pebble.Reader, delegator types.Address) ([]*types.RedelegationEntry, error) {
+	prefix := protowire.AppendBytes([]byte(redelegationIndexPrefix), []byte(delegator))
+	iter, err := reader.NewIter(&pebble.IterOptions{LowerBound: prefix})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool)
+	var completions []int64
+	for iter.First(); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+		key := iter.Key()
+		completion := int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+		if !seen[completion] {
+			seen[completion] = true
+			completions = append(completions, completion)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Slice(completions, func(i, j int) bool { return completions[i] < completions[j] })
+
+	var out []*types.RedelegationEntry
+	for _, completion := range completions {
+		val, closer, err := reader.Get(redelegationKey(completion, delegator))
+		if err != nil {
+			return nil, fmt.Errorf("get redelegation: %w", err)
+		}
+		entries, err := unmarshalRedelegationEntries(val)
+		closer.Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, entries...)
+	}
+	return out, nil
+}
+
+// iterateRedelegations calls fn for every redelegation key below upper, or for
+// all of them when upper is nil, in completion order.
+func iterateRedelegations(reader pebble.Reader, upper []byte, fn func(key []byte, entries []*types.RedelegationEntry) error) error {
+	if upper == nil {
+		upper = []byte(redelegationPrefix + string([]byte{0xFF}))
+	}
+	iter, err := reader.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(redelegationPrefix),
+		UpperBound: upper,
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		entries, err := unmarshalRedelegationEntries(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(append([]byte(nil), iter.Key()...), entries); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// addRedelegation records entry in batch.
+func addRedelegation(batch *pebble.Batch, entry *types.RedelegationEntry) error {
+	key := redelegationKey(entry.CompletionTime, entry.Delegator)
+	var entries []*types.RedelegationEntry
+	val, closer, err := batch.Get(key)
+	switch {
+	case err == nil:
+		entries, err = unmarshalRedelegationEntries(val)
+		closer.Close()
+		if err != nil {
+			return err
+		}
+	case err != pebble.ErrNotFound:
+		return fmt.Errorf("get redelegation: %w", err)
+	}
+	entries = append(entries, entry)
+	if err := batch.Set(redelegationIndexKey(entry.Delegator, entry.DstValidator, entry.CompletionTime), nil, nil); err != nil {
+		return err
+	}
+	return batch.Set(key, marshalRedelegationEntries(entries), nil)
+}
+
+// matureRedelegations forgets every entry completing at or before now; the
+// stake already sits with the destination validator.
+func matureRedelegations(batch *pebble.Batch, now int64) error {
+	var keys [][]byte
+	err := iterateRedelegations(batch, redelegationKey(now+1, ""), func(key []byte, entries []*types.RedelegationEntry) error {
+		keys = append(keys, key)
+		for _, e := range entries {
+			keys = append(keys, redelegationIndexKey(e.Delegator, e.DstValidator, e.CompletionTime))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRedelegationIndex builds the redelegation index for stores written
+// before it.
+func (s *Store) migrateRedelegationIndex() error {
+	_, closer, err := s.db.Get([]byte(metaRedelegationIndex))
+	switch {
+	case err == nil:
+		closer.Close()
+		return nil
+	case err != pebble.ErrNotFound:
+		return err
+	}
+	return s.rebuildRedelegationIndex()
+}
+
+// rebuildRedelegationIndex replaces the redelegation index with one built from
+// the entries in the store.
+func (s *Store) rebuildRedelegationIndex() error {
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	if err := batch.DeleteRange([]byte(redelegationIndexPrefix), []byte(redelegationIndexPrefix+string([]byte{0xFF})), nil); err != nil {
+		return err
+	}
+	err := iterateRedelegations(s.db, nil, func(_ []byte, entries []*types.RedelegationEntry) error {
+		for _, e := range entries {
+			if err := batch.Set(redelegationIndexKey(e.Delegator, e.DstValidator, e.CompletionTime), nil, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Set([]byte(metaRedelegationIndex), []byte{1}, nil); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// slashRedelegations burns SlashDoubleBps of the stake redelegated away from
+// an equivocating validator after the offence, as jailDoubleSigners does for
+// the stake still bonded to it. The stake now backs the destination
+// validator, so it is taken from that delegation.
+func (s *State) slashRedelegations(batch *pebble.Batch, evidence []*types.DuplicateVoteEvidence, get func(types.Address) (*types.Account, error), set func(*types.Account) error) error {
+	if len(evidence) == 0 || s.staking.SlashDoubleBps == 0 {
+		return nil
+	}
+	updates := make(map[string][]*types.RedelegationEntry)
+	var order []string
+	var slashed []*types.RedelegationEntry
+	err := iterateRedelegations(batch, nil, func(key []byte, entries []*types.RedelegationEntry) error {
+		changed := false
+		for _, e := range entries {
+			for _, ev := range evidence {
+				if ev == nil || e.SrcValidator != ev.Validator || e.CreationHeight <= ev.Height {
+					continue
+				}
+				slash := mulDiv(e.Amount, s.staking.SlashDoubleBps, 10_000)
+				if slash > e.Amount {
+					slash = e.Amount
+				}
+				e.Amount -= slash
+				changed = true
+				slashed = append(slashed, &types.RedelegationEntry{Delegator: e.Delegator, DstValidator: e.DstValidator, Amount: slash})
+			}
+		}
+		if changed {
+			updates[string(key)] = entries
+			order = append(order, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range order {
+		if err := batch.Set([]byte(key), marshalRedelegationEntries(updates[key]), nil); err != nil {
+			return err
+		}
+	}
+	for _, sl := range slashed {
+		delegated, err := getDelegationFromReader(batch, sl.DstValidator, sl.Delegator)
+		if err != nil {
+			return err
+		}
+		// Part of the stake may already have been undelegated.
+		burn := sl.Amount
+		if burn > delegated {
+			burn = delegated
+		}
+		acct, err := get(sl.Delegator)
+		if err != nil {
+			return err
+		}
+		if err := updateDelegation(batch, sl.DstValidator, acct, delegated-burn); err != nil {
+			return err
+		}
+		if burn > acct.Stake {
+			burn = acct.Stake
+		}
+		acct.Stake -= burn
+		if err := set(acct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
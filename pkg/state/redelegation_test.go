@@ -0,0 +1,91 @@
+package state
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestRedelegationIndexFollowsEntries(t *testing.T) {
+	c := newTestChain(t,
+		&types.Validator{OperatorAddress: "val0", Stake: 1000},
+		&types.Validator{OperatorAddress: "val1", Stake: 1},
+		&types.Validator{OperatorAddress: "val2", Stake: 1},
+	)
+	c.state.SetStakingParams(StakingParams{UnbondingPeriod: 100})
+	kp, delegator := c.fund(1000)
+	other, _ := c.fund(1000)
+	c.commit([]*types.Transaction{
+		c.signedTx(kp, 0, tx.StakeDelegate{Validator: "val1", Amount: 1000}),
+		c.signedTx(other, 0, tx.StakeDelegate{Validator: "val1", Amount: 1000}),
+	})
+	c.commit([]*types.Transaction{
+		c.signedTx(kp, 1, tx.StakeRedelegate{From: "val1", To: "val2", Amount: 300}),
+		c.signedTx(other, 1, tx.StakeRedelegate{From: "val1", To: "val2", Amount: 300}),
+	})
+	c.now += 10
+	c.commit([]*types.Transaction{c.signedTx(kp, 2, tx.StakeRedelegate{From: "val1", To: "val2", Amount: 200})})
+
+	entries, err := c.state.Store().GetRedelegations(delegator)
+	if err != nil {
+		t.Fatalf("redelegations: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Amount != 300 || entries[1].Amount != 200 || entries[0].CompletionTime >= entries[1].CompletionTime {
+		t.Fatalf("expected the delegator's two entries, earliest first, got %+v", entries)
+	}
+
+	hop := func() error {
+		block := &types.Block{Height: c.parent.Height + 1, Timestamp: c.now + 1, Transactions: []*types.Transaction{
+			c.signedTx(kp, 3, tx.StakeRedelegate{From: "val2", To: "val0", Amount: 100}),
+		}}
+		_, err := c.state.PreviewBlock(block, nil)
+		return err
+	}
+	if err := hop(); err == nil || !strings.Contains(err.Error(), "not matured") {
+		t.Fatalf("hop before maturity: %v", err)
+	}
+	// A store from before the index rebuilds it when opened.
+	db := c.state.Store().db
+	if err := db.DeleteRange([]byte(redelegationIndexPrefix), []byte(redelegationIndexPrefix+string([]byte{0xFF})), pebble.Sync); err != nil {
+		t.Fatalf("delete index: %v", err)
+	}
+	if err := db.Delete([]byte(metaRedelegationIndex), pebble.Sync); err != nil {
+		t.Fatalf("delete index marker: %v", err)
+	}
+	if err := c.state.Store().migrateRedelegationIndex(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := hop(); err == nil || !strings.Contains(err.Error(), "not matured") {
+		t.Fatalf("hop before maturity after migration: %v", err)
+	}
+
+	// The first entry maturing leaves the second one holding the stake.
+	c.now = entries[0].CompletionTime - 1
+	c.commit(nil)
+	if entries, _ := c.state.Store().GetRedelegations(delegator); len(entries) != 1 || entries[0].Amount != 200 {
+		t.Fatalf("after the first entry matured: %+v", entries)
+	}
+	if err := hop(); err == nil {
+		t.Fatalf("hop while an entry is still maturing")
+	}
+	c.now = entries[1].CompletionTime - 1
+	c.commit(nil)
+	if err := hop(); err != nil {
+		t.Fatalf("hop after maturity: %v", err)
+	}
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(redelegationIndexPrefix),
+		UpperBound: []byte(redelegationIndexPrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		t.Fatalf("iter: %v", err)
+	}
+	defer iter.Close()
+	if iter.First() {
+		t.Fatalf("matured entries left in the index")
+	}
+}
@@ -0,0 +1,169 @@
+package state
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// RewardParams controls how much is minted per block and how it is split.
+type RewardParams struct {
+	BlockReward       uint64 // minted for every finalized block
+	ProposerRewardBps uint64 // share of BlockReward paid to the proposer, in basis points
+}
+
+// SetRewardParams sets the block reward parameters. A zero BlockReward mints nothing.
+func (s *State) SetRewardParams(p RewardParams) { s.rewards = p }
+
+// RewardParams returns the block reward parameters.
+func (s *State) RewardParams() RewardParams { return s.rewards }
+
+// mulDiv returns a*b/c without overflowing the intermediate product.
+func mulDiv(a, b, c uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi >= c {
+		return ^uint64(0)
+	}
+	q, _ := bits.Div64(hi, lo, c)
+	return q
+}
+
+// distributeRewards mints the reward for block's parent, whose finality
+// block.LastCommit proves. The proposer of the parent takes ProposerRewardBps,
+// the remainder is shared among the validators that signed LastCommit in
+// proportion to their power, and each validator's amount is split into its
+// commission and a pro rata share of its self-stake and delegations. The
+// delegations' share accrues until the delegators withdraw it.
+// parent may be nil when it is already committed.
+func (s *State) distributeRewards(batch *pebble.Batch, block, parent *types.Block, get func(types.Address) (*types.Account, error), set func(*types.Account) error) error {
+	reward := s.rewards.BlockReward
+	qc := block.LastCommit
+	if reward == 0 || qc == nil {
+		return nil
+	}
+	if qc.BlockHash != block.PrevHash || qc.Height+1 != block.Height {
+		return fmt.Errorf("last commit does not certify the parent of block %d", block.Height)
+	}
+	if parent == nil {
+		var err error
+		if parent, err = s.store.GetBlockByHash(block.PrevHash); err != nil {
+			return err
+		}
+		if parent == nil {
+			return fmt.Errorf("parent of block %d not found", block.Height)
+		}
+	}
+	vset, err := s.store.GetValidatorSet(qc.Height)
+	if err != nil {
+		return err
+	}
+	if vset == nil || len(vset.Validators) == 0 {
+		return fmt.Errorf("no validator set for height %d", qc.Height)
+	}
+	if len(qc.SigBitmap) != (len(vset.Validators)+7)/8 {
+		return fmt.Errorf("invalid last commit bitmap length")
+	}
+
+	var signers []*types.Validator
+	var signedPower uint64
+	for i, v := range vset.Validators {
+		if qc.SigBitmap[i/8]&(1<<uint(i%8)) != 0 {
+			signers = append(signers, v)
+			signedPower += v.Power
+		}
+	}
+	if signedPower == 0 {
+		return fmt.Errorf("last commit carries no voting power")
+	}
+
+	payouts := make(map[types.Address]uint64)
+	var proposer *types.Validator
+	if idx, ok := vset.IndexByAddr[parent.Proposer]; ok && int(idx) < len(vset.Validators) {
+		proposer = vset.Validators[idx]
+	}
+	pool := reward
+	if proposer != nil {
+		share := mulDiv(reward, s.rewards.ProposerRewardBps, 10_000)
+		if share > reward {
+			share = reward
+		}
+		pool -= share
+		payouts[proposer.OperatorAddress] += share
+	}
+	var paid uint64
+	for _, v := range signers {
+		amt := mulDiv(pool, v.Power, signedPower)
+		payouts[v.OperatorAddress] += amt
+		paid += amt
+	}
+	// Rounding dust goes to the proposer, or to the first signer if the
+	// proposer has left the set.
+	if proposer != nil {
+		payouts[proposer.OperatorAddress] += pool - paid
+	} else {
+		payouts[signers[0].OperatorAddress] += pool - paid
+	}
+
+	credits := make(map[types.Address]uint64)
+	for _, v := range vset.Validators {
+		if amt := payouts[v.OperatorAddress]; amt > 0 {
+			if err := splitValidatorReward(batch, v, amt, credits); err != nil {
+				return err
+			}
+		}
+	}
+	addrs := make([]types.Address, 0, len(credits))
+	for addr := range credits {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		acct, err := get(addr)
+		if err != nil {
+			return err
+		}
+		acct.Balance += credits[addr]
+		if err := set(acct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitValidatorReward pays amt earned by v: the operator keeps Commission
+// basis points and the rest is shared by self-stake and delegations in
+// proportion to their bonded amounts, as recorded in state. Validators
+// without a state record pay everything to the operator.
+func splitValidatorReward(batch *pebble.Batch, v *types.Validator, amt uint64, credits map[types.Address]uint64) error {
+	rec, err := getValidatorFromReader(batch, v.OperatorAddress)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		credits[v.OperatorAddress] += amt
+		return nil
+	}
+	r, err := getValidatorRewards(batch, v.OperatorAddress)
+	if err != nil {
+		return err
+	}
+	commission := mulDiv(amt, uint64(rec.Commission), 10_000)
+	if commission > amt {
+		commission = amt
+	}
+	var delegated uint64
+	if bonded := rec.Stake + r.delegated; bonded > 0 {
+		delegated = mulDiv(amt-commission, r.delegated, bonded)
+	}
+	if err := accrueDelegatorRewards(batch, v.OperatorAddress, delegated); err != nil {
+		return err
+	}
+	// The operator keeps its commission and the self-stake share, which
+	// absorbs the rounding dust.
+	credits[v.OperatorAddress] += amt - delegated
+	return nil
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestBlockRewardsPaidToSignersAndDelegators(t *testing.T) {
+	c := newTestChain(t, &types.Validator{OperatorAddress: "val0", Stake: 900, Commission: 1000}, &types.Validator{OperatorAddress: "val1", Stake: 1})
+	c.state.SetRewardParams(RewardParams{BlockReward: 10_000, ProposerRewardBps: 500})
+	kp, alice := c.fund(100)
+	c.commit([]*types.Transaction{c.signedTx(kp, 0, tx.StakeDelegate{Validator: "val0", Amount: 100})})
+	c.commit(nil)
+	c.commit(nil)
+
+	// Alice delegates in block 1; blocks 2 and 3 pay for blocks 1 and 2.
+	// val0 proposed and alone signed both, so it earns the whole reward: 10%
+	// commission, then 900:100 between its self-stake and alice's
+	// delegation. val1 did not sign. Alice's share waits to be withdrawn.
+	want := map[types.Address]uint64{"val0": 2 * 9100, alice: 0, "val1": 0}
+	for addr, balance := range want {
+		acct, err := c.state.GetAccount(addr)
+		if err != nil {
+			t.Fatalf("get %s: %v", addr, err)
+		}
+		if acct.Balance != balance {
+			t.Fatalf("%s balance %d, want %d", addr, acct.Balance, balance)
+		}
+	}
+	pending, err := c.state.Store().GetPendingRewards(alice)
+	if err != nil {
+		t.Fatalf("pending rewards: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Validator != "val0" || pending[0].Amount != 2*900 {
+		t.Fatalf("pending rewards %+v, want 1800 from val0", pending)
+	}
+
+	c.commit([]*types.Transaction{c.signedTx(kp, 1, tx.WithdrawRewards{Validator: "val0"})})
+	c.commit(nil)
+	// Withdrawn and pending rewards add up to alice's share of every block
+	// paid for so far.
+	acct, _ := c.state.GetAccount(alice)
+	pending, _ = c.state.Store().GetPendingRewards(alice)
+	if acct.Balance != 3*900 || pending[0].Amount != 900 {
+		t.Fatalf("withdrew %d with %d pending, want 2700 and 900", acct.Balance, pending[0].Amount)
+	}
+
+	// The rewarded balance is provable against the header of any height.
+	for h := uint64(3); h <= 5; h++ {
+		proved, proof, err := c.state.Store().ProveAccount("val0", h)
+		if err != nil {
+			t.Fatalf("prove at %d: %v", h, err)
+		}
+		header, err := c.state.Store().GetBlockByHeight(h)
+		if err != nil || header == nil {
+			t.Fatalf("header at %d: %v", h, err)
+		}
+		if proved.Balance != (h-1)*9100 {
+			t.Fatalf("proved balance %d at %d", proved.Balance, h)
+		}
+		if err := VerifyAccountProof(header.StateRoot, "val0", proved, proof); err != nil {
+			t.Fatalf("verify against header %d: %v", h, err)
+		}
+	}
+}
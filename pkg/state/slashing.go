@@ -0,0 +1,182 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// signingInfo is the liveness window of a validator: whether it signed each
+// of the last finalized blocks it was expected to sign.
+type signingInfo struct {
+	next     uint64 // blocks recorded; the next one goes to slot next % window
+	observed uint64 // blocks in the window, at most its size
+	missed   uint64 // blocks of the window the validator did not sign
+	bits     []byte // one bit per slot, set when that block was missed
+}
+
+func signingInfoKey(addr types.Address) []byte {
+	return append([]byte(signingInfoPrefix), addr...)
+}
+
+func encodeSigningInfo(info *signingInfo) []byte {
+	b := make([]byte, 24, 24+len(info.bits))
+	binary.BigEndian.PutUint64(b, info.next)
+	binary.BigEndian.PutUint64(b[8:], info.observed)
+	binary.BigEndian.PutUint64(b[16:], info.missed)
+	return append(b, info.bits...)
+}
+
+// getSigningInfo returns the window of addr. A validator without one, or
+// whose window was recorded for another window size, starts afresh.
+func getSigningInfo(reader pebble.Reader, addr types.Address, window uint64) (*signingInfo, error) {
+	fresh := &signingInfo{bits: make([]byte, (window+7)/8)}
+	val, closer, err := reader.Get(signingInfoKey(addr))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return fresh, nil
+		}
+		return nil, fmt.Errorf("get signing info: %w", err)
+	}
+	defer closer.Close()
+	if len(val) < 24 {
+		return nil, fmt.Errorf("invalid signing info")
+	}
+	if uint64(len(val)-24) != (window+7)/8 {
+		return fresh, nil
+	}
+	return &signingInfo{
+		next:     binary.BigEndian.Uint64(val),
+		observed: binary.BigEndian.Uint64(val[8:]),
+		missed:   binary.BigEndian.Uint64(val[16:]),
+		bits:     append([]byte(nil), val[24:]...),
+	}, nil
+}
+
+// record slides the window by one block, dropping the oldest.
+func (info *signingInfo) record(window uint64, signed bool) {
+	slot := info.next % window
+	mask := byte(1) << (slot % 8)
+	if info.bits[slot/8]&mask != 0 {
+		info.missed--
+	}
+	info.bits[slot/8] &^= mask
+	if !signed {
+		info.bits[slot/8] |= mask
+		info.missed++
+	}
+	info.next++
+	if info.observed < window {
+		info.observed++
+	}
+}
+
+// offline reports whether the window is full and more than maxMissedBps of
+// it was missed.
+func (info *signingInfo) offline(window, maxMissedBps uint64) bool {
+	return info.observed >= window && info.missed*10_000 > window*maxMissedBps
+}
+
+// trackLiveness records which validators signed block.LastCommit, the QC
+// finalizing the parent, and slashes and jails those that missed too much of
+// the window. A validator that is already jailed is not punished again for
+// the same absence; either way its window starts afresh.
+func (s *State) trackLiveness(batch *pebble.Batch, block *types.Block, get func(types.Address) (*types.Account, error), set func(*types.Account) error) error {
+	window := s.staking.SignedBlocksWindow
+	qc := block.LastCommit
+	if window == 0 || qc == nil {
+		return nil
+	}
+	vset, err := s.store.GetValidatorSet(qc.Height)
+	if err != nil {
+		return err
+	}
+	if vset == nil {
+		return fmt.Errorf("no validator set for height %d", qc.Height)
+	}
+	if len(qc.SigBitmap) != (len(vset.Validators)+7)/8 {
+		return fmt.Errorf("invalid last commit bitmap length")
+	}
+	for i, v := range vset.Validators {
+		info, err := getSigningInfo(batch, v.OperatorAddress, window)
+		if err != nil {
+			return err
+		}
+		info.record(window, qc.SigBitmap[i/8]&(1<<uint(i%8)) != 0)
+		if !info.offline(window, s.staking.MaxMissedBps) {
+			if err := batch.Set(signingInfoKey(v.OperatorAddress), encodeSigningInfo(info), nil); err != nil {
+				return err
+			}
+			continue
+		}
+		rec, err := getValidatorFromReader(batch, v.OperatorAddress)
+		if err != nil {
+			return err
+		}
+		if rec != nil && !rec.Jailed {
+			if err := s.jailValidator(batch, rec, s.staking.SlashOfflineBps, s.staking.JailOfflineEpochs, block.Height, get, set); err != nil {
+				return err
+			}
+		}
+		if err := batch.Delete(signingInfoKey(v.OperatorAddress), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jailDoubleSigners slashes and jails every validator the evidence proves to
+// have equivocated.
+func (s *State) jailDoubleSigners(batch *pebble.Batch, evidence []*types.DuplicateVoteEvidence, height uint64, get func(types.Address) (*types.Account, error), set func(*types.Account) error) error {
+	for _, ev := range evidence {
+		if ev == nil {
+			continue
+		}
+		rec, err := getValidatorFromReader(batch, ev.Validator)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return fmt.Errorf("validator not found: %s", ev.Validator)
+		}
+		if err := s.jailValidator(batch, rec, s.staking.SlashDoubleBps, s.staking.JailDoubleEpochs, height, get, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jailValidator burns slashBps of the validator's self-stake, which leaves its
+// operator's bonded stake too, and of every delegation bonded to it, and jails
+// it for at least jailEpochs after the epoch of height, never shortening a
+// term it already serves.
+func (s *State) jailValidator(batch *pebble.Batch, rec *types.Validator, slashBps, jailEpochs, height uint64, get func(types.Address) (*types.Account, error), set func(*types.Account) error) error {
+	if err := slashDelegations(batch, rec.OperatorAddress, slashBps); err != nil {
+		return err
+	}
+	slash := slashAmount(rec.Stake, slashBps)
+	rec.Stake -= slash
+	if slash > 0 {
+		acct, err := get(rec.OperatorAddress)
+		if err != nil {
+			return err
+		}
+		if acct.Stake > 0 {
+			if slash > acct.Stake {
+				slash = acct.Stake
+			}
+			acct.Stake -= slash
+			if err := set(acct); err != nil {
+				return err
+			}
+		}
+	}
+	rec.Jailed = true
+	if until := s.epochOf(height) + jailEpochs; until > rec.JailedUntilEpoch {
+		rec.JailedUntilEpoch = until
+	}
+	return setValidatorWithWriter(batch, rec)
+}
@@ -0,0 +1,36 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestDoubleSignSlashesBondedDelegations(t *testing.T) {
+	c := newTestChain(t, &types.Validator{OperatorAddress: "val0", Stake: 1000}, &types.Validator{OperatorAddress: "val1", Stake: 1})
+	c.state.SetStakingParams(StakingParams{SlashDoubleBps: 500})
+	kp, delegator := c.fund(1000)
+	c.commit([]*types.Transaction{c.signedTx(kp, 0, tx.StakeDelegate{Validator: "val1", Amount: 1000})})
+	c.commit(nil)
+
+	// val1 equivocates while the delegation is bonded to it. The bonded
+	// delegation loses SlashDoubleBps, 5%, as unbonding and redelegated stake
+	// would.
+	c.commit(nil, doubleVote("val1", 2, 0))
+	if v, _ := c.state.Store().GetValidator("val1"); v == nil || !v.Jailed {
+		t.Fatalf("double signer not jailed: %+v", v)
+	}
+	if amount, _ := getDelegationFromReader(c.state.Store().db, "val1", delegator); amount != 950 {
+		t.Fatalf("delegation %d after the slash, want 950", amount)
+	}
+
+	// The burned stake leaves the delegator's account once it is settled.
+	if acct, _ := c.state.GetAccount(delegator); acct.Stake != 2000 {
+		t.Fatalf("delegator stake %d before settling, want 2000", acct.Stake)
+	}
+	c.commit([]*types.Transaction{c.signedTx(kp, 1, tx.WithdrawRewards{Validator: "val1"})})
+	if acct, _ := c.state.GetAccount(delegator); acct.Stake != 1950 {
+		t.Fatalf("delegator stake %d after settling, want 1950", acct.Stake)
+	}
+}
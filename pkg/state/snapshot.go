@@ -0,0 +1,445 @@
+package state
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// SnapshotFormat identifies the chunk encoding of the snapshots this node
+// writes and restores.
+const SnapshotFormat = 2
+
+// snapshotChunkSize is the size at which a chunk is closed. Records are never
+// split, so a chunk may run over by one record.
+const snapshotChunkSize = 4 << 20
+
+// snapshotPrefixes are the records a snapshot carries: the state the root
+// commits to, and the validator sets and proposer priorities a node needs
+// besides to continue from the snapshot height. Nothing is taken on trust:
+// the header of the snapshot block commits to the root, the validator sets
+// and the priorities, and all are checked on restore.
+var snapshotPrefixes = append(append([]string(nil), coveredPrefixes...), validatorSetPrefix, metaProposerPriorities)
+
+func inSnapshot(key []byte) bool {
+	for _, prefix := range snapshotPrefixes {
+		if len(key) >= len(prefix) && string(key[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotsDir returns where a node home keeps its state snapshots.
+func SnapshotsDir(home string) string {
+	return filepath.Join(home, "snapshots")
+}
+
+// SnapshotStore keeps state snapshots on disk, one directory per height
+// holding the manifest and the chunks, and prunes all but the most recent.
+type SnapshotStore struct {
+	dir        string
+	keepRecent int
+
+	mu      sync.Mutex
+	writing bool
+	wg      sync.WaitGroup
+}
+
+// NewSnapshotStore creates a snapshot store in dir keeping the keepRecent
+// latest snapshots; zero keeps them all.
+func NewSnapshotStore(dir string, keepRecent int) *SnapshotStore {
+	return &SnapshotStore{dir: dir, keepRecent: keepRecent}
+}
+
+func (ss *SnapshotStore) snapshotDir(height uint64) string {
+	return filepath.Join(ss.dir, fmt.Sprintf("%020d", height))
+}
+
+// Take captures the state of store, which must have just committed the block
+// at height, and writes the snapshot in the background, calling done, if not
+// nil, with the outcome. Only capturing the state holds up the caller. While
+// an earlier snapshot is still being written, Take skips this one.
+func (ss *SnapshotStore) Take(store *Store, height uint64, done func(error)) {
+	ss.mu.Lock()
+	if ss.writing {
+		ss.mu.Unlock()
+		return
+	}
+	ss.writing = true
+	ss.wg.Add(1)
+	ss.mu.Unlock()
+
+	snap := store.db.NewSnapshot()
+	go func() {
+		defer ss.wg.Done()
+		err := ss.write(snap, height)
+		snap.Close()
+		if err == nil {
+			err = ss.prune()
+		}
+		ss.mu.Lock()
+		ss.writing = false
+		ss.mu.Unlock()
+		if done != nil {
+			done(err)
+		}
+	}()
+}
+
+// Wait blocks until the snapshot being written, if any, is done. The store it
+// was taken from must stay open until then.
+func (ss *SnapshotStore) Wait() {
+	ss.wg.Wait()
+}
+
+// write exports the state in snap, taken after committing the block at
+// height, into a new snapshot directory.
+func (ss *SnapshotStore) write(snap *pebble.Snapshot, height uint64) error {
+	final := ss.snapshotDir(height)
+	if _, err := os.Stat(final); err == nil {
+		return nil
+	}
+	latest, err := lastBlockHeight(snap)
+	if err != nil {
+		return err
+	}
+	if latest != height {
+		return fmt.Errorf("snapshot at height %d taken at height %d", height, latest)
+	}
+	hashBytes, closer, err := snap.Get(append([]byte(blockHeightPrefix), encoding.MarshalUint64(height)...))
+	if err != nil {
+		return fmt.Errorf("get block %d: %w", height, err)
+	}
+	manifest := &types.SnapshotManifest{Height: height, Format: SnapshotFormat}
+	copy(manifest.BlockHash[:], hashBytes)
+	closer.Close()
+	if manifest.StateRoot, err = stateRootFromReader(snap, height); err != nil {
+		return err
+	}
+
+	tmp := final + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0o700); err != nil {
+		return err
+	}
+	var chunk []byte
+	flush := func() error {
+		if err := os.WriteFile(filepath.Join(tmp, strconv.Itoa(len(manifest.Chunks))), chunk, 0o600); err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, sha256.Sum256(chunk))
+		chunk = nil
+		return nil
+	}
+	for _, prefix := range snapshotPrefixes {
+		iter, err := snap.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: []byte(prefix + string([]byte{0xFF})),
+		})
+		if err != nil {
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			chunk = appendSnapshotRecord(chunk, iter.Key(), iter.Value())
+			if len(chunk) >= snapshotChunkSize {
+				if err := flush(); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	b, err := encoding.MarshalSnapshotManifest(manifest)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "manifest"), b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, final)
+}
+
+// heights returns the heights of the complete snapshots, newest first.
+func (ss *SnapshotStore) heights() ([]uint64, error) {
+	entries, err := os.ReadDir(ss.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var heights []uint64
+	for _, e := range entries {
+		if h, err := strconv.ParseUint(e.Name(), 10, 64); err == nil && e.IsDir() {
+			heights = append(heights, h)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+	return heights, nil
+}
+
+func (ss *SnapshotStore) prune() error {
+	if ss.keepRecent <= 0 {
+		return nil
+	}
+	heights, err := ss.heights()
+	if err != nil {
+		return err
+	}
+	for len(heights) > ss.keepRecent {
+		if err := os.RemoveAll(ss.snapshotDir(heights[len(heights)-1])); err != nil {
+			return err
+		}
+		heights = heights[:len(heights)-1]
+	}
+	return nil
+}
+
+// ListSnapshots returns the manifests of the snapshots on disk, newest first.
+func (ss *SnapshotStore) ListSnapshots() ([]*types.SnapshotManifest, error) {
+	heights, err := ss.heights()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*types.SnapshotManifest, 0, len(heights))
+	for _, h := range heights {
+		b, err := os.ReadFile(filepath.Join(ss.snapshotDir(h), "manifest"))
+		if err != nil {
+			return nil, err
+		}
+		m, err := encoding.UnmarshalSnapshotManifest(b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// LoadSnapshotChunk returns chunk index of the snapshot at height.
+func (ss *SnapshotStore) LoadSnapshotChunk(height uint64, index uint32) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(ss.snapshotDir(height), strconv.FormatUint(uint64(index), 10)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no chunk %d of snapshot %d", index, height)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// appendSnapshotRecord appends a record to a chunk as field 1 holding the key
+// as field 1 and the value as field 2.
+func appendSnapshotRecord(chunk, key, value []byte) []byte {
+	var rec []byte
+	rec = protowire.AppendTag(rec, 1, protowire.BytesType)
+	rec = protowire.AppendBytes(rec, key)
+	rec = protowire.AppendTag(rec, 2, protowire.BytesType)
+	rec = protowire.AppendBytes(rec, value)
+	chunk = protowire.AppendTag(chunk, 1, protowire.BytesType)
+	return protowire.AppendBytes(chunk, rec)
+}
+
+// readSnapshotChunk calls fn with every record of a chunk.
+func readSnapshotChunk(chunk []byte, fn func(key, value []byte) error) error {
+	for len(chunk) > 0 {
+		num, typ, n := protowire.ConsumeTag(chunk)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			return fmt.Errorf("invalid snapshot record tag")
+		}
+		chunk = chunk[n:]
+		rec, n := protowire.ConsumeBytes(chunk)
+		if n < 0 {
+			return fmt.Errorf("invalid snapshot record")
+		}
+		chunk = chunk[n:]
+		var key, value []byte
+		for i := 1; i <= 2; i++ {
+			num, typ, n := protowire.ConsumeTag(rec)
+			if n < 0 || int(num) != i || typ != protowire.BytesType {
+				return fmt.Errorf("invalid snapshot record field")
+			}
+			rec = rec[n:]
+			v, n := protowire.ConsumeBytes(rec)
+			if n < 0 {
+				return fmt.Errorf("invalid snapshot record field")
+			}
+			rec = rec[n:]
+			if i == 1 {
+				key = v
+			} else {
+				value = v
+			}
+		}
+		if len(rec) != 0 {
+			return fmt.Errorf("invalid snapshot record length")
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotRestorer writes a snapshot into an empty store chunk by chunk, in
+// order. Nothing makes the store usable until Commit, and a restore that fails
+// or is interrupted is cleared by the next attempt.
+type SnapshotRestorer struct {
+	store    *Store
+	manifest *types.SnapshotManifest
+	next     uint32
+}
+
+// NewSnapshotRestorer prepares store to restore the snapshot of manifest. The
+// store must not have committed any block; state written before, as genesis,
+// is cleared.
+func (s *Store) NewSnapshotRestorer(manifest *types.SnapshotManifest) (*SnapshotRestorer, error) {
+	if manifest == nil {
+		return nil, fmt.Errorf("snapshot manifest is nil")
+	}
+	if manifest.Format != SnapshotFormat {
+		return nil, fmt.Errorf("unsupported snapshot format %d", manifest.Format)
+	}
+	height, err := s.LastBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	if height != 0 {
+		return nil, fmt.Errorf("store already has blocks up to height %d", height)
+	}
+	if err := s.clearSnapshotState(); err != nil {
+		return nil, err
+	}
+	return &SnapshotRestorer{store: s, manifest: manifest}, nil
+}
+
+// clearSnapshotState deletes every record a snapshot restores, the state tree
+// and the redelegation index.
+func (s *Store) clearSnapshotState() error {
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for _, prefix := range append([]string{stateTreePrefix, redelegationIndexPrefix}, snapshotPrefixes...) {
+		if err := batch.DeleteRange([]byte(prefix), []byte(prefix+string([]byte{0xFF})), nil); err != nil {
+			return err
+		}
+	}
+	if err := batch.Delete([]byte(metaStateTreeVersion), nil); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// NextChunk returns the index of the chunk ApplyChunk expects next.
+func (r *SnapshotRestorer) NextChunk() uint32 {
+	return r.next
+}
+
+// ApplyChunk writes the chunk at index, which must be the next one and match
+// its hash in the manifest. A chunk that fails leaves the restore where it
+// was, so it can be fetched again elsewhere.
+func (r *SnapshotRestorer) ApplyChunk(index uint32, chunk []byte) error {
+	if index != r.next || int(index) >= len(r.manifest.Chunks) {
+		return fmt.Errorf("unexpected snapshot chunk %d, want %d", index, r.next)
+	}
+	if sha256.Sum256(chunk) != r.manifest.Chunks[index] {
+		return fmt.Errorf("snapshot chunk %d does not match manifest", index)
+	}
+	batch := r.store.db.NewBatch()
+	defer batch.Close()
+	err := readSnapshotChunk(chunk, func(key, value []byte) error {
+		if !inSnapshot(key) {
+			return fmt.Errorf("snapshot chunk %d has foreign key %q", index, key)
+		}
+		return batch.Set(key, value, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return err
+	}
+	r.next++
+	return nil
+}
+
+// Finish builds the state tree over the restored records once every chunk is
+// applied, and checks that it has root, a root taken from a trusted header.
+// On a mismatch the restored state is cleared.
+func (r *SnapshotRestorer) Finish(root types.Hash) error {
+	if int(r.next) != len(r.manifest.Chunks) {
+		return fmt.Errorf("snapshot restore has %d of %d chunks", r.next, len(r.manifest.Chunks))
+	}
+	if err := r.store.rebuildStateTree(r.manifest.Height); err != nil {
+		return err
+	}
+	if err := r.store.rebuildRedelegationIndex(); err != nil {
+		return err
+	}
+	got, err := ComputeStateRoot(r.store)
+	if err != nil {
+		return err
+	}
+	if got != root {
+		if err := r.Abort(); err != nil {
+			return err
+		}
+		return fmt.Errorf("restored state root %s does not match trusted root %s", got, root)
+	}
+	return nil
+}
+
+// Commit completes a finished restore with the block the snapshot was taken
+// at and its commit certificate; the store then continues from that block.
+func (r *SnapshotRestorer) Commit(block *types.Block, qc *types.QuorumCertificate) error {
+	if block == nil || qc == nil {
+		return fmt.Errorf("missing block or commit certificate")
+	}
+	hash, err := encoding.HashBlock(block)
+	if err != nil {
+		return err
+	}
+	if block.Height != r.manifest.Height || hash != r.manifest.BlockHash {
+		return fmt.Errorf("block %d is not the snapshot block", block.Height)
+	}
+	if qc.Height != block.Height || qc.BlockHash != hash {
+		return fmt.Errorf("commit certificate is for another block")
+	}
+	batch := r.store.db.NewBatch()
+	defer batch.Close()
+	if err := setBlockWithWriter(batch, block, hash); err != nil {
+		return err
+	}
+	if err := setCommitCertificateWithWriter(batch, qc); err != nil {
+		return err
+	}
+	if err := setConsensusStateWithWriter(batch, block.Height, 0, hash); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// Abort clears what the restore has written.
+func (r *SnapshotRestorer) Abort() error {
+	return r.store.clearSnapshotState()
+}
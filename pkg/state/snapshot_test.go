@@ -0,0 +1,106 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	source := openTestStore(t)
+	for i := 0; i < 100; i++ {
+		if err := source.SetAccount(testAccount(i, uint64(i+1))); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	root, err := ComputeStateRoot(source)
+	if err != nil {
+		t.Fatalf("root: %v", err)
+	}
+	block := &types.Block{Height: 1, StateRoot: root}
+	hash, err := source.SetBlock(block)
+	if err != nil {
+		t.Fatalf("set block: %v", err)
+	}
+
+	snapshots := NewSnapshotStore(t.TempDir(), 1)
+	var taken error
+	snapshots.Take(source, 1, func(err error) { taken = err })
+	snapshots.Wait()
+	if taken != nil {
+		t.Fatalf("take: %v", taken)
+	}
+	manifests, err := snapshots.ListSnapshots()
+	if err != nil || len(manifests) != 1 {
+		t.Fatalf("list: %v %+v", err, manifests)
+	}
+	m := manifests[0]
+	if m.Height != 1 || m.BlockHash != hash || m.StateRoot != root || len(m.Chunks) == 0 {
+		t.Fatalf("manifest %+v", m)
+	}
+	if _, err := source.NewSnapshotRestorer(m); err == nil {
+		t.Fatalf("restore accepted into a store with blocks")
+	}
+
+	target := openTestStore(t)
+	// State written before the restore, as genesis, does not survive it.
+	if err := target.SetAccount(&types.Account{Address: "genesis", Balance: 1}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	r, err := target.NewSnapshotRestorer(m)
+	if err != nil {
+		t.Fatalf("restorer: %v", err)
+	}
+	for i := range m.Chunks {
+		chunk, err := snapshots.LoadSnapshotChunk(1, uint32(i))
+		if err != nil {
+			t.Fatalf("load chunk %d: %v", i, err)
+		}
+		tampered := append([]byte(nil), chunk...)
+		tampered[len(tampered)-1] ^= 1
+		if err := r.ApplyChunk(uint32(i), tampered); err == nil {
+			t.Fatalf("tampered chunk %d applied", i)
+		}
+		if err := r.ApplyChunk(uint32(i), chunk); err != nil {
+			t.Fatalf("apply chunk %d: %v", i, err)
+		}
+	}
+	if err := r.Finish(types.Hash{1}); err == nil {
+		t.Fatalf("restore finished against another root")
+	}
+	if acct, _ := target.GetAccount(testAccount(0, 0).Address); acct != nil {
+		t.Fatalf("restored state kept after a root mismatch")
+	}
+
+	r, err = target.NewSnapshotRestorer(m)
+	if err != nil {
+		t.Fatalf("restorer: %v", err)
+	}
+	for i := range m.Chunks {
+		chunk, _ := snapshots.LoadSnapshotChunk(1, uint32(i))
+		if err := r.ApplyChunk(uint32(i), chunk); err != nil {
+			t.Fatalf("apply chunk %d: %v", i, err)
+		}
+	}
+	if err := r.Finish(root); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if err := r.Commit(block, &types.QuorumCertificate{Height: 1, BlockHash: hash}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if height, err := target.LastBlockHeight(); err != nil || height != 1 {
+		t.Fatalf("restored height %d: %v", height, err)
+	}
+	if got, _ := ComputeStateRoot(target); got != root {
+		t.Fatalf("restored root %s, want %s", got, root)
+	}
+	if acct, _ := target.GetAccount("genesis"); acct != nil {
+		t.Fatalf("state from before the restore survived")
+	}
+	for i := 0; i < 100; i++ {
+		acct, err := target.GetAccount(testAccount(i, 0).Address)
+		if err != nil || acct == nil || acct.Balance != uint64(i+1) {
+			t.Fatalf("restored account %d: %+v %v", i, acct, err)
+		}
+	}
+}
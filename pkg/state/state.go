@@ -17,6 +17,16 @@ type State struct {
 	store    *Store
 	dag      *DAG
 	rcParams rc.Params
+	rewards  RewardParams
+	staking  StakingParams
+}
+
+// blockEnv describes the block a transaction executes in.
+type blockEnv struct {
+	height        uint64
+	timestamp     int64
+	effectiveTime int64
+	batch         *pebble.Batch // uncommitted writes of the block
 }
 
 // NewState creates a new State manager.
@@ -44,14 +54,16 @@ func (s *State) GetAccount(addr types.Address) (*types.Account, error) {
 
 // PreviewBlock computes the expected state root for a block without mutating persistent state.
 func (s *State) PreviewBlock(block *types.Block, engine *contracts.ContractEngine) (types.Hash, error) {
+	return s.PreviewBlockOn(nil, block, engine)
+}
+
+// PreviewBlockOn computes the expected state root for a block built on top of
+// uncommitted ancestors. Ancestors are applied in order, oldest first, on top
+// of the committed state; nothing is persisted.
+func (s *State) PreviewBlockOn(ancestors []*types.Block, block *types.Block, engine *contracts.ContractEngine) (types.Hash, error) {
 	if block == nil {
 		return types.Hash{}, fmt.Errorf("block is nil")
 	}
-	lastTimestamps, err := s.store.GetLastTimestamps()
-	if err != nil {
-		return types.Hash{}, err
-	}
-	effectiveTime := rc.EffectiveTime(block.Timestamp, lastTimestamps, s.rcParams.MaxSkewSec)
 
 	batch := s.store.NewIndexedBatch()
 	defer batch.Close()
@@ -70,20 +82,47 @@ func (s *State) PreviewBlock(block *types.Block, engine *contracts.ContractEngin
 		return setAccountWithWriter(batch, acct, nil)
 	}
 
-	for _, tx := range block.Transactions {
-		if err := s.applyTransactionWithKV(tx, engine, effectiveTime, get, set, true); err != nil {
+	var parent *types.Block
+	for _, b := range append(append([]*types.Block(nil), ancestors...), block) {
+		if b == nil {
+			return types.Hash{}, fmt.Errorf("block is nil")
+		}
+		lastTimestamps, err := getLastTimestampsFromReader(batch)
+		if err != nil {
+			return types.Hash{}, err
+		}
+		effectiveTime := rc.EffectiveTime(b.Timestamp, lastTimestamps, s.rcParams.MaxSkewSec)
+		env := &blockEnv{height: b.Height, timestamp: b.Timestamp, effectiveTime: effectiveTime, batch: batch}
+		if err := s.executeBlock(env, b, parent, engine, get, set, true); err != nil {
+			return types.Hash{}, err
+		}
+		parent = b
+		// The timestamp window is state, so the root covers its update.
+		if err := setLastTimestampsWithWriter(batch, s.appendTimestamp(lastTimestamps, b.Timestamp)); err != nil {
 			return types.Hash{}, err
 		}
 	}
 
-	return ComputeStateRootFromReader(batch)
+	return updateStateTree(batch, block.Height)
+}
+
+func (s *State) appendTimestamp(lastTimestamps []int64, ts int64) []int64 {
+	lastTimestamps = append(lastTimestamps, ts)
+	if len(lastTimestamps) > s.rcParams.WindowN {
+		lastTimestamps = lastTimestamps[len(lastTimestamps)-s.rcParams.WindowN:]
+	}
+	return lastTimestamps
 }
 
-// ApplyBlock applies a block to state, updating RC and computing a new state root.
-func (s *State) ApplyBlock(block *types.Block, engine *contracts.ContractEngine) (types.Hash, error) {
+// ApplyBlock applies a block to state, updating RC and computing a new state
+// root. The block is stored together with qc, the certificate that finalized it.
+func (s *State) ApplyBlock(block *types.Block, qc *types.QuorumCertificate, engine *contracts.ContractEngine) (types.Hash, error) {
 	if block == nil {
 		return types.Hash{}, fmt.Errorf("block is nil")
 	}
+	if qc == nil || qc.Height != block.Height {
+		return types.Hash{}, fmt.Errorf("missing commit certificate for block %d", block.Height)
+	}
 	previewRoot, err := s.PreviewBlock(block, engine)
 	if err != nil {
 		return types.Hash{}, err
@@ -113,21 +152,16 @@ func (s *State) ApplyBlock(block *types.Block, engine *contracts.ContractEngine)
 	set := func(acct *types.Account) error {
 		return setAccountWithWriter(batch, acct, nil)
 	}
-	for _, tx := range block.Transactions {
-		if err := s.applyTransactionWithKV(tx, engine, effectiveTime, get, set, false); err != nil {
-			return types.Hash{}, err
-		}
+	env := &blockEnv{height: block.Height, timestamp: block.Timestamp, effectiveTime: effectiveTime, batch: batch}
+	if err := s.executeBlock(env, block, nil, engine, get, set, false); err != nil {
+		return types.Hash{}, err
 	}
 
 	// Update timestamp window with raw block timestamp.
-	lastTimestamps = append(lastTimestamps, block.Timestamp)
-	if len(lastTimestamps) > s.rcParams.WindowN {
-		lastTimestamps = lastTimestamps[len(lastTimestamps)-s.rcParams.WindowN:]
-	}
-	if err := setLastTimestampsWithWriter(batch, lastTimestamps); err != nil {
+	if err := setLastTimestampsWithWriter(batch, s.appendTimestamp(lastTimestamps, block.Timestamp)); err != nil {
 		return types.Hash{}, err
 	}
-	root, err := ComputeStateRootFromReader(batch)
+	root, err := updateStateTree(batch, block.Height)
 	if err != nil {
 		return types.Hash{}, err
 	}
@@ -138,9 +172,15 @@ func (s *State) ApplyBlock(block *types.Block, engine *contracts.ContractEngine)
 	if err != nil {
 		return types.Hash{}, err
 	}
+	if qc.BlockHash != hash {
+		return types.Hash{}, fmt.Errorf("commit certificate is for another block")
+	}
 	if err := setBlockWithWriter(batch, block, hash); err != nil {
 		return types.Hash{}, err
 	}
+	if err := setCommitCertificateWithWriter(batch, qc); err != nil {
+		return types.Hash{}, err
+	}
 	if err := batch.Commit(pebble.Sync); err != nil {
 		return types.Hash{}, err
 	}
@@ -153,17 +193,45 @@ func (s *State) ApplyBlock(block *types.Block, engine *contracts.ContractEngine)
 	return root, nil
 }
 
-func (s *State) applyTransaction(txn *types.Transaction, engine *contracts.ContractEngine, effectiveTime int64) error {
-	get := func(addr types.Address) (*types.Account, error) {
-		return s.GetAccount(addr)
+// executeBlock runs the state transition of block: its timestamp and evidence
+// are recorded, unbondings that completed are released, the parent's reward is
+// paid, validators that stayed offline are jailed, the transactions are
+// applied and the block's evidence is punished. parent may be nil when it is
+// committed.
+func (s *State) executeBlock(env *blockEnv, block, parent *types.Block, engine *contracts.ContractEngine, get func(types.Address) (*types.Account, error), set func(*types.Account) error, preview bool) error {
+	if err := recordBlockTime(env.batch, block, s.staking.UnbondingPeriod); err != nil {
+		return err
 	}
-	set := func(acct *types.Account) error {
-		return s.store.SetAccount(acct)
+	if err := setEvidenceWithWriter(env.batch, block); err != nil {
+		return err
+	}
+	if err := matureUnbondings(env.batch, block.Timestamp, get, set); err != nil {
+		return err
+	}
+	if err := matureRedelegations(env.batch, block.Timestamp); err != nil {
+		return err
+	}
+	if err := s.distributeRewards(env.batch, block, parent, get, set); err != nil {
+		return err
+	}
+	if err := s.trackLiveness(env.batch, block, get, set); err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if err := s.applyTransactionWithKV(tx, engine, env, get, set, preview); err != nil {
+			return err
+		}
+	}
+	if err := s.slashUnbondings(env.batch, block.Evidence); err != nil {
+		return err
+	}
+	if err := s.slashRedelegations(env.batch, block.Evidence, get, set); err != nil {
+		return err
 	}
-	return s.applyTransactionWithKV(txn, engine, effectiveTime, get, set, false)
+	return s.jailDoubleSigners(env.batch, block.Evidence, env.height, get, set)
 }
 
-func (s *State) applyTransactionWithKV(txn *types.Transaction, engine *contracts.ContractEngine, effectiveTime int64, get func(types.Address) (*types.Account, error), set func(*types.Account) error, preview bool) error {
+func (s *State) applyTransactionWithKV(txn *types.Transaction, engine *contracts.ContractEngine, env *blockEnv, get func(types.Address) (*types.Account, error), set func(*types.Account) error, preview bool) error {
 	if txn == nil {
 		return fmt.Errorf("transaction is nil")
 	}
@@ -194,7 +262,7 @@ func (s *State) applyTransactionWithKV(txn *types.Transaction, engine *contracts
 	}
 
 	// RC regeneration for sender.
-	sender.RC, sender.LastRCEffectiveTime = s.rcParams.Regen(sender.RC, sender.Stake, sender.LastRCEffectiveTime, effectiveTime)
+	sender.RC, sender.LastRCEffectiveTime = s.rcParams.Regen(sender.RC, sender.Stake, sender.LastRCEffectiveTime, env.effectiveTime)
 	sender.RCMax = s.rcParams.RCMax(sender.Stake)
 
 	if sender.Nonce != txn.Nonce {
@@ -228,18 +296,206 @@ func (s *State) applyTransactionWithKV(txn *types.Transaction, engine *contracts
 		}
 		stateWrites = 2
 	case tx.StakeDelegate:
+		if p.Amount == 0 {
+			return fmt.Errorf("delegation amount must be positive")
+		}
+		v, err := getValidatorFromReader(env.batch, p.Validator)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return fmt.Errorf("validator not found: %s", p.Validator)
+		}
+		if v.Jailed {
+			return fmt.Errorf("validator jailed: %s", p.Validator)
+		}
 		if sender.Balance < p.Amount {
 			return fmt.Errorf("insufficient balance")
 		}
+		delegated, err := getDelegationFromReader(env.batch, p.Validator, txn.From)
+		if err != nil {
+			return err
+		}
+		if err := updateDelegation(env.batch, p.Validator, sender, delegated+p.Amount); err != nil {
+			return err
+		}
 		sender.Balance -= p.Amount
 		sender.Stake += p.Amount
-		stateWrites = 1
+		stateWrites = 3
 	case tx.StakeUndelegate:
-		if sender.Stake < p.Amount {
-			return fmt.Errorf("insufficient stake")
+		delegated, err := getDelegationFromReader(env.batch, p.Validator, txn.From)
+		if err != nil {
+			return err
+		}
+		if p.Amount == 0 || delegated < p.Amount || sender.Stake < p.Amount {
+			return fmt.Errorf("insufficient delegation")
+		}
+		if err := updateDelegation(env.batch, p.Validator, sender, delegated-p.Amount); err != nil {
+			return err
 		}
 		sender.Stake -= p.Amount
-		sender.Balance += p.Amount
+		// The stake stays slashable until the unbonding period is over.
+		if err := addUnbonding(env.batch, &types.UnbondingEntry{
+			Delegator:      txn.From,
+			Validator:      p.Validator,
+			Amount:         p.Amount,
+			CreationHeight: env.height,
+			CompletionTime: env.timestamp + s.staking.UnbondingPeriod,
+		}); err != nil {
+			return err
+		}
+		stateWrites = 4
+	case tx.StakeRedelegate:
+		if p.From == p.To {
+			return fmt.Errorf("cannot redelegate to the same validator")
+		}
+		dst, err := getValidatorFromReader(env.batch, p.To)
+		if err != nil {
+			return err
+		}
+		if dst == nil {
+			return fmt.Errorf("validator not found: %s", p.To)
+		}
+		if dst.Jailed {
+			return fmt.Errorf("validator jailed: %s", p.To)
+		}
+		delegated, err := getDelegationFromReader(env.batch, p.From, txn.From)
+		if err != nil {
+			return err
+		}
+		if p.Amount == 0 || delegated < p.Amount {
+			return fmt.Errorf("insufficient delegation")
+		}
+		// Stake that arrived by redelegation has to mature before it moves
+		// again, or it could hop away from every validator it is slashable for.
+		maturing, err := hasMaturingRedelegation(env.batch, txn.From, p.From)
+		if err != nil {
+			return err
+		}
+		if maturing {
+			return fmt.Errorf("redelegation to %s has not matured", p.From)
+		}
+		if err := updateDelegation(env.batch, p.From, sender, delegated-p.Amount); err != nil {
+			return err
+		}
+		moved, err := getDelegationFromReader(env.batch, p.To, txn.From)
+		if err != nil {
+			return err
+		}
+		if err := updateDelegation(env.batch, p.To, sender, moved+p.Amount); err != nil {
+			return err
+		}
+		if err := addRedelegation(env.batch, &types.RedelegationEntry{
+			Delegator:      txn.From,
+			SrcValidator:   p.From,
+			DstValidator:   p.To,
+			Amount:         p.Amount,
+			CreationHeight: env.height,
+			CompletionTime: env.timestamp + s.staking.UnbondingPeriod,
+		}); err != nil {
+			return err
+		}
+		stateWrites = 6
+	case tx.WithdrawRewards:
+		delegated, err := getDelegationFromReader(env.batch, p.Validator, txn.From)
+		if err != nil {
+			return err
+		}
+		if delegated == 0 {
+			return fmt.Errorf("no delegation to %s", p.Validator)
+		}
+		if err := updateDelegation(env.batch, p.Validator, sender, delegated); err != nil {
+			return err
+		}
+		stateWrites = 3
+	case tx.CreateValidator:
+		existing, err := getValidatorFromReader(env.batch, txn.From)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("validator already registered: %s", txn.From)
+		}
+		if len(p.ConsensusPubKey) == 0 {
+			return fmt.Errorf("missing consensus pubkey")
+		}
+		owner, err := validatorByPubKey(env.batch, p.ConsensusPubKey)
+		if err != nil {
+			return err
+		}
+		if owner != "" {
+			return fmt.Errorf("consensus pubkey already used by %s", owner)
+		}
+		if p.Commission > 10_000 {
+			return fmt.Errorf("commission above 100%%: %d", p.Commission)
+		}
+		if p.SelfStake < s.staking.MinStake {
+			return fmt.Errorf("stake below minimum: %d < %d", p.SelfStake, s.staking.MinStake)
+		}
+		if sender.Balance < p.SelfStake {
+			return fmt.Errorf("insufficient balance")
+		}
+		if err := setValidatorWithWriter(env.batch, &types.Validator{
+			OperatorAddress:        txn.From,
+			ConsensusPubKey:        p.ConsensusPubKey,
+			Stake:                  p.SelfStake,
+			Commission:             p.Commission,
+			CommissionUpdateHeight: env.height,
+		}); err != nil {
+			return err
+		}
+		sender.Balance -= p.SelfStake
+		sender.Stake += p.SelfStake
+		stateWrites = 2
+	case tx.EditValidator:
+		v, err := getValidatorFromReader(env.batch, txn.From)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return fmt.Errorf("validator not found: %s", txn.From)
+		}
+		if p.Commission > 10_000 {
+			return fmt.Errorf("commission above 100%%: %d", p.Commission)
+		}
+		if epoch := s.epochOf(env.height); v.CommissionUpdateHeight != 0 && s.epochOf(v.CommissionUpdateHeight) == epoch {
+			return fmt.Errorf("commission already changed in epoch %d", epoch)
+		}
+		change := uint64(p.Commission) - uint64(v.Commission)
+		if p.Commission < v.Commission {
+			change = uint64(v.Commission) - uint64(p.Commission)
+		}
+		if change > s.staking.MaxCommissionChangeBps {
+			return fmt.Errorf("commission change %d exceeds maximum %d", change, s.staking.MaxCommissionChangeBps)
+		}
+		v.Commission = p.Commission
+		v.CommissionUpdateHeight = env.height
+		if err := setValidatorWithWriter(env.batch, v); err != nil {
+			return err
+		}
+		stateWrites = 2
+	case tx.Unjail:
+		v, err := getValidatorFromReader(env.batch, txn.From)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return fmt.Errorf("validator not found: %s", txn.From)
+		}
+		if !v.Jailed {
+			return fmt.Errorf("validator not jailed: %s", txn.From)
+		}
+		if s.epochOf(env.height) < v.JailedUntilEpoch {
+			return fmt.Errorf("validator jailed until epoch %d", v.JailedUntilEpoch)
+		}
+		// Slashing may have taken the self-stake below what a validator needs.
+		if v.Stake < s.staking.MinStake {
+			return fmt.Errorf("stake below minimum: %d < %d", v.Stake, s.staking.MinStake)
+		}
+		v.Jailed = false
+		if err := setValidatorWithWriter(env.batch, v); err != nil {
+			return err
+		}
 		stateWrites = 1
 	case tx.ContractDeploy:
 		if engine == nil {
@@ -0,0 +1,133 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/georgecane/opencoin/pkg/crypto"
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/rc"
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// testChain applies blocks to a State as consensus commits them, for tests
+// of the transitions blocks drive.
+type testChain struct {
+	t      *testing.T
+	state  *State
+	set    *types.ValidatorSet
+	parent *types.Block
+	now    int64
+}
+
+// newTestChain returns a chain whose registry and validator set are
+// validators, each with power equal to its stake. The first one proposes
+// every block and alone signs every commit.
+func newTestChain(t *testing.T, validators ...*types.Validator) *testChain {
+	t.Helper()
+	store := openTestStore(t)
+	params := rc.Params{Alpha: 1, Beta: 1, CSize: 1, CCompute: 1, CStorage: 1, MaxSkewSec: 30, WindowN: 11}
+	set := &types.ValidatorSet{IndexByAddr: make(map[types.Address]uint32)}
+	for i, v := range validators {
+		if err := store.SetValidator(v); err != nil {
+			t.Fatalf("set validator: %v", err)
+		}
+		member := *v
+		member.Power, member.Index = v.Stake, uint32(i)
+		set.Validators = append(set.Validators, &member)
+		set.IndexByAddr[v.OperatorAddress] = uint32(i)
+		set.TotalPower += member.Power
+	}
+	if err := store.SetValidatorSet(0, set); err != nil {
+		t.Fatalf("set validator set: %v", err)
+	}
+	return &testChain{t: t, state: NewState(store, NewDAG(), params), set: set, now: time.Now().Unix()}
+}
+
+// fund creates an account with balance, whose stake backs the resource
+// credits its transactions spend, and returns its key and address.
+func (c *testChain) fund(balance uint64) (*crypto.Ed25519KeyPair, types.Address) {
+	c.t.Helper()
+	kp, err := crypto.GenerateEd25519()
+	if err != nil {
+		c.t.Fatalf("generate key: %v", err)
+	}
+	addr, err := crypto.AddressFromPubKey(kp.PublicKey)
+	if err != nil {
+		c.t.Fatalf("address: %v", err)
+	}
+	acct := &types.Account{Address: types.Address(addr), Balance: balance, Stake: 1000, RC: 1_000_000}
+	if err := c.state.Store().SetAccount(acct); err != nil {
+		c.t.Fatalf("set account: %v", err)
+	}
+	return kp, acct.Address
+}
+
+// signedTx signs a transaction carrying payload from the account of kp.
+func (c *testChain) signedTx(kp *crypto.Ed25519KeyPair, nonce uint64, payload tx.Payload) *types.Transaction {
+	c.t.Helper()
+	raw, err := tx.EncodePayload(payload, kp.PublicKey)
+	if err != nil {
+		c.t.Fatalf("encode payload: %v", err)
+	}
+	from, _ := crypto.AddressFromPubKey(kp.PublicKey)
+	txn := &types.Transaction{From: types.Address(from), To: types.Address(from), Nonce: nonce, Payload: raw}
+	signBytes, err := tx.SigningBytes(txn)
+	if err != nil {
+		c.t.Fatalf("sign bytes: %v", err)
+	}
+	if txn.Signature, err = crypto.SignEd25519(kp.PrivateKey, signBytes); err != nil {
+		c.t.Fatalf("sign: %v", err)
+	}
+	return txn
+}
+
+// commit applies the next block, carrying txs and evidence, one second after
+// the last one.
+func (c *testChain) commit(txs []*types.Transaction, evidence ...*types.DuplicateVoteEvidence) *types.Block {
+	c.t.Helper()
+	c.now++
+	block := &types.Block{
+		Height:       1,
+		Timestamp:    c.now,
+		Proposer:     c.set.Validators[0].OperatorAddress,
+		Transactions: txs,
+		Evidence:     evidence,
+	}
+	if c.parent != nil {
+		hash, err := encoding.HashBlock(c.parent)
+		if err != nil {
+			c.t.Fatalf("hash parent: %v", err)
+		}
+		bitmap := make([]byte, (len(c.set.Validators)+7)/8)
+		bitmap[0] = 1
+		block.Height, block.PrevHash = c.parent.Height+1, hash
+		block.LastCommit = &types.QuorumCertificate{Height: c.parent.Height, BlockHash: hash, SigBitmap: bitmap}
+	}
+	root, err := c.state.PreviewBlock(block, nil)
+	if err != nil {
+		c.t.Fatalf("preview block %d: %v", block.Height, err)
+	}
+	block.StateRoot = root
+	hash, err := encoding.HashBlock(block)
+	if err != nil {
+		c.t.Fatalf("hash block: %v", err)
+	}
+	if _, err := c.state.ApplyBlock(block, &types.QuorumCertificate{Height: block.Height, BlockHash: hash}, nil); err != nil {
+		c.t.Fatalf("apply block %d: %v", block.Height, err)
+	}
+	c.parent = block
+	return block
+}
+
+// doubleVote returns evidence that validator voted for two blocks at height.
+func doubleVote(validator types.Address, height, round uint64) *types.DuplicateVoteEvidence {
+	vote := func(blockHash types.Hash) *types.PrecommitVote {
+		return &types.PrecommitVote{BlockHash: blockHash, Height: height, Round: round, Validator: validator}
+	}
+	return &types.DuplicateVoteEvidence{
+		Validator: validator, Height: height, Round: round,
+		VoteA: vote(types.Hash{1}), VoteB: vote(types.Hash{2}),
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"path/filepath"
+	"sort"
 
 	"github.com/cockroachdb/pebble"
 
@@ -16,11 +17,30 @@ const (
 	contractPrefix             = "contract/"
 	blockPrefix                = "block/"
 	blockHeightPrefix          = "block_height/"
+	commitCertPrefix           = "commit_cert/"
+	evidencePrefix             = "evidence/"
+	blockTimePrefix            = "blocktime/"
+	validatorSetPrefix         = "valset/"
+	unbondingPrefix            = "unbond/"
+	redelegationPrefix         = "redeleg/"
+	redelegationIndexPrefix    = "redeleg_by/"
+	validatorPrefix            = "validator/"
+	delegationPrefix           = "deleg/"
+	validatorRewardsPrefix     = "valrewards/"
+	signingInfoPrefix          = "signing/"
+	slashEventPrefix           = "slashevt/"
+	stateTreePrefix            = "smt/"
 	metaPrefix                 = "meta/"
 	metaLastTimestamps         = "meta/last_timestamps"
 	metaConsensusHeight        = "meta/consensus_height"
 	metaConsensusRound         = "meta/consensus_round"
 	metaConsensusLastFinalized = "meta/consensus_last_finalized"
+	metaVerifiedHeight         = "meta/verified_height"
+	metaProposerPriorities     = "meta/proposer_priorities"
+	metaStateTreeVersion       = "meta/state_tree_version"
+	metaStateTreeBase          = "meta/state_tree_base"
+	metaStakeRecordVersion     = "meta/stake_record_version"
+	metaRedelegationIndex      = "meta/redelegation_index"
 )
 
 // Store is the persistent state store backed by Pebble.
@@ -35,7 +55,20 @@ func OpenStore(home string) (*Store, error) {
 	if err != nil {
 		return nil, fmt.Errorf("open pebble: %w", err)
 	}
-	return &Store{db: db}, nil
+	s := &Store{db: db}
+	if err := s.migrateStakeRecords(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate stake records: %w", err)
+	}
+	if err := s.migrateRedelegationIndex(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("index redelegations: %w", err)
+	}
+	if err := s.migrateStateTree(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("build state tree: %w", err)
+	}
+	return s, nil
 }
 
 // Close closes the store.
@@ -58,7 +91,28 @@ func (s *Store) GetAccount(addr types.Address) (*types.Account, error) {
 
 // SetAccount persists an account state.
 func (s *Store) SetAccount(acct *types.Account) error {
-	return setAccountWithWriter(s.db, acct, pebble.Sync)
+	return s.writeState(func(batch *pebble.Batch) error {
+		return setAccountWithWriter(batch, acct, nil)
+	})
+}
+
+// writeState commits the consensus records fn writes together with the
+// state tree nodes they change, as part of the state at the last committed
+// height.
+func (s *Store) writeState(fn func(batch *pebble.Batch) error) error {
+	batch := s.db.NewIndexedBatch()
+	defer batch.Close()
+	if err := fn(batch); err != nil {
+		return err
+	}
+	height, err := lastBlockHeight(batch)
+	if err != nil {
+		return err
+	}
+	if _, err := updateStateTree(batch, height); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
 }
 
 // IterateAccounts iterates over all account entries.
@@ -115,7 +169,11 @@ func iterateAccounts(reader pebble.Reader, fn func(key []byte, acct *types.Accou
 
 // GetLastTimestamps returns the last N block timestamps stored.
 func (s *Store) GetLastTimestamps() ([]int64, error) {
-	val, closer, err := s.db.Get([]byte(metaLastTimestamps))
+	return getLastTimestampsFromReader(s.db)
+}
+
+func getLastTimestampsFromReader(reader pebble.Reader) ([]int64, error) {
+	val, closer, err := reader.Get([]byte(metaLastTimestamps))
 	if err != nil {
 		if err == pebble.ErrNotFound {
 			return nil, nil
@@ -128,8 +186,9 @@ func (s *Store) GetLastTimestamps() ([]int64, error) {
 
 // SetLastTimestamps stores the last N block timestamps.
 func (s *Store) SetLastTimestamps(ts []int64) error {
-	val := encodeTimestamps(ts)
-	return s.db.Set([]byte(metaLastTimestamps), val, pebble.Sync)
+	return s.writeState(func(batch *pebble.Batch) error {
+		return setLastTimestampsWithWriter(batch, ts)
+	})
 }
 
 func setLastTimestampsWithWriter(writer pebble.Writer, ts []int64) error {
@@ -181,6 +240,55 @@ func (s *Store) SetBlock(block *types.Block) (types.Hash, error) {
 	return hash, nil
 }
 
+// FirstBlockHeight returns the height of the earliest stored block, which is
+// the snapshot height on a node restored from a snapshot, zero before the
+// first.
+func (s *Store) FirstBlockHeight() (uint64, error) {
+	iter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(blockHeightPrefix),
+		UpperBound: []byte(blockHeightPrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	if !iter.First() {
+		return 0, iter.Error()
+	}
+	key := iter.Key()[len(blockHeightPrefix):]
+	if len(key) != 8 {
+		return 0, fmt.Errorf("invalid block height key")
+	}
+	return binary.BigEndian.Uint64(key), nil
+}
+
+// LastBlockHeight returns the height of the last committed block, zero
+// before the first.
+func (s *Store) LastBlockHeight() (uint64, error) {
+	return lastBlockHeight(s.db)
+}
+
+// lastBlockHeight returns the height of the last committed block, zero
+// before the first.
+func lastBlockHeight(reader pebble.Reader) (uint64, error) {
+	iter, err := reader.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(blockHeightPrefix),
+		UpperBound: []byte(blockHeightPrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+	key := iter.Key()[len(blockHeightPrefix):]
+	if len(key) != 8 {
+		return 0, fmt.Errorf("invalid block height key")
+	}
+	return binary.BigEndian.Uint64(key), nil
+}
+
 // GetBlockByHeight retrieves a block by height.
 func (s *Store) GetBlockByHeight(height uint64) (*types.Block, error) {
 	key := append([]byte(blockHeightPrefix), encoding.MarshalUint64(height)...)
@@ -227,20 +335,181 @@ func setBlockWithWriter(writer pebble.Writer, block *types.Block, hash types.Has
 	return writer.Set(heightKey, hash[:], nil)
 }
 
+// GetCommitCertificate returns the quorum certificate that finalized the block
+// at height, or nil if none was stored.
+func (s *Store) GetCommitCertificate(height uint64) (*types.QuorumCertificate, error) {
+	key := append([]byte(commitCertPrefix), encoding.MarshalUint64(height)...)
+	val, closer, err := s.db.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get commit certificate: %w", err)
+	}
+	defer closer.Close()
+	return encoding.UnmarshalQuorumCertificate(val)
+}
+
+// SetCommitCertificate replaces the stored certificate of the block at
+// qc.Height.
+func (s *Store) SetCommitCertificate(qc *types.QuorumCertificate) error {
+	return setCommitCertificateWithWriter(s.db, qc)
+}
+
+func setCommitCertificateWithWriter(writer pebble.Writer, qc *types.QuorumCertificate) error {
+	val, err := encoding.MarshalQuorumCertificate(qc)
+	if err != nil {
+		return err
+	}
+	key := append([]byte(commitCertPrefix), encoding.MarshalUint64(qc.Height)...)
+	return writer.Set(key, val, nil)
+}
+
+// HasEvidence reports whether evidence with the given ID was committed in a block.
+func (s *Store) HasEvidence(id types.Hash) (bool, error) {
+	key := append([]byte(evidencePrefix), id[:]...)
+	_, closer, err := s.db.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("get evidence: %w", err)
+	}
+	closer.Close()
+	return true, nil
+}
+
+// setEvidenceWithWriter records the evidence committed in block, keyed by
+// evidence ID, with the height that included it.
+func setEvidenceWithWriter(writer pebble.Writer, block *types.Block) error {
+	for _, ev := range block.Evidence {
+		id, err := encoding.EvidenceID(ev)
+		if err != nil {
+			return err
+		}
+		key := append([]byte(evidencePrefix), id[:]...)
+		if err := writer.Set(key, encoding.MarshalUint64(block.Height), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBlockTime returns the timestamp of the committed block at height as the
+// state records it, and false if it is not recorded: the height is not
+// committed, or its timestamp was pruned after the unbonding period.
+func (s *Store) GetBlockTime(height uint64) (int64, bool, error) {
+	key := append([]byte(blockTimePrefix), encoding.MarshalUint64(height)...)
+	val, closer, err := s.db.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("get block time: %w", err)
+	}
+	defer closer.Close()
+	if len(val) != 8 {
+		return 0, false, fmt.Errorf("invalid block time record")
+	}
+	return int64(binary.BigEndian.Uint64(val)), true, nil
+}
+
+// recordBlockTime records the timestamp of block in state, so that offences
+// can be dated on nodes that do not have the block, and prunes the timestamps
+// more than window seconds older than it. A zero window keeps them all.
+func recordBlockTime(batch *pebble.Batch, block *types.Block, window int64) error {
+	key := append([]byte(blockTimePrefix), encoding.MarshalUint64(block.Height)...)
+	if err := batch.Set(key, encoding.MarshalUint64(uint64(block.Timestamp)), nil); err != nil {
+		return err
+	}
+	if window <= 0 {
+		return nil
+	}
+	iter, err := batch.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(blockTimePrefix),
+		UpperBound: key,
+	})
+	if err != nil {
+		return err
+	}
+	var expired [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		if len(iter.Value()) != 8 || int64(binary.BigEndian.Uint64(iter.Value())) >= block.Timestamp-window {
+			break
+		}
+		expired = append(expired, append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetValidatorSet persists the validator set that signs blocks from startHeight
+// until the next persisted set takes over.
+func (s *Store) SetValidatorSet(startHeight uint64, set *types.ValidatorSet) error {
+	b, err := encoding.MarshalValidatorSet(set)
+	if err != nil {
+		return err
+	}
+	key := append([]byte(validatorSetPrefix), encoding.MarshalUint64(startHeight)...)
+	return s.db.Set(key, b, pebble.Sync)
+}
+
+// HasValidatorSet reports whether a validator set starting exactly at startHeight was persisted.
+func (s *Store) HasValidatorSet(startHeight uint64) (bool, error) {
+	key := append([]byte(validatorSetPrefix), encoding.MarshalUint64(startHeight)...)
+	_, closer, err := s.db.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("get validator set: %w", err)
+	}
+	closer.Close()
+	return true, nil
+}
+
+// GetValidatorSet returns the validator set in effect at height, or nil if no
+// set starting at or below height has been persisted.
+func (s *Store) GetValidatorSet(height uint64) (*types.ValidatorSet, error) {
+	iter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(validatorSetPrefix),
+		UpperBound: append([]byte(validatorSetPrefix), encoding.MarshalUint64(height+1)...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+	return encoding.UnmarshalValidatorSet(iter.Value())
+}
+
 // SetConsensusState persists consensus metadata.
 func (s *Store) SetConsensusState(height, round uint64, lastFinalized types.Hash) error {
 	batch := s.db.NewBatch()
 	defer batch.Close()
-	if err := batch.Set([]byte(metaConsensusHeight), encoding.MarshalUint64(height), nil); err != nil {
+	if err := setConsensusStateWithWriter(batch, height, round, lastFinalized); err != nil {
 		return err
 	}
-	if err := batch.Set([]byte(metaConsensusRound), encoding.MarshalUint64(round), nil); err != nil {
+	return batch.Commit(pebble.Sync)
+}
+
+func setConsensusStateWithWriter(writer pebble.Writer, height, round uint64, lastFinalized types.Hash) error {
+	if err := writer.Set([]byte(metaConsensusHeight), encoding.MarshalUint64(height), nil); err != nil {
 		return err
 	}
-	if err := batch.Set([]byte(metaConsensusLastFinalized), lastFinalized[:], nil); err != nil {
+	if err := writer.Set([]byte(metaConsensusRound), encoding.MarshalUint64(round), nil); err != nil {
 		return err
 	}
-	return batch.Commit(pebble.Sync)
+	return writer.Set([]byte(metaConsensusLastFinalized), lastFinalized[:], nil)
 }
 
 // GetConsensusState loads consensus metadata; returns zero values if not found.
@@ -274,3 +543,78 @@ func (s *Store) GetConsensusState() (uint64, uint64, types.Hash, error) {
 	}
 	return height, round, lastFinalized, nil
 }
+
+// VerifiedHeight returns the height up to which the stored blocks were last
+// verified, zero if they never were.
+func (s *Store) VerifiedHeight() (uint64, error) {
+	val, closer, err := s.db.Get([]byte(metaVerifiedHeight))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("get verified height: %w", err)
+	}
+	defer closer.Close()
+	if len(val) != 8 {
+		return 0, fmt.Errorf("invalid verified height")
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// SetVerifiedHeight records that the stored blocks up to height were verified.
+func (s *Store) SetVerifiedHeight(height uint64) error {
+	return s.db.Set([]byte(metaVerifiedHeight), encoding.MarshalUint64(height), pebble.Sync)
+}
+
+// SetProposerPriorities persists the proposer priority accumulators that pick
+// the proposer of height.
+func (s *Store) SetProposerPriorities(height uint64, priorities map[types.Address]int64) error {
+	addrs := make([]string, 0, len(priorities))
+	for addr := range priorities {
+		addrs = append(addrs, string(addr))
+	}
+	sort.Strings(addrs)
+	buf := encoding.MarshalUint64(height)
+	tmp := make([]byte, 8)
+	for _, addr := range addrs {
+		binary.BigEndian.PutUint32(tmp[:4], uint32(len(addr)))
+		buf = append(buf, tmp[:4]...)
+		buf = append(buf, addr...)
+		binary.BigEndian.PutUint64(tmp, uint64(priorities[types.Address(addr)]))
+		buf = append(buf, tmp...)
+	}
+	return s.db.Set([]byte(metaProposerPriorities), buf, pebble.Sync)
+}
+
+// GetProposerPriorities loads the proposer priorities and the height they pick
+// the proposer of; it returns a nil map if none were persisted.
+func (s *Store) GetProposerPriorities() (uint64, map[types.Address]int64, error) {
+	val, closer, err := s.db.Get([]byte(metaProposerPriorities))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, nil, nil
+		}
+		return 0, nil, fmt.Errorf("get proposer priorities: %w", err)
+	}
+	defer closer.Close()
+	if len(val) < 8 {
+		return 0, nil, fmt.Errorf("invalid proposer priorities encoding")
+	}
+	height := binary.BigEndian.Uint64(val[:8])
+	b := val[8:]
+	priorities := make(map[types.Address]int64)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return 0, nil, fmt.Errorf("invalid proposer priorities encoding")
+		}
+		n := int(binary.BigEndian.Uint32(b[:4]))
+		b = b[4:]
+		if len(b) < n+8 {
+			return 0, nil, fmt.Errorf("invalid proposer priorities length")
+		}
+		addr := types.Address(string(b[:n]))
+		priorities[addr] = int64(binary.BigEndian.Uint64(b[n : n+8]))
+		b = b[n+8:]
+	}
+	return height, priorities, nil
+}
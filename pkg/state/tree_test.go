@@ -0,0 +1,236 @@
+package state
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func openTestStore(tb testing.TB) *Store {
+	tb.Helper()
+	store, err := OpenStore(tb.TempDir())
+	if err != nil {
+		tb.Fatalf("open store: %v", err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+func testAccount(i int, balance uint64) *types.Account {
+	return &types.Account{Address: types.Address(fmt.Sprintf("acct%07d", i)), Balance: balance}
+}
+
+// treeNodes returns the latest state tree, by node position.
+func treeNodes(t *testing.T, store *Store) map[string]string {
+	t.Helper()
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(stateTreePrefix),
+		UpperBound: []byte(stateTreePrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		t.Fatalf("iter: %v", err)
+	}
+	defer iter.Close()
+	nodes := make(map[string]string)
+	for iter.First(); iter.Valid(); iter.Next() {
+		// Versions of a position sort oldest first, so the last one wins.
+		pos := string(iter.Key()[:len(iter.Key())-8])
+		if len(iter.Value()) == 0 {
+			delete(nodes, pos)
+			continue
+		}
+		nodes[pos] = string(iter.Value())
+	}
+	return nodes
+}
+
+func TestStateTreeMatchesRebuild(t *testing.T) {
+	store := openTestStore(t)
+	rng := rand.New(rand.NewSource(1))
+	live := make(map[int]bool)
+	for round := 0; round < 20; round++ {
+		err := store.writeState(func(batch *pebble.Batch) error {
+			for j := 0; j < 25; j++ {
+				i := rng.Intn(200)
+				if live[i] && rng.Intn(3) == 0 {
+					delete(live, i)
+					if err := batch.Delete([]byte(accountPrefix+string(testAccount(i, 0).Address)), nil); err != nil {
+						return err
+					}
+					continue
+				}
+				live[i] = true
+				if err := setAccountWithWriter(batch, testAccount(i, rng.Uint64()), nil); err != nil {
+					return err
+				}
+			}
+			return setValidatorWithWriter(batch, &types.Validator{OperatorAddress: types.Address(fmt.Sprintf("val%d", round)), Stake: uint64(round)})
+		})
+		if err != nil {
+			t.Fatalf("write round %d: %v", round, err)
+		}
+
+		root, err := ComputeStateRoot(store)
+		if err != nil {
+			t.Fatalf("root: %v", err)
+		}
+		nodes := treeNodes(t, store)
+		if err := store.rebuildStateTree(0); err != nil {
+			t.Fatalf("rebuild: %v", err)
+		}
+		rebuilt, err := ComputeStateRoot(store)
+		if err != nil {
+			t.Fatalf("root: %v", err)
+		}
+		if root != rebuilt {
+			t.Fatalf("round %d: incremental root %x, rebuilt %x", round, root, rebuilt)
+		}
+		if rebuiltNodes := treeNodes(t, store); len(rebuiltNodes) != len(nodes) {
+			t.Fatalf("round %d: %d tree nodes, rebuilt has %d", round, len(nodes), len(rebuiltNodes))
+		} else {
+			for k, v := range nodes {
+				if rebuiltNodes[k] != v {
+					t.Fatalf("round %d: tree node %x differs from rebuild", round, k)
+				}
+			}
+		}
+	}
+}
+
+func TestStateTreeOrderIndependent(t *testing.T) {
+	a, b := openTestStore(t), openTestStore(t)
+	for i := 0; i < 50; i++ {
+		if err := a.SetAccount(testAccount(i, uint64(i))); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if err := b.SetAccount(testAccount(49-i, uint64(49-i))); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	rootA, _ := ComputeStateRoot(a)
+	rootB, _ := ComputeStateRoot(b)
+	if rootA != rootB || rootA == (types.Hash{}) {
+		t.Fatalf("roots differ: %x vs %x", rootA, rootB)
+	}
+
+	// Removing every record empties the tree.
+	err := a.writeState(func(batch *pebble.Batch) error {
+		for i := 0; i < 50; i++ {
+			if err := batch.Delete([]byte(accountPrefix+string(testAccount(i, 0).Address)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if root, _ := ComputeStateRoot(a); root != (types.Hash{}) {
+		t.Fatalf("expected empty root, got %x", root)
+	}
+	if nodes := treeNodes(t, a); len(nodes) != 0 {
+		t.Fatalf("expected no tree nodes, got %d", len(nodes))
+	}
+}
+
+func TestOpenStoreMigratesFlatState(t *testing.T) {
+	home := t.TempDir()
+	store, err := OpenStore(home)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := store.SetAccount(testAccount(i, 7)); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	want, _ := ComputeStateRoot(store)
+	// A store from before the tree has the records but no tree.
+	if err := store.db.DeleteRange([]byte(stateTreePrefix), []byte(stateTreePrefix+string([]byte{0xFF})), pebble.Sync); err != nil {
+		t.Fatalf("delete tree: %v", err)
+	}
+	if err := store.db.Delete([]byte(metaStateTreeVersion), pebble.Sync); err != nil {
+		t.Fatalf("delete version: %v", err)
+	}
+	store.Close()
+
+	store, err = OpenStore(home)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if got, _ := ComputeStateRoot(store); got != want || got == (types.Hash{}) {
+		t.Fatalf("migrated root %x, want %x", got, want)
+	}
+}
+
+// fillFlatAccounts writes n accounts without the tree, as a store from before
+// the tree holds them.
+func fillFlatAccounts(b *testing.B, store *Store, n int) {
+	batch := store.db.NewBatch()
+	for i := 0; i < n; i++ {
+		if err := setAccountWithWriter(batch, testAccount(i, uint64(i)), nil); err != nil {
+			b.Fatalf("set: %v", err)
+		}
+		if batch.Count() >= 100_000 {
+			if err := batch.Commit(pebble.NoSync); err != nil {
+				b.Fatalf("commit: %v", err)
+			}
+			batch.Close()
+			batch = store.db.NewBatch()
+		}
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		b.Fatalf("commit: %v", err)
+	}
+	batch.Close()
+}
+
+const benchAccounts = 1_000_000
+
+// BenchmarkStateRootUpdate measures the root of a block changing 100 of a
+// million accounts.
+func BenchmarkStateRootUpdate(b *testing.B) {
+	if testing.Short() {
+		b.Skip("builds a million accounts")
+	}
+	store := openTestStore(b)
+	fillFlatAccounts(b, store, benchAccounts)
+	if err := store.rebuildStateTree(0); err != nil {
+		b.Fatalf("rebuild: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		err := store.writeState(func(batch *pebble.Batch) error {
+			for j := 0; j < 100; j++ {
+				if err := setAccountWithWriter(batch, testAccount(rng.Intn(benchAccounts), rng.Uint64()), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("write: %v", err)
+		}
+	}
+}
+
+// BenchmarkStateTreeRebuild measures migrating a million flat accounts.
+func BenchmarkStateTreeRebuild(b *testing.B) {
+	if testing.Short() {
+		b.Skip("builds a million accounts")
+	}
+	store := openTestStore(b)
+	fillFlatAccounts(b, store, benchAccounts)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := store.rebuildStateTree(0); err != nil {
+			b.Fatalf("rebuild: %v", err)
+		}
+	}
+}
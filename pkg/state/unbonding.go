@@ -0,0 +1,185 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// StakingParams controls validator registration, how undelegated stake is
+// released, and how misbehaving validators are slashed and jailed.
+type StakingParams struct {
+	UnbondingPeriod int64  // seconds between undelegation and release
+	SlashDoubleBps  uint64 // share of self-stake, delegations and unbonding stake burned for a double sign, in basis points
+	MinStake        uint64 // self-stake required to create a validator
+	EpochLength     uint64 // blocks per epoch; zero means a single epoch
+	// MaxCommissionChangeBps bounds a validator's commission change; the
+	// commission may change once per epoch.
+	MaxCommissionChangeBps uint64
+	JailDoubleEpochs       uint64 // epochs a double signer stays jailed
+	SlashOfflineBps        uint64 // share of self-stake and delegations burned for downtime, in basis points
+	JailOfflineEpochs      uint64 // epochs an offline validator stays jailed
+	// SignedBlocksWindow is the number of finalized blocks over which liveness
+	// is tracked; a validator missing more than MaxMissedBps of it is slashed.
+	// Zero disables liveness tracking.
+	SignedBlocksWindow uint64
+	MaxMissedBps       uint64
+}
+
+// SetStakingParams sets the validator, unbonding and slashing parameters.
+func (s *State) SetStakingParams(p StakingParams) { s.staking = p }
+
+// StakingParams returns the validator, unbonding and slashing parameters.
+func (s *State) StakingParams() StakingParams { return s.staking }
+
+// epochOf returns the epoch containing height.
+func (s *State) epochOf(height uint64) uint64 {
+	if s.staking.EpochLength == 0 {
+		return 0
+	}
+	return height / s.staking.EpochLength
+}
+
+// unbondingKey orders entries by completion time so maturing them is a prefix
+// scan; entries of one delegator completing at the same time share a key.
+func unbondingKey(completion int64, delegator types.Address) []byte {
+	if completion < 0 {
+		completion = 0
+	}
+	key := append([]byte(unbondingPrefix), make([]byte, 8)...)
+	binary.BigEndian.PutUint64(key[len(unbondingPrefix):], uint64(completion))
+	return append(key, delegator...)
+}
+
+// GetUnbondings returns the pending unbonding entries of delegator, earliest first.
+func (s *Store) GetUnbondings(delegator types.Address) ([]*types.UnbondingEntry, error) {
+	var out []*types.UnbondingEntry
+	err := iterateUnbondings(s.db, nil, func(_ []byte, entries []*types.UnbondingEntry) error {
+		for _, e := range entries {
+			if e.Delegator == delegator {
+				out = append(out, e)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// iterateUnbondings calls fn for every unbonding key below upper, or for all
+// of them when upper is nil, in completion order.
+func iterateUnbondings(reader pebble.Reader, upper []byte, fn func(key []byte, entries []*types.UnbondingEntry) error) error {
+	if upper == nil {
+		upper = []byte(unbondingPrefix + string([]byte{0xFF}))
+	}
+	iter, err := reader.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(unbondingPrefix),
+		UpperBound: upper,
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		entries, err := unmarshalUnbondingEntries(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(append([]byte(nil), iter.Key()...), entries); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// addUnbonding queues entry in batch.
+func addUnbonding(batch *pebble.Batch, entry *types.UnbondingEntry) error {
+	key := unbondingKey(entry.CompletionTime, entry.Delegator)
+	var entries []*types.UnbondingEntry
+	val, closer, err := batch.Get(key)
+	switch {
+	case err == nil:
+		entries, err = unmarshalUnbondingEntries(val)
+		closer.Close()
+		if err != nil {
+			return err
+		}
+	case err != pebble.ErrNotFound:
+		return fmt.Errorf("get unbonding: %w", err)
+	}
+	entries = append(entries, entry)
+	return batch.Set(key, marshalUnbondingEntries(entries), nil)
+}
+
+// matureUnbondings releases every entry completing at or before now to its
+// delegator's balance.
+func matureUnbondings(batch *pebble.Batch, now int64, get func(types.Address) (*types.Account, error), set func(*types.Account) error) error {
+	var keys [][]byte
+	var matured []*types.UnbondingEntry
+	err := iterateUnbondings(batch, unbondingKey(now+1, ""), func(key []byte, entries []*types.UnbondingEntry) error {
+		keys = append(keys, key)
+		matured = append(matured, entries...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range matured {
+		acct, err := get(e.Delegator)
+		if err != nil {
+			return err
+		}
+		acct.Balance += e.Amount
+		if err := set(acct); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slashUnbondings burns SlashDoubleBps of the stake that left an equivocating
+// validator after the offence: it was bonded when the offence was committed.
+func (s *State) slashUnbondings(batch *pebble.Batch, evidence []*types.DuplicateVoteEvidence) error {
+	if len(evidence) == 0 || s.staking.SlashDoubleBps == 0 {
+		return nil
+	}
+	updates := make(map[string][]*types.UnbondingEntry)
+	var order []string
+	err := iterateUnbondings(batch, nil, func(key []byte, entries []*types.UnbondingEntry) error {
+		changed := false
+		for _, e := range entries {
+			for _, ev := range evidence {
+				if ev == nil || e.Validator != ev.Validator || e.CreationHeight <= ev.Height {
+					continue
+				}
+				slash := mulDiv(e.Amount, s.staking.SlashDoubleBps, 10_000)
+				if slash > e.Amount {
+					slash = e.Amount
+				}
+				e.Amount -= slash
+				changed = true
+			}
+		}
+		if changed {
+			updates[string(key)] = entries
+			order = append(order, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range order {
+		if err := batch.Set([]byte(key), marshalUnbondingEntries(updates[key]), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
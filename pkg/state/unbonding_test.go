@@ -0,0 +1,49 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/georgecane/opencoin/pkg/tx"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+func TestUndelegatedStakeUnbondsAndStaysSlashable(t *testing.T) {
+	c := newTestChain(t, &types.Validator{OperatorAddress: "val0", Stake: 1000}, &types.Validator{OperatorAddress: "val1", Stake: 1})
+	c.state.SetStakingParams(StakingParams{UnbondingPeriod: 100, SlashDoubleBps: 500})
+	kp, delegator := c.fund(1000)
+	c.commit(nil)
+	c.commit(nil)
+
+	// val1 equivocated at height 1; the delegator joins and leaves afterwards,
+	// and the evidence lands in the same block as the undelegation.
+	c.commit([]*types.Transaction{
+		c.signedTx(kp, 0, tx.StakeDelegate{Validator: "val1", Amount: 1000}),
+		c.signedTx(kp, 1, tx.StakeUndelegate{Validator: "val1", Amount: 400}),
+	}, doubleVote("val1", 1, 0))
+
+	acct, _ := c.state.GetAccount(delegator)
+	if acct.Stake != 1600 || acct.Balance != 0 {
+		t.Fatalf("stake %d balance %d after undelegating, want 1600 and 0", acct.Stake, acct.Balance)
+	}
+	entries, err := c.state.Store().GetUnbondings(delegator)
+	if err != nil {
+		t.Fatalf("unbondings: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Validator != "val1" || entries[0].Amount != 380 || entries[0].CreationHeight != 3 {
+		t.Fatalf("expected one slashed entry of 380, got %+v", entries)
+	}
+
+	// The stake is released by the first block at the completion time.
+	c.now = entries[0].CompletionTime - 2
+	c.commit(nil)
+	if acct, _ := c.state.GetAccount(delegator); acct.Balance != 0 {
+		t.Fatalf("balance %d before the unbonding completes", acct.Balance)
+	}
+	c.commit(nil)
+	if acct, _ := c.state.GetAccount(delegator); acct.Balance != 380 {
+		t.Fatalf("balance %d after unbonding, want 380", acct.Balance)
+	}
+	if entries, _ := c.state.Store().GetUnbondings(delegator); len(entries) != 0 {
+		t.Fatalf("matured entries still pending: %+v", entries)
+	}
+}
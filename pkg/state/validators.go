@@ -0,0 +1,207 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/georgecane/opencoin/pkg/encoding"
+	"github.com/georgecane/opencoin/pkg/types"
+)
+
+// validatorKey is the registry record of a validator. Its delegations are kept
+// apart, one key each, so a delegation changes without rewriting the record.
+func validatorKey(addr types.Address) []byte {
+	return append([]byte(validatorPrefix), addr...)
+}
+
+// delegationKey groups the delegations of a validator under a length-prefixed
+// validator address.
+func delegationKey(validator, delegator types.Address) []byte {
+	key := protowire.AppendBytes([]byte(delegationPrefix), []byte(validator))
+	return append(key, delegator...)
+}
+
+// SetValidator writes the registry record of v. Delegations are not part of
+// the record and are left unchanged.
+func (s *Store) SetValidator(v *types.Validator) error {
+	return s.writeState(func(batch *pebble.Batch) error {
+		return setValidatorWithWriter(batch, v)
+	})
+}
+
+func setValidatorWithWriter(writer pebble.Writer, v *types.Validator) error {
+	if v == nil {
+		return fmt.Errorf("validator is nil")
+	}
+	record := *v
+	record.Delegations = nil
+	record.Power, record.Index = 0, 0
+	b, err := encoding.MarshalValidator(&record)
+	if err != nil {
+		return err
+	}
+	return writer.Set(validatorKey(v.OperatorAddress), b, nil)
+}
+
+// GetValidator returns the registry record of a validator without its
+// delegations, or nil if it is not registered.
+func (s *Store) GetValidator(addr types.Address) (*types.Validator, error) {
+	return getValidatorFromReader(s.db, addr)
+}
+
+func getValidatorFromReader(reader pebble.Reader, addr types.Address) (*types.Validator, error) {
+	val, closer, err := reader.Get(validatorKey(addr))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get validator: %w", err)
+	}
+	defer closer.Close()
+	return encoding.UnmarshalValidator(val)
+}
+
+// GetValidators returns every registered validator, ordered by address, with
+// its delegations.
+func (s *Store) GetValidators() ([]*types.Validator, error) {
+	var out []*types.Validator
+	byAddr := make(map[types.Address]*types.Validator)
+	iter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(validatorPrefix),
+		UpperBound: []byte(validatorPrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		v, err := encoding.UnmarshalValidator(iter.Value())
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		v.Delegations = make(map[types.Address]uint64)
+		out = append(out, v)
+		byAddr[v.OperatorAddress] = v
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	err = iterateDelegations(s.db, func(validator, delegator types.Address, amount uint64) error {
+		v := byAddr[validator]
+		if v == nil {
+			return fmt.Errorf("delegation to unregistered validator %s", validator)
+		}
+		v.Delegations[delegator] = amount
+		return nil
+	})
+	return out, err
+}
+
+// validatorByPubKey returns the validator registered with consensusPubKey, or
+// an empty address if there is none.
+func validatorByPubKey(reader pebble.Reader, consensusPubKey []byte) (types.Address, error) {
+	iter, err := reader.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(validatorPrefix),
+		UpperBound: []byte(validatorPrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		v, err := encoding.UnmarshalValidator(iter.Value())
+		if err != nil {
+			return "", err
+		}
+		if bytes.Equal(v.ConsensusPubKey, consensusPubKey) {
+			return v.OperatorAddress, nil
+		}
+	}
+	return "", iter.Error()
+}
+
+// iterateDelegations calls fn with every delegation and its amount after the
+// slash events recorded since it was settled.
+func iterateDelegations(reader pebble.Reader, fn func(validator, delegator types.Address, amount uint64) error) error {
+	rewards := make(map[types.Address]*validatorRewards)
+	return iterateDelegationRecords(reader, func(validator, delegator types.Address, rec *delegationRecord) error {
+		r := rewards[validator]
+		if r == nil {
+			var err error
+			if r, err = getValidatorRewards(reader, validator); err != nil {
+				return err
+			}
+			rewards[validator] = r
+		}
+		amount, _, err := rec.settle(reader, validator, r)
+		if err != nil {
+			return err
+		}
+		return fn(validator, delegator, amount)
+	})
+}
+
+// iterateDelegationRecords calls fn with every delegation as stored.
+func iterateDelegationRecords(reader pebble.Reader, fn func(validator, delegator types.Address, rec *delegationRecord) error) error {
+	iter, err := reader.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(delegationPrefix),
+		UpperBound: []byte(delegationPrefix + string([]byte{0xFF})),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		rest := iter.Key()[len(delegationPrefix):]
+		validator, n := protowire.ConsumeBytes(rest)
+		if n < 0 {
+			return fmt.Errorf("invalid delegation key")
+		}
+		amount, period, ratio, err := decodeStakeRecord(iter.Value())
+		if err != nil {
+			return err
+		}
+		rec := &delegationRecord{amount: amount, period: period, ratio: ratio}
+		if err := fn(types.Address(validator), types.Address(rest[n:]), rec); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// getDelegationFromReader returns the amount of a delegation after the slash
+// events recorded since it was settled.
+func getDelegationFromReader(reader pebble.Reader, validator, delegator types.Address) (uint64, error) {
+	d, err := getDelegationRecord(reader, validator, delegator)
+	if err != nil {
+		return 0, err
+	}
+	r, err := getValidatorRewards(reader, validator)
+	if err != nil {
+		return 0, err
+	}
+	amount, _, err := d.settle(reader, validator, r)
+	return amount, err
+}
+
+// getDelegationRecord returns a delegation as stored; a missing delegation is
+// zero.
+func getDelegationRecord(reader pebble.Reader, validator, delegator types.Address) (*delegationRecord, error) {
+	val, closer, err := reader.Get(delegationKey(validator, delegator))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return &delegationRecord{ratio: new(big.Int)}, nil
+		}
+		return nil, fmt.Errorf("get delegation: %w", err)
+	}
+	defer closer.Close()
+	amount, period, ratio, err := decodeStakeRecord(val)
+	if err != nil {
+		return nil, err
+	}
+	return &delegationRecord{amount: amount, period: period, ratio: ratio}, nil
+}
@@ -34,8 +34,12 @@ func (c *Coster) Cost(txn *types.Transaction) (uint64, error) {
 	switch p := env.Payload.(type) {
 	case Transfer:
 		writes = 2
-	case StakeDelegate, StakeUndelegate:
-		writes = 1
+	case StakeDelegate, WithdrawRewards:
+		writes = 3 // account, delegation and validator rewards
+	case StakeUndelegate:
+		writes = 4 // account, delegation, validator rewards and unbonding entry
+	case StakeRedelegate:
+		writes = 6 // account, both delegations and validator rewards, and redelegation entry
 	case ContractDeploy:
 		if c.Contracts != nil {
 			instructions = c.Contracts.EstimateInstructions(p.WASMCode)
@@ -50,6 +54,10 @@ func (c *Coster) Cost(txn *types.Transaction) (uint64, error) {
 		}
 	case GovernanceProposal, GovernanceVote:
 		writes = 1
+	case CreateValidator, EditValidator:
+		writes = 2 // account and validator record
+	case Unjail:
+		writes = 1
 	default:
 		return 0, fmt.Errorf("unsupported payload type")
 	}
@@ -13,6 +13,11 @@ const (
 	PayloadContractCall
 	PayloadGovernanceProposal
 	PayloadGovernanceVote
+	PayloadCreateValidator
+	PayloadEditValidator
+	PayloadUnjail
+	PayloadStakeRedelegate
+	PayloadWithdrawRewards
 )
 
 // Payload is implemented by all transaction payload variants.
@@ -41,6 +46,24 @@ type StakeUndelegate struct {
 
 func (StakeUndelegate) PayloadType() PayloadType { return PayloadStakeUndelegate }
 
+// StakeRedelegate moves a delegation from one validator to another without
+// unbonding.
+type StakeRedelegate struct {
+	From   types.Address
+	To     types.Address
+	Amount uint64
+}
+
+func (StakeRedelegate) PayloadType() PayloadType { return PayloadStakeRedelegate }
+
+// WithdrawRewards pays the sender the rewards its delegation to Validator has
+// earned.
+type WithdrawRewards struct {
+	Validator types.Address
+}
+
+func (WithdrawRewards) PayloadType() PayloadType { return PayloadWithdrawRewards }
+
 type ContractDeploy struct {
 	WASMCode []byte
 	Salt     []byte
@@ -71,3 +94,25 @@ type GovernanceVote struct {
 }
 
 func (GovernanceVote) PayloadType() PayloadType { return PayloadGovernanceVote }
+
+// CreateValidator registers the sender as a validator, bonding SelfStake from
+// its balance.
+type CreateValidator struct {
+	ConsensusPubKey []byte // Dilithium
+	SelfStake       uint64
+	Commission      uint16 // basis points
+}
+
+func (CreateValidator) PayloadType() PayloadType { return PayloadCreateValidator }
+
+// EditValidator changes the commission of the sender's validator.
+type EditValidator struct {
+	Commission uint16 // basis points
+}
+
+func (EditValidator) PayloadType() PayloadType { return PayloadEditValidator }
+
+// Unjail returns the sender's validator to the validator set after its jail term.
+type Unjail struct{}
+
+func (Unjail) PayloadType() PayloadType { return PayloadUnjail }
@@ -58,6 +58,30 @@ func EncodePayload(p Payload, senderPubKey []byte) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case StakeRedelegate:
+		var err error
+		out, err = encodeStakeRedelegate(v)
+		if err != nil {
+			return nil, err
+		}
+	case *StakeRedelegate:
+		var err error
+		out, err = encodeStakeRedelegate(*v)
+		if err != nil {
+			return nil, err
+		}
+	case WithdrawRewards:
+		var err error
+		out, err = encodeWithdrawRewards(v)
+		if err != nil {
+			return nil, err
+		}
+	case *WithdrawRewards:
+		var err error
+		out, err = encodeWithdrawRewards(*v)
+		if err != nil {
+			return nil, err
+		}
 	case ContractDeploy:
 		var err error
 		out, err = encodeContractDeploy(v)
@@ -106,6 +130,42 @@ func EncodePayload(p Payload, senderPubKey []byte) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case CreateValidator:
+		var err error
+		out, err = encodeCreateValidator(v)
+		if err != nil {
+			return nil, err
+		}
+	case *CreateValidator:
+		var err error
+		out, err = encodeCreateValidator(*v)
+		if err != nil {
+			return nil, err
+		}
+	case EditValidator:
+		var err error
+		out, err = encodeEditValidator(v)
+		if err != nil {
+			return nil, err
+		}
+	case *EditValidator:
+		var err error
+		out, err = encodeEditValidator(*v)
+		if err != nil {
+			return nil, err
+		}
+	case Unjail:
+		var err error
+		out, err = encodeUnjail(v)
+		if err != nil {
+			return nil, err
+		}
+	case *Unjail:
+		var err error
+		out, err = encodeUnjail(*v)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("unknown payload type %T", p)
 	}
@@ -273,6 +333,96 @@ func DecodePayload(payload []byte) (*PayloadEnvelope, error) {
 			}
 			env.SenderPubKey = append(env.SenderPubKey[:0], b...)
 			payload = payload[n:]
+		case 9:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected create validator wire type %v", typ)
+			}
+			var b []byte
+			b, n = protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid create validator bytes")
+			}
+			payload = payload[n:]
+			if env.Payload != nil {
+				return nil, fmt.Errorf("duplicate payload")
+			}
+			p, err := decodeCreateValidator(b)
+			if err != nil {
+				return nil, err
+			}
+			env.Payload = p
+		case 10:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected edit validator wire type %v", typ)
+			}
+			var b []byte
+			b, n = protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid edit validator bytes")
+			}
+			payload = payload[n:]
+			if env.Payload != nil {
+				return nil, fmt.Errorf("duplicate payload")
+			}
+			p, err := decodeEditValidator(b)
+			if err != nil {
+				return nil, err
+			}
+			env.Payload = p
+		case 11:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected unjail wire type %v", typ)
+			}
+			var b []byte
+			b, n = protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid unjail bytes")
+			}
+			payload = payload[n:]
+			if env.Payload != nil {
+				return nil, fmt.Errorf("duplicate payload")
+			}
+			p, err := decodeUnjail(b)
+			if err != nil {
+				return nil, err
+			}
+			env.Payload = p
+		case 12:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected stake redelegate wire type %v", typ)
+			}
+			var b []byte
+			b, n = protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid stake redelegate bytes")
+			}
+			payload = payload[n:]
+			if env.Payload != nil {
+				return nil, fmt.Errorf("duplicate payload")
+			}
+			p, err := decodeStakeRedelegate(b)
+			if err != nil {
+				return nil, err
+			}
+			env.Payload = p
+		case 13:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected withdraw rewards wire type %v", typ)
+			}
+			var b []byte
+			b, n = protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid withdraw rewards bytes")
+			}
+			payload = payload[n:]
+			if env.Payload != nil {
+				return nil, fmt.Errorf("duplicate payload")
+			}
+			p, err := decodeWithdrawRewards(b)
+			if err != nil {
+				return nil, err
+			}
+			env.Payload = p
 		default:
 			n = protowire.ConsumeFieldValue(fieldNum, typ, payload)
 			if n < 0 {
@@ -326,6 +476,32 @@ func encodeStakeUndelegate(t StakeUndelegate) ([]byte, error) {
 	return out, nil
 }
 
+func encodeStakeRedelegate(t StakeRedelegate) ([]byte, error) {
+	var inner []byte
+	inner = protowire.AppendTag(inner, 1, protowire.BytesType)
+	inner = protowire.AppendBytes(inner, []byte(t.From))
+	inner = protowire.AppendTag(inner, 2, protowire.BytesType)
+	inner = protowire.AppendBytes(inner, []byte(t.To))
+	inner = protowire.AppendTag(inner, 3, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, t.Amount)
+
+	var out []byte
+	out = protowire.AppendTag(out, 12, protowire.BytesType)
+	out = protowire.AppendBytes(out, inner)
+	return out, nil
+}
+
+func encodeWithdrawRewards(t WithdrawRewards) ([]byte, error) {
+	var inner []byte
+	inner = protowire.AppendTag(inner, 1, protowire.BytesType)
+	inner = protowire.AppendBytes(inner, []byte(t.Validator))
+
+	var out []byte
+	out = protowire.AppendTag(out, 13, protowire.BytesType)
+	out = protowire.AppendBytes(out, inner)
+	return out, nil
+}
+
 func encodeContractDeploy(t ContractDeploy) ([]byte, error) {
 	var inner []byte
 	inner = protowire.AppendTag(inner, 1, protowire.BytesType)
@@ -386,6 +562,39 @@ func encodeGovernanceVote(t GovernanceVote) ([]byte, error) {
 	return out, nil
 }
 
+func encodeCreateValidator(t CreateValidator) ([]byte, error) {
+	var inner []byte
+	inner = protowire.AppendTag(inner, 1, protowire.BytesType)
+	inner = protowire.AppendBytes(inner, t.ConsensusPubKey)
+	inner = protowire.AppendTag(inner, 2, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, t.SelfStake)
+	inner = protowire.AppendTag(inner, 3, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, uint64(t.Commission))
+
+	var out []byte
+	out = protowire.AppendTag(out, 9, protowire.BytesType)
+	out = protowire.AppendBytes(out, inner)
+	return out, nil
+}
+
+func encodeEditValidator(t EditValidator) ([]byte, error) {
+	var inner []byte
+	inner = protowire.AppendTag(inner, 1, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, uint64(t.Commission))
+
+	var out []byte
+	out = protowire.AppendTag(out, 10, protowire.BytesType)
+	out = protowire.AppendBytes(out, inner)
+	return out, nil
+}
+
+func encodeUnjail(Unjail) ([]byte, error) {
+	var out []byte
+	out = protowire.AppendTag(out, 11, protowire.BytesType)
+	out = protowire.AppendBytes(out, nil)
+	return out, nil
+}
+
 func decodeTransfer(b []byte) (Payload, error) {
 	var out Transfer
 	for len(b) > 0 {
@@ -506,6 +715,80 @@ func decodeStakeUndelegate(b []byte) (Payload, error) {
 	return out, nil
 }
 
+func decodeStakeRedelegate(b []byte) (Payload, error) {
+	var out StakeRedelegate
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid stake redelegate tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1, 2:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator")
+			}
+			if num == 1 {
+				out.From = types.Address(string(v))
+			} else {
+				out.To = types.Address(string(v))
+			}
+			b = b[n:]
+		case 3:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid amount type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid amount")
+			}
+			out.Amount = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid redelegate field")
+			}
+			b = b[n:]
+		}
+	}
+	return out, nil
+}
+
+func decodeWithdrawRewards(b []byte) (Payload, error) {
+	var out WithdrawRewards
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid withdraw rewards tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid validator type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid validator")
+			}
+			out.Validator = types.Address(string(v))
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid withdraw rewards field")
+			}
+			b = b[n:]
+		}
+	}
+	return out, nil
+}
+
 func decodeContractDeploy(b []byte) (Payload, error) {
 	var out ContractDeploy
 	for len(b) > 0 {
@@ -695,3 +978,99 @@ func decodeGovernanceVote(b []byte) (Payload, error) {
 	}
 	return out, nil
 }
+
+func decodeCreateValidator(b []byte) (Payload, error) {
+	var out CreateValidator
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid create validator tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return nil, fmt.Errorf("invalid consensus pubkey type")
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid consensus pubkey")
+			}
+			out.ConsensusPubKey = append(out.ConsensusPubKey[:0], v...)
+			b = b[n:]
+		case 2:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid self stake type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid self stake")
+			}
+			out.SelfStake = v
+			b = b[n:]
+		case 3:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid commission type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 0xFFFF {
+				return nil, fmt.Errorf("invalid commission")
+			}
+			out.Commission = uint16(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid create validator field")
+			}
+			b = b[n:]
+		}
+	}
+	return out, nil
+}
+
+func decodeEditValidator(b []byte) (Payload, error) {
+	var out EditValidator
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid edit validator tag")
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return nil, fmt.Errorf("invalid commission type")
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 0xFFFF {
+				return nil, fmt.Errorf("invalid commission")
+			}
+			out.Commission = uint16(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid edit validator field")
+			}
+			b = b[n:]
+		}
+	}
+	return out, nil
+}
+
+func decodeUnjail(b []byte) (Payload, error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid unjail tag")
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid unjail field")
+		}
+		b = b[n:]
+	}
+	return Unjail{}, nil
+}
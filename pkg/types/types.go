@@ -30,6 +30,11 @@ type Block struct {
 	Proposer      Address
 	Transactions  []*Transaction
 	ValidatorSigs [][]byte // ordered by validator-set index, empty slice means missing signature
+	Evidence       []*DuplicateVoteEvidence
+	ValidatorsHash Hash // hash of the validator set that signs this block
+	NextValidatorsHash Hash // hash of the validator set that signs the next block
+	ProposerPrioritiesHash Hash // hash of the proposer priorities that elect the next block's proposer
+	LastCommit     *QuorumCertificate // certifies the parent block and decides whose signatures are rewarded; nil at height 1
 }
 
 // StateNode represents a DAG node for state versioning.
@@ -40,10 +45,12 @@ type StateNode struct {
 }
 
 // Proposal is a HotStuff-style proposal message.
+// Justify certifies the parent block; it is nil only when the parent is the last committed block.
 type Proposal struct {
 	Block       *Block
 	Round       uint64
 	ProposerSig []byte
+	Justify     *QuorumCertificate
 }
 
 // PrecommitVote is a HotStuff-style vote message.
@@ -67,12 +74,68 @@ type QuorumCertificate struct {
 	Signatures    [][]byte // ordered by validator-set index, empty slice means missing signature
 }
 
-// ViewChange represents a view change message.
+// ViewChange announces that a validator timed out in a round. HighQC carries
+// the sender's highest QC.
 type ViewChange struct {
 	Height    uint64
 	Round     uint64
 	Validator Address
 	Signature []byte
+	HighQC    *QuorumCertificate
+}
+
+// TimeoutCertificate aggregates view changes for a round from more than 2/3 of
+// the voting power. HighQC is the highest QC carried by those view changes.
+type TimeoutCertificate struct {
+	Height     uint64
+	Round      uint64
+	SigBitmap  []byte
+	Signatures [][]byte // ordered by validator-set index, empty slice means missing signature
+	HighQC     *QuorumCertificate
+}
+
+// DuplicateVoteEvidence proves that a validator signed two conflicting
+// messages at the same height and round. Exactly one pair is set: two votes
+// for different blocks, or two proposals of different blocks.
+type DuplicateVoteEvidence struct {
+	Validator Address
+	Height    uint64
+	Round     uint64
+	VoteA     *PrecommitVote
+	VoteB     *PrecommitVote
+	ProposalA *Proposal
+	ProposalB *Proposal
+}
+
+// CommittedBlock is a finalized block together with the QC that committed it,
+// as served to nodes catching up through block sync.
+type CommittedBlock struct {
+	Block  *Block
+	Commit *QuorumCertificate
+}
+
+// BlockRangeRequest asks a peer for up to Count committed blocks starting at From.
+type BlockRangeRequest struct {
+	From  uint64
+	Count uint32
+}
+
+// SnapshotManifest describes a state snapshot taken after committing the
+// block at Height: the block it belongs to, the state root it must rebuild,
+// and the hashes of its chunks in order.
+type SnapshotManifest struct {
+	Height    uint64
+	Format    uint32
+	BlockHash Hash
+	StateRoot Hash
+	Chunks    []Hash
+}
+
+// SnapshotRequest asks a peer for chunk Index of its snapshot at Height, or,
+// when Height is zero, for the manifests of the snapshots it serves.
+type SnapshotRequest struct {
+	Height uint64
+	Index  uint32
 }
 
 // Validator represents a validator in DPoS.
@@ -84,8 +147,13 @@ type Validator struct {
 	Delegations map[Address]uint64
 	Commission  uint16
 	Index       uint32
+	// CommissionUpdateHeight is the height of the last commission change,
+	// zero if it never changed.
+	CommissionUpdateHeight uint64
 
-	// Slashing/jailing state.
+	// Slashing/jailing state. A jailed validator is left out of the validator
+	// set until it unjails, which is allowed from JailedUntilEpoch on.
+	Jailed           bool
 	JailedUntilEpoch uint64
 }
 
@@ -109,6 +177,29 @@ type Account struct {
 	PubKey              []byte
 }
 
+// UnbondingEntry is undelegated stake waiting out the unbonding period. It is
+// released to the delegator's balance at CompletionTime and can still be
+// slashed for misbehaviour of Validator before CreationHeight.
+type UnbondingEntry struct {
+	Delegator      Address
+	Validator      Address
+	Amount         uint64
+	CreationHeight uint64
+	CompletionTime int64 // unix seconds
+}
+
+// RedelegationEntry is stake moved from SrcValidator to DstValidator. Until
+// CompletionTime it can still be slashed for misbehaviour of SrcValidator
+// before CreationHeight, and it cannot be redelegated again.
+type RedelegationEntry struct {
+	Delegator      Address
+	SrcValidator   Address
+	DstValidator   Address
+	Amount         uint64
+	CreationHeight uint64
+	CompletionTime int64 // unix seconds
+}
+
 // Contract represents a deployed contract.
 type Contract struct {
 	Address  Address